@@ -0,0 +1,262 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"container/list"
+	"fmt"
+	stdregexp "regexp"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/blevesearch/vellum"
+	"github.com/blevesearch/vellum/levenshtein"
+	"github.com/blevesearch/vellum/regexp"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+// defaultMaxExpansions is the number of terms the prefix, fuzzy and regexp
+// iterators of a dictionary match before failing, see WithMaxExpansions
+const defaultMaxExpansions = 10000
+
+// MaxFuzzyEdits is the most edits Dictionary.FuzzyIterator allows
+const MaxFuzzyEdits = 2
+
+// ErrTooManyExpansions is returned by the prefix, fuzzy and regexp
+// iterators of a dictionary once they match more terms than allowed, see
+// WithMaxExpansions
+var ErrTooManyExpansions = fmt.Errorf("too many term expansions")
+
+// PrefixIterator returns an iterator which only visits the terms starting
+// with prefix
+func (d *Dictionary) PrefixIterator(prefix string) segment.DictionaryIterator {
+	return d.expansionIterator(nil, []byte(prefix))
+}
+
+// FuzzyIterator returns an iterator which only visits the terms at most
+// maxEdits edits from term, whose first prefixLen characters are those of
+// term.  The automaton is compiled once for each term, edits and prefix,
+// and cached.
+func (d *Dictionary) FuzzyIterator(term string, maxEdits, prefixLen int) (segment.DictionaryIterator, error) {
+	if maxEdits < 0 || maxEdits > MaxFuzzyEdits {
+		return nil, fmt.Errorf("max edits %d out of range 0-%d", maxEdits, MaxFuzzyEdits)
+	}
+	key := fmt.Sprintf("fuzzy %d %d %s", maxEdits, prefixLen, term)
+	ca, err := automata.getOrCompile(key, func() (*compiledAutomaton, error) {
+		return compileFuzzy(term, uint8(maxEdits), prefixLen)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d.expansionIterator(ca.a, ca.prefix), nil
+}
+
+// RegexpIterator returns an iterator which only visits the terms matching
+// the whole of the pattern.  The automaton is compiled once for each
+// pattern, and cached.
+func (d *Dictionary) RegexpIterator(pattern string) (segment.DictionaryIterator, error) {
+	ca, err := automata.getOrCompile("regexp "+pattern, func() (*compiledAutomaton, error) {
+		return compileRegexp(pattern)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d.expansionIterator(ca.a, ca.prefix), nil
+}
+
+// expansionIterator returns an iterator visiting the terms starting with
+// prefix which the automaton, if any, matches, up to the max expansions
+// of the segment
+func (d *Dictionary) expansionIterator(a vellum.Automaton, prefix []byte) segment.DictionaryIterator {
+	rv := d.Iterator(a, prefix, prefixSuccessor(prefix))
+	if itr, ok := rv.(*DictionaryIterator); ok && itr != emptyDictionaryIterator {
+		itr.maxExpansions = d.sb.maxExpansions
+	}
+	return rv
+}
+
+// prefixSuccessor returns the smallest key greater than every key starting
+// with prefix, nil if there is none
+func prefixSuccessor(prefix []byte) []byte {
+	rv := append([]byte(nil), prefix...)
+	for i := len(rv) - 1; i >= 0; i-- {
+		if rv[i] < 0xff {
+			rv[i]++
+			return rv[:i+1]
+		}
+	}
+	return nil
+}
+
+// compiledAutomaton is an automaton, and the prefix of every key it matches
+type compiledAutomaton struct {
+	a      vellum.Automaton
+	prefix []byte
+}
+
+// levenshteinBuilders holds the builder of the automata of each number of
+// edits, expensive to build, so built once on first use
+var levenshteinBuilders [MaxFuzzyEdits + 1]struct {
+	once    sync.Once
+	builder *levenshtein.LevenshteinAutomatonBuilder
+	err     error
+}
+
+func compileFuzzy(term string, maxEdits uint8, prefixLen int) (*compiledAutomaton, error) {
+	lb := &levenshteinBuilders[maxEdits]
+	lb.once.Do(func() {
+		lb.builder, lb.err = levenshtein.NewLevenshteinAutomatonBuilder(maxEdits, false)
+	})
+	if lb.err != nil {
+		return nil, lb.err
+	}
+
+	// the prefix is matched exactly, the rest of the term within the edits
+	prefixEnd := 0
+	for i := 0; i < prefixLen && prefixEnd < len(term); i++ {
+		_, size := utf8.DecodeRuneInString(term[prefixEnd:])
+		prefixEnd += size
+	}
+	dfa, err := lb.builder.BuildDfa(term[prefixEnd:], maxEdits)
+	if err != nil {
+		return nil, err
+	}
+	prefix := []byte(term[:prefixEnd])
+	return &compiledAutomaton{a: newPrefixAutomaton(prefix, dfa), prefix: prefix}, nil
+}
+
+func compileRegexp(pattern string) (*compiledAutomaton, error) {
+	a, err := regexp.New(pattern)
+	if err != nil {
+		return nil, err
+	}
+	// every match starts with the literal prefix of the pattern, which
+	// narrows the terms visited
+	std, err := stdregexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	prefix, _ := std.LiteralPrefix()
+	return &compiledAutomaton{a: a, prefix: []byte(prefix)}, nil
+}
+
+// prefixAutomaton matches the keys made of the prefix followed by a key
+// the automaton matches.  The states before the end of the prefix are the
+// number of bytes of the prefix matched, the automaton's states follow,
+// and -1 is the state once a byte does not match the prefix.
+type prefixAutomaton struct {
+	prefix []byte
+	a      vellum.Automaton
+}
+
+func newPrefixAutomaton(prefix []byte, a vellum.Automaton) *prefixAutomaton {
+	return &prefixAutomaton{prefix: prefix, a: a}
+}
+
+func (p *prefixAutomaton) Start() int {
+	if len(p.prefix) == 0 {
+		return p.a.Start()
+	}
+	return 0
+}
+
+func (p *prefixAutomaton) IsMatch(state int) bool {
+	return state >= len(p.prefix) && p.a.IsMatch(state-len(p.prefix))
+}
+
+func (p *prefixAutomaton) CanMatch(state int) bool {
+	if state < len(p.prefix) {
+		return state >= 0
+	}
+	return p.a.CanMatch(state - len(p.prefix))
+}
+
+func (p *prefixAutomaton) WillAlwaysMatch(state int) bool {
+	return state >= len(p.prefix) && p.a.WillAlwaysMatch(state-len(p.prefix))
+}
+
+func (p *prefixAutomaton) Accept(state int, b byte) int {
+	if state < 0 {
+		return state
+	}
+	if state < len(p.prefix) {
+		if b != p.prefix[state] {
+			return -1
+		}
+		if state+1 < len(p.prefix) {
+			return state + 1
+		}
+		return len(p.prefix) + p.a.Start()
+	}
+	return len(p.prefix) + p.a.Accept(state-len(p.prefix), b)
+}
+
+// automatonCacheSize is the number of compiled automata cached
+const automatonCacheSize = 256
+
+// automata caches the compiled automata, which are safe for concurrent use
+var automata = newAutomatonCache(automatonCacheSize)
+
+// automatonCache holds the most recently used compiled automata
+type automatonCache struct {
+	max     int
+	m       sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is the most recently used
+}
+
+type automatonCacheEntry struct {
+	key string
+	ca  *compiledAutomaton
+}
+
+func newAutomatonCache(max int) *automatonCache {
+	return &automatonCache{
+		max:     max,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// getOrCompile returns the automaton of the key, compiling it on a miss,
+// outside the lock, errors are not cached
+func (c *automatonCache) getOrCompile(key string, compile func() (*compiledAutomaton, error)) (
+	*compiledAutomaton, error) {
+	c.m.Lock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		c.m.Unlock()
+		return elem.Value.(*automatonCacheEntry).ca, nil
+	}
+	c.m.Unlock()
+
+	ca, err := compile()
+	if err != nil {
+		return nil, err
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*automatonCacheEntry).ca, nil
+	}
+	c.entries[key] = c.lru.PushFront(&automatonCacheEntry{key: key, ca: ca})
+	for c.lru.Len() > c.max {
+		entry := c.lru.Remove(c.lru.Back()).(*automatonCacheEntry)
+		delete(c.entries, entry.key)
+	}
+	return ca, nil
+}
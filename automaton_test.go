@@ -0,0 +1,259 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+var automatonTestWords = []string{
+	"cat", "cap", "cape", "caps", "car", "card", "care", "cart", "cast", "coat",
+	"cot", "cut", "at", "bat", "chat", "scat", "dog", "dot", "caté", "cäp",
+}
+
+func buildTestSegmentForAutomata(opts ...Option) (*Segment, error) {
+	var results []segment.Document
+	for i, word := range automatonTestWords {
+		doc := FakeDocument{
+			NewFakeField("_id", fmt.Sprintf("%d", i), true, false, false),
+			NewFakeField("word", word, false, false, false),
+		}
+		results = append(results, &doc)
+	}
+	seg, _, err := NewWithOptions(results, encodeNorm, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return seg.(*Segment), nil
+}
+
+// editDistance returns the levenshtein distance between the runes of a and b
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// expectedTerms returns the test words matching, in dictionary order
+func expectedTerms(match func(string) bool) []string {
+	var rv []string
+	for _, word := range automatonTestWords {
+		if match(word) {
+			rv = append(rv, word)
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+func iteratorTerms(t *testing.T, itr segment.DictionaryIterator) []string {
+	var rv []string
+	entry, err := itr.Next()
+	for err == nil && entry != nil {
+		rv = append(rv, entry.Term())
+		entry, err = itr.Next()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rv
+}
+
+func TestDictionaryAutomata(t *testing.T) {
+	seg, err := buildTestSegmentForAutomata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dictInt, err := seg.Dictionary("word")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict := dictInt.(*Dictionary)
+
+	for _, prefix := range []string{"", "c", "ca", "car", "cä", "x"} {
+		actual := iteratorTerms(t, dict.PrefixIterator(prefix))
+		expected := expectedTerms(func(term string) bool { return strings.HasPrefix(term, prefix) })
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("prefix %q: expected %v, got %v", prefix, expected, actual)
+		}
+	}
+
+	for _, term := range []string{"cat", "cap", "ct", "caté"} {
+		for edits := 0; edits <= MaxFuzzyEdits; edits++ {
+			for prefixLen := 0; prefixLen <= 2; prefixLen++ {
+				itr, err := dict.FuzzyIterator(term, edits, prefixLen)
+				if err != nil {
+					t.Fatal(err)
+				}
+				actual := iteratorTerms(t, itr)
+				prefix := string([]rune(term)[:minInt(prefixLen, len([]rune(term)))])
+				expected := expectedTerms(func(candidate string) bool {
+					return strings.HasPrefix(candidate, prefix) && editDistance(term, candidate) <= edits
+				})
+				if !reflect.DeepEqual(actual, expected) {
+					t.Errorf("fuzzy %q edits %d prefix %d: expected %v, got %v", term, edits, prefixLen, expected, actual)
+				}
+			}
+		}
+	}
+
+	for _, pattern := range []string{"ca.*", "c.t", "(dog|cat)", ".*at", "car?d?"} {
+		itr, err := dict.RegexpIterator(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := iteratorTerms(t, itr)
+		re := regexp.MustCompile("^(?:" + pattern + ")$")
+		expected := expectedTerms(re.MatchString)
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("regexp %q: expected %v, got %v", pattern, expected, actual)
+		}
+	}
+}
+
+func TestDictionaryAutomataErrors(t *testing.T) {
+	seg, err := buildTestSegmentForAutomata(WithMaxExpansions(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dictInt, err := seg.Dictionary("word")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict := dictInt.(*Dictionary)
+
+	for _, edits := range []int{-1, MaxFuzzyEdits + 1} {
+		_, err = dict.FuzzyIterator("cat", edits, 0)
+		if err == nil {
+			t.Errorf("expected error for %d edits", edits)
+		}
+	}
+	_, err = dict.RegexpIterator("ca(")
+	if err == nil {
+		t.Errorf("expected error for invalid regexp")
+	}
+
+	// three terms are allowed, the fourth fails
+	itr := dict.PrefixIterator("ca")
+	for i := 0; i < 3; i++ {
+		_, err = itr.Next()
+		if err != nil {
+			t.Fatalf("expected term %d, got %v", i, err)
+		}
+	}
+	_, err = itr.Next()
+	if !errors.Is(err, ErrTooManyExpansions) {
+		t.Errorf("expected too many expansions, got %v", err)
+	}
+
+	// only the terms matched count, not those walked past, all of them for
+	// a pattern only matching at the end of the terms
+	for pattern, expected := range map[string][]string{".*x": nil, ".*e": {"cape", "care"}} {
+		itr, err = dict.RegexpIterator(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := iteratorTerms(t, itr); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("regexp %q: expected %v, got %v", pattern, expected, actual)
+		}
+	}
+	itr, err = dict.RegexpIterator(".*t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		_, err = itr.Next()
+		if err != nil {
+			t.Fatalf("expected term %d, got %v", i, err)
+		}
+	}
+	_, err = itr.Next()
+	if !errors.Is(err, ErrTooManyExpansions) {
+		t.Errorf("expected too many expansions matching .*t, got %v", err)
+	}
+
+	// the limit is only for expansions
+	if terms := iteratorTerms(t, dict.Iterator(nil, nil, nil)); len(terms) != len(automatonTestWords) {
+		t.Errorf("expected %d terms, got %d", len(automatonTestWords), len(terms))
+	}
+
+	// no limit
+	unlimited, err := buildTestSegmentForAutomata(WithMaxExpansions(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dictInt, err = unlimited.Dictionary("word")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if terms := iteratorTerms(t, dictInt.(*Dictionary).PrefixIterator("")); len(terms) != len(automatonTestWords) {
+		t.Errorf("expected %d terms, got %d", len(automatonTestWords), len(terms))
+	}
+}
+
+func TestAutomatonCache(t *testing.T) {
+	c := newAutomatonCache(2)
+	compiles := 0
+	compile := func() (*compiledAutomaton, error) {
+		compiles++
+		return &compiledAutomaton{}, nil
+	}
+	a, _ := c.getOrCompile("a", compile)
+	again, _ := c.getOrCompile("a", compile)
+	if a != again || compiles != 1 {
+		t.Errorf("expected cached automaton, compiled %d times", compiles)
+	}
+	_, _ = c.getOrCompile("b", compile)
+	_, _ = c.getOrCompile("a", compile)
+	_, _ = c.getOrCompile("c", compile) // evicts b
+	_, _ = c.getOrCompile("a", compile)
+	if compiles != 3 {
+		t.Errorf("expected 3 compiles, got %d", compiles)
+	}
+	_, _ = c.getOrCompile("b", compile)
+	if compiles != 4 {
+		t.Errorf("expected b evicted, got %d compiles", compiles)
+	}
+
+	_, err := c.getOrCompile("err", func() (*compiledAutomaton, error) {
+		return nil, fmt.Errorf("failed")
+	})
+	if err == nil || c.entries["err"] != nil {
+		t.Errorf("expected error not cached, got %v", err)
+	}
+}
@@ -0,0 +1,1079 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/blevesearch/vellum"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+// approximate in-memory sizes, used to account against the memory budget
+const (
+	builderTermOverhead    = 96
+	builderPostingOverhead = 40
+	builderLocOverhead     = 32
+)
+
+// Builder builds a segment one document at a time.  Postings, stored
+// fields and doc values are buffered in memory until the memory
+// budget is reached, at which point they are spilled to temporary files,
+// the postings as a run sorted by field and term.  When the segment is written, the runs are
+// merged and encoded the same way as New, so the segment written is
+// identical to the one New produces for the same documents.  When
+// sorting, see WithSort, the documents are renumbered in sort order as the
+// segment is written, which holds the sort keys of every document, and
+// where its stored fields start, in memory until then.
+type Builder struct {
+	normCalc func(string, int) float32
+	opts     options
+
+	// fieldsMap adds 1 to field id to avoid zero value issues
+	//  name -> local field id + 1
+	// local field ids are assigned in the order the fields are seen,
+	// and are remapped to the sorted field ids when writing
+	fieldsMap        map[string]uint16
+	fieldsInv        []string
+	fieldDocs        []uint64
+	fieldFreqs       []uint64
+	includeDocValues []bool
+	reverseTerms     []bool
+
+	numDocs uint64
+
+	// postings added since the last spill
+	//  local field id -> term -> postings
+	dicts   []map[string]*builderTerm
+	memUsed int
+
+	// numeric doc values added since the last spill, see spillNumerics
+	//  local field id -> column
+	numerics     map[uint16]*builderNumerics
+	numericsFile *os.File
+
+	// sorted-set doc values added since the last spill, see spillSortedSets
+	//  local field id -> column
+	sortedSets     map[uint16]*builderSortedSets
+	sortedSetsFile *os.File
+
+	// stored fields added since the last spill, see addStored
+	stored        bytes.Buffer
+	storedFile    *os.File
+	storedSpilled uint64 // length of storedFile
+
+	// when sorting, the keys of each document from its terms, for each sort
+	// field, and where the stored fields of each document start
+	sortKeys      [][][]byte // sort field -> doc -> key
+	storedOffsets []uint64
+
+	runs []*os.File
+
+	// reused for each document
+	fieldLens    []int
+	fieldTFs     []tokenFrequencies
+	storedFields []builderStoredField
+	sortTerms    [][][]byte // sort field -> terms
+	varBuf       []byte
+
+	closed bool
+}
+
+type builderStoredField struct {
+	fieldID uint16
+	val     []byte
+}
+
+// builderTerm holds the postings of a term, in the same form as interim
+type builderTerm struct {
+	docNums   []uint64
+	freqNorms []interimFreqNorm
+	locs      []interimLoc
+}
+
+// NewBuilder returns a Builder which will compute norms using normCalc
+func NewBuilder(normCalc func(string, int) float32, opts ...Option) *Builder {
+	b := &Builder{
+		normCalc:   normCalc,
+		opts:       applyOptions(opts),
+		fieldsMap:  map[string]uint16{},
+		numerics:   map[uint16]*builderNumerics{},
+		sortedSets: map[uint16]*builderSortedSets{},
+		varBuf:     make([]byte, binary.MaxVarintLen64),
+	}
+	if len(b.opts.sort) > 0 {
+		b.sortKeys = make([][][]byte, len(b.opts.sort))
+		b.sortTerms = make([][][]byte, len(b.opts.sort))
+	}
+	b.getOrDefineField(_idFieldName) // _id field is local field id 0
+	return b
+}
+
+func (b *Builder) getOrDefineField(fieldName string) uint16 {
+	fieldIDPlus1, exists := b.fieldsMap[fieldName]
+	if !exists {
+		fieldIDPlus1 = uint16(len(b.fieldsInv) + 1)
+		b.fieldsMap[fieldName] = fieldIDPlus1
+		b.fieldsInv = append(b.fieldsInv, fieldName)
+		b.fieldDocs = append(b.fieldDocs, 0)
+		b.fieldFreqs = append(b.fieldFreqs, 0)
+		b.includeDocValues = append(b.includeDocValues, false)
+		b.reverseTerms = append(b.reverseTerms, false)
+		b.dicts = append(b.dicts, nil)
+		b.fieldLens = append(b.fieldLens, 0)
+		b.fieldTFs = append(b.fieldTFs, nil)
+	}
+	return fieldIDPlus1 - 1
+}
+
+// Add adds a document to the segment being built, the document is assigned
+// the next document number
+func (b *Builder) Add(doc segment.Document) error {
+	if b.closed {
+		return segment.ErrClosed
+	}
+
+	for i := range b.fieldLens { // clear these for reuse
+		b.fieldLens[i] = 0
+		b.fieldTFs[i] = nil
+	}
+	b.storedFields = b.storedFields[:0]
+	for i := range b.sortTerms {
+		b.sortTerms[i] = b.sortTerms[i][:0]
+	}
+
+	var err error
+	doc.EachField(func(field segment.Field) {
+		fieldID := b.getOrDefineField(field.Name())
+
+		if field.Store() {
+			b.storedFields = append(b.storedFields,
+				builderStoredField{fieldID: fieldID, val: field.Value()})
+		}
+
+		if field.IndexDocValues() {
+			b.includeDocValues[fieldID] = true
+		}
+
+		if indexesReverseTerms(field) {
+			b.reverseTerms[fieldID] = true
+		}
+
+		if err == nil {
+			err = b.addNumeric(fieldID, field)
+		}
+		b.addSortedSet(fieldID, field)
+
+		for i, sortField := range b.opts.sort {
+			if sortField.Field == field.Name() {
+				field.EachTerm(func(term segment.FieldTerm) {
+					b.sortTerms[i] = append(b.sortTerms[i], term.Term())
+				})
+			}
+		}
+
+		rollupFieldTerms(field, fieldID, b.fieldLens, b.fieldTFs)
+	})
+	if err != nil {
+		return err
+	}
+
+	if b.sortKeys != nil {
+		b.addSortKeys()
+	}
+
+	err = b.addStored()
+	if err != nil {
+		return err
+	}
+
+	// now that it's been rolled up into fieldTFs, walk that
+	for fieldID, tfs := range b.fieldTFs {
+		if tfs == nil {
+			continue
+		}
+		b.fieldDocs[fieldID]++
+		b.fieldFreqs[fieldID] += uint64(b.fieldLens[fieldID])
+		norm := b.normCalc(b.fieldsInv[fieldID], b.fieldLens[fieldID])
+		b.addPostings(uint16(fieldID), tfs, norm)
+	}
+
+	b.numDocs++
+
+	if b.opts.memoryBudget > 0 && b.memUsed+b.stored.Len() >= b.opts.memoryBudget {
+		return b.spill()
+	}
+	return nil
+}
+
+// addSortKeys records the sort keys of the current document from its
+// terms, and where its stored fields start, see sortOrder
+func (b *Builder) addSortKeys() {
+	for i, sortField := range b.opts.sort {
+		b.sortKeys[i] = append(b.sortKeys[i], termsSortKey(b.sortTerms[i], sortField.Descending))
+	}
+	b.storedOffsets = append(b.storedOffsets, b.storedSpilled+uint64(b.stored.Len()))
+}
+
+// addStored appends the stored fields of the current document to the
+// stored buffer as: uvarint numValues, then for each value
+// uvarint local field id, uvarint length and the value itself
+func (b *Builder) addStored() error {
+	err := b.putUvarints(&b.stored, uint64(len(b.storedFields)))
+	if err != nil {
+		return err
+	}
+	for _, sf := range b.storedFields {
+		err = b.putUvarints(&b.stored, uint64(sf.fieldID), uint64(len(sf.val)))
+		if err != nil {
+			return err
+		}
+		b.stored.Write(sf.val)
+	}
+	return nil
+}
+
+func (b *Builder) addPostings(fieldID uint16, tfs tokenFrequencies, norm float32) {
+	dict := b.dicts[fieldID]
+	if dict == nil {
+		dict = map[string]*builderTerm{}
+		b.dicts[fieldID] = dict
+	}
+
+	for term, tf := range tfs {
+		bt, exists := dict[term]
+		if !exists {
+			bt = &builderTerm{}
+			dict[term] = bt
+			b.memUsed += len(term) + builderTermOverhead
+		}
+
+		bt.docNums = append(bt.docNums, b.numDocs)
+		bt.freqNorms = append(bt.freqNorms, interimFreqNorm{
+			freq:    uint64(tf.Frequency()),
+			norm:    norm,
+			numLocs: len(tf.Locations),
+		})
+
+		for _, loc := range tf.Locations {
+			var locf = fieldID
+			if loc.FieldVal != "" {
+				locf = b.getOrDefineField(loc.FieldVal)
+			}
+			bt.locs = append(bt.locs, interimLoc{
+				fieldID: locf,
+				pos:     uint64(loc.PositionVal),
+				start:   uint64(loc.StartVal),
+				end:     uint64(loc.EndVal),
+			})
+			if len(loc.PayloadVal) > 0 {
+				// the document may be reused once added
+				bt.locs[len(bt.locs)-1].payload = append([]byte(nil), loc.PayloadVal...)
+				b.memUsed += len(loc.PayloadVal)
+			}
+		}
+
+		b.memUsed += builderPostingOverhead + len(tf.Locations)*builderLocOverhead
+	}
+}
+
+func (b *Builder) putUvarints(w io.Writer, vals ...uint64) error {
+	for _, val := range vals {
+		n := binary.PutUvarint(b.varBuf, val)
+		_, err := w.Write(b.varBuf[:n])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fieldOrder returns the local field ids in the order of the fields in
+// the segment, _id first followed by the rest sorted by name
+func (b *Builder) fieldOrder() []uint16 {
+	rv := make([]uint16, len(b.fieldsInv))
+	for i := range rv {
+		rv[i] = uint16(i)
+	}
+	rest := rv[1:] // keep _id as first field
+	sort.Slice(rest, func(i, j int) bool {
+		return b.fieldsInv[rest[i]] < b.fieldsInv[rest[j]]
+	})
+	return rv
+}
+
+func (b *Builder) spill() error {
+	if b.storedFile == nil {
+		var err error
+		b.storedFile, err = ioutil.TempFile(b.opts.tempDir, "ice-stored-")
+		if err != nil {
+			return err
+		}
+	}
+	_, err := b.storedFile.Write(b.stored.Bytes())
+	if err != nil {
+		return err
+	}
+	b.storedSpilled += uint64(b.stored.Len())
+	b.stored.Reset()
+
+	err = b.spillNumerics()
+	if err != nil {
+		return err
+	}
+
+	err = b.spillSortedSets()
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(b.opts.tempDir, "ice-postings-")
+	if err != nil {
+		return err
+	}
+	b.runs = append(b.runs, f)
+
+	bw := bufio.NewWriter(f)
+	run := newBuilderMemRun(b.dicts, b.fieldOrder())
+	for {
+		t, err2 := run.next()
+		if err2 != nil {
+			return err2
+		}
+		if t == nil {
+			break
+		}
+		err = b.writeRunTerm(bw, t)
+		if err != nil {
+			return err
+		}
+	}
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+
+	for i := range b.dicts {
+		b.dicts[i] = nil
+	}
+	b.memUsed = 0
+	return nil
+}
+
+// writeRunTerm writes the postings of a term to a run as: uvarint local
+// field id, uvarint term length, the term, uvarint numDocs, then for each
+// doc the uvarint docNum delta, freq, norm bits and numLocs, followed by
+// the uvarint local field id, pos, start and end of each location
+func (b *Builder) writeRunTerm(w io.Writer, t *builderRunTerm) error {
+	err := b.putUvarints(w, uint64(t.fieldID), uint64(len(t.term)))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, t.term)
+	if err != nil {
+		return err
+	}
+
+	err = b.putUvarints(w, uint64(len(t.postings.docNums)))
+	if err != nil {
+		return err
+	}
+	var prevDocNum uint64
+	locs := t.postings.locs
+	for i, docNum := range t.postings.docNums {
+		freqNorm := t.postings.freqNorms[i]
+		err = b.putUvarints(w, docNum-prevDocNum, freqNorm.freq,
+			uint64(math.Float32bits(freqNorm.norm)), uint64(freqNorm.numLocs))
+		if err != nil {
+			return err
+		}
+		for _, loc := range locs[:freqNorm.numLocs] {
+			err = b.putUvarints(w, uint64(loc.fieldID), loc.pos, loc.start, loc.end, uint64(len(loc.payload)))
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(loc.payload)
+			if err != nil {
+				return err
+			}
+		}
+		locs = locs[freqNorm.numLocs:]
+		prevDocNum = docNum
+	}
+	return nil
+}
+
+// WriteTo writes the segment built from the documents added to w.  No
+// more documents may be added afterwards, and the temporary files used
+// by the Builder are removed before it returns.
+func (b *Builder) WriteTo(w io.Writer) (n int64, err error) {
+	if b.closed {
+		return 0, segment.ErrClosed
+	}
+	defer func() {
+		cerr := b.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+
+	err = b.opts.validate()
+	if err != nil {
+		return 0, err
+	}
+
+	return b.writeSegment(w)
+}
+
+// sortOrder returns the documents in sort order, and the new number of
+// each document, both nil when not sorting.  The keys of a sort field are
+// those New sorts on, its numeric doc values when it has them, otherwise
+// the keys from its terms, when it is indexed with doc values.
+func (b *Builder) sortOrder() (newToOld []int, oldToNew []uint64, err error) {
+	if len(b.opts.sort) == 0 {
+		return nil, nil, nil
+	}
+	sorter := newDocSorter(b.opts.sort, int(b.numDocs))
+	for i, sortField := range b.opts.sort {
+		fieldIDPlus1 := b.fieldsMap[sortField.Field]
+		if fieldIDPlus1 == 0 || !b.includeDocValues[fieldIDPlus1-1] {
+			continue
+		}
+		if b.numerics[fieldIDPlus1-1] != nil {
+			var column *numericColumn
+			column, err = b.numericColumn(fieldIDPlus1-1, nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			itr := column.docs.Iterator()
+			for itr.HasNext() {
+				docNum := itr.Next()
+				sorter.keys[i][docNum] = numericSortKey(column.values[docNum])
+			}
+			continue
+		}
+		sorter.keys[i] = b.sortKeys[i]
+	}
+
+	newToOld = sorter.sort()
+	oldToNew = make([]uint64, len(newToOld))
+	for newDocNum, oldDocNum := range newToOld {
+		oldToNew[oldDocNum] = uint64(newDocNum)
+	}
+	return newToOld, oldToNew, nil
+}
+
+// writeSegment writes the documents to w, in sort order if sorting,
+// otherwise in the order they were added
+func (b *Builder) writeSegment(w io.Writer) (n int64, err error) {
+	newToOld, oldToNew, err := b.sortOrder()
+	if err != nil {
+		return 0, err
+	}
+
+	finalToLocal := b.fieldOrder()
+	fieldsInv := make([]string, len(finalToLocal))
+	localToFinal := make([]uint16, len(finalToLocal))
+	fieldDocs := map[uint16]uint64{}
+	fieldFreqs := map[uint16]uint64{}
+	for fieldID, localID := range finalToLocal {
+		fieldsInv[fieldID] = b.fieldsInv[localID]
+		localToFinal[localID] = uint16(fieldID)
+		fieldDocs[uint16(fieldID)] = b.fieldDocs[localID]
+		fieldFreqs[uint16(fieldID)] = b.fieldFreqs[localID]
+	}
+
+	bw := bufio.NewWriter(w)
+	cw := newCountHashWriter(bw)
+
+	storedIndexOffset, err := b.writeStoredFields(cw, localToFinal, newToOld)
+	if err != nil {
+		return 0, err
+	}
+
+	var fdvIndexOffset uint64
+	var dictOffsets []uint64
+	if b.numDocs > 0 {
+		fdvIndexOffset, dictOffsets, err = b.writeDicts(cw, finalToLocal, localToFinal, oldToNew)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		dictOffsets = make([]uint64, len(fieldsInv))
+	}
+
+	var numericFieldIDs []uint16
+	for fieldID, localID := range finalToLocal {
+		if b.numerics[localID] != nil {
+			numericFieldIDs = append(numericFieldIDs, uint16(fieldID))
+		}
+	}
+	numericOffset, err := persistNumericColumns(numericFieldIDs, b.numDocs, cw,
+		func(fieldID uint16) (*numericColumn, error) {
+			return b.numericColumn(finalToLocal[fieldID], oldToNew)
+		})
+	if err != nil {
+		return 0, err
+	}
+
+	var sortedSetFieldIDs []uint16
+	for fieldID, localID := range finalToLocal {
+		if b.sortedSets[localID] != nil {
+			sortedSetFieldIDs = append(sortedSetFieldIDs, uint16(fieldID))
+		}
+	}
+	sortedSetOffset, err := persistSortedSetColumns(sortedSetFieldIDs, b.numDocs, cw,
+		func(fieldID uint16) (*sortedSetColumn, error) {
+			return b.sortedSetColumn(finalToLocal[fieldID], oldToNew)
+		})
+	if err != nil {
+		return 0, err
+	}
+
+	sortOffset, err := persistSort(b.opts.sort, cw)
+	if err != nil {
+		return 0, err
+	}
+
+	fieldsIndexOffset, err := persistFields(fieldsInv, fieldDocs, fieldFreqs, cw, dictOffsets)
+	if err != nil {
+		return 0, err
+	}
+
+	err = persistFooter(&footer{
+		crc:               cw.Sum32(),
+		chunkMode:         b.opts.chunkMode,
+		numDocs:           b.numDocs,
+		storedIndexOffset: storedIndexOffset,
+		fieldsIndexOffset: fieldsIndexOffset,
+		docValueOffset:    fdvIndexOffset,
+		sortOffset:        sortOffset,
+		numericOffset:     numericOffset,
+		sortedSetOffset:   sortedSetOffset,
+		version:           Version,
+	}, bw)
+	if err != nil {
+		return 0, err
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(cw.Count()) + footerLen, nil
+}
+
+// writeStoredFields writes the stored fields of the documents, in the order
+// of newToOld when sorting
+func (b *Builder) writeStoredFields(w *countHashWriter, localToFinal []uint16, newToOld []int) (
+	storedIndexOffset uint64, err error) {
+	var r io.Reader = bytes.NewReader(b.stored.Bytes())
+	if b.storedFile != nil {
+		_, err = b.storedFile.Seek(0, io.SeekStart)
+		if err != nil {
+			return 0, err
+		}
+		r = io.MultiReader(b.storedFile, r)
+	}
+	d := builderDecoder{r: bufio.NewReader(r)}
+
+	var metaBuf bytes.Buffer
+	metaEncode := func(val uint64) (int, error) {
+		wb := binary.PutUvarint(b.varBuf, val)
+		return metaBuf.Write(b.varBuf[:wb])
+	}
+
+	// keyed by docNum
+	docStoredOffsets := make([]uint64, b.numDocs)
+
+	// keyed by fieldID, for the current doc in the loop
+	docStoredFields := make([][][]byte, len(localToFinal))
+
+	docChunkCoder := newChunkedDocumentCoder(uint64(b.opts.storedChunkDocs), uint64(b.opts.storedChunkBytes),
+		uint64(b.opts.storedLargeValues), b.opts.storedCodec, w)
+
+	var data, record []byte
+	var recordReader bytes.Reader
+	for docNum := uint64(0); docNum < b.numDocs; docNum++ {
+		for fieldID := range docStoredFields { // reset for next doc
+			docStoredFields[fieldID] = docStoredFields[fieldID][:0]
+		}
+
+		if newToOld != nil {
+			record, err = b.storedRecord(newToOld[docNum], record)
+			if err != nil {
+				return 0, err
+			}
+			recordReader.Reset(record)
+			d.r.Reset(&recordReader)
+		}
+
+		numVals := d.uvarint()
+		for i := uint64(0); i < numVals; i++ {
+			fieldID := localToFinal[d.uvarint()]
+			docStoredFields[fieldID] = append(docStoredFields[fieldID], d.bytes(d.uvarint()))
+		}
+		if d.err != nil {
+			return 0, d.err
+		}
+
+		var curr int
+
+		metaBuf.Reset()
+		data = data[:0]
+
+		for fieldID, vals := range docStoredFields {
+			if len(vals) > 0 {
+				curr, data, err = encodeStoredFieldValues(
+					fieldID, vals,
+					curr, metaEncode, data, docChunkCoder)
+				if err != nil {
+					return 0, err
+				}
+			}
+		}
+
+		docStoredOffsets[docNum] = docChunkCoder.Size()
+		_, err = docChunkCoder.Add(docNum, metaBuf.Bytes(), data)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = docChunkCoder.Write()
+	if err != nil {
+		return 0, err
+	}
+
+	storedIndexOffset = uint64(w.Count())
+
+	for _, docStoredOffset := range docStoredOffsets {
+		err = binary.Write(w, binary.BigEndian, docStoredOffset)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return storedIndexOffset, nil
+}
+
+// storedRecord returns the stored fields of the document as added, see
+// addStored, read into buf
+func (b *Builder) storedRecord(docNum int, buf []byte) ([]byte, error) {
+	start := b.storedOffsets[docNum]
+	end := b.storedSpilled + uint64(b.stored.Len())
+	if docNum+1 < len(b.storedOffsets) {
+		end = b.storedOffsets[docNum+1]
+	}
+	if start >= b.storedSpilled {
+		// the buffer is only spilled between documents
+		return b.stored.Bytes()[start-b.storedSpilled : end-b.storedSpilled], nil
+	}
+	if uint64(cap(buf)) < end-start {
+		buf = make([]byte, end-start)
+	}
+	buf = buf[:end-start]
+	_, err := b.storedFile.ReadAt(buf, int64(start))
+	return buf, err
+}
+
+func (b *Builder) writeDicts(w *countHashWriter, finalToLocal, localToFinal []uint16, oldToNew []uint64) (
+	fdvIndexOffset uint64, dictOffsets []uint64, err error) {
+	m := &builderRunMerger{
+		localToFinal: localToFinal,
+		oldToNew:     oldToNew,
+		postingsBS:   roaring.New(),
+	}
+	for _, f := range b.runs {
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return 0, nil, err
+		}
+		m.runs = append(m.runs, &builderFileRun{d: builderDecoder{r: bufio.NewReader(f)}})
+	}
+	m.runs = append(m.runs, newBuilderMemRun(b.dicts, finalToLocal))
+	err = m.start()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	dictOffsets = make([]uint64, len(finalToLocal))
+	fdvOffsetsStart := make([]uint64, len(finalToLocal))
+	fdvOffsetsEnd := make([]uint64, len(finalToLocal))
+
+	buf := make([]byte, binary.MaxVarintLen64)
+
+	// these int coders are initialized with chunk size 1024
+	// however this will be reset to the correct chunk size
+	// while processing each individual field-term section
+	locEncoder := newChunkedIntCoder(uint64(legacyChunkMode), b.numDocs-1)
+	tfEncoder := newChunkedFreqNormCoder(uint64(legacyChunkMode), b.numDocs-1, locEncoder)
+
+	var builderBuf bytes.Buffer
+	builder, err := vellum.New(&builderBuf, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	topTerms := newTopTermsCollector(b.opts.topTerms)
+	var docTermMap [][]byte
+	for fieldID, localID := range finalToLocal {
+		includeDocValues := b.includeDocValues[localID]
+		if includeDocValues {
+			docTermMap = resetDocTermMap(docTermMap, b.numDocs)
+		}
+
+		for {
+			term, ok, err2 := m.nextTerm(localID)
+			if err2 != nil {
+				return 0, nil, err2
+			}
+			if !ok {
+				break
+			}
+			var termDocTermMap [][]byte
+			if includeDocValues {
+				termDocTermMap = docTermMap
+			}
+			err = writeTermPostings(w, builder, b.opts.chunkMode, b.numDocs, term,
+				m.postingsBS, m.freqNorms, m.locs, tfEncoder, locEncoder, buf, termDocTermMap)
+			if err != nil {
+				return 0, nil, err
+			}
+			topTerms.add([]byte(term), m.postingsBS.GetCardinality())
+		}
+
+		dictOffsets[fieldID], err = writeFieldDict(w, builder, &builderBuf, topTerms, b.reverseTerms[localID], buf)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if includeDocValues {
+			fdvOffsetsStart[fieldID], fdvOffsetsEnd[fieldID], err =
+				writeFieldDocValues(w, docTermMap, b.numDocs, b.opts.docValueChunkMode)
+			if err != nil {
+				return 0, nil, err
+			}
+		} else {
+			fdvOffsetsStart[fieldID] = fieldNotUninverted
+			fdvOffsetsEnd[fieldID] = fieldNotUninverted
+		}
+	}
+
+	fdvIndexOffset, err = writeDvLocs(w, buf, fdvOffsetsStart, fdvOffsetsEnd)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return fdvIndexOffset, dictOffsets, nil
+}
+
+func resetDocTermMap(docTermMap [][]byte, numDocs uint64) [][]byte {
+	if uint64(cap(docTermMap)) < numDocs {
+		return make([][]byte, numDocs)
+	}
+	docTermMap = docTermMap[:numDocs]
+	for docNum := range docTermMap {
+		docTermMap[docNum] = docTermMap[docNum][:0]
+	}
+	return docTermMap
+}
+
+// Close removes the temporary files created by the Builder, it only needs
+// to be called when a Builder is abandoned before WriteTo
+func (b *Builder) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	var rv error
+	files := b.runs
+	for _, f := range []*os.File{b.storedFile, b.numericsFile, b.sortedSetsFile} {
+		if f != nil {
+			files = append(files, f)
+		}
+	}
+	for _, f := range files {
+		err := f.Close()
+		if err != nil && rv == nil {
+			rv = err
+		}
+		err = os.Remove(f.Name())
+		if err != nil && rv == nil {
+			rv = err
+		}
+	}
+
+	b.runs = nil
+	b.storedFile = nil
+	b.numericsFile = nil
+	b.sortedSetsFile = nil
+	b.sortKeys = nil
+	b.storedOffsets = nil
+	b.dicts = nil
+	b.numerics = nil
+	b.sortedSets = nil
+	b.stored.Reset()
+	return rv
+}
+
+// builderRunTerm is the postings of a term in a run
+type builderRunTerm struct {
+	fieldID  uint16 // local field id
+	term     string
+	postings *builderTerm
+}
+
+// builderRun iterates the terms of a run, ordered by field and then term,
+// the term returned is only valid until the next call
+type builderRun interface {
+	next() (*builderRunTerm, error)
+}
+
+// builderMemRun is a run over the postings still in memory
+type builderMemRun struct {
+	dicts  []map[string]*builderTerm
+	fields []uint16
+	terms  []string // sorted terms of the current field
+	curr   builderRunTerm
+}
+
+func newBuilderMemRun(dicts []map[string]*builderTerm, fields []uint16) *builderMemRun {
+	return &builderMemRun{
+		dicts:  dicts,
+		fields: fields,
+	}
+}
+
+func (r *builderMemRun) next() (*builderRunTerm, error) {
+	for len(r.terms) == 0 {
+		if len(r.fields) == 0 {
+			return nil, nil
+		}
+		r.curr.fieldID = r.fields[0]
+		r.fields = r.fields[1:]
+
+		dict := r.dicts[r.curr.fieldID]
+		r.terms = r.terms[:0]
+		for term := range dict {
+			r.terms = append(r.terms, term)
+		}
+		sort.Strings(r.terms)
+	}
+
+	r.curr.term = r.terms[0]
+	r.curr.postings = r.dicts[r.curr.fieldID][r.curr.term]
+	r.terms = r.terms[1:]
+	return &r.curr, nil
+}
+
+// builderFileRun is a run which was spilled to a file, see writeRunTerm
+type builderFileRun struct {
+	d        builderDecoder
+	curr     builderRunTerm
+	postings builderTerm
+}
+
+func (r *builderFileRun) next() (*builderRunTerm, error) {
+	fieldID, err := binary.ReadUvarint(r.d.r)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.curr.fieldID = uint16(fieldID)
+	r.curr.term = string(r.d.bytes(r.d.uvarint()))
+
+	r.postings.docNums = r.postings.docNums[:0]
+	r.postings.freqNorms = r.postings.freqNorms[:0]
+	r.postings.locs = r.postings.locs[:0]
+
+	var docNum uint64
+	numDocs := r.d.uvarint()
+	for i := uint64(0); i < numDocs && r.d.err == nil; i++ {
+		docNum += r.d.uvarint()
+		freqNorm := interimFreqNorm{
+			freq:    r.d.uvarint(),
+			norm:    math.Float32frombits(uint32(r.d.uvarint())),
+			numLocs: int(r.d.uvarint()),
+		}
+		r.postings.docNums = append(r.postings.docNums, docNum)
+		r.postings.freqNorms = append(r.postings.freqNorms, freqNorm)
+		for j := 0; j < freqNorm.numLocs && r.d.err == nil; j++ {
+			loc := interimLoc{
+				fieldID: uint16(r.d.uvarint()),
+				pos:     r.d.uvarint(),
+				start:   r.d.uvarint(),
+				end:     r.d.uvarint(),
+			}
+			if payloadLen := r.d.uvarint(); payloadLen > 0 {
+				loc.payload = r.d.bytes(payloadLen)
+			}
+			r.postings.locs = append(r.postings.locs, loc)
+		}
+	}
+	if r.d.err != nil {
+		return nil, r.d.err
+	}
+
+	r.curr.postings = &r.postings
+	return &r.curr, nil
+}
+
+// builderDecoder reads the values written by a Builder to its temporary
+// files, remembering the first error encountered
+type builderDecoder struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (d *builderDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	var rv uint64
+	rv, d.err = binary.ReadUvarint(d.r)
+	if d.err == io.EOF {
+		d.err = io.ErrUnexpectedEOF
+	}
+	return rv
+}
+
+func (d *builderDecoder) bytes(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	rv := make([]byte, n)
+	_, d.err = io.ReadFull(d.r, rv)
+	return rv
+}
+
+// builderRunMerger merges the postings of each term across all the runs,
+// runs hold increasing document numbers, so the postings of a term are
+// appended in the order of the runs, then renumbered when sorting
+type builderRunMerger struct {
+	runs         []builderRun
+	currs        []*builderRunTerm
+	localToFinal []uint16
+	oldToNew     []uint64 // nil unless sorting
+
+	// postings of the current term
+	postingsBS *roaring.Bitmap
+	freqNorms  []interimFreqNorm
+	locs       []interimLoc
+
+	// when sorting, the postings of the current term in the order added
+	docNums       []uint64
+	order         []int
+	locStarts     []int
+	prevFreqNorms []interimFreqNorm
+	prevLocs      []interimLoc
+}
+
+func (m *builderRunMerger) start() (err error) {
+	m.currs = make([]*builderRunTerm, len(m.runs))
+	for i, run := range m.runs {
+		m.currs[i], err = run.next()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextTerm gathers the postings of the next term of the field from all
+// the runs, returning false once there are no more terms for the field
+func (m *builderRunMerger) nextTerm(fieldID uint16) (term string, ok bool, err error) {
+	for _, curr := range m.currs {
+		if curr != nil && curr.fieldID == fieldID && (!ok || curr.term < term) {
+			term = curr.term
+			ok = true
+		}
+	}
+	if !ok {
+		return "", false, nil
+	}
+
+	m.postingsBS.Clear()
+	m.freqNorms = m.freqNorms[:0]
+	m.locs = m.locs[:0]
+	m.docNums = m.docNums[:0]
+
+	for i, curr := range m.currs {
+		if curr == nil || curr.fieldID != fieldID || curr.term != term {
+			continue
+		}
+		if m.oldToNew != nil {
+			m.docNums = append(m.docNums, curr.postings.docNums...)
+		} else {
+			for _, docNum := range curr.postings.docNums {
+				m.postingsBS.Add(uint32(docNum))
+			}
+		}
+		m.freqNorms = append(m.freqNorms, curr.postings.freqNorms...)
+		for _, loc := range curr.postings.locs {
+			loc.fieldID = m.localToFinal[loc.fieldID]
+			m.locs = append(m.locs, loc)
+		}
+
+		m.currs[i], err = m.runs[i].next()
+		if err != nil {
+			return "", false, err
+		}
+	}
+
+	if m.oldToNew != nil {
+		m.renumber()
+	}
+
+	return term, true, nil
+}
+
+// renumber renumbers the postings of the current term in sort order,
+// reordering their freq/norms and locations to match
+func (m *builderRunMerger) renumber() {
+	m.order = m.order[:0]
+	m.locStarts = m.locStarts[:0]
+	var locStart int
+	for i, docNum := range m.docNums {
+		m.docNums[i] = m.oldToNew[docNum]
+		m.postingsBS.Add(uint32(m.docNums[i]))
+		m.order = append(m.order, i)
+		m.locStarts = append(m.locStarts, locStart)
+		locStart += m.freqNorms[i].numLocs
+	}
+	sort.Slice(m.order, func(i, j int) bool {
+		return m.docNums[m.order[i]] < m.docNums[m.order[j]]
+	})
+
+	m.prevFreqNorms, m.freqNorms = m.freqNorms, m.prevFreqNorms[:0]
+	m.prevLocs, m.locs = m.locs, m.prevLocs[:0]
+	for _, i := range m.order {
+		freqNorm := m.prevFreqNorms[i]
+		m.freqNorms = append(m.freqNorms, freqNorm)
+		m.locs = append(m.locs, m.prevLocs[m.locStarts[i]:m.locStarts[i]+freqNorm.numLocs]...)
+	}
+}
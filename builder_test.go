@@ -0,0 +1,241 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+func buildTestAnalysisResultsMany(numDocs int) []segment.Document {
+	var results []segment.Document
+	for i := 0; i < numDocs; i++ {
+		doc := &FakeDocument{
+			NewFakeField("_id", fmt.Sprintf("%08d", i), true, false, false),
+			NewFakeField("body", fmt.Sprintf("w%d w%d w%d", i%7, i%13, i%1031), true, true, false),
+			NewFakeField("tag", fmt.Sprintf("t%d", i%3), false, false, true),
+		}
+		if i%5 == 0 {
+			*doc = append(*doc, NewFakeField("rare", "r", true, true, true))
+		}
+		doc.FakeComposite("_all", []string{"_id"})
+		results = append(results, doc)
+	}
+	return results
+}
+
+func TestBuilder(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []segment.Document
+		opts    []Option
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:    "multi",
+			results: buildTestAnalysisResultsMulti(),
+		},
+		{
+			name:    "different fields",
+			results: buildTestAnalysisResultsMultiWithDifferentFields(true, true),
+		},
+		{
+			name:    "many",
+			results: buildTestAnalysisResultsMany(3000),
+		},
+		{
+			name:    "numeric",
+			results: buildTestAnalysisResultsNumeric(2500),
+		},
+		{
+			name:    "sortedset",
+			results: buildTestAnalysisResultsSortedSet(2500),
+		},
+		{
+			name: "empty sorted",
+			opts: []Option{WithSort(SortField{Field: "tag"})},
+		},
+		{
+			name:    "many sorted",
+			results: buildTestAnalysisResultsMany(3000),
+			opts:    []Option{WithSort(SortField{Field: "rare", MissingFirst: true}, SortField{Field: "tag", Descending: true})},
+		},
+		{
+			name:    "numeric sorted",
+			results: buildTestAnalysisResultsNumeric(2500),
+			opts:    []Option{WithSort(SortField{Field: "price", Descending: true}, SortField{Field: "ts"})},
+		},
+		{
+			name:    "sortedset sorted",
+			results: buildTestAnalysisResultsSortedSet(2500),
+			opts:    []Option{WithSort(SortField{Field: "tags"}, SortField{Field: "code", Descending: true})},
+		},
+	}
+
+	for _, test := range tests {
+		seg, _, err := NewWithOptions(test.results, encodeNorm, test.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected bytes.Buffer
+		_, err = seg.WriteTo(&expected, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, budget := range []int{defaultBuilderMemoryBudget, 4096, 1} {
+			path, cleanup := setupTestDir(t)
+
+			b := NewBuilder(encodeNorm, append(test.opts, WithMemoryBudget(budget), WithTempDir(path))...)
+			for _, doc := range test.results {
+				err = b.Add(doc)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			var actual bytes.Buffer
+			n, err := b.WriteTo(&actual)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(actual.Len()) {
+				t.Errorf("%s/%d: expected %d bytes written, got %d", test.name, budget, actual.Len(), n)
+			}
+			if !bytes.Equal(expected.Bytes(), actual.Bytes()) {
+				t.Errorf("%s/%d: expected builder output to match New", test.name, budget)
+			}
+
+			files, err := ioutil.ReadDir(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 0 {
+				t.Errorf("%s/%d: expected temporary files to be removed, found %d", test.name, budget, len(files))
+			}
+
+			err = b.Add(&FakeDocument{})
+			if err != segment.ErrClosed {
+				t.Errorf("%s/%d: expected closed error adding after write, got %v", test.name, budget, err)
+			}
+			cleanup()
+		}
+	}
+}
+
+func TestBuilderSpillsDocValues(t *testing.T) {
+	tests := []struct {
+		name string
+		// field returns the doc values field of the ith document
+		field func(i int) segment.Field
+		// overhead is the memory used by the doc value of a field over a
+		// plain field with the same term
+		overhead int
+		spilled  func(b *Builder) (spilled bool, pending int)
+	}{
+		{
+			name: "numeric",
+			field: func(i int) segment.Field {
+				return NewFakeNumericField("n", NumericInt64, int64(i*7%2000)-1000, false, true)
+			},
+			overhead: builderNumericOverhead,
+			spilled: func(b *Builder) (spilled bool, pending int) {
+				for _, column := range b.numerics {
+					pending += len(column.docNums)
+				}
+				return b.numericsFile != nil, pending
+			},
+		},
+		{
+			name: "sortedset",
+			field: func(i int) segment.Field {
+				return NewFakeSortedSetField("s", fmt.Sprintf("%05d", i*7%2000))
+			},
+			overhead: 5 + builderSortedSetOverhead,
+			spilled: func(b *Builder) (spilled bool, pending int) {
+				for _, column := range b.sortedSets {
+					pending += len(column.docNums)
+				}
+				return b.sortedSetsFile != nil, pending
+			},
+		},
+	}
+
+	for _, test := range tests {
+		// documents with only doc values, so that mostly they use the
+		// memory budget
+		var results []segment.Document
+		for i := 0; i < 2000; i++ {
+			results = append(results, &FakeTypedDocument{Typed: []segment.Field{test.field(i)}})
+		}
+		seg, _, err := New(results, encodeNorm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected bytes.Buffer
+		_, err = seg.WriteTo(&expected, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the doc values are counted against the memory budget
+		field := test.field(0)
+		plain := NewBuilder(encodeNorm)
+		err = plain.Add(&FakeDocument{NewFakeField(field.Name(), string(field.Value()), false, false, true)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		withDocValues := NewBuilder(encodeNorm)
+		err = withDocValues.Add(results[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if withDocValues.memUsed != plain.memUsed+test.overhead {
+			t.Errorf("%s: expected a doc value to use %d bytes, got %d", test.name, test.overhead, withDocValues.memUsed-plain.memUsed)
+		}
+		_ = plain.Close()
+		_ = withDocValues.Close()
+
+		path, cleanup := setupTestDir(t)
+		b := NewBuilder(encodeNorm, WithMemoryBudget(100*test.overhead), WithTempDir(path))
+		for _, doc := range results {
+			err = b.Add(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		spilled, pending := test.spilled(b)
+		if !spilled {
+			t.Errorf("%s: expected doc values to be spilled", test.name)
+		}
+		if pending >= 100 {
+			t.Errorf("%s: expected fewer than 100 doc values in memory, got %d", test.name, pending)
+		}
+		var actual bytes.Buffer
+		_, err = b.WriteTo(&actual)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected.Bytes(), actual.Bytes()) {
+			t.Errorf("%s: expected builder output to match New", test.name)
+		}
+		cleanup()
+	}
+}
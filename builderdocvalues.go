@@ -0,0 +1,261 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+// approximate in-memory sizes of doc values, used to account against the
+// memory budget
+const (
+	builderNumericOverhead   = 16
+	builderSortedSetOverhead = 32 // plus the length of the term
+)
+
+// builderNumerics holds the numeric doc values of a field added to a
+// Builder since the last spill
+type builderNumerics struct {
+	typ     NumericType
+	docNums []uint64
+	values  []int64
+}
+
+// addNumeric adds the value of the field to the numeric doc values of the
+// field id of the current document, if it has one, like addNumericField
+func (b *Builder) addNumeric(fieldID uint16, field segment.Field) error {
+	numericField, ok := field.(NumericField)
+	if !ok || !field.IndexDocValues() {
+		return nil
+	}
+	column := b.numerics[fieldID]
+	if column == nil {
+		column = &builderNumerics{typ: numericField.NumericType()}
+		b.numerics[fieldID] = column
+	} else if column.typ != numericField.NumericType() {
+		return fmt.Errorf("field %s has numeric values of type %v and %v",
+			field.Name(), column.typ, numericField.NumericType())
+	}
+	if n := len(column.docNums); n > 0 && column.docNums[n-1] == b.numDocs {
+		return nil // the document keeps its first value
+	}
+	column.docNums = append(column.docNums, b.numDocs)
+	column.values = append(column.values, numericField.NumericValue())
+	b.memUsed += builderNumericOverhead
+	return nil
+}
+
+// spillNumerics appends the numeric doc values added since the last spill
+// to the numerics file, for each field as: uvarint local field id, uvarint
+// number of values, then the uvarint docNum delta and the uvarint bits of
+// each value
+func (b *Builder) spillNumerics() error {
+	if b.numericsFile == nil {
+		var err error
+		b.numericsFile, err = ioutil.TempFile(b.opts.tempDir, "ice-numerics-")
+		if err != nil {
+			return err
+		}
+	}
+	bw := bufio.NewWriter(b.numericsFile)
+	for fieldID, column := range b.numerics {
+		if len(column.docNums) == 0 {
+			continue
+		}
+		err := b.putUvarints(bw, uint64(fieldID), uint64(len(column.docNums)))
+		if err != nil {
+			return err
+		}
+		var prevDocNum uint64
+		for i, docNum := range column.docNums {
+			err = b.putUvarints(bw, docNum-prevDocNum, uint64(column.values[i]))
+			if err != nil {
+				return err
+			}
+			prevDocNum = docNum
+		}
+		column.docNums = column.docNums[:0]
+		column.values = column.values[:0]
+	}
+	return bw.Flush()
+}
+
+// numericColumn returns the numeric doc values of the field, both spilled
+// and still in memory, renumbered by newDocNums unless nil
+func (b *Builder) numericColumn(fieldID uint16, newDocNums []uint64) (*numericColumn, error) {
+	pending := b.numerics[fieldID]
+	rv := newNumericColumn(pending.typ)
+	set := func(docNum uint64, val int64) {
+		if newDocNums != nil {
+			docNum = newDocNums[docNum]
+		}
+		rv.set(docNum, val)
+	}
+
+	if b.numericsFile != nil {
+		_, err := b.numericsFile.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		d := builderDecoder{r: bufio.NewReader(b.numericsFile)}
+		for {
+			var recordFieldID uint64
+			recordFieldID, err = binary.ReadUvarint(d.r)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			var docNum uint64
+			numValues := d.uvarint()
+			for i := uint64(0); i < numValues && d.err == nil; i++ {
+				docNum += d.uvarint()
+				val := int64(d.uvarint())
+				if uint16(recordFieldID) == fieldID {
+					set(docNum, val)
+				}
+			}
+			if d.err != nil {
+				return nil, d.err
+			}
+		}
+	}
+
+	for i, docNum := range pending.docNums {
+		set(docNum, pending.values[i])
+	}
+	return rv, nil
+}
+
+// builderSortedSets holds the sorted-set doc values of a field added to a
+// Builder since the last spill, a term per entry
+type builderSortedSets struct {
+	docNums []uint64
+	terms   []string
+}
+
+// addSortedSet adds the terms of the field to the sorted-set doc values of
+// the field id of the current document, if it has them, like
+// addSortedSetField
+func (b *Builder) addSortedSet(fieldID uint16, field segment.Field) {
+	sortedSetField, ok := field.(SortedSetField)
+	if !ok || !field.IndexDocValues() || !sortedSetField.SortedSetDocValues() {
+		return
+	}
+	column := b.sortedSets[fieldID]
+	if column == nil {
+		column = &builderSortedSets{}
+		b.sortedSets[fieldID] = column
+	}
+	field.EachTerm(func(term segment.FieldTerm) {
+		column.docNums = append(column.docNums, b.numDocs)
+		column.terms = append(column.terms, string(term.Term()))
+		b.memUsed += len(term.Term()) + builderSortedSetOverhead
+	})
+}
+
+// spillSortedSets appends the sorted-set doc values added since the last
+// spill to the sorted sets file, for each field as: uvarint local field
+// id, uvarint number of terms, then the uvarint docNum delta, uvarint
+// length and bytes of each term
+func (b *Builder) spillSortedSets() error {
+	if b.sortedSetsFile == nil {
+		var err error
+		b.sortedSetsFile, err = ioutil.TempFile(b.opts.tempDir, "ice-sortedsets-")
+		if err != nil {
+			return err
+		}
+	}
+	bw := bufio.NewWriter(b.sortedSetsFile)
+	for fieldID, column := range b.sortedSets {
+		if len(column.docNums) == 0 {
+			continue
+		}
+		err := b.putUvarints(bw, uint64(fieldID), uint64(len(column.docNums)))
+		if err != nil {
+			return err
+		}
+		var prevDocNum uint64
+		for i, docNum := range column.docNums {
+			err = b.putUvarints(bw, docNum-prevDocNum, uint64(len(column.terms[i])))
+			if err != nil {
+				return err
+			}
+			_, err = bw.WriteString(column.terms[i])
+			if err != nil {
+				return err
+			}
+			prevDocNum = docNum
+		}
+		column.docNums = column.docNums[:0]
+		column.terms = column.terms[:0]
+	}
+	return bw.Flush()
+}
+
+// sortedSetColumn returns the sorted-set doc values of the field, both
+// spilled and still in memory, renumbered by newDocNums unless nil
+func (b *Builder) sortedSetColumn(fieldID uint16, newDocNums []uint64) (*sortedSetColumn, error) {
+	pending := b.sortedSets[fieldID]
+	rv := newSortedSetColumn()
+	add := func(docNum uint64, term string) {
+		if newDocNums != nil {
+			docNum = newDocNums[docNum]
+		}
+		rv.add(docNum, rv.termID(term))
+	}
+
+	if b.sortedSetsFile != nil {
+		_, err := b.sortedSetsFile.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		d := builderDecoder{r: bufio.NewReader(b.sortedSetsFile)}
+		for {
+			var recordFieldID uint64
+			recordFieldID, err = binary.ReadUvarint(d.r)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			var docNum uint64
+			numTerms := d.uvarint()
+			for i := uint64(0); i < numTerms && d.err == nil; i++ {
+				docNum += d.uvarint()
+				term := d.bytes(d.uvarint())
+				if uint16(recordFieldID) == fieldID && d.err == nil {
+					add(docNum, string(term))
+				}
+			}
+			if d.err != nil {
+				return nil, d.err
+			}
+		}
+	}
+
+	for i, docNum := range pending.docNums {
+		add(docNum, pending.terms[i])
+	}
+	return rv, nil
+}
@@ -26,10 +26,27 @@ const legacyChunkMode uint32 = 1024
 
 const chunkModeV1 uint32 = 1025
 
+// chunkModePacked chunks the postings as chunkModeV1 does, with the values
+// of each chunk of freq/norms and locations bit-packed in blocks instead of
+// uvarints, which decode faster
+const chunkModePacked uint32 = 1026
+
 // defaultChunkMode is the most recent improvement to chunking and should
 // be used by default.
 const defaultChunkMode uint32 = chunkModeV1
 
+// chunkModeBytes flags the chunk modes sizing the chunks of each postings
+// list, or the doc values of each field, to hold about the number of bytes
+// held in the bits below chunkModeBytesPacked once uncompressed
+const chunkModeBytes uint32 = 1 << 31
+
+// chunkModeBytesPacked flags a chunkModeBytes mode whose postings are
+// packed as with chunkModePacked
+const chunkModeBytesPacked uint32 = 1 << 30
+
+// maxChunkBytes is the largest target number of bytes of a chunk mode
+const maxChunkBytes = chunkModeBytesPacked - 1
+
 func getChunkSize(chunkMode uint32, cardinality, maxDocs uint64) (uint64, error) {
 	switch {
 	// any chunkMode <= 1024 will always chunk with chunkSize=chunkMode
@@ -37,7 +54,7 @@ func getChunkSize(chunkMode uint32, cardinality, maxDocs uint64) (uint64, error)
 		// legacy chunk size
 		return uint64(chunkMode), nil
 
-	case chunkMode == chunkModeV1:
+	case chunkMode == chunkModeV1 || chunkMode == chunkModePacked:
 		// the observation that the fewest number of dense chunks is the most
 		// desirable layout, given the built-in assumptions of chunking
 		// (that we want to put an upper-bound on the number of items you must
@@ -51,3 +68,69 @@ func getChunkSize(chunkMode uint32, cardinality, maxDocs uint64) (uint64, error)
 	}
 	return 0, fmt.Errorf("unknown chunk mode %d", chunkMode)
 }
+
+// chunkSizeFor returns the chunk size of the chunk mode for the postings of
+// a term, or the doc values of a field, with cardinality docs and about
+// bytes bytes uncompressed, which are only needed by the chunkModeBytes
+// modes.  Since version 3 the chunk size is recorded with the postings or
+// doc values, so any chunk mode may be used to write them.
+func chunkSizeFor(chunkMode uint32, cardinality, bytes, maxDocs uint64) (uint64, error) {
+	target := chunkTargetBytes(chunkMode)
+	if target == 0 {
+		return getChunkSize(chunkMode, cardinality, maxDocs)
+	}
+	// as chunkModeV1, with the number of chunks needed to hold the bytes
+	numChunks := bytes/target + 1
+	chunkSize := maxDocs / numChunks
+	if chunkSize == 0 {
+		chunkSize = 1
+	}
+	return chunkSize, nil
+}
+
+// chunkTargetBytes returns the target number of bytes of each chunk of a
+// chunkModeBytes mode, 0 for the other modes
+func chunkTargetBytes(chunkMode uint32) uint64 {
+	if chunkMode&chunkModeBytes == 0 {
+		return 0
+	}
+	return uint64(chunkMode & maxChunkBytes)
+}
+
+// validChunkMode returns an error if segments cannot be written with the
+// chunk mode, which is for postings, or doc values when not postings
+func validChunkMode(chunkMode uint32, postings bool) error {
+	switch {
+	case chunkMode&chunkModeBytes != 0:
+		if chunkTargetBytes(chunkMode) == 0 {
+			return fmt.Errorf("chunk mode %d targets chunks of 0 bytes", chunkMode)
+		}
+		if chunkMode&chunkModeBytesPacked != 0 && !postings {
+			return fmt.Errorf("chunk mode %d packs postings, not doc values", chunkMode)
+		}
+	case chunkMode == 0 || chunkMode > chunkModePacked:
+		return fmt.Errorf("unknown chunk mode %d", chunkMode)
+	case chunkMode == chunkModePacked && !postings:
+		return fmt.Errorf("chunk mode %d packs postings, not doc values", chunkMode)
+	}
+	return nil
+}
+
+// packedChunks reports whether the values of the chunks of freq/norms and
+// locations of the chunk mode are packed, see packedReader
+func packedChunks(chunkMode uint32) bool {
+	return chunkMode == chunkModePacked ||
+		chunkMode&(chunkModeBytes|chunkModeBytesPacked) == chunkModeBytes|chunkModeBytesPacked
+}
+
+// postingBytes returns the number of bytes of the freq/norm and locations
+// of a posting in uvarint chunks, locBytes being the sum of the
+// locationBytes of its locations, by which the chunkModeBytes modes size
+// the chunks of postings, packed or not
+func postingBytes(freq, norm uint64, locBytes int) uint64 {
+	rv := numUvarintBytes(encodeFreqHasLocs(freq, locBytes > 0)) + numUvarintBytes(norm)
+	if locBytes > 0 {
+		rv += numUvarintBytes(uint64(locBytes)) + locBytes
+	}
+	return uint64(rv)
+}
@@ -0,0 +1,273 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+func TestChunkSizeFor(t *testing.T) {
+	tests := []struct {
+		chunkMode                   uint32
+		cardinality, bytes, maxDocs uint64
+		expected                    uint64
+	}{
+		{chunkMode: 100, cardinality: 5000, bytes: 1 << 20, maxDocs: 10000, expected: 100},
+		{chunkMode: chunkModeV1, cardinality: 5000, bytes: 1 << 20, maxDocs: 10000, expected: 2000},
+		{chunkMode: chunkModePacked, cardinality: 100, maxDocs: 10000, expected: 10000},
+		{chunkMode: uint32(ChunkBytes(1000)), cardinality: 5000, bytes: 9999, maxDocs: 10000, expected: 1000},
+		{chunkMode: uint32(ChunkBytes(1000).Packed()), cardinality: 5000, bytes: 999, maxDocs: 10000, expected: 10000},
+		{chunkMode: uint32(ChunkBytes(1)), cardinality: 5000, bytes: 1 << 20, maxDocs: 10000, expected: 1},
+	}
+	for _, test := range tests {
+		actual, err := chunkSizeFor(test.chunkMode, test.cardinality, test.bytes, test.maxDocs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != test.expected {
+			t.Errorf("chunk mode %d, cardinality %d, bytes %d: expected chunk size %d, got %d",
+				test.chunkMode, test.cardinality, test.bytes, test.expected, actual)
+		}
+	}
+
+	if !packedChunks(uint32(ChunkBytes(1000).Packed())) || packedChunks(uint32(ChunkBytes(1000))) ||
+		ChunkDocs(100).Packed() != ChunkDocs(100) || ChunkByCardinality.Packed() != ChunkByCardinalityPacked {
+		t.Errorf("expected only the packed chunk modes to pack postings")
+	}
+}
+
+// buildTestAnalysisResultsChunking builds the documents of
+// buildTestAnalysisResultsSkips, with doc values in every document, and in
+// every 50th one
+func buildTestAnalysisResultsChunking(numDocs int) []segment.Document {
+	results := buildTestAnalysisResultsSkips(numDocs)
+	for i, result := range results {
+		doc := result.(*FakeDocument)
+		*doc = append(*doc, NewFakeField("tag", fmt.Sprintf("tag%d %s", i%10, strings.Repeat("v", i%20)),
+			false, false, true))
+		if i%50 == 0 {
+			*doc = append(*doc, NewFakeField("rare", fmt.Sprintf("rare%d", i), false, false, true))
+		}
+	}
+	return results
+}
+
+// allDocValues returns the doc values of the fields of each document
+func allDocValues(t *testing.T, seg *Segment, fields ...string) []string {
+	dvr, err := seg.DocumentValueReader(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rv []string
+	for docNum := uint64(0); docNum < seg.footer.numDocs; docNum++ {
+		var values []string
+		err = dvr.VisitDocumentValues(docNum, func(field string, term []byte) {
+			values = append(values, field+" "+string(term))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rv = append(rv, strings.Join(values, ","))
+	}
+	return rv
+}
+
+// chunkSizes returns the chunk size of the postings of each term, and of
+// the doc values of each field
+func chunkSizes(t *testing.T, seg *Segment, field string, terms []string, dvFields []string) map[string]uint64 {
+	rv := map[string]uint64{}
+	dict, err := seg.dictionary(field)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, term := range terms {
+		pl, err := dict.postingsList([]byte(term), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rv[term] = pl.chunkSize
+	}
+	for _, dvField := range dvFields {
+		dvr, err := seg.fieldDocValueReader(seg.fieldsMap[dvField] - 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rv[dvField] = dvr.chunkSize
+	}
+	return rv
+}
+
+func TestChunkingPolicies(t *testing.T) {
+	results := buildTestAnalysisResultsChunking(3000)
+	defaultInt, _, err := New(results, encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultSeg := defaultInt.(*Segment)
+	expectedPostings := allTermPostings(t, defaultSeg, "body")
+	expectedDocValues := allDocValues(t, defaultSeg, "tag", "rare")
+
+	sizes := chunkSizes(t, defaultSeg, "body", []string{"x", "y"}, []string{"tag", "rare"})
+	if !reflect.DeepEqual(sizes, map[string]uint64{"x": 1000, "y": 3000, "tag": 1024, "rare": 1024}) {
+		t.Errorf("expected the default chunk sizes, got %v", sizes)
+	}
+
+	tests := []struct {
+		postings, docValues ChunkMode
+		check               func(sizes map[string]uint64) bool
+	}{
+		{
+			postings:  ChunkDocs(100),
+			docValues: ChunkDocs(16),
+			check: func(sizes map[string]uint64) bool {
+				return reflect.DeepEqual(sizes, map[string]uint64{"x": 100, "y": 100, "tag": 16, "rare": 16})
+			},
+		},
+		{
+			postings:  ChunkByCardinalityPacked,
+			docValues: ChunkByCardinality,
+			check: func(sizes map[string]uint64) bool {
+				return reflect.DeepEqual(sizes, map[string]uint64{"x": 1000, "y": 3000, "tag": 1000, "rare": 3000})
+			},
+		},
+		{
+			// the dense term and field get smaller chunks
+			postings:  ChunkBytes(2048),
+			docValues: ChunkBytes(512),
+			check: func(sizes map[string]uint64) bool {
+				return sizes["x"] < sizes["y"] && sizes["tag"] < sizes["rare"] && sizes["x"] < 1000
+			},
+		},
+		{
+			postings:  ChunkBytes(2048).Packed(),
+			docValues: ChunkBytes(1 << 20),
+			check: func(sizes map[string]uint64) bool {
+				return sizes["x"] < sizes["y"] && sizes["tag"] == 3000 && sizes["rare"] == 3000
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("postings %d doc values %d", test.postings, test.docValues), func(t *testing.T) {
+			opts := []Option{WithPostingsChunking(test.postings), WithDocValueChunking(test.docValues)}
+			built, _, err := NewWithOptions(results, encodeNorm, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			segs := []*Segment{built.(*Segment)}
+			if segs[0].ChunkMode() != uint32(test.postings) {
+				t.Errorf("expected chunk mode %d, got %d", test.postings, segs[0].ChunkMode())
+			}
+
+			// merging the default segment applies the policies
+			for _, workers := range []int{1, 2} {
+				var buf bytes.Buffer
+				_, err = MergeWithOptions([]segment.Segment{defaultSeg}, []*roaring.Bitmap{nil}, 1024,
+					append(opts, WithMergeWorkers(workers))...).WriteTo(&buf, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				merged, err := load(segment.NewDataBytes(buf.Bytes()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				segs = append(segs, merged)
+			}
+
+			for _, seg := range segs {
+				err = seg.Verify(context.Background())
+				if err != nil {
+					t.Fatalf("expected segment to verify, got: %v", err)
+				}
+				sizes := chunkSizes(t, seg, "body", []string{"x", "y"}, []string{"tag", "rare"})
+				if !test.check(sizes) {
+					t.Errorf("unexpected chunk sizes %v", sizes)
+				}
+				if !reflect.DeepEqual(allTermPostings(t, seg, "body"), expectedPostings) {
+					t.Errorf("expected the postings of the default segment")
+				}
+				if !reflect.DeepEqual(allDocValues(t, seg, "tag", "rare"), expectedDocValues) {
+					t.Errorf("expected the doc values of the default segment")
+				}
+			}
+
+			// merging back into the default policies
+			var buf bytes.Buffer
+			_, err = Merge([]segment.Segment{segs[0]}, []*roaring.Bitmap{nil}, 1024).WriteTo(&buf, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			merged, err := load(segment.NewDataBytes(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(allDocValues(t, merged, "tag", "rare"), expectedDocValues) {
+				t.Errorf("expected the doc values of the default segment merged back")
+			}
+		})
+	}
+}
+
+func TestChunkingPoliciesInvalid(t *testing.T) {
+	results := buildTestAnalysisResultsChunking(10)
+	seg, _, err := New(results, encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opt := range []Option{
+		WithPostingsChunking(ChunkDocs(0)),
+		WithPostingsChunking(ChunkDocs(1025)),
+		WithPostingsChunking(ChunkBytes(0)),
+		WithPostingsChunking(ChunkMode(chunkModePacked + 1)),
+		WithDocValueChunking(ChunkByCardinalityPacked),
+		WithDocValueChunking(ChunkBytes(100).Packed()),
+		WithStoredChunking(-1, 0),
+		WithStoredChunking(0, -1),
+	} {
+		_, _, err = NewWithOptions(results, encodeNorm, opt)
+		if err == nil {
+			t.Errorf("expected error building with invalid chunking")
+		}
+		_, err = MergeWithOptions([]segment.Segment{seg}, []*roaring.Bitmap{nil}, 1024, opt).WriteTo(ioutil.Discard, nil)
+		if err == nil {
+			t.Errorf("expected error merging with invalid chunking")
+		}
+		b := NewBuilder(encodeNorm, opt)
+		for _, result := range results {
+			err = b.Add(result)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err = b.WriteTo(ioutil.Discard)
+		if err == nil {
+			t.Errorf("expected error writing a builder with invalid chunking")
+		}
+	}
+}
+
+type ioutilDiscard struct{}
+
+func (ioutilDiscard) Write(p []byte) (int, error) {
+	return len(p), nil
+}
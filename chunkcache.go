@@ -0,0 +1,182 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// chunkCacheSection identifies the section of a segment a cached chunk
+// belongs to
+type chunkCacheSection uint8
+
+const (
+	chunkCacheStored chunkCacheSection = iota + 1
+	chunkCacheDocValues
+)
+
+// segmentCacheIDs numbers the segments loaded, to key their chunks in a
+// shared cache
+var segmentCacheIDs uint64
+
+func nextSegmentCacheID() uint64 {
+	return atomic.AddUint64(&segmentCacheIDs, 1)
+}
+
+type chunkCacheKey struct {
+	segment uint64
+	section chunkCacheSection
+	field   uint16
+	chunk   uint64
+}
+
+type chunkCacheEntry struct {
+	key   chunkCacheKey
+	value []byte
+}
+
+// ChunkCacheStats is a snapshot of the counters of a ChunkCache
+type ChunkCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     int
+	MaxBytes  int
+}
+
+// ChunkCache is a cache of decompressed chunks of stored fields and doc
+// values, shared by the segments loaded with it, see WithChunkCache.  It
+// holds at most its byte budget of chunks, evicting the least recently
+// used, and is safe for concurrent use.  The cached chunks are never
+// modified, so readers use them without copying.
+type ChunkCache struct {
+	maxBytes int
+
+	m         sync.Mutex
+	entries   map[chunkCacheKey]*list.Element
+	segments  map[uint64]map[chunkCacheKey]struct{} // open segment -> keys of its chunks
+	lru       *list.List                            // front is the most recently used
+	bytes     int
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// NewChunkCache returns a cache holding at most maxBytes bytes of
+// decompressed chunks
+func NewChunkCache(maxBytes int) *ChunkCache {
+	return &ChunkCache{
+		maxBytes: maxBytes,
+		entries:  make(map[chunkCacheKey]*list.Element),
+		segments: make(map[uint64]map[chunkCacheKey]struct{}),
+		lru:      list.New(),
+	}
+}
+
+// Stats returns the counters of the cache
+func (c *ChunkCache) Stats() ChunkCacheStats {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return ChunkCacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Entries:   c.lru.Len(),
+		Bytes:     c.bytes,
+		MaxBytes:  c.maxBytes,
+	}
+}
+
+// addSegment returns the id keying the chunks of a segment loaded with the
+// cache, until removeSegment
+func (c *ChunkCache) addSegment() uint64 {
+	segment := nextSegmentCacheID()
+	c.m.Lock()
+	c.segments[segment] = make(map[chunkCacheKey]struct{})
+	c.m.Unlock()
+	return segment
+}
+
+// getOrLoad returns the chunk of the key, loading it on a miss, outside
+// the lock, so concurrent misses may load a chunk more than once
+func (c *ChunkCache) getOrLoad(key chunkCacheKey, load func() ([]byte, error)) ([]byte, error) {
+	if value, ok := c.get(key); ok {
+		return value, nil
+	}
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+	return c.add(key, value), nil
+}
+
+func (c *ChunkCache) get(key chunkCacheKey) ([]byte, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.hits++
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*chunkCacheEntry).value, true
+	}
+	c.misses++
+	return nil, false
+}
+
+// add caches the value of the key, unless larger than the budget or its
+// segment was removed while the value loaded, returning the value cached by
+// a concurrent load if any
+func (c *ChunkCache) add(key chunkCacheKey, value []byte) []byte {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*chunkCacheEntry).value
+	}
+	keys, ok := c.segments[key.segment]
+	if !ok || len(value) > c.maxBytes {
+		return value
+	}
+	c.entries[key] = c.lru.PushFront(&chunkCacheEntry{key: key, value: value})
+	keys[key] = struct{}{}
+	c.bytes += len(value)
+	for c.bytes > c.maxBytes {
+		oldest := c.lru.Back()
+		c.remove(oldest)
+		c.evictions++
+	}
+	return value
+}
+
+// remove drops the chunk of the element, with the lock held
+func (c *ChunkCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*chunkCacheEntry)
+	delete(c.entries, entry.key)
+	delete(c.segments[entry.key.segment], entry.key)
+	c.bytes -= len(entry.value)
+}
+
+// removeSegment drops the chunks of the segment, once it is closed, and
+// those of its loads still in flight as they complete
+func (c *ChunkCache) removeSegment(segment uint64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for key := range c.segments[segment] {
+		c.remove(c.entries[key])
+	}
+	delete(c.segments, segment)
+}
@@ -0,0 +1,328 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+func TestChunkCacheEviction(t *testing.T) {
+	cache := NewChunkCache(100)
+	segmentID := cache.addSegment()
+	value := func(b byte) []byte {
+		return bytes.Repeat([]byte{b}, 40)
+	}
+	key := func(chunk uint64) chunkCacheKey {
+		return chunkCacheKey{segment: segmentID, section: chunkCacheStored, chunk: chunk}
+	}
+	loads := 0
+	get := func(chunk uint64) []byte {
+		rv, err := cache.getOrLoad(key(chunk), func() ([]byte, error) {
+			loads++
+			return value(byte(chunk)), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rv, value(byte(chunk))) {
+			t.Errorf("expected chunk %d, got %v", chunk, rv)
+		}
+		return rv
+	}
+
+	get(0)
+	get(1)
+	get(0) // 1 is now the least recently used
+	get(2) // evicts 1
+	get(0)
+	get(1) // evicts 2
+	if loads != 4 {
+		t.Errorf("expected 4 loads, got %d", loads)
+	}
+	expected := ChunkCacheStats{Hits: 2, Misses: 4, Evictions: 2, Entries: 2, Bytes: 80, MaxBytes: 100}
+	if actual := cache.Stats(); actual != expected {
+		t.Errorf("expected stats %+v, got %+v", expected, actual)
+	}
+
+	// larger than the budget, so never cached
+	big := bytes.Repeat([]byte{9}, 101)
+	for i := 0; i < 2; i++ {
+		rv, err := cache.getOrLoad(key(9), func() ([]byte, error) {
+			return big, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rv, big) {
+			t.Errorf("expected oversized chunk")
+		}
+	}
+	if stats := cache.Stats(); stats.Misses != 6 || stats.Entries != 2 {
+		t.Errorf("expected oversized chunk to miss without evicting, got %+v", stats)
+	}
+
+	_, err := cache.getOrLoad(key(10), func() ([]byte, error) {
+		return nil, fmt.Errorf("failed")
+	})
+	if err == nil {
+		t.Errorf("expected load error")
+	}
+}
+
+func TestChunkCacheRemoveSegment(t *testing.T) {
+	cache := NewChunkCache(100)
+	removed, kept := cache.addSegment(), cache.addSegment()
+	get := func(segmentID, chunk uint64, load func() ([]byte, error)) {
+		_, err := cache.getOrLoad(chunkCacheKey{segment: segmentID, section: chunkCacheStored, chunk: chunk}, load)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	value := func() ([]byte, error) {
+		return bytes.Repeat([]byte{1}, 10), nil
+	}
+	get(removed, 0, value)
+	get(removed, 1, value)
+	get(kept, 0, value)
+
+	// the segment is removed while its chunk loads
+	get(removed, 2, func() ([]byte, error) {
+		cache.removeSegment(removed)
+		return value()
+	})
+	if stats := cache.Stats(); stats.Entries != 1 || stats.Bytes != 10 {
+		t.Errorf("expected only the chunk of the kept segment, got %+v", stats)
+	}
+	if len(cache.segments) != 1 || len(cache.segments[kept]) != 1 {
+		t.Errorf("expected the chunk keys of only the kept segment, got %v", cache.segments)
+	}
+
+	// and once removed its chunks are not cached
+	get(removed, 0, value)
+	if stats := cache.Stats(); stats.Entries != 1 {
+		t.Errorf("expected chunk of removed segment not to be cached, got %+v", stats)
+	}
+}
+
+func buildTestAnalysisResultsCached(start, end int) []segment.Document {
+	var results []segment.Document
+	for i := start; i < end; i++ {
+		vals := testStoredValues(i)
+		results = append(results, &FakeDocument{
+			NewFakeField("_id", vals["_id"], true, false, false),
+			NewFakeField("title", vals["title"], true, false, true),
+			NewFakeField("body", vals["body"], true, false, true),
+		})
+	}
+	return results
+}
+
+// readCachedDoc returns the stored fields and doc values of the document
+func readCachedDoc(seg *Segment, dvr segment.DocumentValueReader, docNum uint64) (map[string][]string, error) {
+	rv := map[string][]string{}
+	err := seg.VisitStoredFields(docNum, func(field string, value []byte) bool {
+		rv[field] = append(rv[field], string(value))
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = dvr.VisitDocumentValues(docNum, func(field string, term []byte) {
+		rv["dv "+field] = append(rv["dv "+field], string(term))
+	})
+	return rv, err
+}
+
+func TestChunkCacheSegments(t *testing.T) {
+	var datas [][]byte
+	var expected [][]map[string][]string
+	for i := 0; i < 2; i++ {
+		segInt, _, err := New(buildTestAnalysisResultsCached(i*1000, (i+1)*1000), encodeNorm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		_, err = segInt.(*Segment).WriteTo(&buf, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		datas = append(datas, buf.Bytes())
+
+		seg := segInt.(*Segment)
+		dvr, err := seg.DocumentValueReader([]string{"title", "body"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var docs []map[string][]string
+		for docNum := uint64(0); docNum < seg.Count(); docNum++ {
+			doc, err := readCachedDoc(seg, dvr, docNum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			docs = append(docs, doc)
+		}
+		expected = append(expected, docs)
+	}
+
+	for _, maxBytes := range []int{1 << 20, 64 << 10} {
+		t.Run(fmt.Sprintf("%d bytes", maxBytes), func(t *testing.T) {
+			cache := NewChunkCache(maxBytes)
+			var segs []*Segment
+			for _, data := range datas {
+				segInt, err := LoadWithOptions(segment.NewDataBytes(data), WithChunkCache(cache))
+				if err != nil {
+					t.Fatal(err)
+				}
+				segs = append(segs, segInt.(*Segment))
+			}
+
+			// concurrent readers, two of each segment, each with its own doc
+			// value reader
+			var wg sync.WaitGroup
+			errs := make(chan error, 4)
+			for reader := 0; reader < 4; reader++ {
+				wg.Add(1)
+				go func(reader int) {
+					defer wg.Done()
+					segI := reader % len(segs)
+					dvr, err := segs[segI].DocumentValueReader([]string{"title", "body"})
+					if err != nil {
+						errs <- err
+						return
+					}
+					for i := uint64(0); i < 2000; i++ {
+						docNum := (i*131 + uint64(reader)) % segs[segI].Count()
+						actual, err := readCachedDoc(segs[segI], dvr, docNum)
+						if err != nil {
+							errs <- err
+							return
+						}
+						if !reflect.DeepEqual(actual, expected[segI][docNum]) {
+							errs <- fmt.Errorf("segment %d doc %d: expected %v, got %v", segI, docNum,
+								expected[segI][docNum], actual)
+							return
+						}
+					}
+				}(reader)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+
+			// the hits depend on how the readers interleave, see
+			// TestChunkCacheHits for exact counts
+			stats := cache.Stats()
+			if stats.Bytes > maxBytes {
+				t.Errorf("expected at most %d bytes cached, got %d", maxBytes, stats.Bytes)
+			}
+			if (stats.Evictions > 0) != (maxBytes < 1<<20) {
+				t.Errorf("expected evictions only with the smaller budget, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestChunkCacheHits(t *testing.T) {
+	segInt, _, err := New(buildTestAnalysisResultsCached(0, 1000), encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = segInt.(*Segment).WriteTo(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	load := func(cache *ChunkCache) *Segment {
+		seg, err := LoadWithOptions(segment.NewDataBytes(buf.Bytes()), WithChunkCache(cache))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return seg.(*Segment)
+	}
+	visit := func(seg *Segment, docNums ...uint64) {
+		for _, docNum := range docNums {
+			err := seg.VisitStoredFields(docNum, func(string, []byte) bool {
+				return true
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// the first and the last doc are in different stored chunks
+	first, last := uint64(0), uint64(999)
+	var chunkBytes []int
+	for _, docNum := range []uint64{first, last} {
+		cache := NewChunkCache(1 << 20)
+		visit(load(cache), docNum)
+		chunkBytes = append(chunkBytes, cache.Stats().Bytes)
+	}
+	maxChunkBytes := chunkBytes[0]
+	if chunkBytes[1] > maxChunkBytes {
+		maxChunkBytes = chunkBytes[1]
+	}
+
+	tests := []struct {
+		maxBytes int
+		expected ChunkCacheStats
+	}{
+		{
+			// both chunks stay cached
+			maxBytes: 1 << 20,
+			expected: ChunkCacheStats{Hits: 3, Misses: 2, Entries: 2, Bytes: chunkBytes[0] + chunkBytes[1]},
+		},
+		{
+			// each chunk evicts the other
+			maxBytes: maxChunkBytes,
+			expected: ChunkCacheStats{Misses: 5, Evictions: 4, Entries: 1, Bytes: chunkBytes[0]},
+		},
+	}
+	for _, test := range tests {
+		cache := NewChunkCache(test.maxBytes)
+		visit(load(cache), first, last, first, last, first)
+		test.expected.MaxBytes = test.maxBytes
+		if actual := cache.Stats(); actual != test.expected {
+			t.Errorf("expected stats %+v, got %+v", test.expected, actual)
+		}
+	}
+
+	// a doc value reader decompresses its chunk once, from the cache
+	cache := NewChunkCache(1 << 20)
+	seg := load(cache)
+	for i := 0; i < 2; i++ {
+		dvr, err := seg.DocumentValueReader([]string{"title", "body"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for docNum := uint64(0); docNum < seg.Count(); docNum++ {
+			err = dvr.VisitDocumentValues(docNum, func(string, []byte) {})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if stats := cache.Stats(); stats.Hits != 2 || stats.Misses != 2 {
+		t.Errorf("expected 2 hits and 2 misses of the 2 doc value chunks, got %+v", stats)
+	}
+}
@@ -0,0 +1,49 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/blugelabs/ice/v2"
+	"github.com/spf13/cobra"
+)
+
+var checkCmd = &cobra.Command{
+	Use:   "check [path]",
+	Short: "check verifies the integrity of the segment",
+	Long:  `The check command recomputes the segment CRC and walks every section of the segment, printing any problems found.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		err := seg.Verify(context.Background())
+		var verifyErr *ice.VerifyError
+		if errors.As(err, &verifyErr) {
+			for _, problem := range verifyErr.Problems {
+				fmt.Println(problem)
+			}
+			return fmt.Errorf("segment check failed, %d problems found", len(verifyErr.Problems))
+		}
+		if err != nil {
+			return fmt.Errorf("error checking segment: %w", err)
+		}
+		fmt.Println("ok")
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(checkCmd)
+}
@@ -18,15 +18,26 @@ import (
 	"fmt"
 
 	segment "github.com/blugelabs/bluge_segment_api"
+	"github.com/blugelabs/ice/v2"
 	"github.com/spf13/cobra"
 )
 
 const dictArgField = 2
 
+var (
+	dictPrefix      string
+	dictSuffix      string
+	dictFuzzy       string
+	dictFuzzyEdits  int
+	dictFuzzyPrefix int
+	dictRegexp      string
+)
+
 var dictCmd = &cobra.Command{
 	Use:   "dict [path] [field]",
 	Short: "dict prints the term dictionary for the specified field",
-	Long:  `The dict command lets you print the term dictionary for the specified field.`,
+	Long: `The dict command lets you print the term dictionary for the specified field,
+or only the terms with a prefix or suffix, within edits of a term, or matching a regexp.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) < dictArgField {
 			return fmt.Errorf("must specify field")
@@ -42,7 +53,10 @@ func exploreDictionary(field string) error {
 		return fmt.Errorf("error accessing dictionary for field '%s': %w", field, err)
 	}
 
-	dictItr := dict.Iterator(nil, nil, nil)
+	dictItr, err := dictionaryIterator(dict.(*ice.Dictionary))
+	if err != nil {
+		return err
+	}
 
 	var dictEntry segment.DictionaryEntry
 	dictEntry, err = dictItr.Next()
@@ -55,9 +69,31 @@ func exploreDictionary(field string) error {
 		dictEntry, err = dictItr.Next()
 	}
 
-	return nil
+	return err
+}
+
+// dictionaryIterator returns the iterator of the terms selected by the
+// flags, all the terms if none are set
+func dictionaryIterator(dict *ice.Dictionary) (segment.DictionaryIterator, error) {
+	switch {
+	case dictFuzzy != "":
+		return dict.FuzzyIterator(dictFuzzy, dictFuzzyEdits, dictFuzzyPrefix)
+	case dictRegexp != "":
+		return dict.RegexpIterator(dictRegexp)
+	case dictPrefix != "":
+		return dict.PrefixIterator(dictPrefix), nil
+	case dictSuffix != "":
+		return dict.SuffixIterator(dictSuffix), nil
+	}
+	return dict.Iterator(nil, nil, nil), nil
 }
 
 func init() {
 	RootCmd.AddCommand(dictCmd)
+	dictCmd.Flags().StringVar(&dictPrefix, "prefix", "", "print only the terms with the prefix")
+	dictCmd.Flags().StringVar(&dictSuffix, "suffix", "", "print only the terms with the suffix")
+	dictCmd.Flags().StringVar(&dictFuzzy, "fuzzy", "", "print only the terms within edits of the term")
+	dictCmd.Flags().IntVar(&dictFuzzyEdits, "edits", 1, "the edits allowed by --fuzzy")
+	dictCmd.Flags().IntVar(&dictFuzzyPrefix, "fuzzy-prefix", 0, "the number of leading characters --fuzzy matches exactly")
+	dictCmd.Flags().StringVar(&dictRegexp, "regexp", "", "print only the terms matching the regexp")
 }
@@ -17,7 +17,9 @@ package cmd
 import (
 	"fmt"
 	"strconv"
+	"time"
 
+	"github.com/blugelabs/ice/v2"
 	"github.com/spf13/cobra"
 )
 
@@ -54,10 +56,71 @@ var docValuesCmd = &cobra.Command{
 			return fmt.Errorf("error visiting document field term: %w", err)
 		}
 
+		for _, field := range args[2:] {
+			err = printNumericDocValue(field, docNum)
+			if err != nil {
+				return err
+			}
+			err = printSortedSetDocValues(field, docNum)
+			if err != nil {
+				return err
+			}
+		}
+
 		return nil
 	},
 }
 
+func printNumericDocValue(field string, docNum uint64) error {
+	numeric, err := seg.NumericDocValues(field)
+	if err != nil {
+		return fmt.Errorf("error reading numeric doc values: %w", err)
+	}
+	if numeric == nil {
+		return nil
+	}
+	val, ok, err := numeric.Get(docNum)
+	if err != nil {
+		return fmt.Errorf("error reading numeric doc value: %w", err)
+	}
+	if ok {
+		fmt.Printf("%s %s %s\n", field, numeric.Type(), printNumeric(numeric.Type(), val))
+	}
+	return nil
+}
+
+func printSortedSetDocValues(field string, docNum uint64) error {
+	sortedSet, err := seg.SortedSetDocValues(field)
+	if err != nil {
+		return fmt.Errorf("error reading sorted-set doc values: %w", err)
+	}
+	if sortedSet == nil {
+		return nil
+	}
+	ords, err := sortedSet.Ordinals(docNum, nil)
+	if err != nil {
+		return fmt.Errorf("error reading sorted-set doc values: %w", err)
+	}
+	for _, ord := range ords {
+		term, err := sortedSet.Term(ord)
+		if err != nil {
+			return fmt.Errorf("error reading sorted-set term: %w", err)
+		}
+		fmt.Printf("%s ord %d %#x (%s)\n", field, ord, term, term)
+	}
+	return nil
+}
+
+func printNumeric(typ ice.NumericType, val int64) string {
+	switch typ {
+	case ice.NumericFloat64:
+		return strconv.FormatFloat(ice.SortableInt64ToFloat64(val), 'g', -1, 64)
+	case ice.NumericDate:
+		return time.Unix(0, val).UTC().Format(time.RFC3339Nano)
+	}
+	return strconv.FormatInt(val, 10)
+}
+
 func init() {
 	RootCmd.AddCommand(docValuesCmd)
 }
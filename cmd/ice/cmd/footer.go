@@ -32,8 +32,20 @@ var footerCmd = &cobra.Command{
 		fmt.Printf("Chunk Mode: %d\n", seg.ChunkMode())
 		fmt.Printf("Fields Idx: %d (%#x)\n", seg.FieldsIndexOffset(), seg.FieldsIndexOffset())
 		fmt.Printf("Stored Idx: %d (%#x)\n", seg.StoredIndexOffset(), seg.StoredIndexOffset())
+		fmt.Printf("Stored Codec: %s\n", seg.StoredCodec())
+		chunkDocs, chunkBytes := seg.StoredChunking()
+		fmt.Printf("Stored Chunking: %d docs, %d bytes\n", chunkDocs, chunkBytes)
+		largeThreshold, largeBytes := seg.StoredLargeValues()
+		fmt.Printf("Stored Large Values: %d bytes threshold, %d bytes\n", largeThreshold, largeBytes)
 		fmt.Printf("DocValue Idx: %d (%#x)\n", seg.DocValueOffset(), seg.DocValueOffset())
 		fmt.Printf("Num Docs: %d\n", seg.NumDocs())
+		fmt.Printf("Sort Idx: %d (%#x)\n", seg.SortOffset(), seg.SortOffset())
+		fmt.Printf("Numeric DocValue Idx: %d (%#x)\n", seg.NumericOffset(), seg.NumericOffset())
+		fmt.Printf("SortedSet DocValue Idx: %d (%#x)\n", seg.SortedSetOffset(), seg.SortedSetOffset())
+		for _, sortField := range seg.Sort() {
+			fmt.Printf("Sort Field: %s (descending: %t, missing first: %t)\n",
+				sortField.Field, sortField.Descending, sortField.MissingFirst)
+		}
 		return nil
 	},
 }
@@ -28,6 +28,9 @@ import (
 
 var seg *ice.Segment
 
+// segClose closes the file of the segment
+var segClose closeFunc = noCloseFunc
+
 const rootArgFilename = 1
 
 // RootCmd represents the base command when called without any subcommands
@@ -41,16 +44,21 @@ var RootCmd = &cobra.Command{
 			return fmt.Errorf("must specify path to file")
 		}
 
-		segInt, _, err := openFromFile(args[0])
+		segInt, closeF, err := openFromFile(args[0])
 		if err != nil {
 			return fmt.Errorf("error opening file: %v", err)
 		}
 		seg = segInt.(*ice.Segment)
+		segClose = closeF
 
 		return nil
 	},
 	PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
-		return nil
+		err := seg.Close()
+		if err != nil {
+			return fmt.Errorf("error closing segment: %v", err)
+		}
+		return segClose()
 	},
 }
 
@@ -0,0 +1,62 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var statsJSON bool
+
+var statsCmd = &cobra.Command{
+	Use:   "stats [path]",
+	Short: "stats prints the bytes taken by each section and field",
+	Long:  `The stats command prints the bytes taken by each section of the segment, per field, and what the terms and doc values of each field hold.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		stats, err := seg.Stats()
+		if err != nil {
+			return fmt.Errorf("error reading segment stats: %v", err)
+		}
+
+		if statsJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(stats)
+		}
+
+		fmt.Printf("docs: %d\n", stats.NumDocs)
+		fmt.Printf("bytes: %d\n", stats.Bytes)
+		fmt.Printf("stored bytes: %d\n", stats.StoredBytes)
+		fmt.Printf("%-20s %10s %10s %10s %10s %10s %10s %10s %10s %10s %8s %8s\n",
+			"field", "dict", "postings", "freqnorm", "locs", "docvals", "numeric", "sortedset",
+			"terms", "1hit", "avglen", "chunks")
+		for _, f := range stats.Fields {
+			fmt.Printf("%-20s %10d %10d %10d %10d %10d %10d %10d %10d %10d %8.2f %8d\n",
+				f.Name, f.DictionaryBytes, f.PostingsBytes, f.FreqNormBytes, f.LocationBytes,
+				f.DocValueBytes, f.NumericDocValueBytes, f.SortedSetDocValueBytes,
+				f.Terms, f.OneHitTerms, f.AvgPostingsLen, f.DocValueChunks)
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(statsCmd)
+	statsCmd.Flags().BoolVar(&statsJSON, "json", false, "print the stats as JSON")
+}
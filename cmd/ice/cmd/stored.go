@@ -25,9 +25,10 @@ const storedArgDocNum = 2
 
 // storedCmd represents the stored command
 var storedCmd = &cobra.Command{
-	Use:   "stored [path] [docNum]",
+	Use:   "stored [path] [docNum] [field]...",
 	Short: "prints the stored section for a doc number",
-	Long:  `The stored command will print the raw stored data bytes for the specified document number.`,
+	Long: `The stored command will print the raw stored data bytes for the specified document number,
+only those of the fields specified, if any.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) < storedArgDocNum {
 			return fmt.Errorf("must specify doc number")
@@ -38,14 +39,18 @@ var storedCmd = &cobra.Command{
 			return fmt.Errorf("unable to parse doc number: %v", err)
 		}
 
-		return seg.VisitStoredFields(docNum, func(field string, value []byte) bool {
+		visitor := func(field string, value []byte) bool {
 			opt := printValue(value)
 			if opt != "" {
 				opt = "(" + opt + ")"
 			}
 			fmt.Printf("%s %#x %s\n", field, value, opt)
 			return true
-		})
+		}
+		if len(args) > storedArgDocNum {
+			return seg.VisitStoredFieldsSubset(docNum, args[storedArgDocNum:], visitor)
+		}
+		return seg.VisitStoredFields(docNum, visitor)
 	},
 }
 
@@ -0,0 +1,63 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/blugelabs/ice/v2"
+	"github.com/spf13/cobra"
+)
+
+const topTermsArgN = 3
+
+var topTermsCmd = &cobra.Command{
+	Use:   "topterms [path] [field] [n]",
+	Short: "topterms prints the terms of a field with the highest doc frequency",
+	Long:  `The topterms command prints the n terms of the specified field with the highest doc frequency.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < topTermsArgN {
+			return fmt.Errorf("must specify field and number of terms")
+		}
+
+		n, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("unable to parse number of terms: %v", err)
+		}
+
+		dict, err := seg.Dictionary(args[1])
+		if err != nil {
+			return fmt.Errorf("error accessing dictionary for field '%s': %w", args[1], err)
+		}
+
+		entries, err := dict.(*ice.Dictionary).TopTerms(n, nil)
+		if err != nil {
+			return fmt.Errorf("error reading top terms: %w", err)
+		}
+		for _, entry := range entries {
+			term := printValueStr(entry.Term())
+			if term == "" {
+				term = fmt.Sprintf("%#x", entry.Term())
+			}
+			fmt.Printf("%s %d\n", term, entry.Count())
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(topTermsCmd)
+}
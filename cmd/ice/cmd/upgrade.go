@@ -0,0 +1,65 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/RoaringBitmap/roaring"
+	segment "github.com/blugelabs/bluge_segment_api"
+	"github.com/blugelabs/ice/v2"
+	"github.com/spf13/cobra"
+)
+
+const upgradeBufferSize = 1 << 20
+
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade [in] [out]",
+	Short: "upgrade rewrites the segment in the current file format",
+	Long: `The upgrade command rewrites the segment into a new file, in the current file format.
+The documents keep their numbers, and a sorted segment stays sorted.  The output file must not exist.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return fmt.Errorf("must specify path to output file")
+		}
+
+		f, err := os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return fmt.Errorf("error creating output file: %w", err)
+		}
+
+		merger := ice.MergeWithOptions([]segment.Segment{seg}, []*roaring.Bitmap{nil}, upgradeBufferSize,
+			ice.WithSort(seg.Sort()...))
+		_, err = merger.WriteTo(f, nil)
+		if err == nil {
+			err = f.Sync()
+		}
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			_ = os.Remove(args[1])
+			return fmt.Errorf("error upgrading segment: %w", err)
+		}
+
+		fmt.Printf("upgraded version %d to version %d\n", seg.Version(), ice.Version)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(upgradeCmd)
+}
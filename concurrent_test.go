@@ -0,0 +1,209 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+// concurrentReads reads every part of the read surface of the segment,
+// returning what was read, so concurrent reads can be compared with serial
+func concurrentReads(seg *Segment, offset uint64) (map[string]interface{}, error) {
+	rv := map[string]interface{}{}
+	for _, term := range []string{"fox", "dog", "index"} {
+		dict, err := seg.Dictionary("body")
+		if err != nil {
+			return nil, err
+		}
+		pl, err := dict.PostingsList([]byte(term), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		itr, err := pl.Iterator(true, true, true, nil)
+		if err != nil {
+			return nil, err
+		}
+		var docNums []uint64
+		for posting, err := itr.Next(); posting != nil || err != nil; posting, err = itr.Next() {
+			if err != nil {
+				return nil, err
+			}
+			docNums = append(docNums, posting.Number())
+		}
+		rv["postings "+term] = docNums
+	}
+
+	matching, err := seg.DocsMatchingTerms([]segment.Term{
+		testIdentifier("00005"), testIdentifier("01234"), testIdentifier("missing"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	rv["matching"] = matching.ToArray()
+
+	dvr, err := seg.DocumentValueReader([]string{"title", "body"})
+	if err != nil {
+		return nil, err
+	}
+	var docNums []uint64
+	for i := uint64(0); i < 300; i++ {
+		docNums = append(docNums, (i*97+offset)%seg.Count())
+	}
+	for _, docNum := range docNums {
+		doc := map[string][]string{}
+		err = seg.VisitStoredFields(docNum, func(field string, value []byte) bool {
+			doc[field] = append(doc[field], string(value))
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = seg.VisitStoredFieldsSubset(docNum, []string{"title"}, func(field string, value []byte) bool {
+			doc["subset "+field] = append(doc["subset "+field], string(value))
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = dvr.VisitDocumentValues(docNum, func(field string, term []byte) {
+			doc["dv "+field] = append(doc["dv "+field], string(term))
+		})
+		if err != nil {
+			return nil, err
+		}
+		rv[fmt.Sprintf("doc %d", docNum)] = doc
+	}
+	err = seg.VisitStoredFieldsBatch(docNums, func(docNum uint64, field string, value []byte) bool {
+		key := fmt.Sprintf("batch %d %s", docNum, field)
+		rv[key] = string(value)
+		return true
+	})
+	return rv, err
+}
+
+func TestConcurrentReads(t *testing.T) {
+	segInt, _, err := New(buildTestAnalysisResultsCached(0, 2000), encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = segInt.(*Segment).WriteTo(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range [][]Option{nil, {WithChunkCache(NewChunkCache(64 << 10))}} {
+		t.Run(fmt.Sprintf("cache %t", len(opts) > 0), func(t *testing.T) {
+			loaded, err := LoadWithOptions(segment.NewDataBytes(buf.Bytes()), opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seg := loaded.(*Segment)
+
+			const readers = 8
+			expected := make([]map[string]interface{}, readers)
+			for reader := range expected {
+				expected[reader], err = concurrentReads(seg, uint64(reader))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, readers)
+			for reader := 0; reader < readers; reader++ {
+				wg.Add(1)
+				go func(reader int) {
+					defer wg.Done()
+					for i := 0; i < 3; i++ {
+						actual, err := concurrentReads(seg, uint64(reader))
+						if err != nil {
+							errs <- err
+							return
+						}
+						if !reflect.DeepEqual(actual, expected[reader]) {
+							errs <- fmt.Errorf("reader %d: expected concurrent reads to match serial reads", reader)
+							return
+						}
+					}
+				}(reader)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestDictionaryErrorUnlocks(t *testing.T) {
+	path, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	segInt, _, err := New(buildTestAnalysisResultsCached(0, 10), encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segPath := filepath.Join(path, "segment.ice")
+	err = persistToFile(segInt.(*Segment), segPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// read from the file, as reads out of range of data in memory panic
+	f, err := os.Open(segPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	data, err := segment.NewDataFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg, err := load(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the dictionary of body is out of range of the data
+	seg.fields[seg.fieldsMap["body"]-1].dictLoc = math.MaxUint32
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2; i++ {
+			if _, err := seg.Dictionary("body"); err == nil {
+				t.Errorf("expected error reading dictionary out of range")
+			}
+		}
+		if _, err := seg.Dictionary("title"); err != nil {
+			t.Errorf("expected to read another dictionary, got: %v", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected reading dictionaries after an error not to block")
+	}
+}
@@ -208,9 +208,17 @@ func (c *chunkedContentCoder) Write() (int, error) {
 	chunkOffsetsLen := uint64(tw) - chunkOffsetsStart
 
 	c.final = c.final[0:8]
+	// write out the chunk size, since version 3
+	binary.BigEndian.PutUint64(c.final, c.chunkSize)
+	nw, err := c.w.Write(c.final)
+	tw += nw
+	if err != nil {
+		return tw, err
+	}
+
 	// write out the length of chunk offsets
 	binary.BigEndian.PutUint64(c.final, chunkOffsetsLen)
-	nw, err := c.w.Write(c.final)
+	nw, err = c.w.Write(c.final)
 	tw += nw
 	if err != nil {
 		return tw, err
@@ -32,12 +32,15 @@ func TestChunkedContentCoder(t *testing.T) {
 			chunkSize: 1,
 			docNums:   []uint64{0},
 			vals:      [][]byte{[]byte("bluge")},
-			// 1 chunk, chunk-0 length 11(b), value
+			// 1 chunk, chunk-0 length 11(b), value, chunk offsets, chunk
+			// size, chunk offsets length and number of chunks
 			expected: []byte{
 				0x1, 0x0, 0x5, 0x28, 0xb5, 0x2f, 0xfd, 0x4, 0x0, 0x29, 0x0, 0x0,
 				'b', 'l', 'u', 'g', 'e',
-				0x7e, 0xde, 0xed, 0x4a, 0x15, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
-				0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1,
+				0x7e, 0xde, 0xed, 0x4a, 0x15,
+				0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1,
+				0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1,
+				0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1,
 			},
 		},
 		{
@@ -54,6 +57,7 @@ func TestChunkedContentCoder(t *testing.T) {
 				0x75, 0x70, 0x73, 0x69, 0x64, 0x65, 0x35, 0x89, 0x5a, 0xd,
 				0x1, 0x1, 0x6, 0x28, 0xb5, 0x2f, 0xfd, 0x4, 0x0, 0x31, 0x0, 0x0,
 				0x73, 0x63, 0x6f, 0x72, 0x63, 0x68, 0xc4, 0x46, 0x89, 0x39, 0x16, 0x2c,
+				0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1,
 				0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2,
 			},
 		},
@@ -22,7 +22,8 @@ import (
 	segment "github.com/blugelabs/bluge_segment_api"
 )
 
-// Dictionary is the representation of the term dictionary
+// Dictionary is the representation of the term dictionary, it holds a
+// reader of the FST, so is not safe for concurrent use
 type Dictionary struct {
 	sb        *Segment
 	field     string
@@ -139,6 +140,17 @@ type DictionaryIterator struct {
 	tmp       PostingsList
 	entry     DictEntry
 	omitCount bool
+
+	// reversed is set when iterating the reversed terms, see SuffixIterator
+	reversed   bool
+	reverseBuf []byte
+
+	// maxExpansions is the number of terms matched before failing with
+	// ErrTooManyExpansions, 0 for no limit.  The terms the automaton walks
+	// past without matching are not counted, as vellum does not report
+	// them, so a pattern such as .*x may walk all the terms of the field.
+	maxExpansions int
+	expansions    int
 }
 
 // Next returns the next entry in the dictionary
@@ -148,7 +160,18 @@ func (i *DictionaryIterator) Next() (segment.DictionaryEntry, error) {
 	} else if i.itr == nil || i.err == vellum.ErrIteratorDone {
 		return nil, nil
 	}
+	if i.maxExpansions > 0 {
+		i.expansions++
+		if i.expansions > i.maxExpansions {
+			i.err = fmt.Errorf("%w: more than %d terms", ErrTooManyExpansions, i.maxExpansions)
+			return nil, i.err
+		}
+	}
 	term, postingsOffset := i.itr.Current()
+	if i.reversed {
+		i.reverseBuf = reverseBytes(i.reverseBuf[:0], term)
+		term = i.reverseBuf
+	}
 	i.entry.term = string(term)
 	if !i.omitCount {
 		i.err = i.tmp.read(postingsOffset, i.d)
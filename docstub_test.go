@@ -15,6 +15,7 @@
 package ice
 
 import (
+	"strconv"
 	"strings"
 
 	segment "github.com/blugelabs/bluge_segment_api"
@@ -192,10 +193,11 @@ func (f *FakeTerm) EachLocation(vl segment.VisitLocation) {
 }
 
 type FakeLocation struct {
-	F string
-	P int
-	S int
-	E int
+	F  string
+	P  int
+	S  int
+	E  int
+	PL []byte
 }
 
 func (f *FakeLocation) Field() string { return f.F }
@@ -203,3 +205,74 @@ func (f *FakeLocation) Pos() int      { return f.P }
 func (f *FakeLocation) Start() int    { return f.S }
 func (f *FakeLocation) End() int      { return f.E }
 func (f *FakeLocation) Size() int     { return 0 }
+func (f *FakeLocation) Payload() []byte {
+	return f.PL
+}
+
+// FakeTypedDocument is a FakeDocument with fields of other types
+type FakeTypedDocument struct {
+	FakeDocument
+	Typed []segment.Field
+}
+
+func (f *FakeTypedDocument) EachField(vf segment.VisitField) {
+	f.FakeDocument.EachField(vf)
+	for _, ff := range f.Typed {
+		vf(ff)
+	}
+}
+
+// FakeNumericField is a FakeField with a numeric value, indexed as its
+// decimal representation
+type FakeNumericField struct {
+	*FakeField
+	NT NumericType
+	NV int64
+}
+
+func NewFakeNumericField(name string, typ NumericType, val int64, store, docVals bool) *FakeNumericField {
+	return &FakeNumericField{
+		FakeField: NewFakeField(name, strconv.FormatInt(val, 10), store, false, docVals),
+		NT:        typ,
+		NV:        val,
+	}
+}
+
+func (f *FakeNumericField) NumericType() NumericType {
+	return f.NT
+}
+
+func (f *FakeNumericField) NumericValue() int64 {
+	return f.NV
+}
+
+// FakeSortedSetField is a FakeField with sorted-set doc values
+type FakeSortedSetField struct {
+	*FakeField
+}
+
+func NewFakeSortedSetField(name, data string) *FakeSortedSetField {
+	return &FakeSortedSetField{
+		FakeField: NewFakeField(name, data, false, false, true),
+	}
+}
+
+func (f *FakeSortedSetField) SortedSetDocValues() bool {
+	return true
+}
+
+// FakeReverseTermsField is a FakeField whose terms are also indexed
+// reversed
+type FakeReverseTermsField struct {
+	*FakeField
+}
+
+func NewFakeReverseTermsField(name, data string) *FakeReverseTermsField {
+	return &FakeReverseTermsField{
+		FakeField: NewFakeField(name, data, false, false, false),
+	}
+}
+
+func (f *FakeReverseTermsField) ReverseTerms() bool {
+	return true
+}
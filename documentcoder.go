@@ -8,25 +8,43 @@ import (
 
 const defaultDocumentChunkSize uint32 = 128
 
+// storedLargeValueFlag is set in the field id of the meta of a stored
+// value in the large value region, the field id being shifted left by one
+const storedLargeValueFlag = 1
+
+// chunkedDocumentCoder compresses the stored docs in chunks, a chunk ends
+// after chunkDocs docs, or once chunkBytes bytes are buffered, when not 0.
+// Values of at least largeThreshold bytes, when not 0, are compressed on
+// their own, and held until they are written after the chunks.
 type chunkedDocumentCoder struct {
-	chunkSize  uint64
-	w          io.Writer
-	buf        *bytes.Buffer
-	metaBuf    []byte
-	n          uint64
-	bytes      uint64
-	compressed []byte
-	offsets    []uint64
+	chunkDocs      uint64
+	chunkBytes     uint64
+	largeThreshold uint64
+	codec          StoredCodec
+	w              io.Writer
+	buf            *bytes.Buffer
+	metaBuf        []byte
+	n              uint64
+	bytes          uint64
+	compressed     []byte
+	offsets        []uint64
+	docStarts      []uint64
+	large          []byte
 }
 
-func newChunkedDocumentCoder(chunkSize uint64, w io.Writer) *chunkedDocumentCoder {
+func newChunkedDocumentCoder(chunkDocs, chunkBytes, largeThreshold uint64, codec StoredCodec,
+	w io.Writer) *chunkedDocumentCoder {
 	c := &chunkedDocumentCoder{
-		chunkSize: chunkSize,
-		w:         w,
+		chunkDocs:      chunkDocs,
+		chunkBytes:     chunkBytes,
+		largeThreshold: largeThreshold,
+		codec:          codec,
+		w:              w,
 	}
 	c.buf = bytes.NewBuffer(nil)
 	c.metaBuf = make([]byte, binary.MaxVarintLen64)
 	c.offsets = append(c.offsets, 0)
+	c.docStarts = append(c.docStarts, 0)
 	return c
 }
 
@@ -55,13 +73,29 @@ func (c *chunkedDocumentCoder) Add(docNum uint64, meta, data []byte) (int, error
 	return wn, c.newLine()
 }
 
+// addLargeValue adds the value to the large value region, if it is large,
+// returning its offset in the region and its compressed length
+func (c *chunkedDocumentCoder) addLargeValue(value []byte) (offset, length uint64, large bool, err error) {
+	if c.largeThreshold == 0 || uint64(len(value)) < c.largeThreshold {
+		return 0, 0, false, nil
+	}
+	c.compressed, err = c.codec.Compress(c.compressed[:cap(c.compressed)], value)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	offset = uint64(len(c.large))
+	c.large = append(c.large, c.compressed...)
+	return offset, uint64(len(c.compressed)), true, nil
+}
+
 func (c *chunkedDocumentCoder) writeToBuf(data []byte) (int, error) {
 	return c.buf.Write(data)
 }
 
 func (c *chunkedDocumentCoder) newLine() error {
 	c.n++
-	if c.n%c.chunkSize != 0 {
+	if (c.chunkDocs == 0 || c.n-c.docStarts[len(c.docStarts)-1] < c.chunkDocs) &&
+		(c.chunkBytes == 0 || uint64(c.buf.Len()) < c.chunkBytes) {
 		return nil
 	}
 	return c.flush()
@@ -70,7 +104,7 @@ func (c *chunkedDocumentCoder) newLine() error {
 func (c *chunkedDocumentCoder) flush() error {
 	if c.buf.Len() > 0 {
 		var err error
-		c.compressed, err = ZSTDCompress(c.compressed[:cap(c.compressed)], c.buf.Bytes(), ZSTDCompressionLevel)
+		c.compressed, err = c.codec.Compress(c.compressed[:cap(c.compressed)], c.buf.Bytes())
 		if err != nil {
 			return err
 		}
@@ -82,6 +116,7 @@ func (c *chunkedDocumentCoder) flush() error {
 		c.buf.Reset()
 	}
 	c.offsets = append(c.offsets, c.bytes)
+	c.docStarts = append(c.docStarts, c.n)
 	return nil
 }
 
@@ -90,7 +125,11 @@ func (c *chunkedDocumentCoder) Write() error {
 	if err := c.flush(); err != nil {
 		return err
 	}
-	var err error
+	// write large values
+	_, err := c.w.Write(c.large)
+	if err != nil {
+		return err
+	}
 	var wn, n int
 	// write chunk offsets
 	for _, offset := range c.offsets {
@@ -110,12 +149,48 @@ func (c *chunkedDocumentCoder) Write() error {
 	if err != nil {
 		return err
 	}
-	return nil
+	// write chunk index
+	if err = c.writeChunkIndex(); err != nil {
+		return err
+	}
+	// write codec dictionary, its length and the codec id
+	dict := c.codec.Dict()
+	if _, err = c.w.Write(dict); err != nil {
+		return err
+	}
+	err = binary.Write(c.w, binary.BigEndian, uint32(len(dict)))
+	if err != nil {
+		return err
+	}
+	return binary.Write(c.w, binary.BigEndian, uint32(c.codec.ID()))
+}
+
+// writeChunkIndex writes out the chunk policy, the large value threshold
+// and the length of the large value region, then the first doc of each
+// chunk, as uvarints, followed by their length
+func (c *chunkedDocumentCoder) writeChunkIndex() error {
+	var wn int
+	vals := []uint64{c.chunkDocs, c.chunkBytes, c.largeThreshold, uint64(len(c.large))}
+	var prev uint64
+	for _, docStart := range c.docStarts {
+		vals = append(vals, docStart-prev)
+		prev = docStart
+	}
+	for _, val := range vals {
+		n := binary.PutUvarint(c.metaBuf, val)
+		if _, err := c.w.Write(c.metaBuf[:n]); err != nil {
+			return err
+		}
+		wn += n
+	}
+	return binary.Write(c.w, binary.BigEndian, uint32(wn))
 }
 
 func (c *chunkedDocumentCoder) Reset() {
 	c.compressed = c.compressed[:0]
 	c.offsets = c.offsets[:0]
+	c.docStarts = c.docStarts[:0]
+	c.large = c.large[:0]
 	c.n = 0
 	c.bytes = 0
 	c.buf.Reset()
@@ -23,6 +23,8 @@ func TestChunkedDocumentCoder(t *testing.T) {
 				0x28, 0xb5, 0x2f, 0xfd, 0x4, 0x0, 0x41,
 				0x0, 0x0, 0x1, 0x5, 0x0, 0x62, 0x6c, 0x75, 0x67, 0x65, 0x2b, 0x30, 0x97, 0x33, 0x0, 0x15, 0x15,
 				0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0x0, 0x3,
+				0x1, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x7,
+				0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3,
 			},
 			expectedChunkNum: 3, // left, chunk, right
 		},
@@ -38,6 +40,8 @@ func TestChunkedDocumentCoder(t *testing.T) {
 				0x0, 0x0, 0x1, 0x6, 0x1, 0x73, 0x63, 0x6f, 0x72, 0x63, 0x68,
 				0x8f, 0x83, 0xa3, 0x37, 0x0, 0x16, 0x2c, 0x2c,
 				0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0x0, 0x4,
+				0x1, 0x0, 0x0, 0x0, 0x0, 0x1, 0x1, 0x0, 0x0, 0x0, 0x0, 0x8,
+				0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3,
 			},
 			expectedChunkNum: 4, // left, chunk, chunk, right
 		},
@@ -45,7 +49,7 @@ func TestChunkedDocumentCoder(t *testing.T) {
 
 	for _, test := range tests {
 		var actual bytes.Buffer
-		cic := newChunkedDocumentCoder(test.chunkSize, &actual)
+		cic := newChunkedDocumentCoder(test.chunkSize, 0, 0, defaultStoredCodec, &actual)
 		for i, docNum := range test.docNums {
 			_, err := cic.Add(docNum, test.metas[i], test.datas[i])
 			if err != nil {
@@ -88,9 +92,9 @@ func TestChunkedDocumentCoders(t *testing.T) {
 
 	var actual1, actual2 bytes.Buffer
 	// chunkedDocumentCoder that writes out at the end
-	cic1 := newChunkedDocumentCoder(chunkSize, &actual1)
+	cic1 := newChunkedDocumentCoder(chunkSize, 0, 0, defaultStoredCodec, &actual1)
 	// chunkedContentCoder that writes out in chunks
-	cic2 := newChunkedDocumentCoder(chunkSize, &actual2)
+	cic2 := newChunkedDocumentCoder(chunkSize, 0, 0, defaultStoredCodec, &actual2)
 
 	for i, docNum := range docNums {
 		_, err := cic1.Add(docNum, metas[i], datas[i])
@@ -32,13 +32,18 @@ type docVisitState struct {
 }
 
 type docValueReader struct {
-	field          string
-	curChunkNum    uint64
-	chunkOffsets   []uint64
-	dvDataLoc      uint64
-	curChunkHeader []metaData
-	curChunkData   []byte // compressed data cache
-	uncompressed   []byte // temp buf for decompression
+	field           string
+	fieldID         uint16
+	curChunkNum     uint64
+	chunkSize       uint64 // docs of each chunk
+	chunkOffsets    []uint64
+	dvDataLoc       uint64
+	curChunkHeader  []metaData
+	curChunkData    []byte // compressed data cache
+	uncompressed    []byte // temp buf for decompression
+	curUncompressed []byte // current chunk decompressed, maybe cached
+	chunkCache      *ChunkCache
+	chunkCacheKey   chunkCacheKey
 }
 
 func (di *docValueReader) size() int {
@@ -55,12 +60,16 @@ func (di *docValueReader) cloneInto(rv *docValueReader) *docValueReader {
 	}
 
 	rv.field = di.field
+	rv.fieldID = di.fieldID
 	rv.curChunkNum = math.MaxInt64
+	rv.chunkSize = di.chunkSize
 	rv.chunkOffsets = di.chunkOffsets // immutable, so it's sharable
 	rv.dvDataLoc = di.dvDataLoc
 	rv.curChunkHeader = rv.curChunkHeader[:0]
 	rv.curChunkData = nil
 	rv.uncompressed = rv.uncompressed[:0]
+	rv.curUncompressed = nil
+	rv.chunkCache = nil
 
 	return rv
 }
@@ -72,8 +81,9 @@ func (di *docValueReader) curChunkNumber() uint64 {
 const fieldDvStartWidth = 8
 const fieldDvEndWidth = 8
 const fieldDvStartEndWidth = fieldDvStartWidth + fieldDvEndWidth
+const fieldDvChunkSizeWidth = 8
 
-func (s *Segment) loadFieldDocValueReader(field string,
+func (s *Segment) loadFieldDocValueReader(field string, fieldID uint16,
 	fieldDvLocStart, fieldDvLocEnd uint64) (*docValueReader, error) {
 	// get the docValue offset for the given fields
 	if fieldDvLocStart == fieldNotUninverted {
@@ -81,10 +91,16 @@ func (s *Segment) loadFieldDocValueReader(field string,
 		return nil, nil
 	}
 
-	// read the number of chunks, and chunk offsets position
+	// read the number of chunks, and chunk offsets position, preceded by
+	// the chunk size since version 3
+	trailerLen := uint64(fieldDvStartEndWidth)
+	chunkSize := uint64(legacyChunkMode)
+	if s.footer.format().hasChunkSizes() {
+		trailerLen += fieldDvChunkSizeWidth
+	}
 	var numChunks, chunkOffsetsPosition uint64
 
-	if fieldDvLocEnd-fieldDvLocStart > fieldDvStartEndWidth {
+	if fieldDvLocEnd-fieldDvLocStart > trailerLen {
 		numChunksData, err := s.data.Read(int(fieldDvLocEnd-fieldDvEndWidth), int(fieldDvLocEnd))
 		if err != nil {
 			return nil, err
@@ -96,8 +112,18 @@ func (s *Segment) loadFieldDocValueReader(field string,
 			return nil, err
 		}
 		chunkOffsetsLen := binary.BigEndian.Uint64(chunkOffsetsLenData)
+		if trailerLen > fieldDvStartEndWidth {
+			chunkSizeData, err := s.data.Read(int(fieldDvLocEnd-trailerLen), int(fieldDvLocEnd-fieldDvStartEndWidth))
+			if err != nil {
+				return nil, err
+			}
+			chunkSize = binary.BigEndian.Uint64(chunkSizeData)
+			if chunkSize == 0 {
+				return nil, fmt.Errorf("loadFieldDocValueReader: invalid chunk size 0")
+			}
+		}
 		// acquire position of chunk offsets
-		chunkOffsetsPosition = (fieldDvLocEnd - 16) - chunkOffsetsLen
+		chunkOffsetsPosition = (fieldDvLocEnd - trailerLen) - chunkOffsetsLen
 	} else {
 		return nil, fmt.Errorf("loadFieldDocValueReader: fieldDvLoc too small: %d-%d", fieldDvLocEnd, fieldDvLocStart)
 	}
@@ -105,6 +131,8 @@ func (s *Segment) loadFieldDocValueReader(field string,
 	fdvIter := &docValueReader{
 		curChunkNum:  math.MaxInt64,
 		field:        field,
+		fieldID:      fieldID,
+		chunkSize:    chunkSize,
 		chunkOffsets: make([]uint64, int(numChunks)),
 	}
 
@@ -129,10 +157,36 @@ func (s *Segment) loadFieldDocValueReader(field string,
 	return fdvIter, nil
 }
 
+// fieldDocValueReader returns the reader of the doc values of the field,
+// nil if it has none, reading its chunk offsets on first use.  The reader
+// returned is shared, so is cloned before use.
+func (s *Segment) fieldDocValueReader(fieldID uint16) (*docValueReader, error) {
+	err := s.loadDocValueIndexOnce()
+	if err != nil {
+		return nil, err
+	}
+	f := &s.fields[fieldID]
+	f.dvOnce.Do(func() {
+		f.dvReader, f.dvErr = s.loadFieldDocValueReader(s.fieldsInv[fieldID], fieldID, f.dvStart, f.dvEnd)
+		if f.dvReader != nil {
+			s.addSize(sizeOfPtr + f.dvReader.size())
+		}
+	})
+	return f.dvReader, f.dvErr
+}
+
 func (di *docValueReader) loadDvChunk(chunkNumber uint64, s *Segment) error {
 	// advance to the chunk where the docValues
 	// reside for the given docNum
 	destChunkDataLoc, curChunkEnd := di.dvDataLoc, di.dvDataLoc
+	di.curUncompressed = nil
+	di.chunkCache = s.chunkCache
+	di.chunkCacheKey = chunkCacheKey{
+		segment: s.chunkCacheID,
+		section: chunkCacheDocValues,
+		field:   di.fieldID,
+		chunk:   chunkNumber,
+	}
 	start, end := readChunkBoundary(int(chunkNumber), di.chunkOffsets)
 	if start >= end {
 		di.curChunkHeader = di.curChunkHeader[:0]
@@ -208,12 +262,14 @@ func (di *docValueReader) iterateAllDocValues(s *Segment, visitor docNumTermsVis
 			continue
 		}
 
-		// uncompress the already loaded data
+		// uncompress the already loaded data, full iterations bypass the
+		// chunk cache
 		uncompressed, err := ZSTDDecompress(di.uncompressed[:cap(di.uncompressed)], di.curChunkData)
 		if err != nil {
 			return err
 		}
 		di.uncompressed = uncompressed
+		di.curUncompressed = uncompressed
 
 		start := uint64(0)
 		for _, entry := range di.curChunkHeader {
@@ -237,18 +293,9 @@ func (di *docValueReader) visitDocValues(docNum uint64,
 		return nil
 	}
 
-	var uncompressed []byte
-	var err error
-	// use the uncompressed copy if available
-	if len(di.uncompressed) > 0 {
-		uncompressed = di.uncompressed
-	} else {
-		// uncompress the already loaded data
-		uncompressed, err = ZSTDDecompress(di.uncompressed[:cap(di.uncompressed)], di.curChunkData)
-		if err != nil {
-			return err
-		}
-		di.uncompressed = uncompressed
+	uncompressed, err := di.uncompressedChunk()
+	if err != nil {
+		return err
 	}
 
 	// pick the terms for the given docNum
@@ -266,6 +313,30 @@ func (di *docValueReader) visitDocValues(docNum uint64,
 	return nil
 }
 
+// uncompressedChunk returns the current chunk decompressed, once per chunk,
+// from the chunk cache of the segment if any
+func (di *docValueReader) uncompressedChunk() ([]byte, error) {
+	// use the uncompressed copy if available
+	if len(di.curUncompressed) > 0 {
+		return di.curUncompressed, nil
+	}
+	var err error
+	if di.chunkCache != nil {
+		// cached chunks are never reused as buffers
+		di.curUncompressed, err = di.chunkCache.getOrLoad(di.chunkCacheKey, func() ([]byte, error) {
+			return ZSTDDecompress(nil, di.curChunkData)
+		})
+		return di.curUncompressed, err
+	}
+	// uncompress the already loaded data
+	di.uncompressed, err = ZSTDDecompress(di.uncompressed[:cap(di.uncompressed)], di.curChunkData)
+	if err != nil {
+		return nil, err
+	}
+	di.curUncompressed = di.uncompressed
+	return di.curUncompressed, nil
+}
+
 func (di *docValueReader) getDocValueLocs(docNum uint64) (start, end uint64) {
 	i := sort.Search(len(di.curChunkHeader), func(i int) bool {
 		return di.curChunkHeader[i].DocNum >= docNum
@@ -281,8 +352,11 @@ func (di *docValueReader) getDocValueLocs(docNum uint64) (start, end uint64) {
 func (s *Segment) visitDocumentFieldTerms(localDocNum uint64, fields []string,
 	visitor segment.DocumentValueVisitor, dvs *docVisitState) (
 	*docVisitState, error) {
+	if err := s.checkOpen(); err != nil {
+		return dvs, err
+	}
 	if dvs == nil {
-		dvs = &docVisitState{}
+		dvs = &docVisitState{segment: s}
 	} else if dvs.segment != s {
 		dvs.segment = s
 		dvs.dvrs = nil
@@ -297,20 +371,17 @@ func (s *Segment) visitDocumentFieldTerms(localDocNum uint64, fields []string,
 				continue
 			}
 			fieldID := fieldIDPlus1 - 1
-			if dvIter, exists := s.fieldDvReaders[fieldID]; exists &&
-				dvIter != nil {
+			dvIter, err := s.fieldDocValueReader(fieldID)
+			if err != nil {
+				dvs.dvrs = nil
+				return dvs, err
+			}
+			if dvIter != nil {
 				dvs.dvrs[fieldID] = dvIter.cloneInto(dvs.dvrs[fieldID])
 			}
 		}
 	}
 
-	// find the chunkNumber where the docValues are stored
-	// NOTE: doc values continue to use legacy chunk mode
-	chunkFactor, err := getChunkSize(legacyChunkMode, 0, 0)
-	if err != nil {
-		return nil, err
-	}
-	docInChunk := localDocNum / chunkFactor
 	var dvr *docValueReader
 	for _, field := range fields {
 		var ok bool
@@ -320,6 +391,8 @@ func (s *Segment) visitDocumentFieldTerms(localDocNum uint64, fields []string,
 		}
 		fieldID := fieldIDPlus1 - 1
 		if dvr, ok = dvs.dvrs[fieldID]; ok && dvr != nil {
+			// find the chunkNumber where the docValues are stored
+			docInChunk := localDocNum / dvr.chunkSize
 			// check if the chunk is already loaded
 			if docInChunk != dvr.curChunkNumber() {
 				err := dvr.loadDvChunk(docInChunk, s)
@@ -334,6 +407,8 @@ func (s *Segment) visitDocumentFieldTerms(localDocNum uint64, fields []string,
 	return dvs, nil
 }
 
+// DocumentValueReader visits the doc values of fields, it caches the
+// current chunk of each field, so is not safe for concurrent use
 type DocumentValueReader struct {
 	fields  []string
 	state   *docVisitState
@@ -17,20 +17,24 @@ package ice
 import (
 	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 
 	segment "github.com/blugelabs/bluge_segment_api"
 )
 
 // Ice footer
 //
-// |========|========|========|========|====|====|====|
-// |     D# |     SF |      F |    FDV | CM |  V | CC |
-// |========|====|===|====|===|====|===|====|====|====|
+// |========|========|========|========|========|========|========|====|====|====|
+// |     D# |     SF |      F |    FDV |     SO |     ND |     SS | CM |  V | CC |
+// |========|====|===|====|===|====|===|====|===|====|===|========|====|====|====|
 //
 // D#  - number of docs
 // SF  - stored fields index offset
 //  F  - field index offset
 // FDV - field doc values offset
+// SO  - sort offset, 0 if the segment is not sorted (since version 3)
+// ND  - numeric doc values offset, 0 if there are none (since version 3)
+// SS  - sorted-set doc values offset, 0 if there are none (since version 3)
 // CM  - chunk Mode
 //  V  - version
 // CC  - crc32
@@ -39,6 +43,9 @@ type footer struct {
 	storedIndexOffset uint64
 	docValueOffset    uint64
 	fieldsIndexOffset uint64
+	sortOffset        uint64
+	numericOffset     uint64
+	sortedSetOffset   uint64
 	numDocs           uint64
 	crc               uint32
 	version           uint32
@@ -46,21 +53,40 @@ type footer struct {
 }
 
 const (
-	crcWidth          = 4
-	verWidth          = 4
-	chunkWidth        = 4
-	fdvOffsetWidth    = 8
-	fieldsOffsetWidth = 8
-	storedOffsetWidth = 8
-	numDocsWidth      = 8
-	footerLen         = crcWidth + verWidth + chunkWidth + fdvOffsetWidth +
+	crcWidth             = 4
+	verWidth             = 4
+	chunkWidth           = 4
+	fdvOffsetWidth       = 8
+	fieldsOffsetWidth    = 8
+	storedOffsetWidth    = 8
+	numDocsWidth         = 8
+	sortOffsetWidth      = 8
+	numericOffsetWidth   = 8
+	sortedSetOffsetWidth = 8
+	footerLenV2          = crcWidth + verWidth + chunkWidth + fdvOffsetWidth +
 		fieldsOffsetWidth + storedOffsetWidth + numDocsWidth
+	footerLen = footerLenV2 + sortOffsetWidth + numericOffsetWidth + sortedSetOffsetWidth
 )
 
+// oldestVersion is the oldest file version which can still be read, the
+// version before the sort, doc values, stored codecs and the rest of the
+// current version were added
+const oldestVersion uint32 = 2
+
+// format returns the format of the footer's version
+func (f *footer) format() segmentFormat {
+	return formats[f.version]
+}
+
+// length returns the length of the footer, which depends on its version
+func (f *footer) length() int {
+	return f.format().footerLen()
+}
+
 func parseFooter(data *segment.Data) (*footer, error) {
-	if data.Len() < footerLen {
+	if data.Len() < footerLenV2 {
 		return nil, fmt.Errorf("data len %d less than footer len %d", data.Len(),
-			footerLen)
+			footerLenV2)
 	}
 
 	rv := &footer{}
@@ -77,9 +103,13 @@ func parseFooter(data *segment.Data) (*footer, error) {
 		return nil, err
 	}
 	rv.version = binary.BigEndian.Uint32(verData)
-	if rv.version != Version {
+	if _, ok := formats[rv.version]; !ok {
 		return nil, fmt.Errorf("unsupported version %d", rv.version)
 	}
+	if data.Len() < rv.length() {
+		return nil, fmt.Errorf("data len %d less than footer len %d", data.Len(),
+			rv.length())
+	}
 
 	chunkOffset := verOffset - chunkWidth
 	chunkData, err := data.Read(chunkOffset, chunkOffset+chunkWidth)
@@ -88,7 +118,39 @@ func parseFooter(data *segment.Data) (*footer, error) {
 	}
 	rv.chunkMode = binary.BigEndian.Uint32(chunkData)
 
-	docValueOffset := chunkOffset - fdvOffsetWidth
+	// the offsets added by later versions precede the chunk mode
+	offsetsEnd := chunkOffset
+	if rv.format().hasSortedSetOffset() {
+		sortedSetOffset := offsetsEnd - sortedSetOffsetWidth
+		var sortedSetData []byte
+		sortedSetData, err = data.Read(sortedSetOffset, sortedSetOffset+sortedSetOffsetWidth)
+		if err != nil {
+			return nil, err
+		}
+		rv.sortedSetOffset = binary.BigEndian.Uint64(sortedSetData)
+		offsetsEnd = sortedSetOffset
+	}
+	if rv.format().hasNumericOffset() {
+		numericOffset := offsetsEnd - numericOffsetWidth
+		var numericData []byte
+		numericData, err = data.Read(numericOffset, numericOffset+numericOffsetWidth)
+		if err != nil {
+			return nil, err
+		}
+		rv.numericOffset = binary.BigEndian.Uint64(numericData)
+		offsetsEnd = numericOffset
+	}
+	if rv.format().hasSortOffset() {
+		sortOffset := offsetsEnd - sortOffsetWidth
+		var sortData []byte
+		sortData, err = data.Read(sortOffset, sortOffset+sortOffsetWidth)
+		if err != nil {
+			return nil, err
+		}
+		rv.sortOffset = binary.BigEndian.Uint64(sortData)
+		offsetsEnd = sortOffset
+	}
+	docValueOffset := offsetsEnd - fdvOffsetWidth
 	docValueData, err := data.Read(docValueOffset, docValueOffset+fdvOffsetWidth)
 	if err != nil {
 		return nil, err
@@ -117,3 +179,15 @@ func parseFooter(data *segment.Data) (*footer, error) {
 	rv.numDocs = binary.BigEndian.Uint64(numDocsData)
 	return rv, nil
 }
+
+// fileCRC returns the CRC-32 of a file made up of data having the
+// provided CRC-32, followed by this footer (excluding the CRC itself)
+func (f *footer) fileCRC(dataCRC uint32) (uint32, error) {
+	w := newCountHashWriter(ioutil.Discard)
+	w.crc = dataCRC
+	err := persistFooterFields(f, w)
+	if err != nil {
+		return 0, err
+	}
+	return w.Sum32(), nil
+}
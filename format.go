@@ -0,0 +1,343 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+// segmentFormat decodes the parts of a segment whose encoding depends on
+// the version of the file.  Load picks the format matching the version in
+// the footer, so that segments written by older versions can still be
+// read, and merged into the current version.
+type segmentFormat interface {
+	// footerLen returns the length of the footer
+	footerLen() int
+
+	// hasSortOffset reports whether the footer holds the sort offset
+	hasSortOffset() bool
+
+	// hasNumericOffset reports whether the footer holds the numeric doc
+	// values offset
+	hasNumericOffset() bool
+
+	// hasSortedSetOffset reports whether the footer holds the sorted-set
+	// doc values offset
+	hasSortedSetOffset() bool
+
+	// hasImpacts reports whether the postings lists record the impacts
+	// of each chunk of freq/norms
+	hasImpacts() bool
+
+	// readPostingsHeader reads the offsets which precede the roaring
+	// bitmap of the postings list at postingsOffset
+	readPostingsHeader(data *segment.Data, postingsOffset uint64) (postingsHeader, error)
+
+	// loadStoredIndex loads the offsets of the stored field chunks
+	loadStoredIndex(s *Segment) error
+
+	// loadDocValueIndex loads where the doc values of each field are, the
+	// doc values themselves being read on first use of each field
+	loadDocValueIndex(s *Segment) error
+
+	// hasTopTerms reports whether the terms of each field with the
+	// highest doc frequency follow its dictionary
+	hasTopTerms() bool
+
+	// hasReverseTerms reports whether the FST of the reversed terms of
+	// each field, if any, follows its top terms
+	hasReverseTerms() bool
+
+	// hasPayloads reports whether the field of each location flags a
+	// payload following the location
+	hasPayloads() bool
+
+	// hasChunkSkips reports whether each chunk of the freq/norms of a
+	// postings list starts with its skip points
+	hasChunkSkips() bool
+
+	// hasChunkSizes reports whether the chunk size of each postings list
+	// follows its offsets, and the chunk size of the doc values of each
+	// field precedes the length of their chunk offsets
+	hasChunkSizes() bool
+
+	// storedLayout identifies the layout of the stored field chunks, merge
+	// only copies the stored docs of a segment byte for byte when it has
+	// the same layout as the current format
+	storedLayout() uint32
+}
+
+// postingsHeader holds the offsets which precede the roaring bitmap of a
+// postings list, n is the length of the header
+type postingsHeader struct {
+	freqOffset    uint64
+	locOffset     uint64
+	impactsOffset uint64
+	chunkSize     uint64 // 0 when not recorded, see hasChunkSizes
+	n             uint64
+}
+
+const (
+	// storedLayoutV2 is the layout of the chunks of stored docs once
+	// decompressed, each a uvarint meta length, uvarint data length, meta
+	// and data
+	storedLayoutV2 uint32 = 2
+	// storedLayoutV3 shifts the field id in the meta left by one, flagging
+	// the values in the large value region, whose meta holds their offset
+	// in the region and their compressed length
+	storedLayoutV3 uint32 = 3
+)
+
+// formats holds the format of each version which can be read
+var formats = map[uint32]segmentFormat{
+	oldestVersion: formatV2{},
+	Version:       formatV3{},
+}
+
+// currentFormat is the format of the segments written by this version
+var currentFormat = formats[Version]
+
+// formatV2 is the format of the segments written before the sort, doc
+// values, stored codecs and the rest of version 3 were added
+type formatV2 struct{}
+
+func (formatV2) footerLen() int {
+	return footerLenV2
+}
+
+func (formatV2) hasSortOffset() bool {
+	return false
+}
+
+func (formatV2) hasNumericOffset() bool {
+	return false
+}
+
+func (formatV2) hasSortedSetOffset() bool {
+	return false
+}
+
+func (formatV2) hasImpacts() bool {
+	return false
+}
+
+func (formatV2) readPostingsHeader(data *segment.Data, postingsOffset uint64) (rv postingsHeader, err error) {
+	rv.freqOffset, rv.n, err = readUvarintAt(data, postingsOffset)
+	if err != nil {
+		return rv, err
+	}
+	var read uint64
+	rv.locOffset, read, err = readUvarintAt(data, postingsOffset+rv.n)
+	if err != nil {
+		return rv, err
+	}
+	rv.n += read
+	if rv.locOffset > 0 && rv.freqOffset > 0 {
+		rv.locOffset += rv.freqOffset
+	}
+	rv.impactsOffset = termNotEncoded
+	return rv, nil
+}
+
+func (formatV2) loadStoredIndex(s *Segment) error {
+	s.storedCodec = defaultStoredCodec
+	err := s.loadStoredFieldChunk(s.footer.storedIndexOffset)
+	if err != nil {
+		return err
+	}
+	s.loadFixedStoredChunkIndex()
+	return nil
+}
+
+func (formatV2) loadDocValueIndex(s *Segment) error {
+	return s.loadDvIndex()
+}
+
+func (formatV2) hasTopTerms() bool {
+	return false
+}
+
+func (formatV2) hasReverseTerms() bool {
+	return false
+}
+
+func (formatV2) hasPayloads() bool {
+	return false
+}
+
+func (formatV2) hasChunkSkips() bool {
+	return false
+}
+
+func (formatV2) hasChunkSizes() bool {
+	return false
+}
+
+func (formatV2) storedLayout() uint32 {
+	return storedLayoutV2
+}
+
+// formatV3 adds the sort, numeric and sorted-set doc values offsets to the
+// footer, the impacts, skip points and chunk size of the postings, the top
+// and reversed terms of each field, payloads, and the codec, chunk policy
+// and large value region of the stored fields
+type formatV3 struct{}
+
+func (formatV3) footerLen() int {
+	return footerLen
+}
+
+func (formatV3) hasSortOffset() bool {
+	return true
+}
+
+func (formatV3) hasNumericOffset() bool {
+	return true
+}
+
+func (formatV3) hasSortedSetOffset() bool {
+	return true
+}
+
+func (formatV3) hasImpacts() bool {
+	return true
+}
+
+func (formatV3) readPostingsHeader(data *segment.Data, postingsOffset uint64) (rv postingsHeader, err error) {
+	rv, err = formatV2{}.readPostingsHeader(data, postingsOffset)
+	if err != nil {
+		return rv, err
+	}
+	var read uint64
+	rv.impactsOffset, read, err = readUvarintAt(data, postingsOffset+rv.n)
+	if err != nil {
+		return rv, err
+	}
+	rv.n += read
+	if rv.impactsOffset > 0 && rv.freqOffset > 0 {
+		rv.impactsOffset += rv.freqOffset
+	}
+	rv.chunkSize, read, err = readUvarintAt(data, postingsOffset+rv.n)
+	if err != nil {
+		return rv, err
+	}
+	if rv.chunkSize == 0 {
+		return rv, fmt.Errorf("invalid postings chunk size 0")
+	}
+	rv.n += read
+	return rv, nil
+}
+
+// loadStoredIndex loads the codec, then the chunk policy, the first doc of
+// each chunk and the large value region, which precede it, then the chunk
+// offsets
+func (formatV3) loadStoredIndex(s *Segment) error {
+	end, err := s.loadStoredCodec()
+	if err != nil {
+		return err
+	}
+	end, err = s.loadStoredChunkIndex(end)
+	if err != nil {
+		return err
+	}
+	err = s.loadStoredFieldChunk(end)
+	if err != nil {
+		return err
+	}
+	if len(s.storedFieldChunkDocStarts) != len(s.storedFieldChunkOffsets) {
+		return fmt.Errorf("found %d stored chunk doc starts for %d chunk offsets",
+			len(s.storedFieldChunkDocStarts), len(s.storedFieldChunkOffsets))
+	}
+	// the large value region follows the last chunk
+	s.storedLargeStart = s.storedFieldChunkOffsets[len(s.storedFieldChunkOffsets)-1]
+	return nil
+}
+
+func (formatV3) loadDocValueIndex(s *Segment) error {
+	err := s.loadDvIndex()
+	if err != nil {
+		return err
+	}
+	err = s.loadNumericIndex()
+	if err != nil {
+		return err
+	}
+	return s.loadSortedSetIndex()
+}
+
+func (formatV3) hasTopTerms() bool {
+	return true
+}
+
+func (formatV3) hasReverseTerms() bool {
+	return true
+}
+
+func (formatV3) hasPayloads() bool {
+	return true
+}
+
+func (formatV3) hasChunkSkips() bool {
+	return true
+}
+
+func (formatV3) hasChunkSizes() bool {
+	return true
+}
+
+func (formatV3) storedLayout() uint32 {
+	return storedLayoutV3
+}
+
+// readUvarintAt reads the uvarint at offset, returning it and its length
+func readUvarintAt(data *segment.Data, offset uint64) (val, n uint64, err error) {
+	end := offset + binary.MaxVarintLen64
+	if end > uint64(data.Len()) {
+		end = uint64(data.Len())
+	}
+	buf, err := data.Read(int(offset), int(end))
+	if err != nil {
+		return 0, 0, err
+	}
+	val, read := binary.Uvarint(buf)
+	if read <= 0 {
+		return 0, 0, fmt.Errorf("invalid uvarint at %d", offset)
+	}
+	return val, uint64(read), nil
+}
+
+// uvarintAtReader reads consecutive uvarints from the data, keeping the
+// first error
+type uvarintAtReader struct {
+	data   *segment.Data
+	offset uint64
+	err    error
+}
+
+func (r *uvarintAtReader) next() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	val, n, err := readUvarintAt(r.data, r.offset)
+	if err != nil {
+		r.err = err
+		return 0
+	}
+	r.offset += n
+	return val
+}
@@ -0,0 +1,118 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+func loadTestFile(t *testing.T, path string) *Segment {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg, err := load(segment.NewDataBytes(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seg
+}
+
+// TestFormatGolden checks New writes the segment of testdata/v3.ice, so
+// that a change of the format is caught, and comes with a new version
+func TestFormatGolden(t *testing.T) {
+	golden, err := ioutil.ReadFile("testdata/v3.ice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg, _, err := NewWithOptions(buildTestAnalysisResultsSort("a", "b", "c", "d", "e", "f"), encodeNorm,
+		WithSort(SortField{Field: "price"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = seg.(*Segment).WriteTo(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), golden) {
+		t.Errorf("expected segment of version %d to match testdata/v3.ice", Version)
+	}
+}
+
+func TestMergeMixedVersions(t *testing.T) {
+	v2 := loadTestFile(t, "testdata/v2.ice")
+	v3 := loadTestFile(t, "testdata/v3.ice")
+	current, _, err := New(buildTestAnalysisResultsSort("g", "h"), encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := []segment.Segment{v2, v3, current}
+
+	for _, workers := range []int{1, 2} {
+		t.Run(fmt.Sprintf("workers %d", workers), func(t *testing.T) {
+			var merged bytes.Buffer
+			drops := []*roaring.Bitmap{roaring.BitmapOf(1), roaring.BitmapOf(0), nil}
+			_, err = MergeWithOptions(segments, drops, 1024, WithMergeWorkers(workers)).WriteTo(&merged, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seg, err := load(segment.NewDataBytes(merged.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seg.Version() != Version {
+				t.Errorf("expected version %d, got %d", Version, seg.Version())
+			}
+			expectedIDs := []string{"a", "c", "d", "e", "f", "b", "e", "d", "a", "c", "g", "h"}
+			if actual := storedIDs(t, seg); !reflect.DeepEqual(actual, expectedIDs) {
+				t.Errorf("expected %v, got %v", expectedIDs, actual)
+			}
+			postings := collectPostings(t, seg, "body", "the", nil, func(itr *PostingsIterator) (segment.Posting, error) {
+				return itr.Next()
+			})
+			if len(postings) != len(expectedIDs) {
+				t.Errorf("expected %d postings, got %d", len(expectedIDs), len(postings))
+			}
+			err = seg.Verify(context.Background())
+			if err != nil {
+				t.Errorf("expected merged segment to verify, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadUnsupportedVersion(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/v2.ice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range []uint32{oldestVersion - 1, Version + 1} {
+		binary.BigEndian.PutUint32(data[len(data)-crcWidth-verWidth:], version)
+		_, err = load(segment.NewDataBytes(data))
+		if err == nil {
+			t.Errorf("expected version %d to be unsupported", version)
+		}
+	}
+}
@@ -19,6 +19,7 @@ type tokenLocation struct {
 	StartVal    int
 	EndVal      int
 	PositionVal int
+	PayloadVal  []byte
 }
 
 type tokenFreq struct {
@@ -168,7 +168,7 @@ func mergeSegments(segments []segment.Segment, drops []*roaring.Bitmap, path str
 
 	// buffer the output
 	br := bufio.NewWriterSize(f, DefaultFileMergerBufferSize)
-	_, count, err := merge(segments, drops, br, nil)
+	_, count, err := merge(segments, drops, br, nil, defaultOptions())
 	if err != nil {
 		cleanup()
 		return 0, err
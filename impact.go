@@ -0,0 +1,230 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+// Since version 3, the freq/norm section of each postings list is followed
+// by the impacts of its chunks, as a uvarint number of chunks followed by
+// the uvarint max freq and min norm bits of the postings in each chunk,
+// both 0 if the chunk has none.  As they bound the score of the postings
+// in a chunk, a scorer can skip chunks which cannot make the top hits
+// without decoding them.
+
+// chunkImpact is the largest freq and smallest norm bits of the postings
+// in a chunk
+type chunkImpact struct {
+	maxFreq  uint64
+	minNorm  uint64
+	hasPosts bool
+}
+
+type chunkImpacts []chunkImpact
+
+func (c *chunkImpacts) reset(numChunks int) {
+	if cap(*c) < numChunks {
+		*c = make(chunkImpacts, numChunks)
+		return
+	}
+	*c = (*c)[:numChunks]
+	for i := range *c {
+		(*c)[i] = chunkImpact{}
+	}
+}
+
+func (c chunkImpacts) add(chunk, freq, normBits uint64) {
+	impact := &c[chunk]
+	if !impact.hasPosts || freq > impact.maxFreq {
+		impact.maxFreq = freq
+	}
+	if !impact.hasPosts || normBits < impact.minNorm {
+		impact.minNorm = normBits
+	}
+	impact.hasPosts = true
+}
+
+// write writes out the impacts using buf, growing it if needed
+func (c chunkImpacts) write(w io.Writer, buf []byte) (int, error) {
+	bufNeeded := binary.MaxVarintLen64 * (1 + 2*len(c))
+	if len(buf) < bufNeeded {
+		buf = make([]byte, bufNeeded)
+	}
+	n := binary.PutUvarint(buf, uint64(len(c)))
+	for _, impact := range c {
+		n += binary.PutUvarint(buf[n:], impact.maxFreq)
+		n += binary.PutUvarint(buf[n:], impact.minNorm)
+	}
+	return w.Write(buf[:n])
+}
+
+// read decodes the impacts written by write
+func (c *chunkImpacts) read(data []byte) error {
+	r := newMemUvarintReader(data)
+	numChunks, err := r.ReadUvarint()
+	if err != nil {
+		return fmt.Errorf("error reading number of impacts: %v", err)
+	}
+	if numChunks > uint64(len(data)) {
+		return fmt.Errorf("%d impacts past end of section", numChunks)
+	}
+	c.reset(int(numChunks))
+	for i := range *c {
+		impact := &(*c)[i]
+		impact.maxFreq, err = r.ReadUvarint()
+		if err != nil {
+			return fmt.Errorf("error reading impact max freq: %v", err)
+		}
+		impact.minNorm, err = r.ReadUvarint()
+		if err != nil {
+			return fmt.Errorf("error reading impact min norm: %v", err)
+		}
+		impact.hasPosts = impact.maxFreq != 0 || impact.minNorm != 0
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%d trailing bytes after impacts", r.Len())
+	}
+	return nil
+}
+
+// BlockImpact bounds the score of the postings in a block of a postings
+// list, the block being a chunk of its freq/norms
+type BlockImpact struct {
+	// MaxFreq is the largest frequency of the postings in the block
+	MaxFreq int
+
+	// MinNorm is the smallest norm of the postings in the block
+	MinNorm float64
+
+	// LastDocNum is the last doc number the block can hold
+	LastDocNum uint64
+}
+
+// loadImpacts reads the impacts of the postings list, if it has them
+func (i *PostingsIterator) loadImpacts() error {
+	if i.impactsLoaded {
+		return nil
+	}
+	i.impactsLoaded = true
+	i.impacts = i.impacts[:0]
+	p := i.postings
+	if p == nil || p.impactsOffset == termNotEncoded {
+		return nil
+	}
+	data, err := p.sb.data.Read(int(p.impactsOffset), int(p.postingsOffset))
+	if err != nil {
+		return err
+	}
+	return i.impacts.read(data)
+}
+
+// blockImpact returns the impact of the chunk holding docNum, or false if
+// there is none recorded for it
+func (i *PostingsIterator) blockImpact(docNum uint64) (BlockImpact, bool) {
+	chunk := docNum / i.postings.chunkSize
+	if chunk >= uint64(len(i.impacts)) {
+		return BlockImpact{}, false
+	}
+	return BlockImpact{
+		MaxFreq:    int(i.impacts[chunk].maxFreq),
+		MinNorm:    float64(math.Float32frombits(uint32(i.impacts[chunk].minNorm))),
+		LastDocNum: (chunk+1)*i.postings.chunkSize - 1,
+	}, true
+}
+
+// peekDocNumAtOrAfter returns the next doc number at or after atOrAfter
+// without moving the iterator
+func (i *PostingsIterator) peekDocNumAtOrAfter(atOrAfter uint64) (uint64, bool) {
+	if i.Actual == nil || !i.Actual.HasNext() {
+		return 0, false
+	}
+	if next := uint64(i.Actual.PeekNext()); next >= atOrAfter {
+		return next, true
+	}
+	if atOrAfter > math.MaxUint32 {
+		return 0, false
+	}
+	rank := i.ActualBM.Rank(uint32(atOrAfter - 1))
+	if rank >= i.ActualBM.GetCardinality() {
+		return 0, false
+	}
+	next, err := i.ActualBM.Select(uint32(rank))
+	if err != nil {
+		return 0, false
+	}
+	return uint64(next), true
+}
+
+// BlockMaxImpact returns the impact of the block holding the next posting
+// at or after docNum, without moving the iterator.  It returns false when
+// there are no more postings, or the segment was written before impacts
+// were recorded, in which case the postings must be scored one by one.
+func (i *PostingsIterator) BlockMaxImpact(docNum uint64) (BlockImpact, bool, error) {
+	if i.normBits1Hit != 0 {
+		if i.docNum1Hit == docNum1HitFinished || i.docNum1Hit < docNum {
+			return BlockImpact{}, false, nil
+		}
+		return BlockImpact{
+			MaxFreq:    1,
+			MinNorm:    float64(math.Float32frombits(uint32(i.normBits1Hit))),
+			LastDocNum: i.docNum1Hit,
+		}, true, nil
+	}
+
+	err := i.loadImpacts()
+	if err != nil {
+		return BlockImpact{}, false, err
+	}
+	next, exists := i.peekDocNumAtOrAfter(docNum)
+	if !exists {
+		return BlockImpact{}, false, nil
+	}
+	impact, ok := i.blockImpact(next)
+	return impact, ok, nil
+}
+
+// AdvanceCompetitive is Advance, except that it skips over whole blocks of
+// postings whose impact competitive reports cannot score high enough,
+// without decoding them.  Blocks without an impact are never skipped.
+func (i *PostingsIterator) AdvanceCompetitive(docNum uint64,
+	competitive func(impact BlockImpact) bool) (segment.Posting, error) {
+	for {
+		impact, ok, err := i.BlockMaxImpact(docNum)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || competitive(impact) {
+			break
+		}
+		if i.normBits1Hit != 0 {
+			i.docNum1Hit = docNum1HitFinished
+			return nil, nil
+		}
+		// the postings are read chunk by chunk, so moving on to a later
+		// chunk than the one being read skips its remaining postings
+		docNum = impact.LastDocNum + 1
+		if docNum > math.MaxUint32 {
+			return nil, nil
+		}
+		i.Actual.AdvanceIfNeeded(uint32(docNum))
+	}
+	return i.nextAtOrAfter(docNum)
+}
@@ -0,0 +1,247 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+// buildTestAnalysisResultsImpacts builds documents where the term x occurs
+// in most of them, as many times in each run of 40 documents, in bodies of
+// varying length
+func buildTestAnalysisResultsImpacts(numDocs int) []segment.Document {
+	var results []segment.Document
+	for i := 0; i < numDocs; i++ {
+		body := strings.Repeat("x ", i/40%5) + strings.Repeat("y ", i%11) + "z"
+		if i%3 == 0 {
+			body = "z"
+		}
+		results = append(results, &FakeDocument{
+			NewFakeField("_id", fmt.Sprintf("%04d", i), true, false, false),
+			NewFakeField("body", body, true, true, false),
+		})
+	}
+	return results
+}
+
+type testPosting struct {
+	docNum uint64
+	freq   int
+	norm   float64
+}
+
+func collectPostings(t *testing.T, seg *Segment, field, term string, except *roaring.Bitmap,
+	next func(itr *PostingsIterator) (segment.Posting, error)) []testPosting {
+	dict, err := seg.dictionary(field)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl, err := dict.postingsList([]byte(term), except, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	itr, err := pl.iterator(true, true, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rv []testPosting
+	posting, err := next(itr)
+	for err == nil && posting != nil {
+		rv = append(rv, testPosting{posting.Number(), posting.Frequency(), posting.Norm()})
+		posting, err = next(itr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rv
+}
+
+func TestBlockMaxImpact(t *testing.T) {
+	const chunkSize = 16
+	segInt, _, err := newWithChunkMode(buildTestAnalysisResultsImpacts(500), encodeNorm, chunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := segInt.(*Segment)
+
+	for _, except := range []*roaring.Bitmap{nil, roaring.BitmapOf(1, 2, 40, 41, 44, 301)} {
+		all := collectPostings(t, seg, "body", "x", except, func(itr *PostingsIterator) (segment.Posting, error) {
+			return itr.Next()
+		})
+
+		// the impacts bound the postings of each chunk
+		dict, err := seg.dictionary("body")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pl, err := dict.postingsList([]byte("x"), except, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		itr, err := pl.iterator(false, false, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, posting := range all {
+			impact, ok, err := itr.BlockMaxImpact(posting.docNum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Fatalf("expected impact for doc %d", posting.docNum)
+			}
+			if impact.LastDocNum != (posting.docNum/chunkSize+1)*chunkSize-1 {
+				t.Errorf("expected doc %d in block ending at %d", posting.docNum, impact.LastDocNum)
+			}
+			if posting.freq > impact.MaxFreq || posting.norm < impact.MinNorm {
+				t.Errorf("doc %d freq %d norm %v outside of block impact %+v",
+					posting.docNum, posting.freq, posting.norm, impact)
+			}
+		}
+
+		// skipping the blocks which cannot have a freq of 4 gives every
+		// posting with a freq of 4, and some others from the same blocks
+		var docNum uint64
+		actual := collectPostings(t, seg, "body", "x", except, func(itr *PostingsIterator) (segment.Posting, error) {
+			posting, err := itr.AdvanceCompetitive(docNum, func(impact BlockImpact) bool {
+				return impact.MaxFreq >= 4
+			})
+			if posting != nil {
+				docNum = posting.Number() + 1
+			}
+			return posting, err
+		})
+		var expected []testPosting
+		for _, posting := range all {
+			if posting.freq == 4 {
+				expected = append(expected, posting)
+			}
+		}
+		var found []testPosting
+		for _, posting := range actual {
+			if posting.freq == 4 {
+				found = append(found, posting)
+			}
+		}
+		if fmt.Sprint(expected) != fmt.Sprint(found) {
+			t.Errorf("expected postings with freq 4 %v, got %v", expected, found)
+		}
+		if len(actual) == len(all) {
+			t.Errorf("expected some blocks to be skipped")
+		}
+		for _, posting := range actual {
+			var matched bool
+			for _, p := range all {
+				matched = matched || p == posting
+			}
+			if !matched {
+				t.Errorf("unexpected posting %v", posting)
+			}
+		}
+	}
+}
+
+func TestBlockMaxImpact1Hit(t *testing.T) {
+	// only merging uses the 1-hit encoding
+	segInt, _, err := newWithChunkMode(buildTestAnalysisResultsImpacts(10), encodeNorm, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var merged bytes.Buffer
+	_, err = Merge([]segment.Segment{segInt}, []*roaring.Bitmap{nil}, 1024).WriteTo(&merged, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg, err := load(segment.NewDataBytes(merged.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict, err := seg.dictionary("_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl, err := dict.postingsList([]byte("0007"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	itr, err := pl.iterator(true, true, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	impact, ok, err := itr.BlockMaxImpact(0)
+	if err != nil || !ok {
+		t.Fatalf("expected 1-hit impact, got %v %v", ok, err)
+	}
+	if impact.MaxFreq != 1 || impact.LastDocNum != 7 {
+		t.Errorf("expected 1-hit impact of doc 7, got %+v", impact)
+	}
+	posting, err := itr.AdvanceCompetitive(0, func(BlockImpact) bool { return false })
+	if err != nil || posting != nil {
+		t.Errorf("expected 1-hit to be skipped, got %v %v", posting, err)
+	}
+}
+
+func TestBlockMaxImpactOlderVersion(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/v2.ice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg, err := load(segment.NewDataBytes(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := collectPostings(t, seg, "body", "the", nil, func(itr *PostingsIterator) (segment.Posting, error) {
+		return itr.Next()
+	})
+	actual := collectPostings(t, seg, "body", "the", nil, func(itr *PostingsIterator) (segment.Posting, error) {
+		if _, ok, err := itr.BlockMaxImpact(0); ok || err != nil {
+			t.Fatalf("expected no impacts, got %v %v", ok, err)
+		}
+		return itr.AdvanceCompetitive(0, func(BlockImpact) bool { return false })
+	})
+	if fmt.Sprint(expected) != fmt.Sprint(actual) {
+		t.Errorf("expected no blocks to be skipped, %v, got %v", expected, actual)
+	}
+}
+
+func TestMergeImpacts(t *testing.T) {
+	seg, _, err := newWithChunkMode(buildTestAnalysisResultsImpacts(500), encodeNorm, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var merged bytes.Buffer
+	_, err = MergeWithOptions([]segment.Segment{seg, seg}, []*roaring.Bitmap{roaring.BitmapOf(3, 4), nil}, 1024,
+		WithMergeWorkers(2)).WriteTo(&merged, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mergedSeg, err := load(segment.NewDataBytes(merged.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Verify checks the impacts against the freq/norms
+	err = mergedSeg.Verify(context.Background())
+	if err != nil {
+		t.Errorf("expected merged segment to verify, got: %v", err)
+	}
+}
@@ -35,6 +35,23 @@ type chunkedIntCoder struct {
 
 	buf        []byte
 	compressed []byte
+
+	// impacts of each chunk, only tracked for freq/norms
+	impacts      chunkImpacts
+	trackImpacts bool
+
+	// skip points of the current chunk, only tracked for freq/norms,
+	// pointing into the chunk of locs as well
+	skips     []chunkSkip
+	chunkDocs int
+	locs      *chunkedIntCoder
+	chunkData []byte
+
+	// the values of the current chunk, when they are packed, see
+	// chunkModePacked
+	packed     bool
+	vals       []uint64
+	packedData []byte
 }
 
 // newChunkedIntCoder returns a new chunk int coder which packs data into
@@ -51,15 +68,32 @@ func newChunkedIntCoder(chunkSize, maxDocNum uint64) *chunkedIntCoder {
 	return rv
 }
 
+// newChunkedFreqNormCoder returns a new chunk int coder for the freq/norm
+// pairs of postings, which also tracks the impact of each chunk, and the
+// skip points of each chunk into it and into the locations of locs
+func newChunkedFreqNormCoder(chunkSize, maxDocNum uint64, locs *chunkedIntCoder) *chunkedIntCoder {
+	rv := newChunkedIntCoder(chunkSize, maxDocNum)
+	rv.trackImpacts = true
+	rv.locs = locs
+	rv.impacts.reset(len(rv.chunkLens))
+	return rv
+}
+
 // Reset lets you reuse this chunked int coder.  buffers are reset and reused
 // from previous use.  you cannot change the chunk size or max doc num.
 func (c *chunkedIntCoder) Reset() {
 	c.final = c.final[:0]
 	c.chunkBuf.Reset()
 	c.currChunk = 0
+	c.skips = c.skips[:0]
+	c.chunkDocs = 0
+	c.vals = c.vals[:0]
 	for i := range c.chunkLens {
 		c.chunkLens[i] = 0
 	}
+	if c.trackImpacts {
+		c.impacts.reset(len(c.chunkLens))
+	}
 }
 
 // SetChunkSize changes the chunk size.  It is only valid to do so
@@ -72,23 +106,47 @@ func (c *chunkedIntCoder) SetChunkSize(chunkSize, maxDocNum uint64) {
 	} else {
 		c.chunkLens = c.chunkLens[:total]
 	}
+	if c.trackImpacts {
+		c.impacts.reset(total)
+	}
+}
+
+// SetPacked sets whether the values of the chunks are packed, see
+// chunkModePacked.  It is only valid to do so with a new chunkedIntCoder,
+// or immediately after calling Reset()
+func (c *chunkedIntCoder) SetPacked(packed bool) {
+	c.packed = packed
 }
 
 // Add encodes the provided integers into the correct chunk for the provided
 // doc num.  You MUST call Add() with increasing docNums.
 func (c *chunkedIntCoder) Add(docNum uint64, vals ...uint64) error {
-	chunk := docNum / c.chunkSize
-	if chunk != c.currChunk {
-		// starting a new chunk
-		c.Close()
-		c.chunkBuf.Reset()
-		c.currChunk = chunk
-	}
+	chunk := c.chunkFor(docNum)
 
 	if len(c.buf) < binary.MaxVarintLen64 {
 		c.buf = make([]byte, binary.MaxVarintLen64)
 	}
 
+	if c.trackImpacts && len(vals) == 2 {
+		freq, _ := decodeFreqHasLocs(vals[0])
+		c.impacts.add(chunk, uint64(freq), vals[1])
+
+		// every skipInterval postings, remember where this one starts
+		if c.chunkDocs > 0 && c.chunkDocs%skipInterval == 0 {
+			c.skips = append(c.skips, chunkSkip{
+				docNum:    docNum,
+				offset:    c.chunkOffset(chunk),
+				locOffset: c.locs.chunkOffset(chunk),
+			})
+		}
+		c.chunkDocs++
+	}
+
+	if c.packed {
+		c.vals = append(c.vals, vals...)
+		return nil
+	}
+
 	for _, val := range vals {
 		wb := binary.PutUvarint(c.buf, val)
 		_, err := c.chunkBuf.Write(c.buf[:wb])
@@ -100,11 +158,64 @@ func (c *chunkedIntCoder) Add(docNum uint64, vals ...uint64) error {
 	return nil
 }
 
+// AddBytes adds the bytes, as is, into the correct chunk for the provided
+// doc num.  You MUST call AddBytes() with increasing docNums, in order
+// with the calls to Add().
+func (c *chunkedIntCoder) AddBytes(docNum uint64, b []byte) error {
+	c.chunkFor(docNum)
+	if c.packed {
+		for _, v := range b {
+			c.vals = append(c.vals, uint64(v))
+		}
+		return nil
+	}
+	_, err := c.chunkBuf.Write(b)
+	return err
+}
+
+// chunkFor returns the chunk of the doc num, starting it if needed
+func (c *chunkedIntCoder) chunkFor(docNum uint64) uint64 {
+	chunk := docNum / c.chunkSize
+	if chunk != c.currChunk {
+		// starting a new chunk
+		c.Close()
+		c.chunkBuf.Reset()
+		c.currChunk = chunk
+		c.skips = c.skips[:0]
+		c.chunkDocs = 0
+		c.vals = c.vals[:0]
+	}
+	return chunk
+}
+
+// chunkOffset returns the number of bytes, or values when packed, added so
+// far to the chunk, 0 if it is not the current one
+func (c *chunkedIntCoder) chunkOffset(chunk uint64) uint64 {
+	if c == nil || c.currChunk != chunk {
+		return 0
+	}
+	if c.packed {
+		return uint64(len(c.vals))
+	}
+	return uint64(c.chunkBuf.Len())
+}
+
 // Close indicates you are done calling Add() this allows the final chunk
 // to be encoded.
 func (c *chunkedIntCoder) Close() error {
+	chunkData := c.chunkBuf.Bytes()
+	if c.packed {
+		c.packedData = appendPackedValues(c.packedData[:0], c.vals)
+		chunkData = c.packedData
+	}
+	if c.trackImpacts && len(chunkData) > 0 {
+		// the skip points of a chunk of freq/norms precede its data
+		c.chunkData = appendChunkSkips(c.chunkData[:0], c.skips)
+		c.chunkData = append(c.chunkData, chunkData...)
+		chunkData = c.chunkData
+	}
 	var err error
-	c.compressed, err = ZSTDCompress(c.compressed[:cap(c.compressed)], c.chunkBuf.Bytes(), ZSTDCompressionLevel)
+	c.compressed, err = ZSTDCompress(c.compressed[:cap(c.compressed)], chunkData, ZSTDCompressionLevel)
 	if err != nil {
 		return err
 	}
@@ -161,6 +272,22 @@ func (c *chunkedIntCoder) writeAt(w io.Writer) (startOffset uint64, err error) {
 	return startOffset, err
 }
 
+// writeImpactsAt writes the impacts of the chunks to the provided writer
+// and returns the starting offset, or termNotEncoded if there are none
+func (c *chunkedIntCoder) writeImpactsAt(w io.Writer) (startOffset uint64, err error) {
+	startOffset = uint64(termNotEncoded)
+	if !c.trackImpacts || len(c.final) == 0 {
+		return startOffset, nil
+	}
+
+	if chw := w.(*countHashWriter); chw != nil {
+		startOffset = uint64(chw.Count())
+	}
+
+	_, err = c.impacts.write(w, c.buf)
+	return startOffset, err
+}
+
 func (c *chunkedIntCoder) FinalSize() int {
 	return len(c.final)
 }
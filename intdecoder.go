@@ -29,6 +29,12 @@ type chunkedIntDecoder struct {
 	uncompressed    []byte // temp buf for decompression
 	data            *segment.Data
 	r               *memUvarintReader
+
+	hasSkips bool        // the chunks start with skip points, see chunkSkip
+	skips    []chunkSkip // of the current chunk
+
+	packed bool // the values of the chunks are packed, see chunkModePacked
+	p      packedReader
 }
 
 func newChunkedIntDecoder(data *segment.Data, offset uint64, rv *chunkedIntDecoder) (*chunkedIntDecoder, error) {
@@ -71,7 +77,7 @@ func newChunkedIntDecoder(data *segment.Data, offset uint64, rv *chunkedIntDecod
 func (d *chunkedIntDecoder) loadChunk(chunk int) error {
 	if d.startOffset == termNotEncoded {
 		d.r = newMemUvarintReader([]byte(nil))
-		return nil
+		return d.p.Reset(nil)
 	}
 
 	if chunk >= len(d.chunkOffsets) {
@@ -92,6 +98,16 @@ func (d *chunkedIntDecoder) loadChunk(chunk int) error {
 		return err
 	}
 	d.curChunkBytes = d.uncompressed
+	d.skips = d.skips[:0]
+	if d.hasSkips && len(d.curChunkBytes) > 0 {
+		d.skips, d.curChunkBytes, err = readChunkSkips(d.curChunkBytes, d.skips)
+		if err != nil {
+			return fmt.Errorf("error reading chunk %d: %v", chunk, err)
+		}
+	}
+	if d.packed {
+		return d.p.Reset(d.curChunkBytes)
+	}
 	if d.r == nil {
 		d.r = newMemUvarintReader(d.curChunkBytes)
 	} else {
@@ -107,6 +123,10 @@ func (d *chunkedIntDecoder) reset() {
 	d.chunkOffsets = d.chunkOffsets[:0]
 	d.curChunkBytes = d.curChunkBytes[:0]
 	d.uncompressed = d.uncompressed[:0]
+	d.hasSkips = false
+	d.skips = d.skips[:0]
+	d.packed = false
+	_ = d.p.Reset(nil)
 
 	// FIXME what?
 	// d.data = d.data[:0]
@@ -121,17 +141,72 @@ func (d *chunkedIntDecoder) isNil() bool {
 }
 
 func (d *chunkedIntDecoder) readUvarint() (uint64, error) {
+	if d.packed {
+		if rv, ok := d.p.nextInBlock(); ok {
+			return rv, nil
+		}
+		return d.p.readNextBlock()
+	}
 	return d.r.ReadUvarint()
 }
 
-func (d *chunkedIntDecoder) SkipUvarint() {
+// readBytes returns the next n bytes of the chunk, valid until the next
+// chunk is loaded
+// readUvarints reads the next len(vals) values of the current chunk into vals
+func (d *chunkedIntDecoder) readUvarints(vals []uint64) error {
+	if d.packed {
+		return d.p.ReadUvarints(vals)
+	}
+	for j := range vals {
+		v, err := d.r.ReadUvarint()
+		if err != nil {
+			return err
+		}
+		vals[j] = v
+	}
+	return nil
+}
+
+func (d *chunkedIntDecoder) readBytes(n int) ([]byte, error) {
+	if d.packed {
+		return d.p.ReadBytes(n)
+	}
+	return d.r.ReadBytes(n)
+}
+
+// seek moves to offset bytes, or values when packed, into the current chunk
+func (d *chunkedIntDecoder) seek(offset uint64) error {
+	if d.packed {
+		return d.p.seek(int(offset))
+	}
+	if offset > uint64(len(d.curChunkBytes)) {
+		return fmt.Errorf("seek to %d past end of chunk of %d bytes", offset, len(d.curChunkBytes))
+	}
+	d.r.C = int(offset)
+	return nil
+}
+
+func (d *chunkedIntDecoder) SkipUvarint() error {
+	if d.packed {
+		return d.p.Skip(1)
+	}
 	d.r.SkipUvarint()
+	return nil
 }
 
-func (d *chunkedIntDecoder) SkipBytes(count int) {
+func (d *chunkedIntDecoder) SkipBytes(count int) error {
+	if d.packed {
+		return d.p.Skip(count)
+	}
 	d.r.SkipBytes(count)
+	return nil
 }
 
+// Len returns the number of bytes, or values when packed, left in the
+// current chunk
 func (d *chunkedIntDecoder) Len() int {
+	if d.packed {
+		return d.p.Len()
+	}
 	return d.r.Len()
 }
@@ -18,7 +18,6 @@ import (
 	"encoding/binary"
 	"fmt"
 
-	"github.com/blevesearch/vellum"
 	segment "github.com/blugelabs/bluge_segment_api"
 )
 
@@ -27,20 +26,27 @@ func Load(data *segment.Data) (segment.Segment, error) {
 	return load(data)
 }
 
+// LoadWithOptions returns an impl of a segment, configured by the options
+// which apply to reading segments, see WithChunkCache and WithMaxExpansions
+func LoadWithOptions(data *segment.Data, opts ...Option) (segment.Segment, error) {
+	rv, err := load(data)
+	if err != nil {
+		return nil, err
+	}
+	o := applyOptions(opts)
+	if o.chunkCache != nil {
+		rv.chunkCache = o.chunkCache
+		rv.chunkCacheID = o.chunkCache.addSegment()
+	}
+	rv.maxExpansions = o.maxExpansions
+	return rv, nil
+}
+
 func load(data *segment.Data) (*Segment, error) {
 	footer, err := parseFooter(data)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing footer: %w", err)
 	}
-	rv := &Segment{
-		data:           data.Slice(0, data.Len()-footerLen),
-		footer:         footer,
-		fieldsMap:      make(map[string]uint16),
-		fieldDvReaders: make(map[uint16]*docValueReader),
-		fieldFSTs:      make(map[uint16]*vellum.FST),
-		fieldDocs:      make(map[uint16]uint64),
-		fieldFreqs:     make(map[uint16]uint64),
-	}
 
 	// FIXME temporarily map to existing footer fields
 	// rv.memCRC = footer.crc
@@ -50,17 +56,32 @@ func load(data *segment.Data) (*Segment, error) {
 	// rv.fieldsIndexOffset = footer.fieldsIndexOffset
 	// rv.docValueOffset = footer.docValueOffset
 
-	err = rv.loadFields()
+	rv, err := newSegment(data.Slice(0, data.Len()-footer.length()), footer)
 	if err != nil {
 		return nil, err
 	}
 
-	err = rv.loadStoredFieldChunk()
+	err = rv.loadSort()
 	if err != nil {
 		return nil, err
 	}
 
-	err = rv.loadDvReaders()
+	return rv, nil
+}
+
+// newSegment returns the segment of the data, preceding the footer, having
+// read the fields index, the stored fields, doc values and the rest of
+// each field being read on first use
+func newSegment(data *segment.Data, footer *footer) (*Segment, error) {
+	rv := &Segment{
+		refs:          1,
+		data:          data,
+		footer:        footer,
+		fieldsMap:     make(map[string]uint16),
+		maxExpansions: defaultMaxExpansions,
+	}
+
+	err := rv.loadFields()
 	if err != nil {
 		return nil, err
 	}
@@ -72,6 +93,8 @@ func load(data *segment.Data) (*Segment, error) {
 
 const fileAddrWidth = 8
 
+// loadFields reads the name and dictionary location of each field, noting
+// where the rest of its entry is
 func (s *Segment) loadFields() error {
 	// NOTE for now we assume the fields index immediately precedes
 	// the footer, and if this changes, need to adjust accordingly (or
@@ -94,7 +117,6 @@ func (s *Segment) loadFields() error {
 		}
 		dictLoc, read := binary.Uvarint(dictLocData)
 		n := uint64(read)
-		s.dictLocs = append(s.dictLocs, dictLoc)
 
 		var nameLen uint64
 		nameLenData, err := s.data.Read(int(addr+n), int(fieldsIndexEnd))
@@ -110,34 +132,115 @@ func (s *Segment) loadFields() error {
 		}
 		n += nameLen
 
-		fieldDocData, err := s.data.Read(int(addr+n), int(fieldsIndexEnd))
-		if err != nil {
-			return err
-		}
-		fieldDocVal, read := binary.Uvarint(fieldDocData)
-		n += uint64(read)
-
-		fieldFreqData, err := s.data.Read(int(addr+n), int(fieldsIndexEnd))
-		if err != nil {
-			return err
-		}
-		fieldFreqVal, _ := binary.Uvarint(fieldFreqData)
-
 		name := string(nameData)
 		s.fieldsInv = append(s.fieldsInv, name)
 		s.fieldsMap[name] = uint16(fieldID + 1)
-		s.fieldDocs[uint16(fieldID)] = fieldDocVal
-		s.fieldFreqs[uint16(fieldID)] = fieldFreqVal
+		s.fields = append(s.fields, segmentField{
+			dictLoc:   dictLoc,
+			statsAddr: addr + n,
+			dvStart:   fieldNotUninverted,
+		})
 
 		fieldID++
 	}
 	return nil
 }
 
-// loadStoredFieldChunk load storedField chunk offsets
-func (s *Segment) loadStoredFieldChunk() error {
+// loadStoredCodec loads the codec of the stored fields, which precedes the
+// stored index, returning where the stored field chunk offsets end
+func (s *Segment) loadStoredCodec() (uint64, error) {
+	pos := int(s.footer.storedIndexOffset) - 2*sizeOfUint32
+	if pos < 0 {
+		return 0, fmt.Errorf("invalid stored index offset %d", s.footer.storedIndexOffset)
+	}
+	codecData, err := s.data.Read(pos, pos+2*sizeOfUint32)
+	if err != nil {
+		return 0, err
+	}
+	dictLen := int(binary.BigEndian.Uint32(codecData))
+	codecID := StoredCodecID(binary.BigEndian.Uint32(codecData[sizeOfUint32:]))
+	if dictLen > pos {
+		return 0, fmt.Errorf("invalid stored codec dictionary length %d", dictLen)
+	}
+	pos -= dictLen
+	var dict []byte
+	if dictLen > 0 {
+		dict, err = s.data.Read(pos, pos+dictLen)
+		if err != nil {
+			return 0, err
+		}
+	}
+	s.storedCodec, err = loadStoredCodec(codecID, dict)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(pos), nil
+}
+
+// loadStoredChunkIndex loads the chunk policy, the large value threshold
+// and length of their region, and the first doc of each chunk of stored
+// fields, which end at end, returning where they start
+func (s *Segment) loadStoredChunkIndex(end uint64) (uint64, error) {
+	if end < uint64(sizeOfUint32) {
+		return 0, fmt.Errorf("invalid stored chunk index end %d", end)
+	}
+	lenData, err := s.data.Read(int(end)-sizeOfUint32, int(end))
+	if err != nil {
+		return 0, err
+	}
+	indexLen := uint64(binary.BigEndian.Uint32(lenData))
+	end -= uint64(sizeOfUint32)
+	if indexLen > end {
+		return 0, fmt.Errorf("invalid stored chunk index length %d", indexLen)
+	}
+	start := end - indexLen
+	indexData, err := s.data.Read(int(start), int(end))
+	if err != nil {
+		return 0, err
+	}
+	var vals []uint64
+	for len(indexData) > 0 {
+		val, read := binary.Uvarint(indexData)
+		if read <= 0 {
+			return 0, fmt.Errorf("invalid stored chunk index")
+		}
+		vals = append(vals, val)
+		indexData = indexData[read:]
+	}
+	const numHeader = 4
+	if len(vals) < numHeader+1 {
+		return 0, fmt.Errorf("invalid stored chunk index")
+	}
+	s.storedChunkDocs, s.storedChunkBytes = vals[0], vals[1]
+	s.storedLargeThreshold, s.storedLargeLen = vals[2], vals[3]
+	s.storedFieldChunkDocStarts = make([]uint64, len(vals)-numHeader)
+	var docStart uint64
+	for i, delta := range vals[numHeader:] {
+		docStart += delta
+		s.storedFieldChunkDocStarts[i] = docStart
+	}
+	return start, nil
+}
+
+// loadFixedStoredChunkIndex sets the first doc of each chunk of stored
+// fields of version 2, which always had chunks of defaultDocumentChunkSize
+// docs
+func (s *Segment) loadFixedStoredChunkIndex() {
+	s.storedChunkDocs = uint64(defaultDocumentChunkSize)
+	s.storedFieldChunkDocStarts = make([]uint64, len(s.storedFieldChunkOffsets))
+	for i := range s.storedFieldChunkDocStarts {
+		docStart := uint64(i) * s.storedChunkDocs
+		if docStart > s.footer.numDocs {
+			docStart = s.footer.numDocs
+		}
+		s.storedFieldChunkDocStarts[i] = docStart
+	}
+}
+
+// loadStoredFieldChunk load storedField chunk offsets, which end at end
+func (s *Segment) loadStoredFieldChunk(end uint64) error {
 	// read chunk num
-	chunkOffsetPos := int(s.footer.storedIndexOffset - uint64(sizeOfUint32))
+	chunkOffsetPos := int(end - uint64(sizeOfUint32))
 	chunkData, err := s.data.Read(chunkOffsetPos, chunkOffsetPos+sizeOfUint32)
 	if err != nil {
 		return err
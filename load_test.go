@@ -0,0 +1,369 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"testing"
+
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+const testLazyFields = 50
+
+func buildTestAnalysisResultsLazy(numDocs int) []segment.Document {
+	var results []segment.Document
+	for i := 0; i < numDocs; i++ {
+		doc := FakeDocument{NewFakeField("_id", fmt.Sprintf("%05d", i), true, false, false)}
+		for field := 0; field < testLazyFields; field++ {
+			doc = append(doc, NewFakeField(fmt.Sprintf("field%02d", field),
+				fmt.Sprintf("value%d", (i+field)%7), true, false, true))
+		}
+		results = append(results, &doc)
+	}
+	return results
+}
+
+// lazyFieldReads reads the dictionary, doc values and stats of the field
+func lazyFieldReads(seg *Segment, field string) (map[string]interface{}, error) {
+	rv := map[string]interface{}{}
+	dict, err := seg.Dictionary(field)
+	if err != nil {
+		return nil, err
+	}
+	pl, err := dict.PostingsList([]byte("value3"), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	rv["count"] = pl.Count()
+
+	dvr, err := seg.DocumentValueReader([]string{field})
+	if err != nil {
+		return nil, err
+	}
+	var terms []string
+	for docNum := uint64(0); docNum < seg.Count(); docNum += 11 {
+		err = dvr.VisitDocumentValues(docNum, func(field string, term []byte) {
+			terms = append(terms, string(term))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	rv["terms"] = terms
+
+	stats, err := seg.CollectionStats(field)
+	if err != nil {
+		return nil, err
+	}
+	rv["docs"] = stats.DocumentCount()
+	rv["freqs"] = stats.SumTotalTermFrequency()
+	return rv, nil
+}
+
+func TestLoadLazyFields(t *testing.T) {
+	segInt, _, err := New(buildTestAnalysisResultsLazy(500), encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = segInt.(*Segment).WriteTo(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg, err := load(segment.NewDataBytes(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the names of the fields are read on load
+	loaded := func(fieldID int) bool {
+		f := &seg.fields[fieldID]
+		return f.fst != nil || f.dvReader != nil || f.docs != 0
+	}
+	for fieldID := range seg.fields {
+		if loaded(fieldID) {
+			t.Errorf("expected field %s not to be loaded", seg.fieldsInv[fieldID])
+		}
+	}
+	if seg.storedFieldChunkOffsets != nil {
+		t.Errorf("expected stored index not to be loaded")
+	}
+
+	size := seg.Size()
+	actual, err := lazyFieldReads(seg, "field07")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual["docs"] != uint64(500) || actual["count"] == uint64(0) {
+		t.Errorf("expected field07 in every doc, got %v", actual)
+	}
+	for fieldID := range seg.fields {
+		if loaded(fieldID) != (seg.fieldsInv[fieldID] == "field07") {
+			t.Errorf("expected only field07 to be loaded, field %s loaded %t",
+				seg.fieldsInv[fieldID], loaded(fieldID))
+		}
+	}
+	if seg.Size() <= size {
+		t.Errorf("expected size %d to grow once field07 is used, got %d", size, seg.Size())
+	}
+
+	size = seg.Size()
+	err = seg.VisitStoredFields(3, func(field string, value []byte) bool {
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seg.storedFieldChunkOffsets == nil || seg.Size() <= size {
+		t.Errorf("expected stored index to be loaded, size %d grown to %d", size, seg.Size())
+	}
+}
+
+func TestLoadLazyFieldsConcurrent(t *testing.T) {
+	segInt, _, err := New(buildTestAnalysisResultsLazy(300), encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = segInt.(*Segment).WriteTo(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]map[string]interface{}{}
+	for field := 0; field < testLazyFields; field++ {
+		name := fmt.Sprintf("field%02d", field)
+		expected[name], err = lazyFieldReads(segInt.(*Segment), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// readers racing to the first use of each field
+	seg, err := load(segment.NewDataBytes(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const readers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, readers)
+	for reader := 0; reader < readers; reader++ {
+		wg.Add(1)
+		go func(reader int) {
+			defer wg.Done()
+			for field := 0; field < testLazyFields; field++ {
+				name := fmt.Sprintf("field%02d", (field+reader)%testLazyFields)
+				actual, err := lazyFieldReads(seg, name)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !reflect.DeepEqual(actual, expected[name]) {
+					errs <- fmt.Errorf("reader %d: expected %s to read %v, got %v", reader, name, expected[name], actual)
+					return
+				}
+			}
+		}(reader)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestSegmentClose(t *testing.T) {
+	segInt, _, err := New(buildTestAnalysisResultsCached(0, 300), encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = segInt.(*Segment).WriteTo(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewChunkCache(1 << 20)
+	loaded, err := LoadWithOptions(segment.NewDataBytes(buf.Bytes()), WithChunkCache(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := loaded.(*Segment)
+	dvr, err := seg.DocumentValueReader([]string{"title", "body"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for docNum := uint64(0); docNum < seg.Count(); docNum++ {
+		_, err = readCachedDoc(seg, dvr, docNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cache.Stats().Entries == 0 {
+		t.Fatalf("expected chunks of the segment cached")
+	}
+	size := seg.Size()
+
+	err = seg.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := cache.Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+		t.Errorf("expected chunks of the closed segment dropped, got %+v", stats)
+	}
+	if seg.Size() >= size {
+		t.Errorf("expected size %d to shrink once closed, got %d", size, seg.Size())
+	}
+
+	_, err = seg.Dictionary("body")
+	if !errors.Is(err, ErrSegmentClosed) {
+		t.Errorf("expected dictionary of closed segment to fail, got: %v", err)
+	}
+	err = seg.VisitStoredFields(0, func(field string, value []byte) bool {
+		return true
+	})
+	if !errors.Is(err, ErrSegmentClosed) {
+		t.Errorf("expected stored fields of closed segment to fail, got: %v", err)
+	}
+	err = dvr.VisitDocumentValues(0, func(field string, term []byte) {})
+	if !errors.Is(err, ErrSegmentClosed) {
+		t.Errorf("expected doc values of closed segment to fail, got: %v", err)
+	}
+	_, err = seg.CollectionStats("body")
+	if !errors.Is(err, ErrSegmentClosed) {
+		t.Errorf("expected stats of closed segment to fail, got: %v", err)
+	}
+	if seg.Acquire() == nil {
+		t.Errorf("expected acquiring closed segment to fail")
+	}
+	if seg.Close() != nil {
+		t.Errorf("expected closing twice to succeed")
+	}
+}
+
+func TestSegmentAcquireRelease(t *testing.T) {
+	segInt, _, err := New(buildTestAnalysisResultsCached(0, 100), encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := segInt.(*Segment)
+
+	// queries in flight while the segment is closed, as a merge replaced it
+	const queries = 4
+	for i := 0; i < queries; i++ {
+		err = seg.Acquire()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = seg.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, queries)
+	for i := 0; i < queries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := concurrentReads(seg, 0)
+			if err != nil {
+				errs <- err
+			}
+			errs <- seg.Release()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("expected query to read the closed segment until released, got: %v", err)
+		}
+	}
+
+	_, err = seg.Dictionary("body")
+	if !errors.Is(err, ErrSegmentClosed) {
+		t.Errorf("expected dictionary of released segment to fail, got: %v", err)
+	}
+	if seg.Release() == nil {
+		t.Errorf("expected releasing more than acquired to fail")
+	}
+}
+
+func TestSegmentReleaseDuringReads(t *testing.T) {
+	dict, err := ioutil.ReadFile("testdata/stored.dict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec, err := NewZSTDDictStoredCodec(ZSTDCompressionLevel, dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = codec.(io.Closer).Close() }()
+	segInt, _, err := NewWithOptions(buildTestAnalysisResultsCached(0, 300), encodeNorm, WithStoredCodec(codec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = segInt.(*Segment).WriteTo(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadWithOptions(segment.NewDataBytes(buf.Bytes()), WithChunkCache(NewChunkCache(1<<16)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := loaded.(*Segment)
+
+	// queries which took no reference keep reading while the segment is
+	// released, each read either succeeds or finds the segment closed
+	const queries = 4
+	var started, wg sync.WaitGroup
+	errs := make(chan error, queries)
+	for i := 0; i < queries; i++ {
+		started.Add(1)
+		wg.Add(1)
+		go func(offset uint64) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				_, err := concurrentReads(seg, offset+uint64(n))
+				if n == 0 {
+					started.Done()
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(uint64(i))
+	}
+	started.Wait()
+	err = seg.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if !errors.Is(err, ErrSegmentClosed) {
+			t.Errorf("expected reads of the released segment to fail as closed, got: %v", err)
+		}
+	}
+}
@@ -99,6 +99,16 @@ func (r *memUvarintReader) SkipBytes(count int) {
 	r.C += count
 }
 
+// ReadBytes returns the next count bytes, which share the memory of S.
+func (r *memUvarintReader) ReadBytes(count int) ([]byte, error) {
+	if count < 0 || count > r.Len() {
+		return nil, fmt.Errorf("memUvarintReader read of %d bytes past end", count)
+	}
+	rv := r.S[r.C : r.C+count : r.C+count]
+	r.C += count
+	return rv, nil
+}
+
 func (r *memUvarintReader) Reset(s []byte) {
 	r.C = 0
 	r.S = s
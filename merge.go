@@ -38,6 +38,7 @@ type Merger struct {
 	drops           []*roaring.Bitmap
 	newDocNums      [][]uint64
 	mergeBufferSize int
+	opts            options
 }
 
 func (m *Merger) WriteTo(w io.Writer, closeCh chan struct{}) (n int64, err error) {
@@ -45,7 +46,7 @@ func (m *Merger) WriteTo(w io.Writer, closeCh chan struct{}) (n int64, err error
 
 	bw := bufio.NewWriterSize(w, m.mergeBufferSize)
 
-	m.newDocNums, sz, err = merge(m.segments, m.drops, bw, closeCh)
+	m.newDocNums, sz, err = merge(m.segments, m.drops, bw, closeCh, m.opts)
 	if err != nil {
 		return
 	}
@@ -64,15 +65,22 @@ func (m *Merger) DocumentNumbers() [][]uint64 {
 }
 
 func Merge(segments []segment.Segment, drops []*roaring.Bitmap, mergeBufferSize int) segment.Merger {
+	return MergeWithOptions(segments, drops, mergeBufferSize)
+}
+
+// MergeWithOptions is Merge, with options controlling how the merge is done
+func MergeWithOptions(segments []segment.Segment, drops []*roaring.Bitmap, mergeBufferSize int,
+	opts ...Option) segment.Merger {
 	return &Merger{
 		segments:        segments,
 		drops:           drops,
 		mergeBufferSize: mergeBufferSize,
+		opts:            applyOptions(opts),
 	}
 }
 
 func merge(segments []segment.Segment, drops []*roaring.Bitmap,
-	w io.Writer, closeCh chan struct{}) (newDocNums [][]uint64, n uint64, err error) {
+	w io.Writer, closeCh chan struct{}, opts options) (newDocNums [][]uint64, n uint64, err error) {
 	segmentBases := make([]*Segment, len(segments))
 	for segmenti, seg := range segments {
 		switch segmentx := seg.(type) {
@@ -82,23 +90,28 @@ func merge(segments []segment.Segment, drops []*roaring.Bitmap,
 			panic(fmt.Sprintf("oops, unexpected segment type: %T", seg))
 		}
 	}
-	return mergeSegmentBasesWriter(segmentBases, drops, w, defaultChunkMode, closeCh)
+	return mergeSegmentBasesWriter(segmentBases, drops, w, opts, closeCh)
 }
 
 func mergeSegmentBasesWriter(segmentBases []*Segment, drops []*roaring.Bitmap, w io.Writer,
-	chunkMode uint32, closeCh chan struct{}) (
+	opts options, closeCh chan struct{}) (
 	newDocNums [][]uint64, n uint64, err error) {
+	err = opts.validate()
+	if err != nil {
+		return nil, 0, err
+	}
+
 	// wrap it for counting (tracking offsets)
 	cr := newCountHashWriter(w)
 
 	var footer *footer
 	newDocNums, footer, err =
-		mergeToWriter(segmentBases, drops, chunkMode, cr, closeCh)
+		mergeToWriter(segmentBases, drops, opts, cr, closeCh)
 	if err != nil {
 		return nil, 0, err
 	}
 	footer.crc = cr.Sum32()
-	footer.chunkMode = chunkMode
+	footer.chunkMode = opts.chunkMode
 
 	err = persistFooter(footer, cr)
 	if err != nil {
@@ -109,7 +122,7 @@ func mergeSegmentBasesWriter(segmentBases []*Segment, drops []*roaring.Bitmap, w
 }
 
 func mergeToWriter(segments []*Segment, drops []*roaring.Bitmap,
-	chunkMode uint32, cr *countHashWriter, closeCh chan struct{}) (
+	opts options, cr *countHashWriter, closeCh chan struct{}) (
 	newDocNums [][]uint64, footerVal *footer,
 	err error) {
 	docValueOffset := uint64(fieldNotUninverted)
@@ -123,19 +136,53 @@ func mergeToWriter(segments []*Segment, drops []*roaring.Bitmap,
 		return nil, nil, segment.ErrClosed
 	}
 
-	var storedIndexOffset uint64
+	var storedIndexOffset, numericOffset, sortedSetOffset uint64
 	var fieldDocs, fieldFreqs map[uint16]uint64
 	var dictLocs []uint64
-	if numDocs > 0 {
+	if numDocs > 0 && len(opts.sort) > 0 {
+		newDocNums, err = sortedDocNums(segments, drops, opts.sort)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		storedIndexOffset, err = mergeStoredSorted(segments, newDocNums,
+			fieldsMap, fieldsInv, numDocs, opts, cr, closeCh)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if numDocs > 0 {
 		storedIndexOffset, newDocNums, err = mergeStoredAndRemap(segments, drops,
-			fieldsMap, fieldsInv, fieldsSame, numDocs, cr, closeCh)
+			fieldsMap, fieldsInv, fieldsSame, numDocs, opts, cr, closeCh)
 		if err != nil {
 			return nil, nil, err
 		}
+	}
+
+	if numDocs > 0 {
 
 		dictLocs, fieldDocs, fieldFreqs, docValueOffset, err = persistMergedRest(segments, drops,
 			fieldsInv, fieldsMap,
-			newDocNums, numDocs, chunkMode, cr, closeCh)
+			newDocNums, numDocs, opts, cr, closeCh)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var numerics map[uint16]*numericColumn
+		numerics, err = mergeNumericDocValues(segments, newDocNums, fieldsMap)
+		if err != nil {
+			return nil, nil, err
+		}
+		numericOffset, err = persistNumericDocValues(numerics, numDocs, cr)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var sortedSets map[uint16]*sortedSetColumn
+		sortedSets, err = mergeSortedSetDocValues(segments, newDocNums, fieldsMap)
+		if err != nil {
+			return nil, nil, err
+		}
+		sortedSetOffset, err = persistSortedSetDocValues(sortedSets, numDocs, cr)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -143,6 +190,11 @@ func mergeToWriter(segments []*Segment, drops []*roaring.Bitmap,
 		dictLocs = make([]uint64, len(fieldsInv))
 	}
 
+	sortOffset, err := persistSort(opts.sort, cr)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	var fieldsIndexOffset uint64
 	fieldsIndexOffset, err = persistFields(fieldsInv, fieldDocs, fieldFreqs, cr, dictLocs)
 	if err != nil {
@@ -154,6 +206,10 @@ func mergeToWriter(segments []*Segment, drops []*roaring.Bitmap,
 		storedIndexOffset: storedIndexOffset,
 		fieldsIndexOffset: fieldsIndexOffset,
 		docValueOffset:    docValueOffset,
+		sortOffset:        sortOffset,
+		numericOffset:     numericOffset,
+		sortedSetOffset:   sortedSetOffset,
+		version:           Version,
 	}, nil
 }
 
@@ -182,10 +238,16 @@ func computeNewDocCount(segments []*Segment, drops []*roaring.Bitmap) uint64 {
 
 func persistMergedRest(segments []*Segment, dropsIn []*roaring.Bitmap,
 	fieldsInv []string, fieldsMap map[string]uint16,
-	newDocNumsIn [][]uint64, newSegDocCount uint64, chunkMode uint32,
+	newDocNumsIn [][]uint64, newSegDocCount uint64, opts options,
 	w *countHashWriter, closeCh chan struct{}) (dictLocs []uint64, fieldDocs,
 	fieldFreqs map[uint16]uint64, docValueOffset uint64, err error) {
+	if opts.mergeWorkers > 1 && len(fieldsInv) > 1 {
+		return persistMergedRestParallel(segments, dropsIn, fieldsInv, fieldsMap,
+			newDocNumsIn, newSegDocCount, opts, w, closeCh)
+	}
+
 	var bufMaxVarintLen64 = make([]byte, binary.MaxVarintLen64)
+	sorted := len(opts.sort) > 0
 
 	dictLocs = make([]uint64, len(fieldsInv))
 	fieldDvLocsStart := make([]uint64, len(fieldsInv))
@@ -194,8 +256,8 @@ func persistMergedRest(segments []*Segment, dropsIn []*roaring.Bitmap,
 	// these int coders are initialized with chunk size 1024
 	// however this will be reset to the correct chunk size
 	// while processing each individual field-term section
-	tfEncoder := newChunkedIntCoder(uint64(legacyChunkMode), newSegDocCount-1)
 	locEncoder := newChunkedIntCoder(uint64(legacyChunkMode), newSegDocCount-1)
+	tfEncoder := newChunkedFreqNormCoder(uint64(legacyChunkMode), newSegDocCount-1, locEncoder)
 
 	var vellumBuf bytes.Buffer
 	newVellum, err := vellum.New(&vellumBuf, nil)
@@ -209,11 +271,34 @@ func persistMergedRest(segments []*Segment, dropsIn []*roaring.Bitmap,
 	fieldDocTracking := roaring.NewBitmap()
 	fieldFreqs = map[uint16]uint64{}
 
+	terms := &directTermWriter{
+		w:                 w,
+		newVellum:         newVellum,
+		bufMaxVarintLen64: bufMaxVarintLen64,
+		topTerms:          newTopTermsCollector(opts.topTerms),
+	}
+
 	// for each field
 	for fieldID, fieldName := range fieldsInv {
-		err = persistMergedRestField(segments, dropsIn, fieldsMap, newDocNumsIn, newSegDocCount, chunkMode, w,
-			closeCh, fieldName, newRoaring, fieldDocTracking, tfEncoder, locEncoder, newVellum, &vellumBuf,
-			bufMaxVarintLen64, fieldFreqs, fieldID, dictLocs, fieldDvLocsStart, fieldDvLocsEnd)
+		segmentsInFocus, newDocNums, err2 := persistMergedRestField(segments, dropsIn, fieldsMap, newDocNumsIn,
+			newSegDocCount, opts.chunkMode, sorted, closeCh, fieldName, newRoaring, fieldDocTracking, tfEncoder,
+			locEncoder, fieldFreqs, fieldID, terms)
+		if err2 != nil {
+			return nil, nil, nil, 0, err2
+		}
+
+		reverse, err2 := mergedReverseTerms(segments, fieldName)
+		if err2 != nil {
+			return nil, nil, nil, 0, err2
+		}
+
+		err = writeMergedDict(w, newVellum, &vellumBuf, terms.topTerms, reverse, bufMaxVarintLen64, fieldID, dictLocs)
+		if err != nil {
+			return nil, nil, nil, 0, err
+		}
+
+		fieldDvLocsStart[fieldID], fieldDvLocsEnd[fieldID], err = buildMergedDocVals(newSegDocCount, w, closeCh,
+			fieldName, segmentsInFocus, newDocNums, sorted, opts.docValueChunkMode)
 		if err != nil {
 			return nil, nil, nil, 0, err
 		}
@@ -236,20 +321,27 @@ func persistMergedRest(segments []*Segment, dropsIn []*roaring.Bitmap,
 	return dictLocs, fieldDocs, fieldFreqs, docValueOffset, nil
 }
 
+// persistMergedRestField merges the postings of each term of a field,
+// passing them to terms in term order, it returns the segments having the
+// field, with their new doc numbers, for merging the field's doc values,
+// sorted is true if the new doc numbers do not follow the segments' order
 func persistMergedRestField(segments []*Segment, dropsIn []*roaring.Bitmap, fieldsMap map[string]uint16,
-	newDocNumsIn [][]uint64, newSegDocCount uint64, chunkMode uint32, w *countHashWriter, closeCh chan struct{},
+	newDocNumsIn [][]uint64, newSegDocCount uint64, chunkMode uint32, sorted bool, closeCh chan struct{},
 	fieldName string, newRoaring, fieldDocTracking *roaring.Bitmap, tfEncoder, locEncoder *chunkedIntCoder,
-	newVellum *vellum.Builder, vellumBuf *bytes.Buffer, bufMaxVarintLen64 []byte, fieldFreqs map[uint16]uint64,
-	fieldID int, dictLocs, fieldDvLocsStart, fieldDvLocsEnd []uint64) error {
+	fieldFreqs map[uint16]uint64, fieldID int, terms mergedTermWriter) (
+	segmentsInFocus []*Segment, newDocNums [][]uint64, err error) {
 	var postings *PostingsList
 	var postItr *PostingsIterator
-	var bufLoc []uint64
+	var hits *sortedHits
+	if sorted || chunkTargetBytes(chunkMode) > 0 {
+		hits = &sortedHits{chunkMode: chunkMode, numDocs: newSegDocCount}
+	}
 
 	// collect FST iterators from all active segments for this field
 	newDocNums, drops, dicts, itrs, segmentsInFocus, err :=
 		setupActiveForField(segments, dropsIn, newDocNumsIn, closeCh, fieldName)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	var prevTerm []byte
@@ -268,14 +360,14 @@ func persistMergedRestField(segments []*Segment, dropsIn []*roaring.Bitmap, fiel
 		if !bytes.Equal(prevTerm, term) {
 			// check for the closure in meantime
 			if isClosed(closeCh) {
-				return segment.ErrClosed
+				return nil, nil, segment.ErrClosed
 			}
 
 			// if the term changed, write out the info collected for the previous term
-			err = finishTerm(w, newRoaring, tfEncoder, locEncoder, newVellum, bufMaxVarintLen64, prevTerm, &lastDocNum,
+			err = finishTerm(terms, hits, newRoaring, tfEncoder, locEncoder, prevTerm, &lastDocNum,
 				&lastFreq, &lastNorm)
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
 		}
 
@@ -283,28 +375,32 @@ func persistMergedRestField(segments []*Segment, dropsIn []*roaring.Bitmap, fiel
 			err = prepareNewTerm(newSegDocCount, chunkMode, tfEncoder, locEncoder, fieldFreqs, fieldID, enumerator,
 				dicts, drops)
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
 		}
 
 		postings, err = dicts[itrI].postingsListFromOffset(
 			postingsOffset, drops[itrI], postings)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 
 		postItr, err = postings.iterator(true, true, true, postItr)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 
-		// can no longer optimize by copying, since chunk factor could have changed
-		lastDocNum, lastFreq, lastNorm, bufLoc, err = mergeTermFreqNormLocs(
-			fieldsMap, postItr, newDocNums[itrI], newRoaring,
-			tfEncoder, locEncoder, bufLoc, fieldDocTracking)
+		if hits != nil {
+			err = hits.add(fieldsMap, postItr, newDocNums[itrI], newRoaring, fieldDocTracking)
+		} else {
+			// can no longer optimize by copying, since chunk factor could have changed
+			lastDocNum, lastFreq, lastNorm, err = mergeTermFreqNormLocs(
+				fieldsMap, postItr, newDocNums[itrI], newRoaring,
+				tfEncoder, locEncoder, fieldDocTracking)
+		}
 
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 
 		prevTerm = prevTerm[:0] // copy to prevTerm in case Next() reuses term mem
@@ -313,30 +409,23 @@ func persistMergedRestField(segments []*Segment, dropsIn []*roaring.Bitmap, fiel
 		err = enumerator.Next()
 	}
 	if err != vellum.ErrIteratorDone {
-		return err
+		return nil, nil, err
 	}
 
-	err = finishTerm(w, newRoaring, tfEncoder, locEncoder, newVellum, bufMaxVarintLen64, prevTerm, &lastDocNum,
+	err = finishTerm(terms, hits, newRoaring, tfEncoder, locEncoder, prevTerm, &lastDocNum,
 		&lastFreq, &lastNorm)
 	if err != nil {
-		return err
-	}
-
-	err = writeMergedDict(w, newVellum, vellumBuf, bufMaxVarintLen64, fieldID, dictLocs)
-	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	err = buildMergedDocVals(newSegDocCount, w, closeCh, fieldName, fieldID, fieldDvLocsStart, fieldDvLocsEnd,
-		segmentsInFocus, newDocNums)
-	if err != nil {
-		return err
-	}
-	return nil
+	return segmentsInFocus, newDocNums, nil
 }
 
-func writeMergedDict(w *countHashWriter, newVellum io.Closer, vellumBuf *bytes.Buffer,
-	bufMaxVarintLen64 []byte, fieldID int, dictLocs []uint64) error {
+// writeMergedDict writes out the vellum of a field, followed by its top
+// terms and, if reverse, its reversed terms, recording where it starts in
+// dictLocs
+func writeMergedDict(w *countHashWriter, newVellum io.Closer, vellumBuf *bytes.Buffer, topTerms *topTermsCollector,
+	reverse bool, bufMaxVarintLen64 []byte, fieldID int, dictLocs []uint64) error {
 	dictOffset := uint64(w.Count())
 
 	err := newVellum.Close()
@@ -358,22 +447,38 @@ func writeMergedDict(w *countHashWriter, newVellum io.Closer, vellumBuf *bytes.B
 		return err
 	}
 
+	err = topTerms.write(w, bufMaxVarintLen64)
+	if err != nil {
+		return err
+	}
+
+	err = writeReverseDict(w, vellumData, reverse, bufMaxVarintLen64)
+	if err != nil {
+		return err
+	}
+
 	dictLocs[fieldID] = dictOffset
 	return nil
 }
 
-func buildMergedDocVals(newSegDocCount uint64, w *countHashWriter, closeCh chan struct{}, fieldName string, fieldID int,
-	fieldDvLocsStart, fieldDvLocsEnd []uint64, segmentsInFocus []*Segment, newDocNums [][]uint64) error {
+// buildMergedDocVals merges the doc values of a field in chunks of the chunk
+// mode, returning where they start and end, or fieldNotUninverted if none of
+// the segments have them, sorted is true if the new doc numbers do not
+// follow the segments' order
+func buildMergedDocVals(newSegDocCount uint64, w *countHashWriter, closeCh chan struct{}, fieldName string,
+	segmentsInFocus []*Segment, newDocNums [][]uint64, sorted bool, chunkMode uint32) (start, end uint64, err error) {
 	// get the field doc value offset (start)
-	fieldDvLocsStart[fieldID] = uint64(w.Count())
-
-	// update the field doc values
-	// NOTE: doc values continue to use legacy chunk mode
-	chunkSize, err := getChunkSize(legacyChunkMode, 0, 0)
-	if err != nil {
-		return err
+	start = uint64(w.Count())
+
+	// the doc values are buffered when sorted, or when sizing the chunks
+	// from them, in which case the encoder is created once they are
+	var fdvEncoder *chunkedContentCoder
+	var sortedVals *sortedDocValues
+	if sorted || chunkMode > legacyChunkMode {
+		sortedVals = &sortedDocValues{}
+	} else {
+		fdvEncoder = newChunkedContentCoder(uint64(chunkMode), newSegDocCount-1, w, true)
 	}
-	fdvEncoder := newChunkedContentCoder(chunkSize, newSegDocCount-1, w, true)
 
 	fdvReadersAvailable := false
 	var dvIterClone *docValueReader
@@ -381,18 +486,29 @@ func buildMergedDocVals(newSegDocCount uint64, w *countHashWriter, closeCh chan
 		segmentI := segmentI
 		// check for the closure in meantime
 		if isClosed(closeCh) {
-			return segment.ErrClosed
+			return 0, 0, segment.ErrClosed
 		}
 
 		fieldIDPlus1 := seg.fieldsMap[fieldName]
-		if dvIter, exists := seg.fieldDvReaders[fieldIDPlus1-1]; exists &&
-			dvIter != nil {
+		if fieldIDPlus1 == 0 {
+			continue
+		}
+		var dvIter *docValueReader
+		dvIter, err = seg.fieldDocValueReader(fieldIDPlus1 - 1)
+		if err != nil {
+			return 0, 0, err
+		}
+		if dvIter != nil {
 			fdvReadersAvailable = true
 			dvIterClone = dvIter.cloneInto(dvIterClone)
 			err = dvIterClone.iterateAllDocValues(seg, func(docNum uint64, terms []byte) error {
 				if newDocNums[segmentI][docNum] == docDropped {
 					return nil
 				}
+				if sortedVals != nil {
+					sortedVals.add(newDocNums[segmentI][docNum], terms)
+					return nil
+				}
 				err2 := fdvEncoder.Add(newDocNums[segmentI][docNum], terms)
 				if err2 != nil {
 					return err2
@@ -400,30 +516,42 @@ func buildMergedDocVals(newSegDocCount uint64, w *countHashWriter, closeCh chan
 				return nil
 			})
 			if err != nil {
-				return err
+				return 0, 0, err
 			}
 		}
 	}
 
-	if fdvReadersAvailable {
-		err = fdvEncoder.Close()
+	if !fdvReadersAvailable {
+		return fieldNotUninverted, fieldNotUninverted, nil
+	}
+
+	if sortedVals != nil {
+		var chunkSize uint64
+		chunkSize, err = chunkSizeFor(chunkMode, uint64(len(sortedVals.docNums)), uint64(len(sortedVals.terms)),
+			newSegDocCount)
 		if err != nil {
-			return err
+			return 0, 0, err
 		}
-
-		// persist the doc value details for this field
-		_, err = fdvEncoder.Write()
+		fdvEncoder = newChunkedContentCoder(chunkSize, newSegDocCount-1, w, true)
+		err = sortedVals.encode(fdvEncoder)
 		if err != nil {
-			return err
+			return 0, 0, err
 		}
+	}
 
-		// get the field doc value offset (end)
-		fieldDvLocsEnd[fieldID] = uint64(w.Count())
-	} else {
-		fieldDvLocsStart[fieldID] = fieldNotUninverted
-		fieldDvLocsEnd[fieldID] = fieldNotUninverted
+	err = fdvEncoder.Close()
+	if err != nil {
+		return 0, 0, err
 	}
-	return nil
+
+	// persist the doc value details for this field
+	_, err = fdvEncoder.Write()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// get the field doc value offset (end)
+	return start, uint64(w.Count()), nil
 }
 
 func prepareNewTerm(newSegDocCount uint64, chunkMode uint32, tfEncoder, locEncoder *chunkedIntCoder,
@@ -443,6 +571,12 @@ func prepareNewTerm(newSegDocCount uint64, chunkMode uint32, tfEncoder, locEncod
 		newCard += pl.Count()
 		fieldFreqs[uint16(fieldID)] += newCard
 	}
+	tfEncoder.SetPacked(packedChunks(chunkMode))
+	locEncoder.SetPacked(packedChunks(chunkMode))
+	if chunkTargetBytes(chunkMode) > 0 {
+		// sized once the hits of the term are buffered, see sortedHits
+		return nil
+	}
 	// compute correct chunk size with this
 	var chunkSize uint64
 	chunkSize, err = getChunkSize(chunkMode, newCard, newSegDocCount)
@@ -455,8 +589,16 @@ func prepareNewTerm(newSegDocCount uint64, chunkMode uint32, tfEncoder, locEncod
 	return nil
 }
 
-func finishTerm(w *countHashWriter, newRoaring *roaring.Bitmap, tfEncoder, locEncoder *chunkedIntCoder,
-	newVellum *vellum.Builder, bufMaxVarintLen64, term []byte, lastDocNum, lastFreq, lastNorm *uint64) error {
+func finishTerm(terms mergedTermWriter, hits *sortedHits, newRoaring *roaring.Bitmap,
+	tfEncoder, locEncoder *chunkedIntCoder, term []byte, lastDocNum, lastFreq, lastNorm *uint64) error {
+	if hits != nil {
+		var err error
+		*lastDocNum, *lastFreq, *lastNorm, err = hits.encode(tfEncoder, locEncoder)
+		if err != nil {
+			return err
+		}
+	}
+
 	tfEncoder.Close()
 	locEncoder.Close()
 
@@ -473,19 +615,11 @@ func finishTerm(w *countHashWriter, newRoaring *roaring.Bitmap, tfEncoder, locEn
 		return false, 0, 0
 	}
 
-	postingsOffset, err := writePostings(newRoaring,
-		tfEncoder, locEncoder, use1HitEncoding, w, bufMaxVarintLen64)
+	err := terms.writeTerm(term, newRoaring, tfEncoder, locEncoder, use1HitEncoding)
 	if err != nil {
 		return err
 	}
 
-	if postingsOffset > 0 {
-		err = newVellum.Insert(term, postingsOffset)
-		if err != nil {
-			return err
-		}
-	}
-
 	newRoaring.Clear()
 
 	tfEncoder.Reset()
@@ -498,6 +632,40 @@ func finishTerm(w *countHashWriter, newRoaring *roaring.Bitmap, tfEncoder, locEn
 	return nil
 }
 
+// mergedTermWriter writes out the postings of each term of a field as
+// it is merged, terms are passed in order
+type mergedTermWriter interface {
+	writeTerm(term []byte, postings *roaring.Bitmap, tfEncoder, locEncoder *chunkedIntCoder,
+		use1HitEncoding func(uint64) (bool, uint64, uint64)) error
+}
+
+// directTermWriter writes the postings straight to the new segment, and
+// adds the terms to the field's vellum and top terms
+type directTermWriter struct {
+	w                 *countHashWriter
+	newVellum         *vellum.Builder
+	bufMaxVarintLen64 []byte
+	topTerms          *topTermsCollector
+}
+
+func (d *directTermWriter) writeTerm(term []byte, postings *roaring.Bitmap, tfEncoder, locEncoder *chunkedIntCoder,
+	use1HitEncoding func(uint64) (bool, uint64, uint64)) error {
+	d.topTerms.add(term, postings.GetCardinality())
+	postingsOffset, err := writePostings(postings,
+		tfEncoder, locEncoder, use1HitEncoding, d.w, d.bufMaxVarintLen64)
+	if err != nil {
+		return err
+	}
+
+	if postingsOffset > 0 {
+		err = d.newVellum.Insert(term, postingsOffset)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func writeDvLocs(w *countHashWriter, bufMaxVarintLen64 []byte, fieldDvLocsStart, fieldDvLocsEnd []uint64) (uint64, error) {
 	fieldDvLocsOffset := uint64(w.Count())
 
@@ -557,13 +725,13 @@ const numUintsLocation = 4
 
 func mergeTermFreqNormLocs(fieldsMap map[string]uint16, postItr *PostingsIterator,
 	newDocNums []uint64, newRoaring *roaring.Bitmap,
-	tfEncoder, locEncoder *chunkedIntCoder, bufLoc []uint64, docTracking *roaring.Bitmap) (
-	lastDocNum, lastFreq, lastNorm uint64, bufLocOut []uint64, err error) {
+	tfEncoder, locEncoder *chunkedIntCoder, docTracking *roaring.Bitmap) (
+	lastDocNum, lastFreq, lastNorm uint64, err error) {
 	next, err := postItr.Next()
 	for next != nil && err == nil {
 		hitNewDocNum := newDocNums[next.Number()]
 		if hitNewDocNum == docDropped {
-			return 0, 0, 0, nil, fmt.Errorf("see hit with dropped docNum")
+			return 0, 0, 0, fmt.Errorf("see hit with dropped docNum")
 		}
 
 		newRoaring.Add(uint32(hitNewDocNum))
@@ -577,33 +745,26 @@ func mergeTermFreqNormLocs(fieldsMap map[string]uint16, postItr *PostingsIterato
 		err = tfEncoder.Add(hitNewDocNum,
 			encodeFreqHasLocs(uint64(nextFreq), len(locs) > 0), nextNorm)
 		if err != nil {
-			return 0, 0, 0, nil, err
+			return 0, 0, 0, err
 		}
 
 		if len(locs) > 0 {
 			numBytesLocs := 0
 			for _, loc := range locs {
-				numBytesLocs += totalUvarintBytes(uint64(fieldsMap[loc.Field()]-1),
-					uint64(loc.Pos()), uint64(loc.Start()), uint64(loc.End()))
+				numBytesLocs += locEncoder.locationLen(uint64(fieldsMap[loc.Field()]-1),
+					uint64(loc.Pos()), uint64(loc.Start()), uint64(loc.End()), locationPayload(loc))
 			}
 
 			err = locEncoder.Add(hitNewDocNum, uint64(numBytesLocs))
 			if err != nil {
-				return 0, 0, 0, nil, err
+				return 0, 0, 0, err
 			}
 
 			for _, loc := range locs {
-				if cap(bufLoc) < numUintsLocation {
-					bufLoc = make([]uint64, 0, numUintsLocation)
-				}
-				args := bufLoc[0:4]
-				args[0] = uint64(fieldsMap[loc.Field()] - 1)
-				args[1] = uint64(loc.Pos())
-				args[2] = uint64(loc.Start())
-				args[3] = uint64(loc.End())
-				err = locEncoder.Add(hitNewDocNum, args...)
+				err = addLocation(locEncoder, hitNewDocNum, uint64(fieldsMap[loc.Field()]-1),
+					uint64(loc.Pos()), uint64(loc.Start()), uint64(loc.End()), locationPayload(loc))
 				if err != nil {
-					return 0, 0, 0, nil, err
+					return 0, 0, 0, err
 				}
 			}
 		}
@@ -615,12 +776,12 @@ func mergeTermFreqNormLocs(fieldsMap map[string]uint16, postItr *PostingsIterato
 		next, err = postItr.Next()
 	}
 
-	return lastDocNum, lastFreq, lastNorm, bufLoc, err
+	return lastDocNum, lastFreq, lastNorm, err
 }
 
 func mergeStoredAndRemap(segments []*Segment, drops []*roaring.Bitmap,
 	fieldsMap map[string]uint16, fieldsInv []string, fieldsSame bool, newSegDocCount uint64,
-	w *countHashWriter, closeCh chan struct{}) (storedIndexOffset uint64, newDocNums [][]uint64, err error) {
+	opts options, w *countHashWriter, closeCh chan struct{}) (storedIndexOffset uint64, newDocNums [][]uint64, err error) {
 	var newDocNum uint64
 
 	var data []byte
@@ -639,7 +800,8 @@ func mergeStoredAndRemap(segments []*Segment, drops []*roaring.Bitmap,
 	defer visitDocumentCtxPool.Put(vdc)
 
 	// document chunk coder
-	docChunkCoder := newChunkedDocumentCoder(uint64(defaultDocumentChunkSize), w)
+	docChunkCoder := newChunkedDocumentCoder(uint64(opts.storedChunkDocs), uint64(opts.storedChunkBytes),
+		uint64(opts.storedLargeValues), opts.storedCodec, w)
 
 	// for each segment
 	for segI, seg := range segments {
@@ -648,14 +810,21 @@ func mergeStoredAndRemap(segments []*Segment, drops []*roaring.Bitmap,
 			return 0, nil, segment.ErrClosed
 		}
 
+		err = seg.loadStoredIndexOnce()
+		if err != nil {
+			return 0, nil, err
+		}
+
 		segNewDocNums := make([]uint64, seg.footer.numDocs)
 
 		dropsI := drops[segI]
 
 		// optimize when the field mapping is the same across all
-		// segments and there are no deletions, via byte-copying
-		// of stored docs bytes directly to the writer
-		if fieldsSame && (dropsI == nil || dropsI.GetCardinality() == 0) {
+		// segments, there are no deletions and the stored docs can be
+		// copied, via byte-copying of stored docs bytes directly to the
+		// writer
+		if fieldsSame && (dropsI == nil || dropsI.GetCardinality() == 0) &&
+			seg.storedDocsCopyable(uint64(opts.storedLargeValues)) {
 			err := seg.copyStoredDocs(newDocNum, docNumOffsets, docChunkCoder)
 			if err != nil {
 				return 0, nil, err
@@ -680,23 +849,87 @@ func mergeStoredAndRemap(segments []*Segment, drops []*roaring.Bitmap,
 		newDocNums = append(newDocNums, segNewDocNums)
 	}
 
+	storedIndexOffset, err = writeStoredIndex(docChunkCoder, docNumOffsets, w)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return storedIndexOffset, newDocNums, nil
+}
+
+// mergeStoredSorted writes out the stored fields of the documents in the
+// order of their new doc numbers, returning the start of the stored index
+func mergeStoredSorted(segments []*Segment, newDocNums [][]uint64,
+	fieldsMap map[string]uint16, fieldsInv []string, newSegDocCount uint64,
+	opts options, w *countHashWriter, closeCh chan struct{}) (storedIndexOffset uint64, err error) {
+	var data []byte
+	var metaBuf bytes.Buffer
+	varBuf := make([]byte, binary.MaxVarintLen64)
+	metaEncode := func(val uint64) (int, error) {
+		wb := binary.PutUvarint(varBuf, val)
+		return metaBuf.Write(varBuf[:wb])
+	}
+
+	vals := make([][][]byte, len(fieldsInv))
+
+	docNumOffsets := make([]uint64, newSegDocCount)
+
+	vdc := visitDocumentCtxPool.Get().(*visitDocumentCtx)
+	defer visitDocumentCtxPool.Put(vdc)
+
+	// document chunk coder
+	docChunkCoder := newChunkedDocumentCoder(uint64(opts.storedChunkDocs), uint64(opts.storedChunkBytes),
+		uint64(opts.storedLargeValues), opts.storedCodec, w)
+
+	// find the segment and doc num of each new doc num
+	oldSegs := make([]int, newSegDocCount)
+	oldDocNums := make([]uint64, newSegDocCount)
+	for segI, segNewDocNums := range newDocNums {
+		for docNum, newDocNum := range segNewDocNums {
+			if newDocNum != docDropped {
+				oldSegs[newDocNum] = segI
+				oldDocNums[newDocNum] = uint64(docNum)
+			}
+		}
+	}
+
+	for newDocNum := uint64(0); newDocNum < newSegDocCount; newDocNum++ {
+		// check for the closure in meantime
+		if newDocNum%uint64(defaultDocumentChunkSize) == 0 && isClosed(closeCh) {
+			return 0, segment.ErrClosed
+		}
+
+		data, err = mergeStoredDoc(segments[oldSegs[newDocNum]], oldDocNums[newDocNum], newDocNum,
+			&metaBuf, data, fieldsInv, vals, vdc, fieldsMap, metaEncode, docNumOffsets, docChunkCoder)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return writeStoredIndex(docChunkCoder, docNumOffsets, w)
+}
+
+// writeStoredIndex finishes the stored documents and writes out the offset
+// of each, returning where the offsets start
+func writeStoredIndex(docChunkCoder *chunkedDocumentCoder, docNumOffsets []uint64,
+	w *countHashWriter) (uint64, error) {
 	// document chunk coder
 	if err := docChunkCoder.Write(); err != nil {
-		return 0, nil, err
+		return 0, err
 	}
 
 	// return value is the start of the stored index
-	storedIndexOffset = uint64(w.Count())
+	storedIndexOffset := uint64(w.Count())
 
 	// now write out the stored doc index
 	for _, docNumOffset := range docNumOffsets {
 		err := binary.Write(w, binary.BigEndian, docNumOffset)
 		if err != nil {
-			return 0, nil, err
+			return 0, err
 		}
 	}
 
-	return storedIndexOffset, newDocNums, nil
+	return storedIndexOffset, nil
 }
 
 func mergeStoredAndRemapSegment(seg *Segment, dropsI *roaring.Bitmap, segNewDocNums []uint64, newDocNum uint64,
@@ -713,47 +946,72 @@ func mergeStoredAndRemapSegment(seg *Segment, dropsI *roaring.Bitmap, segNewDocN
 
 		segNewDocNums[docNum] = newDocNum
 
-		curr := 0
-		metaBuf.Reset()
-		data = data[:0]
-
-		// collect all the data
-		for i := 0; i < len(fieldsInv); i++ {
-			vals[i] = vals[i][:0]
-		}
-		err := seg.visitDocument(vdc, docNum, func(field string, value []byte) bool {
-			fieldID := int(fieldsMap[field]) - 1
-			vals[fieldID] = append(vals[fieldID], value)
-			return true
-		})
+		var err error
+		data, err = mergeStoredDoc(seg, docNum, newDocNum, metaBuf, data, fieldsInv, vals, vdc, fieldsMap,
+			metaEncode, docNumOffsets, docChunkCoder)
 		if err != nil {
 			return 0, err
 		}
 
-		// now walk the fields in order
-		for fieldID := 0; fieldID < len(fieldsInv); fieldID++ {
-			storedFieldValues := vals[fieldID]
+		newDocNum++
+	}
+	return newDocNum, nil
+}
 
-			var err2 error
-			curr, data, err2 = encodeStoredFieldValues(fieldID,
-				storedFieldValues, curr, metaEncode, data)
-			if err2 != nil {
-				return 0, err2
-			}
-		}
+// mergeStoredDoc re-encodes the stored fields of a document with the
+// new field ids, adding it to the new segment as newDocNum
+func mergeStoredDoc(seg *Segment, docNum, newDocNum uint64,
+	metaBuf *bytes.Buffer, data []byte, fieldsInv []string, vals [][][]byte, vdc *visitDocumentCtx,
+	fieldsMap map[string]uint16, metaEncode func(val uint64) (int, error), docNumOffsets []uint64,
+	docChunkCoder *chunkedDocumentCoder) ([]byte, error) {
+	curr := 0
+	metaBuf.Reset()
+	data = data[:0]
+
+	// collect all the data
+	for i := 0; i < len(fieldsInv); i++ {
+		vals[i] = vals[i][:0]
+	}
+	err := seg.visitDocument(vdc, docNum, func(field string, value []byte) bool {
+		fieldID := int(fieldsMap[field]) - 1
+		vals[fieldID] = append(vals[fieldID], value)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		metaBytes := metaBuf.Bytes()
+	// now walk the fields in order
+	for fieldID := 0; fieldID < len(fieldsInv); fieldID++ {
+		storedFieldValues := vals[fieldID]
 
-		// record where we're about to start writing
-		docNumOffsets[newDocNum] = docChunkCoder.Size()
-		// document chunk line
-		if _, err := docChunkCoder.Add(newDocNum, metaBytes, data); err != nil {
-			return 0, err
+		var err2 error
+		curr, data, err2 = encodeStoredFieldValues(fieldID,
+			storedFieldValues, curr, metaEncode, data, docChunkCoder)
+		if err2 != nil {
+			return nil, err2
 		}
+	}
 
-		newDocNum++
+	metaBytes := metaBuf.Bytes()
+
+	// record where we're about to start writing
+	docNumOffsets[newDocNum] = docChunkCoder.Size()
+	// document chunk line
+	if _, err := docChunkCoder.Add(newDocNum, metaBytes, data); err != nil {
+		return nil, err
 	}
-	return newDocNum, nil
+	return data, nil
+}
+
+// storedDocsCopyable returns whether the chunks of stored fields can be
+// copied to a segment with the large value threshold: they must have the
+// current layout, refer to no large value, and hold no value the threshold
+// would make large
+func (s *Segment) storedDocsCopyable(largeThreshold uint64) bool {
+	return s.footer.format().storedLayout() == currentFormat.storedLayout() &&
+		s.storedLargeLen == 0 &&
+		(largeThreshold == 0 || (s.storedLargeThreshold > 0 && s.storedLargeThreshold <= largeThreshold))
 }
 
 // copyStoredDocs writes out a segment's stored doc info, optimized by
@@ -776,7 +1034,7 @@ func (s *Segment) copyStoredDocs(newDocNum uint64, newDocNumOffsets []uint64, do
 		if err != nil {
 			return err
 		}
-		uncompressed, err = ZSTDDecompress(uncompressed[:cap(uncompressed)], compressed)
+		uncompressed, err = s.decompressStored(uncompressed[:cap(uncompressed)], compressed)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,354 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/blevesearch/vellum"
+)
+
+// mergedField holds a field merged by a worker, ready to be written out
+// once the fields before it have been written
+type mergedField struct {
+	terms        bufferedTermWriter
+	docValues    bytes.Buffer
+	hasDocValues bool
+	reverseTerms bool
+	fieldDocs    uint64
+	fieldFreqs   uint64
+	err          error
+}
+
+// persistMergedRestParallel is persistMergedRest with the fields merged
+// concurrently by opts.mergeWorkers workers.  The postings of a term
+// reference absolute offsets in the segment, so a worker buffers the
+// encoded sections of each term, and the fields are then written in order,
+// building each field's vellum as they are, which gives the same segment
+// as merging the fields serially.
+func persistMergedRestParallel(segments []*Segment, dropsIn []*roaring.Bitmap,
+	fieldsInv []string, fieldsMap map[string]uint16,
+	newDocNumsIn [][]uint64, newSegDocCount uint64, opts options,
+	w *countHashWriter, closeCh chan struct{}) (dictLocs []uint64, fieldDocs,
+	fieldFreqs map[uint16]uint64, docValueOffset uint64, err error) {
+	results := make([]chan *mergedField, len(fieldsInv))
+	for i := range results {
+		results[i] = make(chan *mergedField, 1)
+	}
+
+	// limits how many fields are merged or waiting to be written
+	window := make(chan struct{}, 2*opts.mergeWorkers)
+	work := make(chan int)
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(work)
+		for fieldID := range fieldsInv {
+			select {
+			case window <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case work <- fieldID:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < opts.mergeWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m := newFieldMerger(newSegDocCount, opts.topTerms)
+			for fieldID := range work {
+				results[fieldID] <- m.mergeField(segments, dropsIn, fieldsMap, newDocNumsIn,
+					newSegDocCount, opts, closeCh, fieldsInv[fieldID], fieldID)
+			}
+		}()
+	}
+
+	var bufMaxVarintLen64 = make([]byte, binary.MaxVarintLen64)
+
+	dictLocs = make([]uint64, len(fieldsInv))
+	fieldDvLocsStart := make([]uint64, len(fieldsInv))
+	fieldDvLocsEnd := make([]uint64, len(fieldsInv))
+
+	var vellumBuf bytes.Buffer
+	newVellum, err := vellum.New(&vellumBuf, nil)
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+
+	fieldDocs = map[uint16]uint64{}
+	fieldFreqs = map[uint16]uint64{}
+
+	for fieldID := range fieldsInv {
+		mf := <-results[fieldID]
+		if mf.err != nil {
+			return nil, nil, nil, 0, mf.err
+		}
+
+		err = mf.terms.replay(w, newVellum, bufMaxVarintLen64)
+		if err != nil {
+			return nil, nil, nil, 0, err
+		}
+
+		err = writeMergedDict(w, newVellum, &vellumBuf, mf.terms.topTerms, mf.reverseTerms, bufMaxVarintLen64,
+			fieldID, dictLocs)
+		if err != nil {
+			return nil, nil, nil, 0, err
+		}
+
+		if mf.hasDocValues {
+			fieldDvLocsStart[fieldID] = uint64(w.Count())
+			_, err = w.Write(mf.docValues.Bytes())
+			if err != nil {
+				return nil, nil, nil, 0, err
+			}
+			fieldDvLocsEnd[fieldID] = uint64(w.Count())
+		} else {
+			fieldDvLocsStart[fieldID] = fieldNotUninverted
+			fieldDvLocsEnd[fieldID] = fieldNotUninverted
+		}
+
+		// reset vellum buffer and vellum builder
+		vellumBuf.Reset()
+		err = newVellum.Reset(&vellumBuf)
+		if err != nil {
+			return nil, nil, nil, 0, err
+		}
+
+		fieldDocs[uint16(fieldID)] = mf.fieldDocs
+		fieldFreqs[uint16(fieldID)] = mf.fieldFreqs
+
+		<-window
+	}
+
+	docValueOffset, err = writeDvLocs(w, bufMaxVarintLen64, fieldDvLocsStart, fieldDvLocsEnd)
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+
+	return dictLocs, fieldDocs, fieldFreqs, docValueOffset, nil
+}
+
+// fieldMerger holds the state reused by a worker across the fields it merges
+type fieldMerger struct {
+	tfEncoder        *chunkedIntCoder
+	locEncoder       *chunkedIntCoder
+	newRoaring       *roaring.Bitmap
+	fieldDocTracking *roaring.Bitmap
+	fieldFreqs       map[uint16]uint64
+	topTerms         int
+}
+
+func newFieldMerger(newSegDocCount uint64, topTerms int) *fieldMerger {
+	// these int coders are initialized with chunk size 1024
+	// however this will be reset to the correct chunk size
+	// while processing each individual field-term section
+	locEncoder := newChunkedIntCoder(uint64(legacyChunkMode), newSegDocCount-1)
+	return &fieldMerger{
+		tfEncoder:        newChunkedFreqNormCoder(uint64(legacyChunkMode), newSegDocCount-1, locEncoder),
+		locEncoder:       locEncoder,
+		newRoaring:       roaring.NewBitmap(),
+		fieldDocTracking: roaring.NewBitmap(),
+		fieldFreqs:       map[uint16]uint64{},
+		topTerms:         topTerms,
+	}
+}
+
+func (m *fieldMerger) mergeField(segments []*Segment, dropsIn []*roaring.Bitmap, fieldsMap map[string]uint16,
+	newDocNumsIn [][]uint64, newSegDocCount uint64, opts options, closeCh chan struct{},
+	fieldName string, fieldID int) *mergedField {
+	sorted := len(opts.sort) > 0
+	rv := &mergedField{}
+	rv.terms.topTerms = newTopTermsCollector(m.topTerms)
+
+	segmentsInFocus, newDocNums, err := persistMergedRestField(segments, dropsIn, fieldsMap, newDocNumsIn,
+		newSegDocCount, opts.chunkMode, sorted, closeCh, fieldName, m.newRoaring, m.fieldDocTracking, m.tfEncoder,
+		m.locEncoder, m.fieldFreqs, fieldID, &rv.terms)
+	if err != nil {
+		rv.err = err
+		return rv
+	}
+
+	// doc values only hold offsets relative to their start,
+	// so they can be copied to wherever the field is written
+	start, _, err := buildMergedDocVals(newSegDocCount, newCountHashWriter(&rv.docValues), closeCh,
+		fieldName, segmentsInFocus, newDocNums, sorted, opts.docValueChunkMode)
+	if err != nil {
+		rv.err = err
+		return rv
+	}
+	rv.hasDocValues = start != fieldNotUninverted
+
+	rv.reverseTerms, err = mergedReverseTerms(segments, fieldName)
+	if err != nil {
+		rv.err = err
+		return rv
+	}
+
+	rv.fieldDocs = m.fieldDocTracking.GetCardinality()
+	rv.fieldFreqs = m.fieldFreqs[uint16(fieldID)]
+	delete(m.fieldFreqs, uint16(fieldID))
+	return rv
+}
+
+// bufferedTermWriter buffers the encoded sections of the postings of each
+// term, so that a field can be merged before it is known where in the
+// segment it will be written
+type bufferedTermWriter struct {
+	buf               bytes.Buffer
+	terms             []bufferedTerm
+	termsBuf          []byte
+	bufMaxVarintLen64 [binary.MaxVarintLen64]byte
+	topTerms          *topTermsCollector
+}
+
+type bufferedTerm struct {
+	termEnd int // end of the term in termsBuf
+
+	// fstVal is the 1-hit encoded postings, when postingsLen is 0
+	fstVal uint64
+
+	// lengths of the term's freq/norm, location, impacts and roaring
+	// sections in buf
+	tfLen       int
+	locLen      int
+	impactsLen  int
+	postingsLen int
+
+	chunkSize uint64
+}
+
+func (b *bufferedTermWriter) writeTerm(term []byte, postings *roaring.Bitmap, tfEncoder,
+	locEncoder *chunkedIntCoder, use1HitEncoding func(uint64) (bool, uint64, uint64)) error {
+	termCardinality := postings.GetCardinality()
+	if termCardinality <= 0 {
+		return nil
+	}
+	b.topTerms.add(term, termCardinality)
+
+	var bt bufferedTerm
+	encodeAs1Hit, docNum1Hit, normBits1Hit := use1HitEncoding(termCardinality)
+	if encodeAs1Hit {
+		bt.fstVal = fSTValEncode1Hit(docNum1Hit, normBits1Hit)
+	} else {
+		var err error
+		if tfEncoder.FinalSize() > 0 {
+			bt.tfLen, err = tfEncoder.Write(&b.buf)
+			if err != nil {
+				return err
+			}
+		}
+		if locEncoder.FinalSize() > 0 {
+			bt.locLen, err = locEncoder.Write(&b.buf)
+			if err != nil {
+				return err
+			}
+		}
+		if tfEncoder.FinalSize() > 0 {
+			bt.impactsLen, err = tfEncoder.impacts.write(&b.buf, b.bufMaxVarintLen64[:])
+			if err != nil {
+				return err
+			}
+		}
+		bt.postingsLen, err = writeRoaringWithLen(postings, &b.buf, b.bufMaxVarintLen64[:])
+		if err != nil {
+			return err
+		}
+		bt.chunkSize = tfEncoder.chunkSize
+	}
+
+	b.termsBuf = append(b.termsBuf, term...)
+	bt.termEnd = len(b.termsBuf)
+	b.terms = append(b.terms, bt)
+	return nil
+}
+
+// replay writes out the buffered postings the same way writePostings
+// would have, inserting each term into the field's vellum
+func (b *bufferedTermWriter) replay(w *countHashWriter, newVellum *vellum.Builder,
+	bufMaxVarintLen64 []byte) error {
+	data := b.buf.Bytes()
+	var termStart int
+	for _, bt := range b.terms {
+		term := b.termsBuf[termStart:bt.termEnd]
+		termStart = bt.termEnd
+
+		postingsOffset := bt.fstVal
+		if bt.postingsLen > 0 {
+			tfOffset, err := writeEncodedAt(w, data[:bt.tfLen])
+			if err != nil {
+				return err
+			}
+			data = data[bt.tfLen:]
+
+			locOffset, err := writeEncodedAt(w, data[:bt.locLen])
+			if err != nil {
+				return err
+			}
+			data = data[bt.locLen:]
+
+			impactsOffset, err := writeEncodedAt(w, data[:bt.impactsLen])
+			if err != nil {
+				return err
+			}
+			data = data[bt.impactsLen:]
+
+			postingsOffset = uint64(w.Count())
+			err = writePostingsOffsets(tfOffset, locOffset, impactsOffset, bt.chunkSize, w, bufMaxVarintLen64)
+			if err != nil {
+				return err
+			}
+
+			_, err = w.Write(data[:bt.postingsLen])
+			if err != nil {
+				return err
+			}
+			data = data[bt.postingsLen:]
+		}
+
+		err := newVellum.Insert(term, postingsOffset)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEncodedAt writes the output of a chunkedIntCoder, returning where
+// it starts, or termNotEncoded if it is empty, like chunkedIntCoder.writeAt
+func writeEncodedAt(w *countHashWriter, encoded []byte) (uint64, error) {
+	if len(encoded) == 0 {
+		return uint64(termNotEncoded), nil
+	}
+	startOffset := uint64(w.Count())
+	_, err := w.Write(encoded)
+	return startOffset, err
+}
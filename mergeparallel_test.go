@@ -0,0 +1,69 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+func TestMergeParallel(t *testing.T) {
+	segMany, _, err := New(buildTestAnalysisResultsMany(2000), encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segMulti, err := buildTestSegmentMulti()
+	if err != nil {
+		t.Fatal(err)
+	}
+	segDiff, err := buildTestSegmentMultiWithDifferentFields(true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segments := []segment.Segment{segMany, segMulti, segDiff, segMany}
+	drops := []*roaring.Bitmap{roaring.BitmapOf(1, 7, 500), nil, roaring.BitmapOf(0), nil}
+
+	var expected bytes.Buffer
+	_, err = Merge(segments, drops, 1024).WriteTo(&expected, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, workers := range []int{2, 3, 8} {
+		var actual bytes.Buffer
+		merger := MergeWithOptions(segments, drops, 1024, WithMergeWorkers(workers))
+		_, err = merger.WriteTo(&actual, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected.Bytes(), actual.Bytes()) {
+			t.Errorf("%d workers: expected parallel merge to match serial merge", workers)
+		}
+
+		merged, err := load(segment.NewDataBytes(actual.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = merged.Verify(context.Background())
+		if err != nil {
+			t.Errorf("%d workers: expected merged segment to verify, got: %v", workers, err)
+		}
+	}
+}
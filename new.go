@@ -34,11 +34,32 @@ var newSegmentBufferAvgBytesPerDocFactor = 1.0
 // of a segment for the source documents
 func New(results []segment.Document, normCalc func(string, int) float32) (
 	segment.Segment, uint64, error) {
-	return newWithChunkMode(results, normCalc, defaultChunkMode)
+	return newWithOptions(results, normCalc, defaultOptions())
+}
+
+// NewWithOptions is New, with options controlling how the segment is built
+func NewWithOptions(results []segment.Document, normCalc func(string, int) float32,
+	opts ...Option) (segment.Segment, uint64, error) {
+	return newWithOptions(results, normCalc, applyOptions(opts))
 }
 
 func newWithChunkMode(results []segment.Document, normCalc func(string, int) float32,
 	chunkMode uint32) (segment.Segment, uint64, error) {
+	opts := defaultOptions()
+	opts.chunkMode = chunkMode
+	return newWithOptions(results, normCalc, opts)
+}
+
+func newWithOptions(results []segment.Document, normCalc func(string, int) float32,
+	opts options) (segment.Segment, uint64, error) {
+	err := opts.validate()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(opts.sort) > 0 {
+		results = sortDocuments(results, opts.sort)
+	}
+
 	s := interimPool.Get().(*interim)
 
 	s.normCalc = normCalc
@@ -57,22 +78,33 @@ func newWithChunkMode(results []segment.Document, normCalc func(string, int) flo
 	}
 
 	s.results = results
-	s.chunkMode = chunkMode
+	s.chunkMode = opts.chunkMode
+	s.docValueChunkMode = opts.docValueChunkMode
+	s.sort = opts.sort
+	s.storedCodec = opts.storedCodec
+	s.storedChunkDocs = opts.storedChunkDocs
+	s.storedChunkBytes = opts.storedChunkBytes
+	s.storedLargeValues = opts.storedLargeValues
+	s.topTerms = newTopTermsCollector(opts.topTerms)
 	s.w = newCountHashWriter(&br)
 
 	var footer *footer
-	footer, dictOffsets, storedFieldChunkOffsets, err := s.convert()
+	footer, err = s.convert()
 	if err != nil {
 		return nil, uint64(0), err
 	}
-	footer.crc = s.w.Sum32()
-	footer.chunkMode = chunkMode
+	footer.chunkMode = opts.chunkMode
 	footer.numDocs = uint64(len(results))
+	footer.crc, err = footer.fileCRC(s.w.Sum32())
+	if err != nil {
+		return nil, uint64(0), err
+	}
 
-	sb, err := initSegmentBase(br.Bytes(), footer,
-		s.FieldsMap, s.FieldsInv,
-		s.FieldDocs, s.FieldFreqs,
-		dictOffsets, storedFieldChunkOffsets)
+	sb, err := initSegmentBase(br.Bytes(), footer)
+	if err == nil {
+		sb.sort = opts.sort
+		sb.maxExpansions = opts.maxExpansions
+	}
 
 	if err == nil && s.reset() == nil {
 		s.lastNumDocs = len(results)
@@ -83,30 +115,8 @@ func newWithChunkMode(results []segment.Document, normCalc func(string, int) flo
 	return sb, uint64(len(br.Bytes())), err
 }
 
-func initSegmentBase(mem []byte, footer *footer,
-	fieldsMap map[string]uint16, fieldsInv []string,
-	fieldsDocs, fieldsFreqs map[uint16]uint64,
-	dictLocs []uint64, storedFieldChunkOffsets []uint64) (*Segment, error) {
-	sb := &Segment{
-		data:                    segment.NewDataBytes(mem),
-		footer:                  footer,
-		fieldsMap:               fieldsMap,
-		fieldsInv:               fieldsInv,
-		fieldDocs:               fieldsDocs,
-		fieldFreqs:              fieldsFreqs,
-		dictLocs:                dictLocs,
-		fieldDvReaders:          make(map[uint16]*docValueReader),
-		fieldFSTs:               make(map[uint16]*vellum.FST),
-		storedFieldChunkOffsets: storedFieldChunkOffsets,
-	}
-	sb.updateSize()
-
-	err := sb.loadDvReaders()
-	if err != nil {
-		return nil, err
-	}
-
-	return sb, nil
+func initSegmentBase(mem []byte, footer *footer) (*Segment, error) {
+	return newSegment(segment.NewDataBytes(mem), footer)
 }
 
 var interimPool = sync.Pool{New: func() interface{} { return &interim{} }}
@@ -116,7 +126,17 @@ var interimPool = sync.Pool{New: func() interface{} { return &interim{} }}
 type interim struct {
 	results []segment.Document
 
-	chunkMode uint32
+	chunkMode         uint32
+	docValueChunkMode uint32
+
+	sort []SortField
+
+	storedCodec       StoredCodec
+	storedChunkDocs   int
+	storedChunkBytes  int
+	storedLargeValues int
+
+	topTerms *topTermsCollector
 
 	w *countHashWriter
 
@@ -148,6 +168,10 @@ type interim struct {
 	//  field id -> bool
 	IncludeDocValues []bool
 
+	// Fields whose terms are also indexed reversed, see ReverseTermsField
+	//  field id -> bool
+	ReverseTerms []bool
+
 	// postings id -> bitmap of docNums
 	Postings []*roaring.Bitmap
 
@@ -179,6 +203,13 @@ type interim struct {
 func (s *interim) reset() (err error) {
 	s.results = nil
 	s.chunkMode = 0
+	s.docValueChunkMode = 0
+	s.sort = nil
+	s.storedCodec = nil
+	s.storedChunkDocs = 0
+	s.storedChunkBytes = 0
+	s.storedLargeValues = 0
+	s.topTerms = nil
 	s.w = nil
 	s.FieldsMap = nil
 	s.FieldsInv = nil
@@ -194,6 +225,10 @@ func (s *interim) reset() (err error) {
 		s.IncludeDocValues[i] = false
 	}
 	s.IncludeDocValues = s.IncludeDocValues[:0]
+	for i := range s.ReverseTerms {
+		s.ReverseTerms[i] = false
+	}
+	s.ReverseTerms = s.ReverseTerms[:0]
 	for _, idn := range s.Postings {
 		idn.Clear()
 	}
@@ -247,9 +282,10 @@ type interimLoc struct {
 	pos     uint64
 	start   uint64
 	end     uint64
+	payload []byte
 }
 
-func (s *interim) convert() (f *footer, dictOffsets, storedFieldChunkOffsets []uint64, err error) {
+func (s *interim) convert() (f *footer, err error) {
 	s.FieldsMap = map[string]uint16{}
 	s.FieldDocs = map[uint16]uint64{}
 	s.FieldFreqs = map[uint16]uint64{}
@@ -276,6 +312,12 @@ func (s *interim) convert() (f *footer, dictOffsets, storedFieldChunkOffsets []u
 		s.IncludeDocValues = make([]bool, len(s.FieldsInv))
 	}
 
+	if cap(s.ReverseTerms) >= len(s.FieldsInv) {
+		s.ReverseTerms = s.ReverseTerms[:len(s.FieldsInv)]
+	} else {
+		s.ReverseTerms = make([]bool, len(s.FieldsInv))
+	}
+
 	s.prepareDicts()
 
 	for _, dict := range s.DictKeys {
@@ -284,34 +326,59 @@ func (s *interim) convert() (f *footer, dictOffsets, storedFieldChunkOffsets []u
 
 	s.processDocuments()
 
+	numerics, err := s.collectNumerics()
+	if err != nil {
+		return nil, err
+	}
+	sortedSets := s.collectSortedSets()
+
 	var storedIndexOffset uint64
-	storedIndexOffset, storedFieldChunkOffsets, err = s.writeStoredFields()
+	storedIndexOffset, err = s.writeStoredFields()
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
 
 	var fdvIndexOffset uint64
+	var dictOffsets []uint64
 
 	if len(s.results) > 0 {
 		fdvIndexOffset, dictOffsets, err = s.writeDicts()
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, err
 		}
 	} else {
 		dictOffsets = make([]uint64, len(s.FieldsInv))
 	}
 
+	numericOffset, err := persistNumericDocValues(numerics, uint64(len(s.results)), s.w)
+	if err != nil {
+		return nil, err
+	}
+
+	sortedSetOffset, err := persistSortedSetDocValues(sortedSets, uint64(len(s.results)), s.w)
+	if err != nil {
+		return nil, err
+	}
+
+	sortOffset, err := persistSort(s.sort, s.w)
+	if err != nil {
+		return nil, err
+	}
+
 	fieldsIndexOffset, err := persistFields(s.FieldsInv, s.FieldDocs, s.FieldFreqs, s.w, dictOffsets)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
 
 	return &footer{
 		storedIndexOffset: storedIndexOffset,
 		fieldsIndexOffset: fieldsIndexOffset,
 		docValueOffset:    fdvIndexOffset,
+		sortOffset:        sortOffset,
+		numericOffset:     numericOffset,
+		sortedSetOffset:   sortedSetOffset,
 		version:           Version,
-	}, dictOffsets, storedFieldChunkOffsets, nil
+	}, nil
 }
 
 func (s *interim) getOrDefineField(fieldName string) int {
@@ -469,49 +536,10 @@ func (s *interim) processDocuments() {
 func (s *interim) processDocument(docNum uint64,
 	result segment.Document,
 	fieldLens []int, fieldTFs []tokenFrequencies) {
-	visitField := func(field segment.Field) {
+	result.EachField(func(field segment.Field) {
 		fieldID := uint16(s.getOrDefineField(field.Name()))
-		fieldLens[fieldID] += field.Length()
-
-		if existingFreqs := fieldTFs[fieldID]; existingFreqs == nil {
-			fieldTFs[fieldID] = make(map[string]*tokenFreq)
-		}
-
-		existingFreqs := fieldTFs[fieldID]
-		field.EachTerm(func(term segment.FieldTerm) {
-			tfk := string(term.Term())
-			existingTf, exists := existingFreqs[tfk]
-			if exists {
-				term.EachLocation(func(location segment.Location) {
-					existingTf.Locations = append(existingTf.Locations,
-						&tokenLocation{
-							FieldVal:    field.Name(),
-							StartVal:    location.Start(),
-							EndVal:      location.End(),
-							PositionVal: location.Pos(),
-						})
-				})
-				existingTf.frequency += term.Frequency()
-			} else {
-				newTf := &tokenFreq{
-					TermVal:   term.Term(),
-					frequency: term.Frequency(),
-				}
-				term.EachLocation(func(location segment.Location) {
-					newTf.Locations = append(newTf.Locations,
-						&tokenLocation{
-							FieldVal:    location.Field(),
-							StartVal:    location.Start(),
-							EndVal:      location.End(),
-							PositionVal: location.Pos(),
-						})
-				})
-				existingFreqs[tfk] = newTf
-			}
-		})
-	}
-
-	result.EachField(visitField)
+		rollupFieldTerms(field, fieldID, fieldLens, fieldTFs)
+	})
 
 	// now that it's been rolled up into fieldTFs, walk that
 	for fieldID, tfs := range fieldTFs {
@@ -543,6 +571,7 @@ func (s *interim) processDocument(docNum uint64,
 						pos:     uint64(loc.PositionVal),
 						start:   uint64(loc.StartVal),
 						end:     uint64(loc.EndVal),
+						payload: loc.PayloadVal,
 					})
 				}
 
@@ -552,8 +581,81 @@ func (s *interim) processDocument(docNum uint64,
 	}
 }
 
-func (s *interim) writeStoredFields() (
-	storedIndexOffset uint64, storedFieldChunkOffsets []uint64, err error) {
+// collectNumerics collects the numeric doc values of the documents
+func (s *interim) collectNumerics() (map[uint16]*numericColumn, error) {
+	rv := map[uint16]*numericColumn{}
+	var err error
+	for docNum, result := range s.results {
+		result.EachField(func(field segment.Field) {
+			if err == nil {
+				fieldID := s.FieldsMap[field.Name()] - 1
+				err = addNumericField(rv, fieldID, field, uint64(docNum))
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rv, nil
+}
+
+// collectSortedSets collects the sorted-set doc values of the documents
+func (s *interim) collectSortedSets() map[uint16]*sortedSetColumn {
+	rv := map[uint16]*sortedSetColumn{}
+	for docNum, result := range s.results {
+		result.EachField(func(field segment.Field) {
+			addSortedSetField(rv, s.FieldsMap[field.Name()]-1, field, uint64(docNum))
+		})
+	}
+	return rv
+}
+
+// rollupFieldTerms adds the length and terms of a field to the running
+// totals for the document, combining multiple instances of the same field
+func rollupFieldTerms(field segment.Field, fieldID uint16, fieldLens []int, fieldTFs []tokenFrequencies) {
+	fieldLens[fieldID] += field.Length()
+
+	if existingFreqs := fieldTFs[fieldID]; existingFreqs == nil {
+		fieldTFs[fieldID] = make(map[string]*tokenFreq)
+	}
+
+	existingFreqs := fieldTFs[fieldID]
+	field.EachTerm(func(term segment.FieldTerm) {
+		tfk := string(term.Term())
+		existingTf, exists := existingFreqs[tfk]
+		if exists {
+			term.EachLocation(func(location segment.Location) {
+				existingTf.Locations = append(existingTf.Locations,
+					&tokenLocation{
+						FieldVal:    field.Name(),
+						StartVal:    location.Start(),
+						EndVal:      location.End(),
+						PositionVal: location.Pos(),
+						PayloadVal:  locationPayload(location),
+					})
+			})
+			existingTf.frequency += term.Frequency()
+		} else {
+			newTf := &tokenFreq{
+				TermVal:   term.Term(),
+				frequency: term.Frequency(),
+			}
+			term.EachLocation(func(location segment.Location) {
+				newTf.Locations = append(newTf.Locations,
+					&tokenLocation{
+						FieldVal:    location.Field(),
+						StartVal:    location.Start(),
+						EndVal:      location.End(),
+						PositionVal: location.Pos(),
+						PayloadVal:  locationPayload(location),
+					})
+			})
+			existingFreqs[tfk] = newTf
+		}
+	})
+}
+
+func (s *interim) writeStoredFields() (storedIndexOffset uint64, err error) {
 	varBuf := make([]byte, binary.MaxVarintLen64)
 	metaEncode := func(val uint64) (int, error) {
 		wb := binary.PutUvarint(varBuf, val)
@@ -570,7 +672,8 @@ func (s *interim) writeStoredFields() (
 	docStoredFields := map[uint16]interimStoredField{}
 
 	// document chunk coder
-	docChunkCoder := newChunkedDocumentCoder(uint64(defaultDocumentChunkSize), s.w)
+	docChunkCoder := newChunkedDocumentCoder(uint64(s.storedChunkDocs), uint64(s.storedChunkBytes),
+		uint64(s.storedLargeValues), s.storedCodec, s.w)
 
 	for docNum, result := range s.results {
 		for fieldID := range docStoredFields { // reset for next doc
@@ -589,6 +692,10 @@ func (s *interim) writeStoredFields() (
 			if field.IndexDocValues() {
 				s.IncludeDocValues[fieldID] = true
 			}
+
+			if indexesReverseTerms(field) {
+				s.ReverseTerms[fieldID] = true
+			}
 		})
 
 		var curr int
@@ -602,9 +709,9 @@ func (s *interim) writeStoredFields() (
 			if exists {
 				curr, data, err = encodeStoredFieldValues(
 					fieldID, isf.vals,
-					curr, metaEncode, data)
+					curr, metaEncode, data, docChunkCoder)
 				if err != nil {
-					return 0, nil, err
+					return 0, err
 				}
 			}
 		}
@@ -613,27 +720,25 @@ func (s *interim) writeStoredFields() (
 		docStoredOffsets[docNum] = docChunkCoder.Size()
 		_, err = docChunkCoder.Add(uint64(docNum), metaBytes, data)
 		if err != nil {
-			return 0, nil, err
+			return 0, err
 		}
 	}
 
 	// document chunk coder
 	err = docChunkCoder.Write()
 	if err != nil {
-		return 0, nil, err
+		return 0, err
 	}
-	storedFieldChunkOffsets = docChunkCoder.Offsets()
-
 	storedIndexOffset = uint64(s.w.Count())
 
 	for _, docStoredOffset := range docStoredOffsets {
 		err = binary.Write(s.w, binary.BigEndian, docStoredOffset)
 		if err != nil {
-			return 0, nil, err
+			return 0, err
 		}
 	}
 
-	return storedIndexOffset, storedFieldChunkOffsets, nil
+	return storedIndexOffset, nil
 }
 
 func (s *interim) writeDicts() (fdvIndexOffset uint64, dictOffsets []uint64, err error) {
@@ -647,8 +752,8 @@ func (s *interim) writeDicts() (fdvIndexOffset uint64, dictOffsets []uint64, err
 	// these int coders are initialized with chunk size 1024
 	// however this will be reset to the correct chunk size
 	// while processing each individual field-term section
-	tfEncoder := newChunkedIntCoder(uint64(legacyChunkMode), uint64(len(s.results)-1))
 	locEncoder := newChunkedIntCoder(uint64(legacyChunkMode), uint64(len(s.results)-1))
+	tfEncoder := newChunkedFreqNormCoder(uint64(legacyChunkMode), uint64(len(s.results)-1), locEncoder)
 
 	var docTermMap [][]byte
 
@@ -666,19 +771,9 @@ func (s *interim) writeDicts() (fdvIndexOffset uint64, dictOffsets []uint64, err
 		}
 	}
 
-	fdvIndexOffset = uint64(s.w.Count())
-
-	for i := 0; i < len(fdvOffsetsStart); i++ {
-		n := binary.PutUvarint(buf, fdvOffsetsStart[i])
-		_, err := s.w.Write(buf[:n])
-		if err != nil {
-			return 0, nil, err
-		}
-		n = binary.PutUvarint(buf, fdvOffsetsEnd[i])
-		_, err = s.w.Write(buf[:n])
-		if err != nil {
-			return 0, nil, err
-		}
+	fdvIndexOffset, err = writeDvLocs(s.w, buf, fdvOffsetsStart, fdvOffsetsEnd)
+	if err != nil {
+		return 0, nil, err
 	}
 
 	return fdvIndexOffset, dictOffsets, nil
@@ -704,93 +799,143 @@ func (s *interim) writeDictsField(docTermMap [][]byte, fieldID int, terms []stri
 		}
 	}
 
-	err := s.builder.Close()
+	var err error
+	dictOffsets[fieldID], err = writeFieldDict(s.w, s.builder, &s.builderBuf, s.topTerms,
+		s.ReverseTerms[fieldID], buf)
 	if err != nil {
 		return err
 	}
 
+	if s.IncludeDocValues[fieldID] {
+		fdvOffsetsStart[fieldID], fdvOffsetsEnd[fieldID], err =
+			writeFieldDocValues(s.w, docTermMap, uint64(len(s.results)), s.docValueChunkMode)
+		if err != nil {
+			return err
+		}
+	} else {
+		fdvOffsetsStart[fieldID] = fieldNotUninverted
+		fdvOffsetsEnd[fieldID] = fieldNotUninverted
+	}
+	return nil
+}
+
+// writeFieldDict writes out the vellum FST which has been built for a field,
+// followed by its top terms and, if reverse, its reversed terms, returning
+// where it starts, and then resets the builder and the top terms for reuse
+func writeFieldDict(w *countHashWriter, builder *vellum.Builder, builderBuf *bytes.Buffer,
+	topTerms *topTermsCollector, reverse bool, buf []byte) (dictOffset uint64, err error) {
+	err = builder.Close()
+	if err != nil {
+		return 0, err
+	}
+
 	// record where this dictionary starts
-	dictOffsets[fieldID] = uint64(s.w.Count())
+	dictOffset = uint64(w.Count())
 
-	vellumData := s.builderBuf.Bytes()
+	vellumData := builderBuf.Bytes()
 
 	// write out the length of the vellum data
 	n := binary.PutUvarint(buf, uint64(len(vellumData)))
-	_, err = s.w.Write(buf[:n])
+	_, err = w.Write(buf[:n])
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// write this vellum to disk
-	_, err = s.w.Write(vellumData)
+	_, err = w.Write(vellumData)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	// reset vellum for reuse
-	s.builderBuf.Reset()
+	err = topTerms.write(w, buf)
+	if err != nil {
+		return 0, err
+	}
 
-	err = s.builder.Reset(&s.builderBuf)
+	err = writeReverseDict(w, vellumData, reverse, buf)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	// write the field doc values
-	// NOTE: doc values continue to use legacy chunk mode
-	chunkSize, err := getChunkSize(legacyChunkMode, 0, 0)
+	// reset vellum for reuse
+	builderBuf.Reset()
+
+	err = builder.Reset(builderBuf)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	fdvEncoder := newChunkedContentCoder(chunkSize, uint64(len(s.results)-1), s.w, false)
-	if s.IncludeDocValues[fieldID] {
-		for docNum, docTerms := range docTermMap {
-			if len(docTerms) > 0 {
-				err = fdvEncoder.Add(uint64(docNum), docTerms)
-				if err != nil {
-					return err
-				}
-			}
-		}
-		err = fdvEncoder.Close()
-		if err != nil {
-			return err
-		}
 
-		fdvOffsetsStart[fieldID] = uint64(s.w.Count())
+	return dictOffset, nil
+}
 
-		_, err = fdvEncoder.Write()
-		if err != nil {
-			return err
+// writeFieldDocValues writes out the doc values of a field, from the
+// separated terms collected for each document, in chunks of the chunk mode
+func writeFieldDocValues(w *countHashWriter, docTermMap [][]byte, numDocs uint64, chunkMode uint32) (
+	start, end uint64, err error) {
+	var cardinality, bytes uint64
+	for _, docTerms := range docTermMap {
+		if len(docTerms) > 0 {
+			cardinality++
+			bytes += uint64(len(docTerms))
 		}
+	}
+	chunkSize, err := chunkSizeFor(chunkMode, cardinality, bytes, numDocs)
+	if err != nil {
+		return 0, 0, err
+	}
+	fdvEncoder := newChunkedContentCoder(chunkSize, numDocs-1, w, false)
+	for docNum, docTerms := range docTermMap {
+		if len(docTerms) > 0 {
+			err = fdvEncoder.Add(uint64(docNum), docTerms)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	err = fdvEncoder.Close()
+	if err != nil {
+		return 0, 0, err
+	}
 
-		fdvOffsetsEnd[fieldID] = uint64(s.w.Count())
+	start = uint64(w.Count())
 
-		fdvEncoder.Reset()
-	} else {
-		fdvOffsetsStart[fieldID] = fieldNotUninverted
-		fdvOffsetsEnd[fieldID] = fieldNotUninverted
+	_, err = fdvEncoder.Write()
+	if err != nil {
+		return 0, 0, err
 	}
-	return nil
+
+	return start, uint64(w.Count()), nil
 }
 
 func (s *interim) writeDictsTermField(docTermMap [][]byte, dict map[string]uint64, term string, tfEncoder,
 	locEncoder *chunkedIntCoder, buf []byte) error {
 	pid := dict[term] - 1
+	s.topTerms.add([]byte(term), s.Postings[pid].GetCardinality())
+	return writeTermPostings(s.w, s.builder, s.chunkMode, uint64(len(s.results)), term,
+		s.Postings[pid], s.FreqNorms[pid], s.Locs[pid], tfEncoder, locEncoder, buf, docTermMap)
+}
 
-	postingsBS := s.Postings[pid]
-
-	freqNorms := s.FreqNorms[pid]
+// writeTermPostings encodes the postings list, freq/norms and locations
+// of a term and adds the term to the field's dictionary builder, the
+// docTermMap (if not nil) is updated with the term for each document
+func writeTermPostings(w *countHashWriter, builder *vellum.Builder, chunkMode uint32, numDocs uint64,
+	term string, postingsBS *roaring.Bitmap, freqNorms []interimFreqNorm, locs []interimLoc,
+	tfEncoder, locEncoder *chunkedIntCoder, buf []byte, docTermMap [][]byte) error {
 	freqNormOffset := 0
-
-	locs := s.Locs[pid]
 	locOffset := 0
 
-	chunkSize, err := getChunkSize(s.chunkMode, postingsBS.GetCardinality(), uint64(len(s.results)))
+	var bytes uint64
+	if chunkTargetBytes(chunkMode) > 0 {
+		bytes = interimPostingsBytes(freqNorms, locs)
+	}
+	chunkSize, err := chunkSizeFor(chunkMode, postingsBS.GetCardinality(), bytes, numDocs)
 	if err != nil {
 		return err
 	}
-	tfEncoder.SetChunkSize(chunkSize, uint64(len(s.results)-1))
-	locEncoder.SetChunkSize(chunkSize, uint64(len(s.results)-1))
+	tfEncoder.SetChunkSize(chunkSize, numDocs-1)
+	locEncoder.SetChunkSize(chunkSize, numDocs-1)
+	tfEncoder.SetPacked(packedChunks(chunkMode))
+	locEncoder.SetPacked(packedChunks(chunkMode))
 
 	postingsItr := postingsBS.Iterator()
 	for postingsItr.HasNext() {
@@ -808,8 +953,8 @@ func (s *interim) writeDictsTermField(docTermMap [][]byte, dict map[string]uint6
 		if freqNorm.numLocs > 0 {
 			numBytesLocs := 0
 			for _, loc := range locs[locOffset : locOffset+freqNorm.numLocs] {
-				numBytesLocs += totalUvarintBytes(
-					uint64(loc.fieldID), loc.pos, loc.start, loc.end)
+				numBytesLocs += locEncoder.locationLen(
+					uint64(loc.fieldID), loc.pos, loc.start, loc.end, loc.payload)
 			}
 
 			err = locEncoder.Add(docNum, uint64(numBytesLocs))
@@ -818,8 +963,8 @@ func (s *interim) writeDictsTermField(docTermMap [][]byte, dict map[string]uint6
 			}
 
 			for _, loc := range locs[locOffset : locOffset+freqNorm.numLocs] {
-				err = locEncoder.Add(docNum,
-					uint64(loc.fieldID), loc.pos, loc.start, loc.end)
+				err = addLocation(locEncoder, docNum,
+					uint64(loc.fieldID), loc.pos, loc.start, loc.end, loc.payload)
 				if err != nil {
 					return err
 				}
@@ -830,9 +975,11 @@ func (s *interim) writeDictsTermField(docTermMap [][]byte, dict map[string]uint6
 
 		freqNormOffset++
 
-		docTermMap[docNum] = append(
-			append(docTermMap[docNum], term...),
-			termSeparator)
+		if docTermMap != nil {
+			docTermMap[docNum] = append(
+				append(docTermMap[docNum], term...),
+				termSeparator)
+		}
 	}
 
 	tfEncoder.Close()
@@ -840,13 +987,13 @@ func (s *interim) writeDictsTermField(docTermMap [][]byte, dict map[string]uint6
 
 	var postingsOffset uint64
 	postingsOffset, err =
-		writePostings(postingsBS, tfEncoder, locEncoder, nil, s.w, buf)
+		writePostings(postingsBS, tfEncoder, locEncoder, nil, w, buf)
 	if err != nil {
 		return err
 	}
 
 	if postingsOffset > uint64(0) {
-		err = s.builder.Insert([]byte(term), postingsOffset)
+		err = builder.Insert([]byte(term), postingsOffset)
 		if err != nil {
 			return err
 		}
@@ -856,3 +1003,18 @@ func (s *interim) writeDictsTermField(docTermMap [][]byte, dict map[string]uint6
 	locEncoder.Reset()
 	return nil
 }
+
+// interimPostingsBytes returns the postingBytes of the freq/norms and
+// locations of a term
+func interimPostingsBytes(freqNorms []interimFreqNorm, locs []interimLoc) uint64 {
+	var rv uint64
+	for _, freqNorm := range freqNorms {
+		locBytes := 0
+		for _, loc := range locs[:freqNorm.numLocs] {
+			locBytes += locationBytes(uint64(loc.fieldID), loc.pos, loc.start, loc.end, loc.payload)
+		}
+		locs = locs[freqNorm.numLocs:]
+		rv += postingBytes(freqNorm.freq, uint64(math.Float32bits(freqNorm.norm)), locBytes)
+	}
+	return rv
+}
@@ -0,0 +1,643 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/RoaringBitmap/roaring"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+// NumericType is the type of the values of a field's numeric doc values
+type NumericType uint8
+
+const (
+	// NumericInt64 values are stored as they are
+	NumericInt64 NumericType = iota + 1
+	// NumericFloat64 values are stored as returned by Float64ToSortableInt64
+	NumericFloat64
+	// NumericDate values are stored as nanoseconds since the unix epoch
+	NumericDate
+)
+
+func (t NumericType) String() string {
+	switch t {
+	case NumericInt64:
+		return "int64"
+	case NumericFloat64:
+		return "float64"
+	case NumericDate:
+		return "date"
+	}
+	return fmt.Sprintf("NumericType(%d)", uint8(t))
+}
+
+// NumericField is implemented by fields with a numeric value.  When such a
+// field indexes doc values, its value is also stored as numeric doc values,
+// column-wise, see Segment.NumericDocValues.  A document keeps the first
+// value of a field when it has more than one.
+type NumericField interface {
+	segment.Field
+
+	// NumericType returns the type of the value
+	NumericType() NumericType
+
+	// NumericValue returns the value, represented as described by its type
+	NumericValue() int64
+}
+
+// Float64ToSortableInt64 returns an int64 ordered the same way as the
+// float64, for use as the value of a NumericFloat64 field
+func Float64ToSortableInt64(f float64) int64 {
+	i := int64(math.Float64bits(f))
+	if i < 0 {
+		i ^= math.MaxInt64
+	}
+	return i
+}
+
+// SortableInt64ToFloat64 returns the float64 of an int64 returned by
+// Float64ToSortableInt64
+func SortableInt64ToFloat64(i int64) float64 {
+	if i < 0 {
+		i ^= math.MaxInt64
+	}
+	return math.Float64frombits(uint64(i))
+}
+
+// numericDocValuesChunkSize is the number of documents in each chunk of
+// numeric doc values
+const numericDocValuesChunkSize = 1024
+
+// numericColumn holds the numeric doc values of a field while a segment is
+// being built or merged
+type numericColumn struct {
+	typ    NumericType
+	docs   *roaring.Bitmap
+	values []int64 // docNum -> value, 0 if the doc has none
+}
+
+func newNumericColumn(typ NumericType) *numericColumn {
+	return &numericColumn{
+		typ:  typ,
+		docs: roaring.New(),
+	}
+}
+
+// set sets the value of docNum, unless it already has one
+func (c *numericColumn) set(docNum uint64, val int64) {
+	if c.docs.CheckedAdd(uint32(docNum)) {
+		if uint64(len(c.values)) <= docNum {
+			c.values = append(c.values, make([]int64, docNum+1-uint64(len(c.values)))...)
+		}
+		c.values[docNum] = val
+	}
+}
+
+// addNumericField adds the value of the field to the numeric doc values of
+// the field id, if it has one
+func addNumericField(columns map[uint16]*numericColumn, fieldID uint16, field segment.Field,
+	docNum uint64) error {
+	numericField, ok := field.(NumericField)
+	if !ok || !field.IndexDocValues() {
+		return nil
+	}
+	column := columns[fieldID]
+	if column == nil {
+		column = newNumericColumn(numericField.NumericType())
+		columns[fieldID] = column
+	} else if column.typ != numericField.NumericType() {
+		return fmt.Errorf("field %s has numeric values of type %v and %v",
+			field.Name(), column.typ, numericField.NumericType())
+	}
+	column.set(docNum, numericField.NumericValue())
+	return nil
+}
+
+// persistNumericDocValues writes out the numeric doc values of each field,
+// then an index of them, returning where the index starts, or 0 if there
+// are none.  For each field the chunks are written first, then the
+// column header: uvarint type, uvarint chunk size, uvarint start of the
+// chunks, uvarint number of chunks, the uvarint length of each chunk and
+// the uvarint length and roaring bitmap of the docs with a value.  The
+// index is a uvarint count, then the uvarint field id and uvarint column
+// header offset of each field.
+func persistNumericDocValues(columns map[uint16]*numericColumn, numDocs uint64,
+	w *countHashWriter) (uint64, error) {
+	fieldIDs := make([]uint16, 0, len(columns))
+	for fieldID := range columns {
+		fieldIDs = append(fieldIDs, fieldID)
+	}
+	sort.Slice(fieldIDs, func(i, j int) bool {
+		return fieldIDs[i] < fieldIDs[j]
+	})
+	return persistNumericColumns(fieldIDs, numDocs, w, func(fieldID uint16) (*numericColumn, error) {
+		return columns[fieldID], nil
+	})
+}
+
+// persistNumericColumns is persistNumericDocValues for the ascending field
+// ids, getting the column of each field only once the previous one is
+// written
+func persistNumericColumns(fieldIDs []uint16, numDocs uint64, w *countHashWriter,
+	column func(fieldID uint16) (*numericColumn, error)) (uint64, error) {
+	if len(fieldIDs) == 0 || numDocs == 0 {
+		return 0, nil
+	}
+
+	headerOffsets := make([]uint64, len(fieldIDs))
+	for i, fieldID := range fieldIDs {
+		c, err := column(fieldID)
+		if err != nil {
+			return 0, err
+		}
+		headerOffsets[i], err = persistNumericColumn(c, numDocs, w)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	rv := uint64(w.Count())
+	err := writeUvarints(w, uint64(len(fieldIDs)))
+	if err != nil {
+		return 0, err
+	}
+	for i, fieldID := range fieldIDs {
+		err = writeUvarints(w, uint64(fieldID), headerOffsets[i])
+		if err != nil {
+			return 0, err
+		}
+	}
+	return rv, nil
+}
+
+// persistNumericColumn writes out the chunks of the column, then its
+// header, returning where the header starts
+func persistNumericColumn(column *numericColumn, numDocs uint64, w *countHashWriter) (uint64, error) {
+	chunksStart := uint64(w.Count())
+	var chunkLens []uint64
+	vals := make([]int64, 0, numericDocValuesChunkSize)
+	var buf []byte
+	for start := uint64(0); start < numDocs; start += numericDocValuesChunkSize {
+		end := start + numericDocValuesChunkSize
+		if end > numDocs {
+			end = numDocs
+		}
+		// documents without a value take the minimum value of the
+		// chunk, so they do not widen the range of the values
+		var missing int64
+		var hasValues bool
+		for docNum := start; docNum < end; docNum++ {
+			if column.docs.Contains(uint32(docNum)) && (!hasValues || column.values[docNum] < missing) {
+				missing = column.values[docNum]
+				hasValues = true
+			}
+		}
+		vals = vals[:0]
+		for docNum := start; docNum < end; docNum++ {
+			if column.docs.Contains(uint32(docNum)) {
+				vals = append(vals, column.values[docNum])
+			} else {
+				vals = append(vals, missing)
+			}
+		}
+		buf = encodeNumericChunk(vals, buf[:0])
+		_, err := w.Write(buf)
+		if err != nil {
+			return 0, err
+		}
+		chunkLens = append(chunkLens, uint64(len(buf)))
+	}
+
+	rv := uint64(w.Count())
+	err := writeUvarints(w, uint64(column.typ), numericDocValuesChunkSize, chunksStart, uint64(len(chunkLens)))
+	if err != nil {
+		return 0, err
+	}
+	err = writeUvarints(w, chunkLens...)
+	if err != nil {
+		return 0, err
+	}
+	docs, err := column.docs.ToBytes()
+	if err != nil {
+		return 0, err
+	}
+	err = writeUvarints(w, uint64(len(docs)))
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.Write(docs)
+	if err != nil {
+		return 0, err
+	}
+	return rv, nil
+}
+
+// encodeNumericChunk appends the values to buf using frame of reference
+// and gcd encoding: the varint minimum, the uvarint greatest common divisor
+// of the differences from the minimum, a byte with the number of bits per
+// value, then the difference of each value divided by the divisor, packed
+// using that many bits, least significant first
+func encodeNumericChunk(vals []int64, buf []byte) []byte {
+	minVal := vals[0]
+	for _, val := range vals {
+		if val < minVal {
+			minVal = val
+		}
+	}
+	var gcd, maxDelta uint64
+	for _, val := range vals {
+		delta := uint64(val) - uint64(minVal)
+		gcd = gcd64(gcd, delta)
+		if delta > maxDelta {
+			maxDelta = delta
+		}
+	}
+	var numBits int
+	if gcd > 0 {
+		numBits = bits.Len64(maxDelta / gcd)
+	}
+
+	var tmp [binary.MaxVarintLen64]byte
+	buf = append(buf, tmp[:binary.PutVarint(tmp[:], minVal)]...)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], gcd)]...)
+	buf = append(buf, byte(numBits))
+	if numBits == 0 {
+		return buf
+	}
+	start := len(buf)
+	buf = append(buf, make([]byte, packedLen(len(vals), numBits))...)
+	for i, val := range vals {
+		packBits(buf[start:], numBits, i, (uint64(val)-uint64(minVal))/gcd)
+	}
+	return buf
+}
+
+func gcd64(a, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// packedLen returns the number of bytes holding n values of numBits each
+func packedLen(n, numBits int) int {
+	return (n*numBits + 7) / 8
+}
+
+// packBits writes the i'th value of numBits bits into packed
+func packBits(packed []byte, numBits, i int, val uint64) {
+	pos := i * numBits
+	for written := 0; written < numBits; {
+		shift := pos % 8
+		n := 8 - shift
+		if n > numBits-written {
+			n = numBits - written
+		}
+		packed[pos/8] |= byte(val>>uint(written)&(1<<uint(n)-1)) << uint(shift)
+		written += n
+		pos += n
+	}
+}
+
+// unpackBits reads the i'th value of numBits bits from packed
+func unpackBits(packed []byte, numBits, i int) uint64 {
+	pos := i * numBits
+	var rv uint64
+	for read := 0; read < numBits; {
+		shift := pos % 8
+		n := 8 - shift
+		if n > numBits-read {
+			n = numBits - read
+		}
+		rv |= uint64(packed[pos/8]>>uint(shift)&(1<<uint(n)-1)) << uint(read)
+		read += n
+		pos += n
+	}
+	return rv
+}
+
+// unpackAllBits reads the first len(dst) values of numBits bits from
+// packed, a word at a time when a value and its offset in its first byte
+// fit in one
+func unpackAllBits(dst []uint64, packed []byte, numBits int) {
+	mask := uint64(1)<<uint(numBits) - 1
+	for i := range dst {
+		pos := i * numBits
+		if numBits > 56 || pos/8+8 > len(packed) {
+			dst[i] = unpackBits(packed, numBits, i)
+			continue
+		}
+		dst[i] = binary.LittleEndian.Uint64(packed[pos/8:]) >> uint(pos%8) & mask
+	}
+}
+
+// numericColumnMeta holds the column header of a field's numeric doc values
+type numericColumnMeta struct {
+	typ         NumericType
+	chunkSize   uint64
+	chunkStarts []uint64 // chunk i spans chunkStarts[i] to chunkStarts[i+1]
+	docs        *roaring.Bitmap
+}
+
+// loadNumericIndex reads where the numeric doc values of each field are
+func (s *Segment) loadNumericIndex() error {
+	if s.footer.numericOffset == 0 {
+		return nil
+	}
+	numFields, n, err := readUvarintAt(s.data, s.footer.numericOffset)
+	if err != nil {
+		return fmt.Errorf("error reading numeric doc values: %v", err)
+	}
+	offset := s.footer.numericOffset + n
+	for i := uint64(0); i < numFields; i++ {
+		var fieldID, headerOffset uint64
+		fieldID, n, err = readUvarintAt(s.data, offset)
+		if err != nil {
+			return fmt.Errorf("error reading numeric doc values field: %v", err)
+		}
+		offset += n
+		headerOffset, n, err = readUvarintAt(s.data, offset)
+		if err != nil {
+			return fmt.Errorf("error reading numeric doc values field: %v", err)
+		}
+		offset += n
+		if fieldID >= uint64(len(s.fieldsInv)) {
+			return fmt.Errorf("numeric doc values field id %d out of range", fieldID)
+		}
+		s.fields[fieldID].numericHeader = headerOffset
+		s.fields[fieldID].hasNumeric = true
+	}
+	return nil
+}
+
+// fieldNumericMeta returns the column header of the numeric doc values of
+// the field, nil if it has none, reading it on first use
+func (s *Segment) fieldNumericMeta(fieldID uint16) (*numericColumnMeta, error) {
+	err := s.loadDocValueIndexOnce()
+	if err != nil {
+		return nil, err
+	}
+	f := &s.fields[fieldID]
+	f.numericOnce.Do(func() {
+		if !f.hasNumeric {
+			return
+		}
+		f.numeric, f.numericErr = s.loadNumericColumnMeta(f.numericHeader)
+		if f.numericErr != nil {
+			f.numericErr = fmt.Errorf("error reading numeric doc values of field %s: %v", s.fieldsInv[fieldID], f.numericErr)
+			return
+		}
+		s.addSize(sizeOfPtr + len(f.numeric.chunkStarts)*sizeOfUint64 + int(f.numeric.docs.GetSizeInBytes()))
+	})
+	return f.numeric, f.numericErr
+}
+
+func (s *Segment) loadNumericColumnMeta(offset uint64) (*numericColumnMeta, error) {
+	r := &uvarintAtReader{data: s.data, offset: offset}
+	rv := &numericColumnMeta{
+		typ:       NumericType(r.next()),
+		chunkSize: r.next(),
+		docs:      roaring.New(),
+	}
+	chunkStart := r.next()
+	numChunks := r.next()
+	rv.chunkStarts = append(rv.chunkStarts, chunkStart)
+	for i := uint64(0); i < numChunks && r.err == nil; i++ {
+		chunkStart += r.next()
+		rv.chunkStarts = append(rv.chunkStarts, chunkStart)
+	}
+	docsLen := r.next()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if rv.chunkSize == 0 {
+		return nil, fmt.Errorf("chunk size 0")
+	}
+	docsData, err := s.data.Read(int(r.offset), int(r.offset+docsLen))
+	if err != nil {
+		return nil, err
+	}
+	_, err = rv.docs.FromBuffer(docsData)
+	if err != nil {
+		return nil, fmt.Errorf("error loading roaring bitmap: %v", err)
+	}
+	return rv, nil
+}
+
+// NumericDocValues reads the numeric doc values of a field, it caches the
+// current chunk, so is not safe for concurrent use
+type NumericDocValues struct {
+	sb   *Segment
+	meta *numericColumnMeta
+
+	curChunk int
+	minVal   int64
+	gcd      uint64
+	numBits  int
+	packed   []byte
+	deltas   []uint64 // unpacked from the current chunk by Fill
+}
+
+// NumericDocValues returns a reader of the numeric doc values of the field,
+// or nil if the field has none, see NumericField
+func (s *Segment) NumericDocValues(field string) (*NumericDocValues, error) {
+	fieldIDPlus1 := s.fieldsMap[field]
+	if fieldIDPlus1 == 0 {
+		return nil, nil
+	}
+	meta, err := s.fieldNumericMeta(fieldIDPlus1 - 1)
+	if meta == nil || err != nil {
+		return nil, err
+	}
+	return &NumericDocValues{
+		sb:       s,
+		meta:     meta,
+		curChunk: -1,
+	}, nil
+}
+
+// Type returns the type of the values
+func (n *NumericDocValues) Type() NumericType {
+	return n.meta.typ
+}
+
+// Get returns the value of the document, and whether it has one
+func (n *NumericDocValues) Get(docNum uint64) (int64, bool, error) {
+	if !n.meta.docs.Contains(uint32(docNum)) {
+		return 0, false, nil
+	}
+	chunk := int(docNum / n.meta.chunkSize)
+	if chunk != n.curChunk {
+		err := n.loadChunk(chunk)
+		if err != nil {
+			return 0, false, err
+		}
+	}
+	if n.numBits == 0 {
+		return n.minVal, true, nil
+	}
+	delta := unpackBits(n.packed, n.numBits, int(docNum%n.meta.chunkSize))
+	return int64(uint64(n.minVal) + delta*n.gcd), true, nil
+}
+
+// Fill sets out[i] to the value of docNums[i], or 0 if it has none, it is
+// fastest when the doc numbers are ascending, as each chunk is unpacked
+// once for the run of doc numbers in it
+func (n *NumericDocValues) Fill(docNums []uint64, out []int64) error {
+	if len(out) < len(docNums) {
+		return fmt.Errorf("out has length %d, less than %d doc numbers", len(out), len(docNums))
+	}
+	for i := 0; i < len(docNums); {
+		chunk := docNums[i] / n.meta.chunkSize
+		end := i + 1
+		for end < len(docNums) && docNums[end]/n.meta.chunkSize == chunk && docNums[end] >= docNums[end-1] &&
+			docNums[end] < n.sb.footer.numDocs {
+			end++
+		}
+		if end-i == 1 {
+			val, _, err := n.Get(docNums[i])
+			if err != nil {
+				return err
+			}
+			out[i] = val
+		} else {
+			err := n.fillChunk(int(chunk), docNums[i:end], out[i:end])
+			if err != nil {
+				return err
+			}
+		}
+		i = end
+	}
+	return nil
+}
+
+// fillChunk sets out[i] to the value of docNums[i], ascending doc numbers
+// of the chunk, unpacking the chunk up to the last of them
+func (n *NumericDocValues) fillChunk(chunk int, docNums []uint64, out []int64) error {
+	if chunk != n.curChunk {
+		err := n.loadChunk(chunk)
+		if err != nil {
+			return err
+		}
+	}
+	chunkStart := uint64(chunk) * n.meta.chunkSize
+	if n.numBits > 0 {
+		numDeltas := int(docNums[len(docNums)-1]-chunkStart) + 1
+		if cap(n.deltas) < numDeltas {
+			n.deltas = make([]uint64, numDeltas)
+		}
+		n.deltas = n.deltas[:numDeltas]
+		unpackAllBits(n.deltas, n.packed, n.numBits)
+	}
+	// skip looking up each document when all of the run have values
+	first, last := docNums[0], docNums[len(docNums)-1]
+	all := n.meta.docs.Rank(uint32(last))-n.meta.docs.Rank(uint32(first)) == last-first
+	all = all && n.meta.docs.Contains(uint32(first))
+	for i, docNum := range docNums {
+		switch {
+		case !all && !n.meta.docs.Contains(uint32(docNum)):
+			out[i] = 0
+		case n.numBits == 0:
+			out[i] = n.minVal
+		default:
+			out[i] = int64(uint64(n.minVal) + n.deltas[docNum-chunkStart]*n.gcd)
+		}
+	}
+	return nil
+}
+
+func (n *NumericDocValues) loadChunk(chunk int) error {
+	if chunk+1 >= len(n.meta.chunkStarts) {
+		return fmt.Errorf("numeric doc values chunk %d out of range", chunk)
+	}
+	start, end := n.meta.chunkStarts[chunk], n.meta.chunkStarts[chunk+1]
+	data, err := n.sb.data.Read(int(start), int(end))
+	if err != nil {
+		return err
+	}
+	minVal, read := binary.Varint(data)
+	if read <= 0 {
+		return fmt.Errorf("invalid numeric doc values chunk %d", chunk)
+	}
+	data = data[read:]
+	gcd, read := binary.Uvarint(data)
+	if read <= 0 || read >= len(data) {
+		return fmt.Errorf("invalid numeric doc values chunk %d", chunk)
+	}
+	numBits := int(data[read])
+	packed := data[read+1:]
+	chunkDocs := n.sb.footer.numDocs - uint64(chunk)*n.meta.chunkSize
+	if chunkDocs > n.meta.chunkSize {
+		chunkDocs = n.meta.chunkSize
+	}
+	if numBits > 64 || len(packed) < packedLen(int(chunkDocs), numBits) {
+		return fmt.Errorf("invalid numeric doc values chunk %d", chunk)
+	}
+	n.curChunk = chunk
+	n.minVal = minVal
+	n.gcd = gcd
+	n.numBits = numBits
+	n.packed = packed
+	return nil
+}
+
+// mergeNumericDocValues collects the numeric doc values of the segments'
+// remaining documents, at their new doc numbers
+func mergeNumericDocValues(segments []*Segment, newDocNums [][]uint64,
+	fieldsMap map[string]uint16) (map[uint16]*numericColumn, error) {
+	columns := map[uint16]*numericColumn{}
+	for segI, seg := range segments {
+		for fieldID, name := range seg.fieldsInv {
+			meta, err := seg.fieldNumericMeta(uint16(fieldID))
+			if err != nil {
+				return nil, err
+			}
+			if meta == nil {
+				continue
+			}
+			newFieldID := fieldsMap[name] - 1
+			column := columns[newFieldID]
+			if column == nil {
+				column = newNumericColumn(meta.typ)
+				columns[newFieldID] = column
+			} else if column.typ != meta.typ {
+				return nil, fmt.Errorf("field %s has numeric values of type %v and %v", name, column.typ, meta.typ)
+			}
+
+			reader := &NumericDocValues{sb: seg, meta: meta, curChunk: -1}
+			itr := meta.docs.Iterator()
+			for itr.HasNext() {
+				docNum := uint64(itr.Next())
+				newDocNum := newDocNums[segI][docNum]
+				if newDocNum == docDropped {
+					continue
+				}
+				var val int64
+				val, _, err = reader.Get(docNum)
+				if err != nil {
+					return nil, err
+				}
+				column.set(newDocNum, val)
+			}
+		}
+	}
+	return columns, nil
+}
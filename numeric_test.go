@@ -0,0 +1,339 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+var testNumericFields = []struct {
+	name string
+	typ  NumericType
+	val  func(i int) (int64, bool)
+}{
+	{
+		name: "price",
+		typ:  NumericFloat64,
+		val: func(i int) (int64, bool) {
+			return Float64ToSortableInt64(float64(i%50)*1.25 - 10), i%7 != 0
+		},
+	},
+	{
+		name: "count",
+		typ:  NumericInt64,
+		val: func(i int) (int64, bool) {
+			return 1000000 + int64(i%100)*1000, true
+		},
+	},
+	{
+		name: "ts",
+		typ:  NumericDate,
+		val: func(i int) (int64, bool) {
+			return 1600000000000000000 + int64(i)*1000000000, true
+		},
+	},
+	{
+		name: "extreme",
+		typ:  NumericInt64,
+		val: func(i int) (int64, bool) {
+			vals := []int64{math.MinInt64, math.MaxInt64, 0, -1}
+			if i < len(vals) {
+				return vals[i], true
+			}
+			return 0, false
+		},
+	},
+	{
+		name: "constant",
+		typ:  NumericInt64,
+		val: func(i int) (int64, bool) {
+			return 42, true
+		},
+	},
+}
+
+// buildTestAnalysisResultsNumeric builds documents with the numeric fields
+// of testNumericFields, and the id i as a 5 digit number
+func buildTestAnalysisResultsNumeric(numDocs int) []segment.Document {
+	var results []segment.Document
+	for i := 0; i < numDocs; i++ {
+		doc := &FakeTypedDocument{
+			FakeDocument: FakeDocument{
+				NewFakeField("_id", fmt.Sprintf("%05d", i), true, false, false),
+				NewFakeField("body", "the "+strconv.Itoa(i%3), true, true, false),
+			},
+		}
+		for _, field := range testNumericFields {
+			if val, ok := field.val(i); ok {
+				doc.Typed = append(doc.Typed, NewFakeNumericField(field.name, field.typ, val, false, true))
+			}
+		}
+		results = append(results, doc)
+	}
+	return results
+}
+
+// checkNumerics checks the numeric doc values of each document of the
+// segment are those of the document with its id
+func checkNumerics(t *testing.T, seg *Segment) {
+	var docNums []uint64
+	ids := storedIDs(t, seg)
+	for docNum := range ids {
+		docNums = append(docNums, uint64(docNum))
+	}
+	for _, field := range testNumericFields {
+		dvs, err := seg.NumericDocValues(field.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dvs == nil {
+			t.Fatalf("expected numeric doc values for %s", field.name)
+		}
+		if dvs.Type() != field.typ {
+			t.Errorf("expected %s to have type %v, got %v", field.name, field.typ, dvs.Type())
+		}
+		out := make([]int64, len(docNums))
+		err = dvs.Fill(docNums, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for docNum, id := range ids {
+			i, err := strconv.Atoi(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, expectedOK := field.val(i)
+			actual, ok, err := dvs.Get(uint64(docNum))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != expectedOK || (ok && actual != expected) {
+				t.Errorf("%s doc %d (%s): expected %d %t, got %d %t", field.name, docNum, id, expected, expectedOK,
+					actual, ok)
+			}
+			if ok && out[docNum] != expected || !ok && out[docNum] != 0 {
+				t.Errorf("%s doc %d (%s): expected fill of %d, got %d", field.name, docNum, id, expected, out[docNum])
+			}
+		}
+	}
+}
+
+func TestNumericDocValues(t *testing.T) {
+	segInt, _, err := New(buildTestAnalysisResultsNumeric(2500), encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := segInt.(*Segment)
+	checkNumerics(t, seg)
+
+	for _, field := range []string{"body", "missing"} {
+		dvs, err := seg.NumericDocValues(field)
+		if dvs != nil || err != nil {
+			t.Errorf("expected no numeric doc values for %s, got %v, %v", field, dvs, err)
+		}
+	}
+	err = seg.Verify(context.Background())
+	if err != nil {
+		t.Errorf("expected segment to verify, got: %v", err)
+	}
+}
+
+func TestNumericDocValuesFill(t *testing.T) {
+	segInt, _, err := New(buildTestAnalysisResultsNumeric(2500), encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := segInt.(*Segment)
+	// runs in a chunk, across chunks, descending, repeated, sparse and past
+	// the last document
+	docNums := []uint64{0, 1, 2, 3, 1000, 1001, 5, 4, 4, 2499, 2498, 2400, 2499, 2500, 9999, 7, 8}
+	for _, field := range testNumericFields {
+		dvs, err := seg.NumericDocValues(field.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := make([]int64, len(docNums))
+		err = dvs.Fill(docNums, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, docNum := range docNums {
+			expected, _, err := dvs.Get(docNum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out[i] != expected {
+				t.Errorf("%s doc %d: expected fill of %d, got %d", field.name, docNum, expected, out[i])
+			}
+		}
+	}
+}
+
+// BenchmarkNumericFill compares filling the values of every document with
+// getting them one by one
+func BenchmarkNumericFill(b *testing.B) {
+	segInt, _, err := New(buildTestAnalysisResultsNumeric(10000), encodeNorm)
+	if err != nil {
+		b.Fatal(err)
+	}
+	seg := segInt.(*Segment)
+	docNums := make([]uint64, seg.Count())
+	for i := range docNums {
+		docNums[i] = uint64(i)
+	}
+	out := make([]int64, len(docNums))
+	dvs, err := seg.NumericDocValues("ts")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("fill", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			err = dvs.Fill(docNums, out)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("get", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for j, docNum := range docNums {
+				out[j], _, err = dvs.Get(docNum)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func TestNumericDocValuesMerge(t *testing.T) {
+	results := buildTestAnalysisResultsNumeric(1500)
+	segA, _, err := New(results[:1000], encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segB, _, err := New(results[1000:], encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segC, _, err := New(buildTestAnalysisResultsSort("a", "b"), encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{
+			name: "serial",
+		},
+		{
+			name: "parallel",
+			opts: []Option{WithMergeWorkers(4)},
+		},
+		{
+			name: "sorted",
+			opts: []Option{WithSort(SortField{Field: "body", Descending: true})},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var merged bytes.Buffer
+			_, err = MergeWithOptions([]segment.Segment{segA, segC, segB},
+				[]*roaring.Bitmap{roaring.BitmapOf(0, 5, 999), roaring.BitmapOf(0, 1), nil}, 1024, test.opts...).
+				WriteTo(&merged, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seg, err := load(segment.NewDataBytes(merged.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seg.Count() != 1497 {
+				t.Errorf("expected 1497 docs, got %d", seg.Count())
+			}
+			checkNumerics(t, seg)
+			err = seg.Verify(context.Background())
+			if err != nil {
+				t.Errorf("expected merged segment to verify, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestNumericDocValuesTypeConflict(t *testing.T) {
+	results := []segment.Document{
+		&FakeTypedDocument{
+			FakeDocument: FakeDocument{NewFakeField("_id", "a", true, false, false)},
+			Typed:        []segment.Field{NewFakeNumericField("n", NumericInt64, 1, false, true)},
+		},
+		&FakeTypedDocument{
+			FakeDocument: FakeDocument{NewFakeField("_id", "b", true, false, false)},
+			Typed:        []segment.Field{NewFakeNumericField("n", NumericDate, 1, false, true)},
+		},
+	}
+	_, _, err := New(results, encodeNorm)
+	if err == nil {
+		t.Errorf("expected error building segment with conflicting numeric types")
+	}
+	b := NewBuilder(encodeNorm)
+	defer func() { _ = b.Close() }()
+	err = b.Add(results[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Add(results[1])
+	if err == nil {
+		t.Errorf("expected error adding document with conflicting numeric type")
+	}
+
+	segInt, _, err := New(results[:1], encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segDate, _, err := New(results[1:], encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Merge([]segment.Segment{segInt, segDate}, []*roaring.Bitmap{nil, nil}, 1024).
+		WriteTo(&bytes.Buffer{}, nil)
+	if err == nil {
+		t.Errorf("expected error merging segments with conflicting numeric types")
+	}
+}
+
+func TestSortableFloat64(t *testing.T) {
+	vals := []float64{math.Inf(-1), -math.MaxFloat64, -1.5, -math.SmallestNonzeroFloat64, 0,
+		math.SmallestNonzeroFloat64, 1, 1.5, math.MaxFloat64, math.Inf(1)}
+	for i, val := range vals {
+		sortable := Float64ToSortableInt64(val)
+		if actual := SortableInt64ToFloat64(sortable); actual != val {
+			t.Errorf("expected %v, got %v", val, actual)
+		}
+		if i > 0 && sortable <= Float64ToSortableInt64(vals[i-1]) {
+			t.Errorf("expected %v to sort after %v", val, vals[i-1])
+		}
+	}
+}
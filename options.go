@@ -0,0 +1,260 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import "fmt"
+
+// defaultBuilderMemoryBudget is the approximate number of bytes a Builder
+// will buffer before spilling to temporary files
+const defaultBuilderMemoryBudget = 64 << 20
+
+// Option configures how segments are built, merged and loaded
+type Option func(*options)
+
+type options struct {
+	chunkMode         uint32 // of the postings
+	docValueChunkMode uint32
+	memoryBudget      int
+	tempDir           string
+	mergeWorkers      int
+	sort              []SortField
+	storedCodec       StoredCodec
+
+	storedChunkDocs   int
+	storedChunkBytes  int
+	storedLargeValues int
+
+	topTerms int
+
+	chunkCache    *ChunkCache
+	maxExpansions int
+}
+
+func defaultOptions() options {
+	return options{
+		chunkMode:         defaultChunkMode,
+		docValueChunkMode: legacyChunkMode,
+		memoryBudget:      defaultBuilderMemoryBudget,
+		storedCodec:       defaultStoredCodec,
+
+		storedChunkDocs: int(defaultDocumentChunkSize),
+
+		topTerms: defaultTopTerms,
+
+		maxExpansions: defaultMaxExpansions,
+	}
+}
+
+// validate returns an error if segments cannot be written with the options
+func (o *options) validate() error {
+	err := validChunkMode(o.chunkMode, true)
+	if err != nil {
+		return fmt.Errorf("invalid postings chunking: %v", err)
+	}
+	err = validChunkMode(o.docValueChunkMode, false)
+	if err != nil {
+		return fmt.Errorf("invalid doc value chunking: %v", err)
+	}
+	if o.storedCodec == nil {
+		return fmt.Errorf("invalid stored codec: nil")
+	}
+	if o.storedChunkDocs < 0 || o.storedChunkBytes < 0 {
+		return fmt.Errorf("invalid stored chunking: %d docs, %d bytes, limits must not be negative",
+			o.storedChunkDocs, o.storedChunkBytes)
+	}
+	return nil
+}
+
+func applyOptions(opts []Option) options {
+	rv := defaultOptions()
+	for _, opt := range opts {
+		opt(&rv)
+	}
+	return rv
+}
+
+// WithMemoryBudget sets the approximate number of bytes of postings and
+// stored fields a Builder holds in memory before spilling them to
+// temporary files
+func WithMemoryBudget(bytes int) Option {
+	return func(o *options) {
+		o.memoryBudget = bytes
+	}
+}
+
+// WithTempDir sets the directory in which a Builder creates its temporary
+// files, the default is the directory returned by os.TempDir
+func WithTempDir(dir string) Option {
+	return func(o *options) {
+		o.tempDir = dir
+	}
+}
+
+// WithMergeWorkers sets the number of fields merged concurrently by Merge,
+// the segment produced is the same regardless of the number of workers
+func WithMergeWorkers(n int) Option {
+	return func(o *options) {
+		o.mergeWorkers = n
+	}
+}
+
+// WithSort sorts the documents of a segment built by NewWithOptions or a
+// Builder, or merged by MergeWithOptions, on the doc values of the fields,
+// renumbering them, the sort is recorded in the segment, see Segment.Sort
+func WithSort(fields ...SortField) Option {
+	return func(o *options) {
+		o.sort = fields
+	}
+}
+
+// WithStoredCodec sets the codec compressing the stored fields of a segment
+// built or merged, the default is zstd at ZSTDCompressionLevel
+func WithStoredCodec(codec StoredCodec) Option {
+	return func(o *options) {
+		o.storedCodec = codec
+	}
+}
+
+// ChunkMode is a policy splitting the postings lists or the doc values of a
+// segment into chunks of consecutive doc nums, reading a posting or doc
+// value decompresses and decodes its whole chunk.  The chunk size picked
+// is recorded with each postings list and the doc values of each field.
+type ChunkMode uint32
+
+const (
+	// ChunkByCardinality chunks each postings list, or the doc values of
+	// each field, into the fewest chunks holding at most about 1024 docs
+	// with postings or values each, the default for postings
+	ChunkByCardinality = ChunkMode(chunkModeV1)
+
+	// ChunkByCardinalityPacked is ChunkByCardinality, with the
+	// freq/norms and locations of the postings bit-packed, which are read
+	// faster, it is only for postings
+	ChunkByCardinalityPacked = ChunkMode(chunkModePacked)
+)
+
+// ChunkDocs returns the chunk mode of chunks of docs consecutive doc nums,
+// from 1 to 1024, other numbers are rejected when writing a segment.
+// ChunkDocs(1024) is the default for doc values.
+func ChunkDocs(docs int) ChunkMode {
+	if docs < 1 || docs > int(legacyChunkMode) {
+		return 0
+	}
+	return ChunkMode(docs)
+}
+
+// ChunkBytes returns the adaptive chunk mode splitting each postings list,
+// or the doc values of each field, into chunks of about bytes bytes once
+// uncompressed, so the chunks of dense and sparse terms or fields are read
+// at a similar cost.  The bytes of the postings are those of their uvarint
+// encoding, even when packed.  A merge buffers the postings of each term
+// and the doc values of each field to size their chunks.
+func ChunkBytes(bytes int) ChunkMode {
+	if bytes < 1 {
+		return ChunkMode(chunkModeBytes)
+	}
+	if bytes > int(maxChunkBytes) {
+		bytes = int(maxChunkBytes)
+	}
+	return ChunkMode(chunkModeBytes | uint32(bytes))
+}
+
+// Packed returns the chunk mode with the freq/norms and locations of the
+// postings bit-packed, for ChunkByCardinality and ChunkBytes modes, the
+// other modes are returned as is
+func (m ChunkMode) Packed() ChunkMode {
+	switch {
+	case uint32(m) == chunkModeV1:
+		return ChunkByCardinalityPacked
+	case uint32(m)&chunkModeBytes != 0:
+		return m | ChunkMode(chunkModeBytesPacked)
+	}
+	return m
+}
+
+// WithPostingsChunking sets the chunk mode of the postings of a segment
+// built or merged, the default is ChunkByCardinality.  The chunk mode is
+// recorded in the segment, see Segment.ChunkMode.
+func WithPostingsChunking(mode ChunkMode) Option {
+	return func(o *options) {
+		o.chunkMode = uint32(mode)
+	}
+}
+
+// WithDocValueChunking sets the chunk mode of the doc values of a segment
+// built or merged, the default is ChunkDocs(1024).  The chunking of the
+// stored fields is set by WithStoredChunking.
+func WithDocValueChunking(mode ChunkMode) Option {
+	return func(o *options) {
+		o.docValueChunkMode = uint32(mode)
+	}
+}
+
+// WithStoredChunking sets when each chunk of stored fields ends, after docs
+// documents, or once its uncompressed documents reach bytes, whichever
+// comes first, a limit of 0 is no limit.  Reading the stored fields of a
+// document decompresses its whole chunk, so smaller chunks make reads
+// cheaper, and larger chunks compress better.  The default is chunks of
+// 128 documents, the policy is recorded in the segment.
+func WithStoredChunking(docs, bytes int) Option {
+	return func(o *options) {
+		o.storedChunkDocs = docs
+		o.storedChunkBytes = bytes
+	}
+}
+
+// WithChunkCache caches the decompressed chunks of stored fields and doc
+// values of the segments loaded with LoadWithOptions in the cache, which
+// may be shared by any number of segments.  By default each reader only
+// keeps the chunk it last decompressed.
+func WithChunkCache(cache *ChunkCache) Option {
+	return func(o *options) {
+		o.chunkCache = cache
+	}
+}
+
+// WithStoredLargeValues stores each stored field value of at least
+// threshold bytes compressed on its own, after the chunks of stored
+// fields, so visiting the other fields of the document never decompresses
+// it, see Segment.VisitStoredFieldsSubset.  The large values are held in
+// memory until the stored fields are written.  The default of 0 keeps every
+// value in the chunks.
+func WithStoredLargeValues(threshold int) Option {
+	return func(o *options) {
+		o.storedLargeValues = threshold
+	}
+}
+
+// WithTopTerms sets the number of terms of each field with the highest doc
+// frequency recorded in a segment built or merged, answering
+// Dictionary.TopTerms without reading the postings lists.  The default is
+// 32, 0 records none.
+func WithTopTerms(n int) Option {
+	return func(o *options) {
+		o.topTerms = n
+	}
+}
+
+// WithMaxExpansions sets the number of terms the prefix, fuzzy and regexp
+// iterators of the dictionaries of a segment loaded with LoadWithOptions
+// or built by NewWithOptions match, before failing with
+// ErrTooManyExpansions.  It bounds the terms returned, not the terms of
+// the dictionary walked to find them, which for a pattern such as .*x may
+// be all of them.  The default is 10000, 0 is no limit.
+func WithMaxExpansions(n int) Option {
+	return func(o *options) {
+		o.maxExpansions = n
+	}
+}
@@ -0,0 +1,341 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// With chunkModePacked, the values of each chunk of freq/norms and locations
+// are bit-packed instead of being a stream of uvarints: a uvarint number of
+// values, followed by blocks of packedBlockLen values, the last one holding
+// those left.  Each block is encoded with a frame of reference, a byte
+// holding the bit width of the values, the uvarint smallest value, and a
+// byte holding the number of exceptions, followed by the difference of each
+// value from the smallest one, packed little endian in the bit width, and
+// then by each exception, the byte index of a value whose difference does
+// not fit the bit width and the uvarint bits of the difference above it.
+// The bit width is chosen to encode the block in the fewest bytes, so a few
+// large values do not widen the whole block.  The bytes of a payload are
+// each a value, and lengths and offsets within the chunk count values.
+
+// packedBlockLen is the number of values of each block of a packed chunk
+const packedBlockLen = 128
+
+// appendPackedValues appends the packed encoding of the values to dst,
+// nothing if there are none
+func appendPackedValues(dst []byte, vals []uint64) []byte {
+	if len(vals) == 0 {
+		return dst
+	}
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(vals)))
+	dst = append(dst, buf[:n]...)
+	for start := 0; start < len(vals); start += packedBlockLen {
+		end := start + packedBlockLen
+		if end > len(vals) {
+			end = len(vals)
+		}
+		dst = appendPackedBlock(dst, vals[start:end])
+	}
+	return dst
+}
+
+// appendPackedBlock appends the encoding of a block of values to dst
+func appendPackedBlock(dst []byte, block []uint64) []byte {
+	min := block[0]
+	for _, v := range block[1:] {
+		if v < min {
+			min = v
+		}
+	}
+	width := packedBlockWidth(block, min)
+
+	var buf [binary.MaxVarintLen64]byte
+	dst = append(dst, byte(width))
+	n := binary.PutUvarint(buf[:], min)
+	dst = append(dst, buf[:n]...)
+	exceptionsAt := len(dst)
+	dst = append(dst, 0)
+
+	packedStart := len(dst)
+	for i := packedLen(len(block), int(width)); i > 0; i-- {
+		dst = append(dst, 0)
+	}
+	packed := dst[packedStart:]
+	for i, v := range block {
+		delta := v - min
+		if width < 64 {
+			delta &= 1<<width - 1
+		}
+		packBits(packed, int(width), i, delta)
+	}
+
+	var numExceptions byte
+	for i, v := range block {
+		if width < 64 && (v-min)>>width != 0 {
+			dst = append(dst, byte(i))
+			n = binary.PutUvarint(buf[:], (v-min)>>width)
+			dst = append(dst, buf[:n]...)
+			numExceptions++
+		}
+	}
+	dst[exceptionsAt] = numExceptions
+	return dst
+}
+
+// packedBlockWidth returns the bit width encoding the differences of the
+// block from min in the fewest bytes, counting those of the exceptions
+func packedBlockWidth(block []uint64, min uint64) uint {
+	var counts [65]int // of the differences of each bit length
+	for _, v := range block {
+		counts[bits.Len64(v-min)]++
+	}
+	maxLen := 64
+	for maxLen > 0 && counts[maxLen] == 0 {
+		maxLen--
+	}
+	bestWidth, bestCost := maxLen, packedLen(len(block), maxLen)
+	for width := maxLen - 1; width >= 0; width-- {
+		cost := packedLen(len(block), width)
+		for l := width + 1; l <= maxLen; l++ {
+			// the index byte and the uvarint bits above the width
+			cost += counts[l] * (1 + (l-width+6)/7)
+		}
+		if cost < bestCost {
+			bestWidth, bestCost = width, cost
+		}
+	}
+	return uint(bestWidth)
+}
+
+// unpackBlock decodes the values packed in width bits into dst, using
+// padded to copy the packed bytes to when width is at most 56, so that the
+// 8 bytes at the byte offset of each value can be read at once
+func unpackBlock(dst []uint64, packed []byte, width uint, padded *[packedBlockLen*8 + 8]byte) {
+	if width == 0 {
+		for i := range dst {
+			dst[i] = 0
+		}
+		return
+	}
+	if width > 56 {
+		for i := range dst {
+			dst[i] = unpackBits(packed, int(width), i)
+		}
+		return
+	}
+	copy(padded[:], packed)
+	mask := uint64(1)<<width - 1
+	var off uint
+	for i := range dst {
+		dst[i] = binary.LittleEndian.Uint64(padded[(off/8)%(packedBlockLen*8):]) >> (off % 8) & mask
+		off += width
+	}
+}
+
+// packedReader reads the values of a packed chunk, decoding a block at a
+// time
+type packedReader struct {
+	data      []byte // the blocks
+	numValues int
+
+	block      [packedBlockLen]uint64
+	blockStart int // index of the first value of the decoded block
+	blockLen   int // 0 when no block is decoded
+	i          int // index in the block of the next value to read
+	next       int // offset in data of the block after the decoded one
+	padded     [packedBlockLen*8 + 8]byte
+
+	bytes []byte // backs the values read as bytes, see ReadBytes
+}
+
+// Reset starts reading the packed chunk data
+func (r *packedReader) Reset(data []byte) error {
+	r.data, r.numValues = nil, 0
+	r.blockStart, r.blockLen, r.i, r.next = 0, 0, 0, 0
+	r.bytes = r.bytes[:0]
+	if len(data) == 0 {
+		return nil
+	}
+	numValues, n := binary.Uvarint(data)
+	if n <= 0 || numValues > uint64(len(data))*packedBlockLen {
+		return fmt.Errorf("invalid number of packed values")
+	}
+	r.data = data[n:]
+	r.numValues = int(numValues)
+	return nil
+}
+
+// Len returns the number of unread values
+func (r *packedReader) Len() int {
+	return r.numValues - r.blockStart - r.i
+}
+
+// ReadUvarint returns the next value, it is named after memUvarintReader's
+func (r *packedReader) ReadUvarint() (uint64, error) {
+	if rv, ok := r.nextInBlock(); ok {
+		return rv, nil
+	}
+	return r.readNextBlock()
+}
+
+// nextInBlock returns the next value if it is in the decoded block, it is
+// small enough to be inlined in the loops reading values
+func (r *packedReader) nextInBlock() (uint64, bool) {
+	if r.i < r.blockLen {
+		rv := r.block[uint(r.i)%packedBlockLen]
+		r.i++
+		return rv, true
+	}
+	return 0, false
+}
+
+// readNextBlock decodes the next block and returns its first value
+func (r *packedReader) readNextBlock() (uint64, error) {
+	err := r.loadBlock(false)
+	if err != nil {
+		return 0, err
+	}
+	r.i = 1
+	return r.block[0], nil
+}
+
+// ReadUvarints reads the next len(vals) values into vals, copying them at
+// once when they are all in the decoded block
+func (r *packedReader) ReadUvarints(vals []uint64) error {
+	if r.i+len(vals) <= r.blockLen {
+		r.i += copy(vals, r.block[r.i:r.blockLen])
+		return nil
+	}
+	for j := range vals {
+		v, err := r.ReadUvarint()
+		if err != nil {
+			return err
+		}
+		vals[j] = v
+	}
+	return nil
+}
+
+// ReadBytes returns the next count values as bytes, they are valid until
+// the next chunk is read
+func (r *packedReader) ReadBytes(count int) ([]byte, error) {
+	if count < 0 || count > r.Len() {
+		return nil, fmt.Errorf("packed read of %d bytes past end", count)
+	}
+	start := len(r.bytes)
+	for i := 0; i < count; i++ {
+		v, err := r.ReadUvarint()
+		if err != nil {
+			return nil, err
+		}
+		if v > 0xff {
+			return nil, fmt.Errorf("packed value %d is not a byte", v)
+		}
+		r.bytes = append(r.bytes, byte(v))
+	}
+	return r.bytes[start:len(r.bytes):len(r.bytes)], nil
+}
+
+// Skip skips count values
+func (r *packedReader) Skip(count int) error {
+	return r.seek(r.blockStart + r.i + count)
+}
+
+// seek moves to the value at index pos, at or after the current one,
+// skipping the blocks in between without decoding them
+func (r *packedReader) seek(pos int) error {
+	if cur := r.blockStart + r.i; pos < cur || pos > r.numValues {
+		return fmt.Errorf("seek to packed value %d from %d of %d", pos, cur, r.numValues)
+	}
+	for pos >= r.blockStart+r.blockLen && pos < r.numValues {
+		// skip the block unless pos is in the one after the decoded one
+		skip := pos >= r.blockStart+r.blockLen+packedBlockLen
+		err := r.loadBlock(skip)
+		if err != nil {
+			return err
+		}
+	}
+	r.i = pos - r.blockStart
+	return nil
+}
+
+// loadBlock moves to the block after the decoded one, decoding it unless
+// skip, in which case it is left as an empty block past its values
+func (r *packedReader) loadBlock(skip bool) error {
+	start := r.blockStart + r.blockLen
+	if start >= r.numValues {
+		return fmt.Errorf("packed read past end of %d values", r.numValues)
+	}
+	n := r.numValues - start
+	if n > packedBlockLen {
+		n = packedBlockLen
+	}
+
+	data := r.data[r.next:]
+	if len(data) < 1 || data[0] > 64 {
+		return fmt.Errorf("invalid packed block at value %d", start)
+	}
+	width := uint(data[0])
+	min, read := binary.Uvarint(data[1:])
+	if read <= 0 || len(data) < 1+read+1 {
+		return fmt.Errorf("invalid packed block at value %d", start)
+	}
+	numExceptions := int(data[1+read])
+	data = data[1+read+1:]
+	blockBytes := packedLen(n, int(width))
+	if len(data) < blockBytes {
+		return fmt.Errorf("packed block at value %d past end of chunk", start)
+	}
+	packed := data[:blockBytes]
+	data = data[blockBytes:]
+
+	block := r.block[:n]
+	if !skip {
+		unpackBlock(block, packed, width, &r.padded)
+	}
+	for i := 0; i < numExceptions; i++ {
+		if len(data) < 1 || int(data[0]) >= n || width == 64 {
+			return fmt.Errorf("invalid packed exception at value %d", start)
+		}
+		index := data[0]
+		high, read := binary.Uvarint(data[1:])
+		if read <= 0 {
+			return fmt.Errorf("invalid packed exception at value %d", start)
+		}
+		data = data[1+read:]
+		if !skip {
+			block[index] |= high << width
+		}
+	}
+	if !skip && min != 0 {
+		for i := range block {
+			block[i] += min
+		}
+	}
+
+	r.next = len(r.data) - len(data)
+	r.blockStart = start
+	r.blockLen = n
+	r.i = 0
+	if skip {
+		r.blockStart += n
+		r.blockLen = 0
+	}
+	return nil
+}
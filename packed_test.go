@@ -0,0 +1,355 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+func TestPackedValues(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	tests := map[string]func(i int) uint64{
+		"zeros": func(int) uint64 { return 0 },
+		"same":  func(int) uint64 { return 1 << 40 },
+		"small": func(int) uint64 { return uint64(rnd.Intn(16)) },
+		"exceptions": func(int) uint64 {
+			if rnd.Intn(20) == 0 {
+				return uint64(rnd.Int63())
+			}
+			return uint64(rnd.Intn(100))
+		},
+		"wide": func(int) uint64 { return rnd.Uint64() },
+		"max": func(i int) uint64 {
+			if i%2 == 0 {
+				return math.MaxUint64
+			}
+			return 0
+		},
+		"bytes": func(int) uint64 { return uint64(rnd.Intn(256)) },
+	}
+	for name, value := range tests {
+		for _, n := range []int{0, 1, 127, 128, 129, 1000} {
+			t.Run(fmt.Sprintf("%s %d", name, n), func(t *testing.T) {
+				vals := make([]uint64, n)
+				for i := range vals {
+					vals[i] = value(i)
+				}
+				data := appendPackedValues(nil, vals)
+
+				var r packedReader
+				err := r.Reset(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var actual []uint64
+				for r.Len() > 0 {
+					val, err := r.ReadUvarint()
+					if err != nil {
+						t.Fatal(err)
+					}
+					actual = append(actual, val)
+				}
+				if !reflect.DeepEqual(actual, vals) && len(vals) > 0 {
+					t.Errorf("expected %v, got %v", vals, actual)
+				}
+				_, err = r.ReadUvarint()
+				if err == nil {
+					t.Errorf("expected error reading past the values")
+				}
+
+				// read several values at a time, across blocks
+				err = r.Reset(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for pos := 0; pos+3 <= n; pos += 3 {
+					var three [3]uint64
+					err = r.ReadUvarints(three[:])
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !reflect.DeepEqual(three[:], vals[pos:pos+3]) {
+						t.Fatalf("expected %v at %d, got %v", vals[pos:pos+3], pos, three)
+					}
+				}
+
+				// seek forward by varying steps
+				err = r.Reset(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for pos := 0; pos < n; pos += 1 + rnd.Intn(300) {
+					err = r.seek(pos)
+					if err != nil {
+						t.Fatal(err)
+					}
+					val, err := r.ReadUvarint()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if val != vals[pos] {
+						t.Fatalf("expected %d at %d, got %d", vals[pos], pos, val)
+					}
+				}
+				if err = r.seek(n); err != nil || r.Len() != 0 {
+					t.Errorf("expected seek to the end, got %v with %d left", err, r.Len())
+				}
+			})
+		}
+	}
+}
+
+func TestPackedReadBytes(t *testing.T) {
+	var vals []uint64
+	for i := 0; i < 300; i++ {
+		vals = append(vals, uint64(i%256))
+	}
+	vals = append(vals, 256)
+	var r packedReader
+	err := r.Reset(appendPackedValues(nil, vals))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := r.ReadBytes(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := r.ReadBytes(200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range first {
+		if first[i] != byte(i) || second[i] != byte(i+100) {
+			t.Fatalf("expected bytes %d and %d at %d, got %d and %d", i, i+100, i, first[i], second[i])
+		}
+	}
+	_, err = r.ReadBytes(1)
+	if err == nil {
+		t.Errorf("expected error reading value 256 as a byte")
+	}
+	_, err = r.ReadBytes(2)
+	if err == nil {
+		t.Errorf("expected error reading bytes past the end")
+	}
+}
+
+func TestPackedReaderErrors(t *testing.T) {
+	data := appendPackedValues(nil, []uint64{1, 2, 3, 1000, 5})
+	for _, corrupt := range [][]byte{
+		{0x80},
+		{5},
+		{5, 65, 0, 0},
+		data[:len(data)-1],
+	} {
+		var r packedReader
+		err := r.Reset(corrupt)
+		for err == nil && r.Len() > 0 {
+			_, err = r.ReadUvarint()
+		}
+		if err == nil {
+			t.Errorf("expected error reading %v", corrupt)
+		}
+	}
+}
+
+func TestPackedChunkMode(t *testing.T) {
+	results := buildTestAnalysisResultsSkips(3000)
+	results = append(results, buildTestAnalysisResultsPayload(0, 300)...)
+	varintSeg, _, err := newWithChunkMode(results, encodeNorm, chunkModeV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packedInt, _, err := newWithChunkMode(results, encodeNorm, chunkModePacked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packedSeg := packedInt.(*Segment)
+	if packedSeg.ChunkMode() != chunkModePacked {
+		t.Errorf("expected chunk mode %d, got %d", chunkModePacked, packedSeg.ChunkMode())
+	}
+	err = packedSeg.Verify(context.Background())
+	if err != nil {
+		t.Fatalf("expected packed segment to verify, got: %v", err)
+	}
+
+	// merging into either chunk mode keeps the postings
+	var merged []*Segment
+	for _, chunkMode := range []uint32{chunkModeV1, chunkModePacked} {
+		var buf bytes.Buffer
+		_, err = MergeWithOptions([]segment.Segment{packedSeg, varintSeg}, []*roaring.Bitmap{nil, nil}, 1024, func(o *options) {
+			o.chunkMode = chunkMode
+		}).WriteTo(&buf, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seg, err := load(segment.NewDataBytes(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = seg.Verify(context.Background())
+		if err != nil {
+			t.Fatalf("expected segment merged in chunk mode %d to verify, got: %v", chunkMode, err)
+		}
+		merged = append(merged, seg)
+	}
+
+	for _, field := range []string{"body", "title"} {
+		expected := allTermPostings(t, varintSeg.(*Segment), field)
+		if actual := allTermPostings(t, packedSeg, field); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected the postings of %s in the packed segment to match", field)
+		}
+		for _, seg := range merged {
+			actual := allTermPostings(t, seg, field)
+			for term, postings := range expected {
+				if !reflect.DeepEqual(actual[term][:len(postings)], postings) ||
+					!reflect.DeepEqual(actual[term][len(postings):], postings) {
+					t.Errorf("expected the postings of %s %s merged in chunk mode %d to be repeated",
+						field, term, seg.ChunkMode())
+				}
+			}
+		}
+	}
+
+	// advancing reads the same postings as in the uvarint chunks
+	for _, term := range []string{"x", "y", "z"} {
+		var postings [][]skipTestPosting
+		for _, seg := range []*Segment{varintSeg.(*Segment), packedSeg} {
+			dict, err := seg.dictionary("body")
+			if err != nil {
+				t.Fatal(err)
+			}
+			pl, err := dict.postingsList([]byte(term), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			itr, err := pl.iterator(true, true, true, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var target uint64
+			postings = append(postings, skipTestPostings(t, itr, func(itr *PostingsIterator) (segment.Posting, error) {
+				target += 97
+				return itr.Advance(target)
+			}))
+		}
+		if !reflect.DeepEqual(postings[0], postings[1]) {
+			t.Errorf("expected advancing over %s to find %d postings, got %d", term, len(postings[0]), len(postings[1]))
+		}
+	}
+}
+
+// allTermPostings returns the postings of each term of the field, with
+// their locations and payloads
+func allTermPostings(t *testing.T, seg *Segment, field string) map[string][]string {
+	dict, err := seg.dictionary(field)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rv := map[string][]string{}
+	itr := dict.Iterator(nil, nil, nil)
+	for entry, err := itr.Next(); entry != nil || err != nil; entry, err = itr.Next() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		pl, err := dict.postingsList([]byte(entry.Term()), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		postings, err := pl.iterator(true, true, true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for p, err := postings.Next(); p != nil || err != nil; p, err = postings.Next() {
+			if err != nil {
+				t.Fatal(err)
+			}
+			posting := fmt.Sprintf("%d %f", p.Frequency(), p.Norm())
+			for _, loc := range p.Locations() {
+				posting += fmt.Sprintf(" %s %d %d %d %q", loc.Field(), loc.Pos(), loc.Start(), loc.End(),
+					loc.(*Location).Payload())
+			}
+			rv[entry.Term()] = append(rv[entry.Term()], posting)
+		}
+	}
+	return rv
+}
+
+func BenchmarkPackedReader(b *testing.B) {
+	n, buf := generateCommonUvarints(64, 512)
+	vals := make([]uint64, 0, n)
+	r := &memUvarintReader{S: buf}
+	for r.Len() > 0 {
+		val, _ := r.ReadUvarint()
+		vals = append(vals, val)
+	}
+	data := appendPackedValues(nil, vals)
+
+	var reader packedReader
+	_ = reader.Reset(data)
+	seen := 0
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if seen >= n {
+			_ = reader.Reset(data)
+			seen = 0
+		}
+
+		_, _ = reader.ReadUvarint()
+		seen++
+	}
+}
+
+func BenchmarkPostingsIteratorChunkModes(b *testing.B) {
+	results := buildTestAnalysisResultsSkips(10000)
+	for _, chunkMode := range []uint32{chunkModeV1, chunkModePacked} {
+		seg, _, err := newWithChunkMode(results, encodeNorm, chunkMode)
+		if err != nil {
+			b.Fatal(err)
+		}
+		dict, err := seg.(*Segment).dictionary("body")
+		if err != nil {
+			b.Fatal(err)
+		}
+		pl, err := dict.postingsList([]byte("x"), nil, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprintf("chunk mode %d", chunkMode), func(b *testing.B) {
+			var itr *PostingsIterator
+			for i := 0; i < b.N; i++ {
+				itr, err = pl.iterator(true, true, true, itr)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for p, err := itr.Next(); p != nil || err != nil; p, err = itr.Next() {
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+// PayloadLocation is implemented by locations carrying payload bytes, such
+// as a part of speech tag, a boost or a token type, which are stored with
+// the location, see Location.Payload
+type PayloadLocation interface {
+	segment.Location
+
+	// Payload returns the payload of the location, nil if it has none
+	Payload() []byte
+}
+
+// locationPayload returns the payload of the location, nil if it has none
+func locationPayload(loc segment.Location) []byte {
+	if payloadLoc, ok := loc.(PayloadLocation); ok {
+		return payloadLoc.Payload()
+	}
+	return nil
+}
+
+// encodeLocationField returns the field of a location as encoded, its
+// field id shifted left by one, flagging whether a payload follows the end
+// of the location (since version 3)
+func encodeLocationField(fieldID uint64, payload []byte) uint64 {
+	rv := fieldID << 1
+	if len(payload) > 0 {
+		rv |= 1
+	}
+	return rv
+}
+
+// decodeLocationField returns the field id of an encoded location field,
+// and whether a payload follows the end of the location
+func decodeLocationField(val uint64) (fieldID uint64, hasPayload bool) {
+	return val >> 1, val&1 != 0
+}
+
+// locationLen returns the number of bytes of the encoded location, or the
+// number of values when the chunks are packed
+func (c *chunkedIntCoder) locationLen(fieldID, pos, start, end uint64, payload []byte) int {
+	if c.packed {
+		rv := numUintsLocation
+		if len(payload) > 0 {
+			rv += 1 + len(payload)
+		}
+		return rv
+	}
+	return locationBytes(fieldID, pos, start, end, payload)
+}
+
+// locationBytes returns the number of bytes of the location encoded as
+// uvarints
+func locationBytes(fieldID, pos, start, end uint64, payload []byte) int {
+	rv := totalUvarintBytes(encodeLocationField(fieldID, payload), pos, start, end)
+	if len(payload) > 0 {
+		rv += numUvarintBytes(uint64(len(payload))) + len(payload)
+	}
+	return rv
+}
+
+// addLocation encodes the location of the doc num, the field, pos, start
+// and end, followed by the length of the payload and its bytes, if any
+func addLocation(locEncoder *chunkedIntCoder, docNum, fieldID, pos, start, end uint64, payload []byte) error {
+	err := locEncoder.Add(docNum, encodeLocationField(fieldID, payload), pos, start, end)
+	if err != nil || len(payload) == 0 {
+		return err
+	}
+	err = locEncoder.Add(docNum, uint64(len(payload)))
+	if err != nil {
+		return err
+	}
+	return locEncoder.AddBytes(docNum, payload)
+}
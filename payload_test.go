@@ -0,0 +1,209 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+// testPayload is the payload of the term at pos of the doc, every third
+// location has none
+func testPayload(doc int, term string, pos int) []byte {
+	if (doc+pos)%3 == 0 {
+		return nil
+	}
+	return []byte(fmt.Sprintf("%s/%d", term, doc))
+}
+
+// buildTestAnalysisResultsPayload builds documents with a title whose
+// locations carry payloads, and a rank to sort on
+func buildTestAnalysisResultsPayload(start, end int) []segment.Document {
+	words := []string{"red", "green", "blue", "shoe", "shirt", "hat", "big", "small"}
+	var results []segment.Document
+	for i := start; i < end; i++ {
+		title := fmt.Sprintf("%s %s %s %s", words[i%8], words[(i/8)%8], words[(i*3)%8], words[i%8])
+		titleField := NewFakeField("title", title, false, true, false)
+		for _, term := range titleField.T {
+			for _, loc := range term.L {
+				loc.PL = testPayload(i, term.T, loc.P)
+			}
+		}
+		doc := FakeDocument{
+			NewFakeField("_id", strconv.Itoa(i), true, false, false),
+			titleField,
+			NewFakeField("rank", fmt.Sprintf("%03d", (i*37)%101), false, false, true),
+		}
+		results = append(results, &doc)
+	}
+	return results
+}
+
+// checkPayloads checks the payload of every location of the title is the
+// one of its document, term and position
+func checkPayloads(t *testing.T, seg *Segment) {
+	ids := storedIDs(t, seg)
+	dict, err := seg.dictionary("title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var locs, payloads int
+	itr := dict.Iterator(nil, nil, nil)
+	for entry, err := itr.Next(); entry != nil || err != nil; entry, err = itr.Next() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		pl, err := dict.PostingsList([]byte(entry.Term()), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		postings, err := pl.Iterator(true, true, true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for p, err := postings.Next(); p != nil || err != nil; p, err = postings.Next() {
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc, _ := strconv.Atoi(ids[p.Number()])
+			for _, loc := range p.Locations() {
+				locs++
+				expected := testPayload(doc, entry.Term(), loc.Pos())
+				actual := loc.(*Location).Payload()
+				if !bytes.Equal(actual, expected) {
+					t.Fatalf("doc %d term %s pos %d: expected payload %q, got %q", doc, entry.Term(), loc.Pos(),
+						expected, actual)
+				}
+				if actual != nil {
+					payloads++
+				}
+			}
+		}
+	}
+	if payloads == 0 || payloads == locs {
+		t.Errorf("expected some of the %d locations with payloads, got %d", locs, payloads)
+	}
+	err = seg.Verify(context.Background())
+	if err != nil {
+		t.Errorf("expected segment to verify, got: %v", err)
+	}
+}
+
+func TestPayloads(t *testing.T) {
+	results := buildTestAnalysisResultsPayload(0, 300)
+	segInt, _, err := New(results, encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := segInt.(*Segment)
+	checkPayloads(t, seg)
+
+	b := NewBuilder(encodeNorm, WithMemoryBudget(1<<10))
+	defer func() { _ = b.Close() }()
+	for _, result := range results {
+		err = b.Add(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var built bytes.Buffer
+	_, err = b.WriteTo(&built)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected bytes.Buffer
+	_, err = seg.WriteTo(&expected, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(built.Bytes(), expected.Bytes()) {
+		t.Errorf("expected Builder segment to match New segment")
+	}
+
+	sorted, _, err := NewWithOptions(results, encodeNorm, WithSort(SortField{Field: "rank"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPayloads(t, sorted.(*Segment))
+}
+
+func TestPayloadsMerge(t *testing.T) {
+	var segments []segment.Segment
+	for i := 0; i < 3; i++ {
+		segInt, _, err := New(buildTestAnalysisResultsPayload(i*100, (i+1)*100), encodeNorm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments = append(segments, segInt)
+	}
+	segments = append(segments, loadTestFile(t, "testdata/v2.ice"))
+	drops := []*roaring.Bitmap{roaring.BitmapOf(1, 5), nil, roaring.BitmapOf(99), nil}
+
+	for _, opts := range [][]Option{
+		{WithMergeWorkers(1)},
+		{WithMergeWorkers(2)},
+		{WithSort(SortField{Field: "rank", Descending: true})},
+	} {
+		var merged bytes.Buffer
+		_, err := MergeWithOptions(segments, drops, 1024, opts...).WriteTo(&merged, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seg, err := load(segment.NewDataBytes(merged.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkPayloads(t, seg)
+
+		// the locations of the older version have no payloads
+		pl, err := seg.dictionary("body")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkOlderLocations(t, pl)
+	}
+}
+
+func checkOlderLocations(t *testing.T, dict *Dictionary) {
+	pl, err := dict.PostingsList([]byte("the"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postings, err := pl.Iterator(true, true, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for p, err := postings.Next(); p != nil || err != nil; p, err = postings.Next() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, loc := range p.Locations() {
+			n++
+			if loc.Pos() != 1 || loc.(*Location).Payload() != nil {
+				t.Errorf("expected the at position 1 without payload, got %d %q", loc.Pos(), loc.(*Location).Payload())
+			}
+		}
+	}
+	if n != 6 {
+		t.Errorf("expected 6 locations of the, got %d", n)
+	}
+}
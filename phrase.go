@@ -0,0 +1,258 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"fmt"
+	"sort"
+
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+// PhraseIterator iterates the documents in which the terms of a phrase
+// occur in order, each at most slop positions from where it would be in
+// the exact phrase, see Segment.PhraseIterator.  It is not safe for
+// concurrent use.
+type PhraseIterator struct {
+	slop  int
+	terms []*phraseTerm // in phrase order
+	order []*phraseTerm // by increasing doc frequency, to intersect the docs
+	done  bool
+
+	started bool   // once a document is returned
+	last    uint64 // the document last returned
+
+	next  PhrasePosting // reused across Next() calls
+	match []segment.Location
+}
+
+// phraseTerm is the postings iterator of a term of the phrase, and the
+// locations of the term in the document it is on
+type phraseTerm struct {
+	itr     *PostingsIterator
+	posting segment.Posting // nil before the first call to Advance
+	locs    []Location      // copied, the iterator reuses its own
+	count   uint64
+}
+
+// PhrasePosting is a document matching a phrase, and each occurrence of
+// the phrase in it
+type PhrasePosting struct {
+	docNum  uint64
+	matches []PhraseMatch
+	locs    []segment.Location // backs the matches
+}
+
+// Number returns the document number of this posting in this segment
+func (p *PhrasePosting) Number() uint64 {
+	return p.docNum
+}
+
+// Matches returns each occurrence of the phrase in the document, ordered
+// by the position of its first term
+func (p *PhrasePosting) Matches() []PhraseMatch {
+	return p.matches
+}
+
+// PhraseMatch is an occurrence of a phrase, the location of each of its
+// terms, in phrase order
+type PhraseMatch []segment.Location
+
+// PhraseIterator returns an iterator of the documents in which the terms
+// occur in the field in order, as a phrase.  Each term after the first may
+// be some positions away from where it would be in the exact phrase, the
+// distances adding up to at most slop, so a slop of 0 only matches the
+// exact phrase.  Only the fields indexed with their term locations can
+// match phrases.
+func (s *Segment) PhraseIterator(field string, terms [][]byte, slop int) (*PhraseIterator, error) {
+	if slop < 0 {
+		return nil, fmt.Errorf("phrase slop %d less than 0", slop)
+	}
+	rv := &PhraseIterator{slop: slop}
+	if len(terms) == 0 {
+		rv.done = true
+		return rv, nil
+	}
+	dict, err := s.dictionary(field)
+	if err != nil {
+		return nil, err
+	}
+	if dict == nil {
+		rv.done = true
+		return rv, nil
+	}
+
+	rv.terms = make([]*phraseTerm, len(terms))
+	for i, term := range terms {
+		var pl *PostingsList
+		pl, err = dict.postingsList(term, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var itr *PostingsIterator
+		itr, err = pl.iterator(true, false, true, nil)
+		if err != nil {
+			return nil, err
+		}
+		rv.terms[i] = &phraseTerm{itr: itr, count: pl.Count()}
+		if rv.terms[i].count == 0 {
+			rv.done = true
+		}
+	}
+	rv.order = append([]*phraseTerm(nil), rv.terms...)
+	sort.SliceStable(rv.order, func(i, j int) bool {
+		return rv.order[i].count < rv.order[j].count
+	})
+	rv.match = make([]segment.Location, len(terms))
+	return rv, nil
+}
+
+// Next returns the next document matching the phrase, or nil at the end,
+// the posting returned is reused by the next call
+func (i *PhraseIterator) Next() (*PhrasePosting, error) {
+	return i.Advance(0)
+}
+
+// Advance returns the first document at or after docNum, and after the
+// document last returned, matching the phrase, or nil at the end
+func (i *PhraseIterator) Advance(docNum uint64) (*PhrasePosting, error) {
+	if i.done {
+		return nil, nil
+	}
+	if i.started && docNum <= i.last {
+		docNum = i.last + 1
+	}
+	for {
+		var found bool
+		var err error
+		docNum, found, err = i.nextCommonDoc(docNum)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			i.done = true
+			return nil, nil
+		}
+		if i.findMatches(docNum) {
+			i.started = true
+			i.last = docNum
+			return &i.next, nil
+		}
+		docNum++
+	}
+}
+
+// nextCommonDoc advances the term iterators to the first document at or
+// after docNum on which they all are, rarest term first
+func (i *PhraseIterator) nextCommonDoc(docNum uint64) (uint64, bool, error) {
+	for agreed := 0; agreed < len(i.order); {
+		t := i.order[agreed]
+		if t.posting == nil || t.posting.Number() < docNum {
+			var err error
+			t.posting, err = t.itr.Advance(docNum)
+			if err != nil || t.posting == nil {
+				return 0, false, err
+			}
+		}
+		if t.posting.Number() > docNum {
+			docNum = t.posting.Number()
+			if agreed > 0 {
+				agreed = 0
+				continue
+			}
+		}
+		agreed++
+	}
+	return docNum, true, nil
+}
+
+// findMatches collects the occurrences of the phrase in the document all
+// the terms are on, reporting whether there are any
+func (i *PhraseIterator) findMatches(docNum uint64) bool {
+	for _, t := range i.terms {
+		t.locs = t.locs[:0]
+		for _, loc := range t.posting.Locations() {
+			t.locs = append(t.locs, *loc.(*Location))
+		}
+		if len(t.locs) == 0 {
+			return false
+		}
+		sort.SliceStable(t.locs, func(a, b int) bool {
+			return t.locs[a].pos < t.locs[b].pos
+		})
+	}
+
+	i.next.docNum = docNum
+	i.next.matches = i.next.matches[:0]
+	i.next.locs = i.next.locs[:0]
+	for j := range i.terms[0].locs {
+		i.match[0] = &i.terms[0].locs[j]
+		i.extend(1, 0)
+	}
+	// the matches index into locs once it stops growing
+	n := len(i.terms)
+	for j := range i.next.matches {
+		i.next.matches[j] = i.next.locs[j*n : (j+1)*n : (j+1)*n]
+	}
+	return len(i.next.matches) > 0
+}
+
+// extend tries each location of the term at index after the location of
+// the previous term in the match, recording the complete matches
+func (i *PhraseIterator) extend(index, dist int) {
+	if index == len(i.terms) {
+		i.next.locs = append(i.next.locs, i.match...)
+		i.next.matches = append(i.next.matches, nil)
+		return
+	}
+	prevPos := i.match[index-1].Pos()
+	for j := range i.terms[index].locs {
+		loc := &i.terms[index].locs[j]
+		if i.matched(index, loc.pos) {
+			continue
+		}
+		termDist := dist + absInt(loc.pos-(prevPos+1))
+		if termDist > i.slop {
+			if loc.pos > prevPos {
+				break // the later locations are further away
+			}
+			continue
+		}
+		i.match[index] = loc
+		i.extend(index+1, termDist)
+	}
+}
+
+// matched reports whether an earlier term of the match is at pos, as each
+// position holds a single term
+func (i *PhraseIterator) matched(index, pos int) bool {
+	for _, loc := range i.match[:index] {
+		if loc.Pos() == pos {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *PhraseIterator) Close() error {
+	return nil
+}
+
+func absInt(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,243 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+var phraseTestTitles = []string{
+	"the quick brown fox jumps over the lazy dog",
+	"the quick fox",
+	"quick the brown fox",
+	"the brown quick fox",
+	"fox brown quick the",
+	"to be or not to be",
+	"the the the quick quick",
+	"brown",
+	"the lazy brown dog and the quick brown fox",
+}
+
+// buildTestAnalysisResultsPhrase builds documents with the titles, indexed
+// with and without their locations
+func buildTestAnalysisResultsPhrase(start, end int) []segment.Document {
+	var results []segment.Document
+	for i := start; i < end; i++ {
+		title := phraseTestTitles[i%len(phraseTestTitles)]
+		doc := FakeDocument{
+			NewFakeField("_id", fmt.Sprintf("%05d", i), true, false, false),
+			NewFakeField("title", title, false, true, false),
+			NewFakeField("nolocs", title, false, false, false),
+		}
+		results = append(results, &doc)
+	}
+	return results
+}
+
+// naivePhraseMatches returns the positions of each occurrence of the
+// phrase in the title, trying every combination of positions
+func naivePhraseMatches(title string, phrase []string, slop int) [][]int {
+	tokens := strings.Split(title, " ")
+	var rv [][]int
+	var try func(match []int, dist int)
+	try = func(match []int, dist int) {
+		if len(match) == len(phrase) {
+			rv = append(rv, append([]int(nil), match...))
+			return
+		}
+		for pos := 1; pos <= len(tokens); pos++ {
+			if tokens[pos-1] != phrase[len(match)] {
+				continue
+			}
+			if len(match) == 0 {
+				try(append(match, pos), 0)
+				continue
+			}
+			if containsInt(match, pos) {
+				continue
+			}
+			prev := match[len(match)-1]
+			if d := dist + absInt(pos-(prev+1)); d <= slop {
+				try(append(match, pos), d)
+			}
+		}
+	}
+	try(nil, 0)
+	return rv
+}
+
+func containsInt(vals []int, val int) bool {
+	for _, v := range vals {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
+func phraseMatchPositions(p *PhrasePosting) [][]int {
+	var rv [][]int
+	for _, match := range p.Matches() {
+		var positions []int
+		for _, loc := range match {
+			positions = append(positions, loc.Pos())
+		}
+		rv = append(rv, positions)
+	}
+	return rv
+}
+
+func checkPhraseIterator(t *testing.T, seg *Segment, start int) {
+	phrases := []string{"quick", "the quick", "quick brown fox", "the fox", "brown fox", "to be", "the the",
+		"fox quick", "quick the", "lazy dog", "missing", "the missing", "be or not to be", "the quick the",
+		"to be or not to be"}
+	for _, phrase := range phrases {
+		var terms [][]byte
+		for _, term := range strings.Split(phrase, " ") {
+			terms = append(terms, []byte(term))
+		}
+		for slop := 0; slop <= 3; slop++ {
+			itr, err := seg.PhraseIterator("title", terms, slop)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for docNum := uint64(0); docNum < seg.Count(); docNum++ {
+				title := phraseTestTitles[(start+int(docNum))%len(phraseTestTitles)]
+				expected := naivePhraseMatches(title, strings.Split(phrase, " "), slop)
+				if len(expected) == 0 {
+					continue
+				}
+				p, err := itr.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if p == nil || p.Number() != docNum {
+					t.Fatalf("phrase %q slop %d: expected doc %d, got %v", phrase, slop, docNum, p)
+				}
+				if actual := phraseMatchPositions(p); !reflect.DeepEqual(actual, expected) {
+					t.Errorf("phrase %q slop %d doc %d: expected %v, got %v", phrase, slop, docNum, expected, actual)
+				}
+			}
+			p, err := itr.Next()
+			if err != nil || p != nil {
+				t.Errorf("phrase %q slop %d: expected end, got %v %v", phrase, slop, p, err)
+			}
+		}
+	}
+}
+
+func TestPhraseIterator(t *testing.T) {
+	segInt, _, err := New(buildTestAnalysisResultsPhrase(0, 50), encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := segInt.(*Segment)
+	checkPhraseIterator(t, seg, 0)
+
+	// the locations of the terms are those of the title
+	itr, err := seg.PhraseIterator("title", [][]byte{[]byte("brown"), []byte("fox")}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := itr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc := p.Matches()[0][1]
+	if p.Number() != 0 || loc.Start() != 16 || loc.End() != 19 || loc.Pos() != 4 {
+		t.Errorf("expected fox at 16-19 of doc 0, got doc %d %d-%d", p.Number(), loc.Start(), loc.End())
+	}
+
+	// advancing skips the docs before, and never goes back
+	p, err = itr.Advance(20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == nil || p.Number() != 20 {
+		t.Fatalf("expected doc 20, got %v", p)
+	}
+	p, err = itr.Advance(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == nil || p.Number() != 26 {
+		t.Fatalf("expected doc 26, got %v", p)
+	}
+
+	// a position is only used once in a match, so the repeated term needs
+	// a second occurrence
+	itr, err = seg.PhraseIterator("title", [][]byte{[]byte("the"), []byte("quick"), []byte("the")}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = itr.Advance(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != nil && p.Number() == 1 {
+		t.Errorf("expected \"the quick fox\" not to match \"the quick the\", got %v", phraseMatchPositions(p))
+	}
+
+	for _, test := range []struct {
+		field string
+		terms [][]byte
+	}{
+		{"nolocs", [][]byte{[]byte("quick"), []byte("brown")}},
+		{"missing", [][]byte{[]byte("quick")}},
+		{"title", nil},
+	} {
+		itr, err = seg.PhraseIterator(test.field, test.terms, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err = itr.Next()
+		if err != nil || p != nil {
+			t.Errorf("field %s: expected no match, got %v %v", test.field, p, err)
+		}
+	}
+
+	_, err = seg.PhraseIterator("title", [][]byte{[]byte("quick")}, -1)
+	if err == nil {
+		t.Errorf("expected error for negative slop")
+	}
+}
+
+func TestPhraseIteratorMerge(t *testing.T) {
+	var segments []segment.Segment
+	for i := 0; i < 2; i++ {
+		segInt, _, err := New(buildTestAnalysisResultsPhrase(i*30, (i+1)*30), encodeNorm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments = append(segments, segInt)
+	}
+	var merged bytes.Buffer
+	_, err := Merge(segments, []*roaring.Bitmap{nil, nil}, 1024).WriteTo(&merged, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg, err := load(segment.NewDataBytes(merged.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPhraseIterator(t, seg, 0)
+}
@@ -81,6 +81,7 @@ type PostingsList struct {
 	postingsOffset uint64
 	freqOffset     uint64
 	locOffset      uint64
+	impactsOffset  uint64
 	postings       *roaring.Bitmap
 	except         *roaring.Bitmap
 
@@ -154,6 +155,7 @@ func (p *PostingsList) iterator(includeFreq, includeNorm, includeLocs bool,
 		nextSegmentLocs := rv.nextSegmentLocs[:0]
 
 		buf := rv.buf
+		impacts := rv.impacts
 
 		*rv = PostingsIterator{} // clear the struct
 
@@ -164,11 +166,13 @@ func (p *PostingsList) iterator(includeFreq, includeNorm, includeLocs bool,
 		rv.nextSegmentLocs = nextSegmentLocs
 
 		rv.buf = buf
+		rv.impacts = impacts
 	}
 
 	rv.postings = p
 	rv.includeFreqNorm = includeFreq || includeNorm || includeLocs
 	rv.includeLocs = includeLocs
+	rv.locPayloads = includeLocs && p.sb != nil && p.sb.footer.format().hasPayloads()
 
 	if p.normBits1Hit != 0 {
 		// "1-hit" encoding
@@ -194,6 +198,8 @@ func (p *PostingsList) iterator(includeFreq, includeNorm, includeLocs bool,
 		if err != nil {
 			return nil, err
 		}
+		rv.freqNormReader.hasSkips = p.sb.footer.format().hasChunkSkips()
+		rv.freqNormReader.packed = packedChunks(p.sb.footer.chunkMode)
 	}
 
 	// initialize the loc chunk reader
@@ -203,6 +209,7 @@ func (p *PostingsList) iterator(includeFreq, includeNorm, includeLocs bool,
 		if err != nil {
 			return nil, err
 		}
+		rv.locReader.packed = packedChunks(p.sb.footer.chunkMode)
 	}
 
 	rv.all = p.postings.Iterator()
@@ -243,32 +250,20 @@ func (p *PostingsList) read(postingsOffset uint64, d *Dictionary) error {
 	}
 
 	// read the location of the freq/norm details
-	var n uint64
-	var read int
-
-	freqOffsetData, err := d.sb.data.Read(int(postingsOffset+n), int(postingsOffset+binary.MaxVarintLen64))
-	if err != nil {
-		return err
-	}
-	p.freqOffset, read = binary.Uvarint(freqOffsetData)
-	n += uint64(read)
-
-	locOffsetData, err := d.sb.data.Read(int(postingsOffset+n), int(postingsOffset+n+binary.MaxVarintLen64))
+	header, err := d.sb.footer.format().readPostingsHeader(d.sb.data, postingsOffset)
 	if err != nil {
 		return err
 	}
-	p.locOffset, read = binary.Uvarint(locOffsetData)
-	if p.locOffset > 0 && p.freqOffset > 0 {
-		p.locOffset += p.freqOffset
-	}
-	n += uint64(read)
+	p.freqOffset = header.freqOffset
+	p.locOffset = header.locOffset
+	p.impactsOffset = header.impactsOffset
+	n := header.n
 
 	postingsLenData, err := d.sb.data.Read(int(postingsOffset+n), int(postingsOffset+n+binary.MaxVarintLen64))
 	if err != nil {
 		return err
 	}
-	var postingsLen uint64
-	postingsLen, read = binary.Uvarint(postingsLenData)
+	postingsLen, read := binary.Uvarint(postingsLenData)
 	n += uint64(read)
 
 	roaringData, err := d.sb.data.Read(int(postingsOffset+n), int(postingsOffset+n+postingsLen))
@@ -285,8 +280,7 @@ func (p *PostingsList) read(postingsOffset uint64, d *Dictionary) error {
 		return fmt.Errorf("error loading roaring bitmap: %v", err)
 	}
 
-	p.chunkSize, err = getChunkSize(d.sb.footer.chunkMode,
-		p.postings.GetCardinality(), d.sb.footer.numDocs)
+	p.chunkSize, err = d.sb.postingsChunkSize(header, p.postings.GetCardinality())
 	if err != nil {
 		return err
 	}
@@ -294,6 +288,15 @@ func (p *PostingsList) read(postingsOffset uint64, d *Dictionary) error {
 	return nil
 }
 
+// postingsChunkSize returns the chunk size of the postings list with the
+// header and cardinality, recorded in the header since version 3
+func (s *Segment) postingsChunkSize(header postingsHeader, cardinality uint64) (uint64, error) {
+	if header.chunkSize > 0 {
+		return header.chunkSize, nil
+	}
+	return getChunkSize(s.footer.chunkMode, cardinality, s.footer.numDocs)
+}
+
 func (p *PostingsList) init1Hit(fstVal uint64) error {
 	docNum, normBits := fSTValDecode1Hit(fstVal)
 
@@ -303,7 +306,9 @@ func (p *PostingsList) init1Hit(fstVal uint64) error {
 	return nil
 }
 
-// PostingsIterator provides a way to iterate through the postings list
+// PostingsIterator provides a way to iterate through the postings list,
+// it is not safe for concurrent use, but any number of iterators of a
+// postings list may be used at once
 type PostingsIterator struct {
 	postings *PostingsList
 	all      roaring.IntPeekable
@@ -323,8 +328,12 @@ type PostingsIterator struct {
 
 	buf []byte
 
+	impacts       chunkImpacts // loaded on demand, see loadImpacts
+	impactsLoaded bool
+
 	includeFreqNorm bool
 	includeLocs     bool
+	locPayloads     bool // the locations flag their payloads, see hasPayloads
 }
 
 var emptyPostingsIterator = &PostingsIterator{}
@@ -392,7 +401,10 @@ func (i *PostingsIterator) skipFreqNormReadHasLocs() (bool, error) {
 		return false, fmt.Errorf("error reading freqHasLocs: %v", err)
 	}
 
-	i.freqNormReader.SkipUvarint() // Skip normBits.
+	err = i.freqNormReader.SkipUvarint() // Skip normBits.
+	if err != nil {
+		return false, fmt.Errorf("error skipping norm: %v", err)
+	}
 
 	return freqHasLocs&0x01 != 0, nil // See decodeFreqHasLocs() / hasLocs.
 }
@@ -414,25 +426,29 @@ func decodeFreqHasLocs(freqHasLocs uint64) (int, bool) {
 // readLocation processes all the integers on the stream representing a single
 // location.
 func (i *PostingsIterator) readLocation(l *Location) error {
-	// read off field
-	fieldID, err := i.locReader.readUvarint()
-	if err != nil {
-		return fmt.Errorf("error reading location field: %v", err)
-	}
-	// read off pos
-	pos, err := i.locReader.readUvarint()
-	if err != nil {
-		return fmt.Errorf("error reading location pos: %v", err)
-	}
-	// read off start
-	start, err := i.locReader.readUvarint()
+	// read off field, pos, start and end
+	var vals [4]uint64
+	err := i.locReader.readUvarints(vals[:])
 	if err != nil {
-		return fmt.Errorf("error reading location start: %v", err)
+		return fmt.Errorf("error reading location: %v", err)
 	}
-	// read off end
-	end, err := i.locReader.readUvarint()
-	if err != nil {
-		return fmt.Errorf("error reading location end: %v", err)
+	fieldID, pos, start, end := vals[0], vals[1], vals[2], vals[3]
+
+	l.payload = nil
+	if i.locPayloads {
+		var hasPayload bool
+		fieldID, hasPayload = decodeLocationField(fieldID)
+		if hasPayload {
+			var payloadLen uint64
+			payloadLen, err = i.locReader.readUvarint()
+			if err != nil {
+				return fmt.Errorf("error reading location payload length: %v", err)
+			}
+			l.payload, err = i.locReader.readBytes(int(payloadLen))
+			if err != nil {
+				return fmt.Errorf("error reading location payload: %v", err)
+			}
+		}
 	}
 
 	l.field = i.postings.sb.fieldsInv[fieldID]
@@ -549,32 +565,18 @@ func (i *PostingsIterator) nextDocNumAtOrAfter(atOrAfter uint64) (docNum uint64,
 	}
 
 	n := i.Actual.Next()
-	allN := i.all.Next()
-
-	nChunk := n / uint32(i.postings.chunkSize)
-
-	// when allN becomes >= to here, then allN is in the same chunk as nChunk.
-	allNReachesNChunk := nChunk * uint32(i.postings.chunkSize)
 
-	// n is the next actual hit (excluding some postings), and
-	// allN is the next hit in the full postings, and
-	// if they don't match, move 'all' forwards until they do
-	for allN != n {
-		// we've reached same chunk, so move the freq/norm/loc decoders forward
-		if i.includeFreqNorm && allN >= allNReachesNChunk {
-			err := i.currChunkNext(nChunk)
-			if err != nil {
-				return 0, false, err
-			}
-		}
+	// n is the next actual hit (excluding some postings), and the
+	// freq/norm/loc decoders are at the next hit in the full postings,
+	// so move 'all' and the decoders forwards to n
+	allN := i.all.PeekNext()
+	i.all.AdvanceIfNeeded(n)
+	i.all.Next()
 
-		allN = i.all.Next()
-	}
-
-	if i.includeFreqNorm && (i.currChunk != nChunk || i.freqNormReader.isNil()) {
-		err := i.loadChunk(int(nChunk))
+	if i.includeFreqNorm {
+		err := i.skipPostings(allN, n)
 		if err != nil {
-			return 0, false, fmt.Errorf("error loading chunk: %v", err)
+			return 0, false, err
 		}
 	}
 
@@ -595,41 +597,19 @@ func (i *PostingsIterator) nextDocNumAtOrAfterClean(
 		return uint64(i.Actual.Next()), true, nil
 	}
 
-	// freq-norm's needed, so maintain freq-norm chunk reader
-	sameChunkNexts := 0 // # of times we called Next() in the same chunk
-	n := i.Actual.Next()
-	nChunk := n / uint32(i.postings.chunkSize)
-
-	for uint64(n) < atOrAfter && i.Actual.HasNext() {
-		n = i.Actual.Next()
-
-		nChunkPrev := nChunk
-		nChunk = n / uint32(i.postings.chunkSize)
-
-		if nChunk != nChunkPrev {
-			sameChunkNexts = 0
-		} else {
-			sameChunkNexts++
-		}
-	}
-
-	if uint64(n) < atOrAfter {
-		// couldn't find anything
-		return 0, false, nil
-	}
+	// freq-norm's needed, so maintain freq-norm chunk reader, which is at
+	// the next hit
+	from := i.Actual.PeekNext()
+	i.Actual.AdvanceIfNeeded(uint32(atOrAfter))
 
-	for j := 0; j < sameChunkNexts; j++ {
-		err := i.currChunkNext(nChunk)
-		if err != nil {
-			return 0, false, fmt.Errorf("error optimized currChunkNext: %v", err)
-		}
+	if !i.Actual.HasNext() {
+		return 0, false, nil // couldn't find anything
 	}
 
-	if i.currChunk != nChunk || i.freqNormReader.isNil() {
-		err := i.loadChunk(int(nChunk))
-		if err != nil {
-			return 0, false, fmt.Errorf("error loading chunk: %v", err)
-		}
+	n := i.Actual.Next()
+	err = i.skipPostings(from, n)
+	if err != nil {
+		return 0, false, fmt.Errorf("error skipping postings: %v", err)
 	}
 
 	return uint64(n), true, nil
@@ -656,7 +636,10 @@ func (i *PostingsIterator) currChunkNext(nChunk uint32) error {
 		}
 
 		// skip over all the location bytes
-		i.locReader.SkipBytes(int(numLocsBytes))
+		err = i.locReader.SkipBytes(int(numLocsBytes))
+		if err != nil {
+			return fmt.Errorf("error skipping locations: %v", err)
+		}
 	}
 
 	return nil
@@ -737,15 +720,16 @@ func (p *Posting) Locations() []segment.Location {
 
 // Location represents the location of a single occurrence
 type Location struct {
-	field string
-	pos   int
-	start int
-	end   int
+	field   string
+	pos     int
+	start   int
+	end     int
+	payload []byte
 }
 
 func (l *Location) Size() int {
 	return reflectStaticSizeLocation +
-		len(l.field)
+		len(l.field) + len(l.payload)
 }
 
 // Field returns the name of the field (useful in composite fields to know
@@ -768,3 +752,9 @@ func (l *Location) End() int {
 func (l *Location) Pos() int {
 	return l.pos
 }
+
+// Payload returns the payload of this occurrence, nil if it has none, its
+// bytes are only valid until the iterator moves to the next posting
+func (l *Location) Payload() []byte {
+	return l.payload
+}
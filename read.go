@@ -16,49 +16,90 @@ package ice
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
 )
 
-func (s *Segment) getDocStoredMetaAndUnCompressed(docNum uint64) (meta, data []byte, err error) {
-	_, storedOffset, n, metaLen, dataLen, err := s.getDocStoredOffsets(docNum)
+// getDocStoredMetaAndUnCompressed returns the meta and data of the stored
+// fields of the doc number, decompressing its chunk into vdc.chunk
+func (s *Segment) getDocStoredMetaAndUnCompressed(vdc *visitDocumentCtx, docNum uint64) (meta, data []byte, err error) {
+	err = s.loadStoredIndexOnce()
 	if err != nil {
 		return nil, nil, err
 	}
-
-	meta = s.storedFieldChunkUncompressed[int(storedOffset+n):int(storedOffset+n+metaLen)]
-	data = s.storedFieldChunkUncompressed[int(storedOffset+n+metaLen):int(storedOffset+n+metaLen+dataLen)]
-	return meta, data, nil
-}
-
-func (s *Segment) getDocStoredOffsets(docNum uint64) (indexOffset, storedOffset, n, metaLen, dataLen uint64, err error) {
-	indexOffset, storedOffset, err = s.getDocStoredOffsetsOnly(docNum)
+	_, storedOffset, err := s.getDocStoredOffsetsOnly(docNum)
 	if err != nil {
-		return 0, 0, 0, 0, 0, err
+		return nil, nil, err
 	}
 
 	// document chunk coder
-	chunkI := docNum / uint64(defaultDocumentChunkSize)
-	chunkOffsetStart := s.storedFieldChunkOffsets[int(chunkI)]
-	chunkOffsetEnd := s.storedFieldChunkOffsets[int(chunkI)+1]
-	compressed, err := s.data.Read(int(chunkOffsetStart), int(chunkOffsetEnd))
+	chunkI, err := s.storedChunk(docNum)
 	if err != nil {
-		return 0, 0, 0, 0, 0, err
+		return nil, nil, err
 	}
-	s.storedFieldChunkUncompressed = s.storedFieldChunkUncompressed[:0]
-	s.storedFieldChunkUncompressed, err = ZSTDDecompress(s.storedFieldChunkUncompressed[:cap(s.storedFieldChunkUncompressed)], compressed)
+	uncompressed, err := s.storedChunkUncompressed(chunkI, &vdc.chunk)
 	if err != nil {
-		return 0, 0, 0, 0, 0, err
+		return nil, nil, err
 	}
+	return storedDocMetaAndData(uncompressed, storedOffset)
+}
 
-	metaLenData := s.storedFieldChunkUncompressed[int(storedOffset):int(storedOffset+binary.MaxVarintLen64)]
-	var read int
-	metaLen, read = binary.Uvarint(metaLenData)
-	n += uint64(read)
+// storedChunkUncompressed returns the chunk of stored fields decompressed,
+// from the chunk cache if any, else decompressing it into buf
+func (s *Segment) storedChunkUncompressed(chunk int, buf *[]byte) ([]byte, error) {
+	chunkOffsetStart := s.storedFieldChunkOffsets[chunk]
+	chunkOffsetEnd := s.storedFieldChunkOffsets[chunk+1]
+	if s.chunkCache != nil {
+		key := chunkCacheKey{segment: s.chunkCacheID, section: chunkCacheStored, chunk: uint64(chunk)}
+		return s.chunkCache.getOrLoad(key, func() ([]byte, error) {
+			compressed, err := s.data.Read(int(chunkOffsetStart), int(chunkOffsetEnd))
+			if err != nil {
+				return nil, err
+			}
+			// cached chunks are never reused as buffers
+			return s.decompressStored(nil, compressed)
+		})
+	}
+	compressed, err := s.data.Read(int(chunkOffsetStart), int(chunkOffsetEnd))
+	if err != nil {
+		return nil, err
+	}
+	*buf, err = s.decompressStored((*buf)[:cap(*buf)], compressed)
+	return *buf, err
+}
 
-	dataLenData := s.storedFieldChunkUncompressed[int(storedOffset+n):int(storedOffset+n+binary.MaxVarintLen64)]
-	dataLen, read = binary.Uvarint(dataLenData)
-	n += uint64(read)
+// decompressStored decompresses a chunk of stored fields, or a large value,
+// with the codec of the segment, which is closed once all the references
+// to the segment are released
+func (s *Segment) decompressStored(dst, src []byte) ([]byte, error) {
+	rv, err := s.storedCodec.Decompress(dst, src)
+	if errors.Is(err, errStoredCodecClosed) {
+		return nil, ErrSegmentClosed
+	}
+	return rv, err
+}
 
-	return indexOffset, storedOffset, n, metaLen, dataLen, nil
+// storedDocMetaAndData returns the meta and data of the document stored at
+// storedOffset in the uncompressed chunk
+func storedDocMetaAndData(uncompressed []byte, storedOffset uint64) (meta, data []byte, err error) {
+	if storedOffset >= uint64(len(uncompressed)) {
+		return nil, nil, fmt.Errorf("stored offset %d past end of chunk %d", storedOffset, len(uncompressed))
+	}
+	metaLen, read := binary.Uvarint(uncompressed[storedOffset:])
+	if read <= 0 {
+		return nil, nil, fmt.Errorf("invalid stored meta length at %d", storedOffset)
+	}
+	n := storedOffset + uint64(read)
+	dataLen, read := binary.Uvarint(uncompressed[n:])
+	if read <= 0 {
+		return nil, nil, fmt.Errorf("invalid stored data length at %d", storedOffset)
+	}
+	n += uint64(read)
+	if n+metaLen+dataLen > uint64(len(uncompressed)) {
+		return nil, nil, fmt.Errorf("stored meta and data at %d past end of chunk %d", storedOffset, len(uncompressed))
+	}
+	return uncompressed[n : n+metaLen], uncompressed[n+metaLen : n+metaLen+dataLen], nil
 }
 
 func (s *Segment) getDocStoredOffsetsOnly(docNum uint64) (indexOffset, storedOffset uint64, err error) {
@@ -70,3 +111,19 @@ func (s *Segment) getDocStoredOffsetsOnly(docNum uint64) (indexOffset, storedOff
 	storedOffset = binary.BigEndian.Uint64(storedOffsetData)
 	return indexOffset, storedOffset, nil
 }
+
+// storedChunk returns the chunk of stored fields holding docNum
+func (s *Segment) storedChunk(docNum uint64) (int, error) {
+	if docNum >= s.footer.numDocs {
+		return 0, fmt.Errorf("doc %d out of range of %d docs", docNum, s.footer.numDocs)
+	}
+	// the last chunk starting at or before docNum, as an empty chunk ends
+	// the chunks when the last is full
+	chunk := sort.Search(len(s.storedFieldChunkDocStarts), func(i int) bool {
+		return s.storedFieldChunkDocStarts[i] > docNum
+	}) - 1
+	if chunk < 0 || chunk+1 >= len(s.storedFieldChunkOffsets) {
+		return 0, fmt.Errorf("no stored chunk for doc %d", docNum)
+	}
+	return chunk, nil
+}
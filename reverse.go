@@ -0,0 +1,279 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/blevesearch/vellum"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+// ReverseTermsField is implemented by fields whose terms may also be
+// indexed with their bytes reversed, so Dictionary.SuffixIterator finds the
+// terms ending with a suffix without visiting every term
+type ReverseTermsField interface {
+	segment.Field
+
+	// ReverseTerms reports whether the terms of the field are also indexed
+	// reversed
+	ReverseTerms() bool
+}
+
+// indexesReverseTerms reports whether the field asks for its terms to be
+// indexed reversed
+func indexesReverseTerms(field segment.Field) bool {
+	reverseField, ok := field.(ReverseTermsField)
+	return ok && reverseField.ReverseTerms()
+}
+
+// reverseTerm is a term with its bytes reversed, and the offset of the
+// postings list of the term
+type reverseTerm struct {
+	term           []byte
+	postingsOffset uint64
+}
+
+// writeReverseDict writes out the length of the vellum FST of the terms of
+// the dictionary in vellumData with their bytes reversed, each mapped to
+// the postings list of the term, followed by the FST, or a length of 0 if
+// reverse is false
+func writeReverseDict(w io.Writer, vellumData []byte, reverse bool, buf []byte) error {
+	var reverseData []byte
+	if reverse {
+		var err error
+		reverseData, err = buildReverseFST(vellumData)
+		if err != nil {
+			return err
+		}
+	}
+
+	n := binary.PutUvarint(buf, uint64(len(reverseData)))
+	_, err := w.Write(buf[:n])
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(reverseData)
+	return err
+}
+
+// buildReverseFST returns the vellum FST of the terms of the FST in
+// vellumData with their bytes reversed, nil if it has no terms
+func buildReverseFST(vellumData []byte) ([]byte, error) {
+	fst, err := vellum.Load(vellumData)
+	if err != nil {
+		return nil, err
+	}
+	if fst.Len() == 0 {
+		return nil, nil
+	}
+
+	terms := make([]reverseTerm, 0, fst.Len())
+	itr, err := fst.Iterator(nil, nil)
+	for err == nil {
+		term, postingsOffset := itr.Current()
+		terms = append(terms, reverseTerm{term: reverseBytes(nil, term), postingsOffset: postingsOffset})
+		err = itr.Next()
+	}
+	if err != vellum.ErrIteratorDone {
+		return nil, err
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		return bytes.Compare(terms[i].term, terms[j].term) < 0
+	})
+
+	var reverseBuf bytes.Buffer
+	builder, err := vellum.New(&reverseBuf, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range terms {
+		err = builder.Insert(t.term, t.postingsOffset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = builder.Close()
+	if err != nil {
+		return nil, err
+	}
+	return reverseBuf.Bytes(), nil
+}
+
+// reverseBytes appends the bytes of b in reverse order to dst
+func reverseBytes(dst, b []byte) []byte {
+	for i := len(b) - 1; i >= 0; i-- {
+		dst = append(dst, b[i])
+	}
+	return dst
+}
+
+// fieldReverseFST returns the FST of the reversed terms of the field's
+// dictionary, nil if it has none, reading it on first use
+func (s *Segment) fieldReverseFST(fieldID uint16) (*vellum.FST, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	f := &s.fields[fieldID]
+	f.reverseOnce.Do(func() {
+		if f.dictLoc == 0 || !s.footer.format().hasReverseTerms() {
+			return
+		}
+		var start, end uint64
+		start, end, f.reverseErr = s.readReverseDictLoc(f.dictLoc)
+		if f.reverseErr != nil || start == end {
+			return
+		}
+		var reverseData []byte
+		reverseData, f.reverseErr = s.data.Read(int(start), int(end))
+		if f.reverseErr != nil {
+			return
+		}
+		f.reverse, f.reverseErr = vellum.Load(reverseData)
+		if f.reverseErr == nil {
+			s.addSize(sizeOfPtr + s.readSize(reverseData))
+		}
+	})
+	return f.reverse, f.reverseErr
+}
+
+// readReverseDictLoc returns where the FST of the reversed terms following
+// the top terms of the dictionary at dictLoc starts and ends
+func (s *Segment) readReverseDictLoc(dictLoc uint64) (start, end uint64, err error) {
+	_, topTermsEnd, err := s.readTopTerms(dictLoc)
+	if err != nil {
+		return 0, 0, err
+	}
+	reverseLen, n, err := readUvarintAt(s.data, topTermsEnd)
+	if err != nil {
+		return 0, 0, err
+	}
+	start = topTermsEnd + n
+	end = start + reverseLen
+	if end > uint64(s.data.Len()) {
+		return 0, 0, fmt.Errorf("reverse dictionary end %d past data len %d", end, s.data.Len())
+	}
+	return start, end, nil
+}
+
+// hasReverseTerms reports whether the terms of the field are indexed
+// reversed in the segment
+func (s *Segment) hasReverseTerms(field string) (bool, error) {
+	fieldIDPlus1 := s.fieldsMap[field]
+	if fieldIDPlus1 == 0 {
+		return false, nil
+	}
+	fst, err := s.fieldReverseFST(fieldIDPlus1 - 1)
+	return fst != nil, err
+}
+
+// mergedReverseTerms reports whether the terms of the field are indexed
+// reversed in any of the segments, and so in the merged segment
+func mergedReverseTerms(segments []*Segment, field string) (bool, error) {
+	for _, seg := range segments {
+		reverse, err := seg.hasReverseTerms(field)
+		if err != nil || reverse {
+			return reverse, err
+		}
+	}
+	return false, nil
+}
+
+// SuffixIterator returns an iterator which only visits the terms ending
+// with suffix.  When the terms of the field are indexed reversed, only the
+// terms ending with suffix are read, and they are visited in the order of
+// their reversed bytes, otherwise every term of the dictionary is read, and
+// they are visited in order.
+func (d *Dictionary) SuffixIterator(suffix string) segment.DictionaryIterator {
+	if d.fst == nil {
+		return emptyDictionaryIterator
+	}
+	reverse, err := d.sb.fieldReverseFST(d.fieldID)
+	if err != nil {
+		return &DictionaryIterator{err: err}
+	}
+	if reverse == nil {
+		return d.expansionIterator(newSuffixAutomaton([]byte(suffix)), nil)
+	}
+
+	rv := &DictionaryIterator{
+		d:             d,
+		reversed:      true,
+		maxExpansions: d.sb.maxExpansions,
+	}
+	prefix := reverseBytes(nil, []byte(suffix))
+	itr, err := reverse.Search(nil, prefix, prefixSuccessor(prefix))
+	if err == nil {
+		rv.itr = itr
+	} else if err != vellum.ErrIteratorDone {
+		rv.err = err
+	}
+	return rv
+}
+
+// suffixAutomaton matches the keys ending with the suffix, each state is
+// the length of the longest prefix of the suffix the key read ends with
+type suffixAutomaton struct {
+	suffix []byte
+	fail   []int // the state after a byte not continuing each state
+}
+
+func newSuffixAutomaton(suffix []byte) *suffixAutomaton {
+	// the failure function of Knuth-Morris-Pratt
+	fail := make([]int, len(suffix)+1)
+	k := 0
+	for i := 1; i < len(suffix); i++ {
+		for k > 0 && suffix[i] != suffix[k] {
+			k = fail[k]
+		}
+		if suffix[i] == suffix[k] {
+			k++
+		}
+		fail[i+1] = k
+	}
+	return &suffixAutomaton{suffix: suffix, fail: fail}
+}
+
+func (a *suffixAutomaton) Start() int {
+	return 0
+}
+
+func (a *suffixAutomaton) IsMatch(state int) bool {
+	return state == len(a.suffix)
+}
+
+func (a *suffixAutomaton) CanMatch(int) bool {
+	return true
+}
+
+func (a *suffixAutomaton) WillAlwaysMatch(int) bool {
+	return len(a.suffix) == 0
+}
+
+func (a *suffixAutomaton) Accept(state int, b byte) int {
+	for {
+		if state < len(a.suffix) && a.suffix[state] == b {
+			return state + 1
+		}
+		if state == 0 {
+			return 0
+		}
+		state = a.fail[state]
+	}
+}
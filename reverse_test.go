@@ -0,0 +1,256 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+var reverseTestHosts = []string{"example.com", "mail.example.com", "example.org", "test.com", "com", "moc", ""}
+
+// buildTestAnalysisResultsReverse builds documents with an email indexed
+// reversed, and a host which is not
+func buildTestAnalysisResultsReverse(start, end int) []segment.Document {
+	var results []segment.Document
+	for i := start; i < end; i++ {
+		host := reverseTestHosts[i%len(reverseTestHosts)]
+		doc := &FakeTypedDocument{
+			FakeDocument: FakeDocument{
+				NewFakeField("_id", fmt.Sprintf("%05d", i), true, false, false),
+				NewFakeField("host", host, false, false, false),
+			},
+			Typed: []segment.Field{NewFakeReverseTermsField("email", fmt.Sprintf("user%d@%s", i%10, host))},
+		}
+		results = append(results, doc)
+	}
+	return results
+}
+
+// suffixTerms returns the terms and counts the iterator visits, sorted by
+// term, and the dictionary terms ending with suffix with their counts
+func suffixTerms(t *testing.T, dict *Dictionary, suffix string) (actual, expected []string) {
+	itr := dict.SuffixIterator(suffix)
+	for entry, err := itr.Next(); entry != nil || err != nil; entry, err = itr.Next() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual = append(actual, fmt.Sprintf("%s %d", entry.Term(), entry.Count()))
+	}
+	sort.Strings(actual)
+
+	all := dict.Iterator(nil, nil, nil)
+	for entry, err := all.Next(); entry != nil || err != nil; entry, err = all.Next() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(entry.Term(), suffix) {
+			expected = append(expected, fmt.Sprintf("%s %d", entry.Term(), entry.Count()))
+		}
+	}
+	return actual, expected
+}
+
+func checkSuffixIterator(t *testing.T, seg *Segment, reversed bool) {
+	for _, field := range []string{"email", "host"} {
+		dictInt, err := seg.Dictionary(field)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dict := dictInt.(*Dictionary)
+		reverse, err := seg.fieldReverseFST(dict.fieldID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (reverse != nil) != (reversed && field == "email") {
+			t.Errorf("field %s: expected reversed terms %t", field, reversed && field == "email")
+		}
+		for _, suffix := range []string{"", ".com", "example.com", "@com", "m", "x", "user1@", "c"} {
+			actual, expected := suffixTerms(t, dict, suffix)
+			if strings.Join(actual, ",") != strings.Join(expected, ",") {
+				t.Errorf("field %s suffix %q: expected %v, got %v", field, suffix, expected, actual)
+			}
+		}
+	}
+	err := seg.Verify(context.Background())
+	if err != nil {
+		t.Errorf("expected segment to verify, got: %v", err)
+	}
+}
+
+func TestSuffixIterator(t *testing.T) {
+	results := buildTestAnalysisResultsReverse(0, 100)
+	segInt, _, err := New(results, encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := segInt.(*Segment)
+	checkSuffixIterator(t, seg, true)
+
+	b := NewBuilder(encodeNorm, WithMemoryBudget(1<<10))
+	defer func() { _ = b.Close() }()
+	for _, result := range results {
+		err = b.Add(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var built bytes.Buffer
+	_, err = b.WriteTo(&built)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected bytes.Buffer
+	_, err = seg.WriteTo(&expected, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(built.Bytes(), expected.Bytes()) {
+		t.Errorf("expected Builder segment to match New segment")
+	}
+
+	// reversed terms visited in the order of their reversed bytes
+	dict, err := seg.dictionary("email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	itr := dict.SuffixIterator("@example.com")
+	var prev []byte
+	for entry, err := itr.Next(); entry != nil || err != nil; entry, err = itr.Next() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		reversed := reverseBytes(nil, []byte(entry.Term()))
+		if bytes.Compare(prev, reversed) >= 0 {
+			t.Errorf("expected %q after %q reversed", entry.Term(), prev)
+		}
+		prev = reversed
+	}
+}
+
+func TestSuffixIteratorMerge(t *testing.T) {
+	var segments []segment.Segment
+	for i := 0; i < 3; i++ {
+		segInt, _, err := New(buildTestAnalysisResultsReverse(i*50, (i+1)*50), encodeNorm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments = append(segments, segInt)
+	}
+	drops := []*roaring.Bitmap{roaring.BitmapOf(0, 2, 4, 6), nil, roaring.BitmapOf(49)}
+
+	var expected []byte
+	for _, workers := range []int{1, 2} {
+		t.Run(fmt.Sprintf("workers %d", workers), func(t *testing.T) {
+			var merged bytes.Buffer
+			_, err := MergeWithOptions(segments, drops, 1024, WithMergeWorkers(workers)).WriteTo(&merged, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected == nil {
+				expected = merged.Bytes()
+			} else if !bytes.Equal(merged.Bytes(), expected) {
+				t.Errorf("expected parallel merge to match serial merge")
+			}
+			seg, err := load(segment.NewDataBytes(merged.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkSuffixIterator(t, seg, true)
+		})
+	}
+
+	// merged with an older version, whose terms are not reversed
+	var merged bytes.Buffer
+	_, err := Merge([]segment.Segment{loadTestFile(t, "testdata/v2.ice"), segments[0]},
+		[]*roaring.Bitmap{nil, nil}, 1024).WriteTo(&merged, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg, err := load(segment.NewDataBytes(merged.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSuffixIterator(t, seg, true)
+}
+
+func TestSuffixIteratorNotReversed(t *testing.T) {
+	seg := loadTestFile(t, "testdata/v2.ice")
+	dictInt, err := seg.Dictionary("body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, expected := suffixTerms(t, dictInt.(*Dictionary), "e")
+	if len(actual) == 0 || strings.Join(actual, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+
+	segInt, _, err := NewWithOptions(buildTestAnalysisResultsReverse(0, 100), encodeNorm, WithMaxExpansions(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"email", "host"} {
+		dictInt, err = segInt.Dictionary(field)
+		if err != nil {
+			t.Fatal(err)
+		}
+		itr := dictInt.(*Dictionary).SuffixIterator("m")
+		for i := 0; i < 3; i++ {
+			_, err = itr.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err = itr.Next()
+		if !errors.Is(err, ErrTooManyExpansions) {
+			t.Errorf("field %s: expected too many expansions, got %v", field, err)
+		}
+	}
+}
+
+func TestSuffixAutomaton(t *testing.T) {
+	for _, test := range []struct {
+		suffix string
+		key    string
+		match  bool
+	}{
+		{"", "", true},
+		{"", "abc", true},
+		{"abc", "abc", true},
+		{"abc", "xabc", true},
+		{"abc", "ababc", true},
+		{"aab", "aaab", true},
+		{"abab", "abaabab", true},
+		{"abc", "abcx", false},
+		{"abc", "bc", false},
+	} {
+		a := newSuffixAutomaton([]byte(test.suffix))
+		state := a.Start()
+		for i := 0; i < len(test.key); i++ {
+			state = a.Accept(state, test.key[i])
+		}
+		if a.IsMatch(state) != test.match {
+			t.Errorf("suffix %q key %q: expected match %t", test.suffix, test.key, test.match)
+		}
+	}
+}
@@ -20,48 +20,199 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/RoaringBitmap/roaring"
 	"github.com/blevesearch/vellum"
 	segment "github.com/blugelabs/bluge_segment_api"
 )
 
-const Version uint32 = 2
+const Version uint32 = 3
 
 const Type string = "ice"
 
+// Segment is a loaded segment.  It is safe for concurrent use by multiple
+// goroutines, its per call state being held in pooled contexts.  The
+// readers it returns, such as a Dictionary, PostingsIterator,
+// DocumentValueReader, NumericDocValues or SortedSetDocValues, each hold
+// their current position or chunk, so each is for one goroutine at a time.
+//
+// The one loading a segment holds a reference to it, released by Close,
+// and others may hold more, see Acquire.  Once all are released, what the
+// segment read from its data is freed, and using it returns
+// ErrSegmentClosed.
 type Segment struct {
+	size   uint64 // resident bytes, first for atomic access, see Size
+	refs   int64  // references held, see Acquire
+	closed uint32 // 1 once closed, 2 once all references are released
+
 	data   *segment.Data
 	footer *footer
 
-	fieldsMap  map[string]uint16 // fieldName -> fieldID+1
-	fieldsInv  []string          // fieldID -> fieldName
-	fieldDocs  map[uint16]uint64 // fieldID -> # docs with value in field
-	fieldFreqs map[uint16]uint64 // fieldID -> # total tokens in field
+	fieldsMap map[string]uint16 // fieldName -> fieldID+1
+	fieldsInv []string          // fieldID -> fieldName
+	fields    []segmentField    // fieldID -> state read on first use
+
+	// the stored field chunk index, read on first use, see
+	// loadStoredIndexOnce
+	storedOnce                sync.Once
+	storedErr                 error
+	storedFieldChunkOffsets   []uint64 // stored field chunk offset
+	storedFieldChunkDocStarts []uint64 // first doc num of each stored field chunk
+	storedCodec               StoredCodec
+	storedChunkDocs           uint64
+	storedChunkBytes          uint64
+	storedLargeThreshold      uint64
+	storedLargeStart          uint64 // start of the large value region
+	storedLargeLen            uint64
+
+	// where the doc values of each field are, read on first use, see
+	// loadDocValueIndexOnce
+	dvIndexOnce sync.Once
+	dvIndexErr  error
+
+	chunkCache   *ChunkCache // shared by segments, nil unless loaded with one
+	chunkCacheID uint64
+
+	maxExpansions int // see WithMaxExpansions
+
+	sort []SortField
+}
+
+// segmentField is the state of a field of a segment.  Loading a segment
+// only reads the name and dictionary location of each field, the other
+// parts are read on first use, each behind its own sync.Once, so opening a
+// segment with many fields costs little when few are used.  An error
+// reading a part is returned by each of its uses.
+type segmentField struct {
+	dictLoc   uint64
+	statsAddr uint64 // of the docs and freqs in the field's entry
+
+	// set by the doc value index
+	dvStart, dvEnd  uint64
+	numericHeader   uint64
+	hasNumeric      bool
+	sortedSetHeader uint64
+	hasSortedSet    bool
+
+	statsOnce sync.Once
+	docs      uint64 // # docs with value in field
+	freqs     uint64 // # total tokens in field
+	statsErr  error
+
+	fstOnce sync.Once
+	fst     *vellum.FST
+	fstErr  error
+
+	dvOnce   sync.Once
+	dvReader *docValueReader
+	dvErr    error
+
+	numericOnce sync.Once
+	numeric     *numericColumnMeta
+	numericErr  error
+
+	sortedSetOnce sync.Once
+	sortedSet     *sortedSetColumnMeta
+	sortedSetErr  error
+
+	topTermsOnce sync.Once
+	topTerms     []DictEntry
+	topTermsErr  error
+
+	reverseOnce sync.Once
+	reverse     *vellum.FST
+	reverseErr  error
+}
+
+// ErrSegmentClosed is returned using a segment once all its references
+// are released, see Close
+var ErrSegmentClosed = fmt.Errorf("segment closed")
+
+// Acquire takes a reference to the segment, so it stays open until the
+// reference is released, even when closed meanwhile.  It fails once the
+// segment is closed and all its references released.
+func (s *Segment) Acquire() error {
+	for {
+		refs := atomic.LoadInt64(&s.refs)
+		if refs <= 0 {
+			return ErrSegmentClosed
+		}
+		if atomic.CompareAndSwapInt64(&s.refs, refs, refs+1) {
+			return nil
+		}
+	}
+}
 
-	storedFieldChunkOffsets      []uint64 // stored field chunk offset
-	storedFieldChunkUncompressed []byte   // for uncompress cache
+// Release releases a reference taken by Acquire, the last one freeing
+// what the segment read from its data.  The readers the holder obtained
+// from the segment are not to be used after.
+func (s *Segment) Release() error {
+	refs := atomic.AddInt64(&s.refs, -1)
+	if refs < 0 {
+		atomic.AddInt64(&s.refs, 1)
+		return fmt.Errorf("segment released more than acquired")
+	}
+	if refs == 0 {
+		s.free()
+	}
+	return nil
+}
 
-	dictLocs       []uint64
-	fieldDvReaders map[uint16]*docValueReader // naive chunk cache per field
-	fieldDvNames   []string                   // field names cached in fieldDvReaders
-	size           uint64
+// Close releases the reference of the one which loaded the segment, once,
+// see Release.  The data of the segment is not closed, it belongs to the
+// caller of Load, and is to be kept until all references are released.
+func (s *Segment) Close() error {
+	if !atomic.CompareAndSwapUint32(&s.closed, 0, 1) {
+		return nil
+	}
+	return s.Release()
+}
 
-	// state loaded dynamically
-	m         sync.Mutex
-	fieldFSTs map[uint16]*vellum.FST
+// free drops the chunks of the segment in the chunk cache, releases the
+// stored codec loaded with the segment, and stops counting the state read
+// on first use in its size.  That state is left for the garbage collector,
+// as calls which found the segment open before it was freed may still be
+// using it, only the calls after fail with ErrSegmentClosed.
+func (s *Segment) free() {
+	atomic.StoreUint32(&s.closed, 2)
+	if closer, ok := s.storedCodec.(io.Closer); ok {
+		_ = closer.Close()
+	}
+	if s.chunkCache != nil {
+		s.chunkCache.removeSegment(s.chunkCacheID)
+	}
+	s.updateSize()
+}
+
+// checkOpen returns ErrSegmentClosed once all references to the segment
+// are released
+func (s *Segment) checkOpen() error {
+	if atomic.LoadUint32(&s.closed) > 1 {
+		return ErrSegmentClosed
+	}
+	return nil
 }
 
 func (s *Segment) WriteTo(w io.Writer, _ chan struct{}) (int64, error) {
+	if err := s.checkOpen(); err != nil {
+		return 0, err
+	}
 	bw := bufio.NewWriter(w)
 
-	n, err := s.data.WriteTo(w)
+	// recompute the CRC of the data as it is written, as the footer of a
+	// loaded segment holds the CRC of the whole file, footer included
+	cw := newCountHashWriter(w)
+	n, err := s.data.WriteTo(cw)
 	if err != nil {
 		return n, fmt.Errorf("error persisting segment: %w", err)
 	}
 
-	err = persistFooter(s.footer, bw)
+	footer := *s.footer
+	footer.crc = cw.Sum32()
+	err = persistFooter(&footer, bw)
 	if err != nil {
 		return n, fmt.Errorf("error persisting segment footer: %w", err)
 	}
@@ -71,7 +222,7 @@ func (s *Segment) WriteTo(w io.Writer, _ chan struct{}) (int64, error) {
 		return n, err
 	}
 
-	return n + footerLen, nil
+	return n + int64(footer.length()), nil
 }
 
 func (s *Segment) Type() string {
@@ -83,10 +234,13 @@ func (s *Segment) Version() uint32 {
 	return s.footer.version
 }
 
+// Size returns the bytes the segment holds in memory, which grow as the
+// parts of its fields are read on first use
 func (s *Segment) Size() int {
-	return int(s.size)
+	return int(atomic.LoadUint64(&s.size))
 }
 
+// updateSize sets the size of what a segment holds once loaded
 func (s *Segment) updateSize() {
 	sizeInBytes := reflectStaticSizeSegment +
 		s.data.Size()
@@ -96,21 +250,27 @@ func (s *Segment) updateSize() {
 		sizeInBytes += (len(k) + sizeOfString) + sizeOfUint16
 	}
 
-	// fieldsInv, dictLocs
+	// fieldsInv, fields
 	for _, entry := range s.fieldsInv {
 		sizeInBytes += len(entry) + sizeOfString
 	}
-	sizeInBytes += len(s.dictLocs) * sizeOfUint64
+	sizeInBytes += len(s.fields) * reflectStaticSizeSegmentField
 
-	// fieldDvReaders
-	for _, v := range s.fieldDvReaders {
-		sizeInBytes += sizeOfUint16 + sizeOfPtr
-		if v != nil {
-			sizeInBytes += v.size()
-		}
-	}
+	atomic.StoreUint64(&s.size, uint64(sizeInBytes))
+}
 
-	s.size = uint64(sizeInBytes)
+// addSize adds the size of a part read on first use
+func (s *Segment) addSize(sizeInBytes int) {
+	atomic.AddUint64(&s.size, uint64(sizeInBytes))
+}
+
+// readSize returns the size of data read, which is only held in memory on
+// top of the segment's data when that data is not itself in memory
+func (s *Segment) readSize(data []byte) int {
+	if s.data.Size() > 0 {
+		return 0
+	}
+	return len(data)
 }
 
 // DictionaryReader returns the term dictionary for the specified field
@@ -123,6 +283,9 @@ func (s *Segment) Dictionary(field string) (segment.Dictionary, error) {
 }
 
 func (s *Segment) dictionary(field string) (rv *Dictionary, err error) {
+	if err = s.checkOpen(); err != nil {
+		return nil, err
+	}
 	fieldIDPlus1 := s.fieldsMap[field]
 	if fieldIDPlus1 > 0 {
 		rv = &Dictionary{
@@ -131,33 +294,11 @@ func (s *Segment) dictionary(field string) (rv *Dictionary, err error) {
 			fieldID: fieldIDPlus1 - 1,
 		}
 
-		dictStart := s.dictLocs[rv.fieldID]
-		if dictStart > 0 {
-			var ok bool
-			s.m.Lock()
-			if rv.fst, ok = s.fieldFSTs[rv.fieldID]; !ok {
-				// read the length of the vellum data
-				var vellumLenData []byte
-				vellumLenData, err = s.data.Read(int(dictStart), int(dictStart+binary.MaxVarintLen64))
-				if err != nil {
-					return nil, err
-				}
-				vellumLen, read := binary.Uvarint(vellumLenData)
-				var fstBytes []byte
-				fstBytes, err = s.data.Read(int(dictStart+uint64(read)), int(dictStart+uint64(read)+vellumLen))
-				if err != nil {
-					return nil, err
-				}
-				rv.fst, err = vellum.Load(fstBytes)
-				if err != nil {
-					s.m.Unlock()
-					return nil, fmt.Errorf("dictionary field %s vellum err: %v", field, err)
-				}
-
-				s.fieldFSTs[rv.fieldID] = rv.fst
-			}
-
-			s.m.Unlock()
+		rv.fst, err = s.fieldFST(rv.fieldID)
+		if err != nil {
+			return nil, fmt.Errorf("dictionary field %s vellum err: %v", field, err)
+		}
+		if rv.fst != nil {
 			rv.fstReader, err = rv.fst.Reader()
 			if err != nil {
 				return nil, fmt.Errorf("dictionary field %s vellum reader err: %v", field, err)
@@ -168,11 +309,46 @@ func (s *Segment) dictionary(field string) (rv *Dictionary, err error) {
 	return rv, nil
 }
 
+// fieldFST returns the FST of the field's dictionary, nil if it has none,
+// reading it on first use
+func (s *Segment) fieldFST(fieldID uint16) (*vellum.FST, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	f := &s.fields[fieldID]
+	f.fstOnce.Do(func() {
+		if f.dictLoc == 0 {
+			return
+		}
+		// read the length of the vellum data
+		vellumLenData, err := s.data.Read(int(f.dictLoc), int(f.dictLoc+binary.MaxVarintLen64))
+		if err != nil {
+			f.fstErr = err
+			return
+		}
+		vellumLen, read := binary.Uvarint(vellumLenData)
+		fstBytes, err := s.data.Read(int(f.dictLoc+uint64(read)), int(f.dictLoc+uint64(read)+vellumLen))
+		if err != nil {
+			f.fstErr = err
+			return
+		}
+		f.fst, f.fstErr = vellum.Load(fstBytes)
+		if f.fstErr == nil {
+			s.addSize(sizeOfPtr + s.readSize(fstBytes))
+		}
+	})
+	return f.fst, f.fstErr
+}
+
 // visitDocumentCtx holds data structures that are reusable across
 // multiple VisitStoredFields() calls to avoid memory allocations
 type visitDocumentCtx struct {
-	buf    []byte
-	reader bytes.Reader
+	buf     []byte // the large values of the document
+	large   []byte
+	fields  []bool
+	chunk   []byte
+	records []byte
+	reader  bytes.Reader
 }
 
 var visitDocumentCtxPool = sync.Pool{
@@ -190,44 +366,226 @@ func (s *Segment) VisitStoredFields(num uint64, visitor segment.StoredFieldVisit
 	return s.visitDocument(vdc, num, visitor)
 }
 
+// VisitStoredFieldsSubset invokes the visitor for each stored field of the
+// specified doc number among fields, skipping the others without reading
+// their values.  Unlike VisitStoredFields, the large values of the skipped
+// fields are never decompressed, see WithStoredLargeValues.
+func (s *Segment) VisitStoredFieldsSubset(num uint64, fields []string, visitor segment.StoredFieldVisitor) error {
+	vdc := visitDocumentCtxPool.Get().(*visitDocumentCtx)
+	defer visitDocumentCtxPool.Put(vdc)
+
+	// translate the names to field ids once
+	vdc.fields = vdc.fields[:0]
+	for _, field := range fields {
+		fieldIDPlus1 := int(s.fieldsMap[field])
+		if fieldIDPlus1 == 0 {
+			continue
+		}
+		for len(vdc.fields) < fieldIDPlus1 {
+			vdc.fields = append(vdc.fields, false)
+		}
+		vdc.fields[fieldIDPlus1-1] = true
+	}
+	if len(vdc.fields) == 0 {
+		// none of the fields exist in this segment
+		return nil
+	}
+	return s.visitDocumentFields(vdc, num, vdc.fields, visitor)
+}
+
+// VisitStoredFieldsBatch invokes the visitor for each stored field of each
+// of the doc numbers, in their order, skipping those out of range.  Unlike
+// calling VisitStoredFields for each, the chunk of stored fields of several
+// documents is decompressed once, the documents requested being read in
+// chunk order, and held until they are visited.  The visitor returning
+// false skips the remaining fields of that document.
+func (s *Segment) VisitStoredFieldsBatch(docNums []uint64,
+	visitor func(docNum uint64, field string, value []byte) bool) error {
+	vdc := visitDocumentCtxPool.Get().(*visitDocumentCtx)
+	defer visitDocumentCtxPool.Put(vdc)
+
+	records, err := s.storedBatchRecords(vdc, docNums)
+	if err != nil {
+		return err
+	}
+	for i, record := range records {
+		if !record.ok {
+			continue
+		}
+		docNum := docNums[i]
+		meta := vdc.records[record.start : record.start+record.metaLen]
+		data := vdc.records[record.start+record.metaLen : record.start+record.metaLen+record.dataLen]
+		err = s.visitStoredDoc(vdc, meta, data, nil, func(field string, value []byte) bool {
+			return visitor(docNum, field, value)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storedDocRecord locates the meta and data of a document requested in a
+// batch, copied out of its chunk
+type storedDocRecord struct {
+	start   int
+	metaLen int
+	dataLen int
+	ok      bool
+}
+
+// storedBatchRecords copies the meta and data of each of the doc numbers
+// in range to vdc.records, decompressing each chunk once
+func (s *Segment) storedBatchRecords(vdc *visitDocumentCtx, docNums []uint64) ([]storedDocRecord, error) {
+	if err := s.loadStoredIndexOnce(); err != nil {
+		return nil, err
+	}
+
+	// the requests in order of doc number, hence of chunk
+	order := make([]int, 0, len(docNums))
+	for i, docNum := range docNums {
+		if docNum < s.footer.numDocs {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return docNums[order[i]] < docNums[order[j]]
+	})
+
+	// copy the meta and data of each document out of its chunk
+	records := make([]storedDocRecord, len(docNums))
+	vdc.records = vdc.records[:0]
+	chunk := -1
+	var uncompressed []byte
+	for i, request := range order {
+		docNum := docNums[request]
+		if i > 0 && docNums[order[i-1]] == docNum {
+			records[request] = records[order[i-1]]
+			continue
+		}
+		docChunk, err := s.storedChunk(docNum)
+		if err != nil {
+			return nil, err
+		}
+		if docChunk != chunk {
+			uncompressed, err = s.storedChunkUncompressed(docChunk, &vdc.chunk)
+			if err != nil {
+				return nil, err
+			}
+			chunk = docChunk
+		}
+		_, storedOffset, err := s.getDocStoredOffsetsOnly(docNum)
+		if err != nil {
+			return nil, err
+		}
+		meta, data, err := storedDocMetaAndData(uncompressed, storedOffset)
+		if err != nil {
+			return nil, err
+		}
+		start := len(vdc.records)
+		vdc.records = append(append(vdc.records, meta...), data...)
+		records[request] = storedDocRecord{start: start, metaLen: len(meta), dataLen: len(data), ok: true}
+	}
+	return records, nil
+}
+
 func (s *Segment) visitDocument(vdc *visitDocumentCtx, num uint64,
+	visitor segment.StoredFieldVisitor) error {
+	return s.visitDocumentFields(vdc, num, nil, visitor)
+}
+
+// visitDocumentFields visits the stored fields of the doc number whose
+// field id is true in fields, or all of them when fields is nil
+func (s *Segment) visitDocumentFields(vdc *visitDocumentCtx, num uint64, fields []bool,
 	visitor segment.StoredFieldVisitor) error {
 	// first make sure this is a valid number in this segment
-	if num < s.footer.numDocs {
-		meta, uncompressed, err := s.getDocStoredMetaAndUnCompressed(num)
+	if num >= s.footer.numDocs {
+		return nil
+	}
+	meta, uncompressed, err := s.getDocStoredMetaAndUnCompressed(vdc, num)
+	if err != nil {
+		return err
+	}
+	return s.visitStoredDoc(vdc, meta, uncompressed, fields, visitor)
+}
+
+// visitStoredDoc visits the stored fields of the meta and data of a
+// document whose field id is true in fields, or all of them when fields is
+// nil
+func (s *Segment) visitStoredDoc(vdc *visitDocumentCtx, meta, uncompressed []byte, fields []bool,
+	visitor segment.StoredFieldVisitor) error {
+	vdc.reader.Reset(meta)
+	vdc.buf = vdc.buf[:0]
+	largeFlags := s.footer.format().storedLayout() >= storedLayoutV3
+
+	var keepGoing = true
+	for keepGoing {
+		field, err := binary.ReadUvarint(&vdc.reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var large bool
+		if largeFlags {
+			large = field&storedLargeValueFlag != 0
+			field >>= 1
+		}
+		offset, err := binary.ReadUvarint(&vdc.reader)
+		if err != nil {
+			return err
+		}
+		l, err := binary.ReadUvarint(&vdc.reader)
 		if err != nil {
 			return err
 		}
 
-		vdc.reader.Reset(meta)
-
-		var keepGoing = true
-		for keepGoing {
-			field, err := binary.ReadUvarint(&vdc.reader)
-			if err == io.EOF {
+		if fields != nil {
+			if field >= uint64(len(fields)) {
+				// the meta is in field id order, so no requested field follows
 				break
 			}
-			if err != nil {
-				return err
+			if !fields[field] {
+				continue
 			}
-			offset, err := binary.ReadUvarint(&vdc.reader)
-			if err != nil {
-				return err
-			}
-			l, err := binary.ReadUvarint(&vdc.reader)
+		}
+		var value []byte
+		if large {
+			value, err = s.storedLargeValue(vdc, offset, l)
 			if err != nil {
 				return err
 			}
-
-			value := uncompressed[offset : offset+l]
-			keepGoing = visitor(s.fieldsInv[field], value)
+		} else {
+			value = uncompressed[offset : offset+l]
 		}
-
-		vdc.buf = uncompressed
+		keepGoing = visitor(s.fieldsInv[field], value)
 	}
 	return nil
 }
 
+// storedLargeValue decompresses the large value of the compressed length
+// at the offset in the large value region, appending it to the large
+// values of the document visited, so it stays valid until the next visit
+func (s *Segment) storedLargeValue(vdc *visitDocumentCtx, offset, l uint64) ([]byte, error) {
+	if offset+l > s.storedLargeLen {
+		return nil, fmt.Errorf("large value at %d of %d bytes beyond region of %d bytes", offset, l, s.storedLargeLen)
+	}
+	start := s.storedLargeStart + offset
+	compressed, err := s.data.Read(int(start), int(start+l))
+	if err != nil {
+		return nil, err
+	}
+	vdc.large, err = s.decompressStored(vdc.large[:cap(vdc.large)], compressed)
+	if err != nil {
+		return nil, err
+	}
+	// values kept by the visitor point into the previous array when it grows
+	bufStart := len(vdc.buf)
+	vdc.buf = append(vdc.buf, vdc.large...)
+	return vdc.buf[bufStart:len(vdc.buf):len(vdc.buf)], nil
+}
+
 // Count returns the number of documents in this segment.
 func (s *Segment) Count() uint64 {
 	return s.footer.numDocs
@@ -299,13 +657,81 @@ func (s *Segment) NumDocs() uint64 {
 	return s.footer.numDocs
 }
 
-func (s *Segment) loadDvReaders() error {
+// SortedSetOffset returns the location of the sorted-set doc values index
+// in the segment, 0 if there are none
+func (s *Segment) SortedSetOffset() uint64 {
+	return s.footer.sortedSetOffset
+}
+
+// StoredChunking returns the policy ending the chunks of stored fields, see
+// WithStoredChunking, zero if the stored index cannot be read
+func (s *Segment) StoredChunking() (docs, bytes uint64) {
+	if s.loadStoredIndexOnce() != nil {
+		return 0, 0
+	}
+	return s.storedChunkDocs, s.storedChunkBytes
+}
+
+// StoredLargeValues returns the threshold of the stored values kept outside
+// the chunks, see WithStoredLargeValues, and the number of bytes they take,
+// zero if the stored index cannot be read
+func (s *Segment) StoredLargeValues() (threshold, bytes uint64) {
+	if s.loadStoredIndexOnce() != nil {
+		return 0, 0
+	}
+	return s.storedLargeThreshold, s.storedLargeLen
+}
+
+// StoredCodec returns the id of the codec compressing the stored fields,
+// zero if the stored index cannot be read
+func (s *Segment) StoredCodec() StoredCodecID {
+	if s.loadStoredIndexOnce() != nil {
+		return 0
+	}
+	return s.storedCodec.ID()
+}
+
+// loadStoredIndexOnce reads the index of the chunks of stored fields, as
+// per the version, on first use of the stored fields
+func (s *Segment) loadStoredIndexOnce() error {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	s.storedOnce.Do(func() {
+		s.storedErr = s.footer.format().loadStoredIndex(s)
+		if s.storedErr == nil {
+			s.addSize((len(s.storedFieldChunkOffsets) + len(s.storedFieldChunkDocStarts)) * sizeOfUint64)
+		}
+	})
+	return s.storedErr
+}
+
+// loadDocValueIndexOnce reads where the doc values of each field are, as
+// per the version, on first use of the doc values of any field
+func (s *Segment) loadDocValueIndexOnce() error {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	s.dvIndexOnce.Do(func() {
+		s.dvIndexErr = s.footer.format().loadDocValueIndex(s)
+	})
+	return s.dvIndexErr
+}
+
+// NumericOffset returns the location of the numeric doc values index in
+// the segment, 0 if there are none
+func (s *Segment) NumericOffset() uint64 {
+	return s.footer.numericOffset
+}
+
+// loadDvIndex reads the start and end of the doc values of each field
+func (s *Segment) loadDvIndex() error {
 	if s.footer.docValueOffset == fieldNotUninverted || s.footer.numDocs == 0 {
 		return nil
 	}
 
 	var read uint64
-	for fieldID, field := range s.fieldsInv {
+	for fieldID := range s.fieldsInv {
 		var fieldLocStart, fieldLocEnd uint64
 		var n int
 		fieldLocStartData, err := s.data.Read(int(s.footer.docValueOffset+read), int(s.footer.docValueOffset+read+binary.MaxVarintLen64))
@@ -314,7 +740,7 @@ func (s *Segment) loadDvReaders() error {
 		}
 		fieldLocStart, n = binary.Uvarint(fieldLocStartData)
 		if n <= 0 {
-			return fmt.Errorf("loadDvReaders: failed to read the docvalue offset start for field %d", fieldID)
+			return fmt.Errorf("loadDvIndex: failed to read the docvalue offset start for field %d", fieldID)
 		}
 		read += uint64(n)
 		fieldLocEndData, err := s.data.Read(int(s.footer.docValueOffset+read), int(s.footer.docValueOffset+read+binary.MaxVarintLen64))
@@ -323,18 +749,12 @@ func (s *Segment) loadDvReaders() error {
 		}
 		fieldLocEnd, n = binary.Uvarint(fieldLocEndData)
 		if n <= 0 {
-			return fmt.Errorf("loadDvReaders: failed to read the docvalue offset end for field %d", fieldID)
+			return fmt.Errorf("loadDvIndex: failed to read the docvalue offset end for field %d", fieldID)
 		}
 		read += uint64(n)
 
-		fieldDvReader, err := s.loadFieldDocValueReader(field, fieldLocStart, fieldLocEnd)
-		if err != nil {
-			return err
-		}
-		if fieldDvReader != nil {
-			s.fieldDvReaders[uint16(fieldID)] = fieldDvReader
-			s.fieldDvNames = append(s.fieldDvNames, field)
-		}
+		s.fields[fieldID].dvStart = fieldLocStart
+		s.fields[fieldID].dvEnd = fieldLocEnd
 	}
 
 	return nil
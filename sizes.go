@@ -30,6 +30,7 @@ func init() {
 	var u64 uint64
 	sizeOfUint64 = int(reflect.TypeOf(u64).Size())
 	reflectStaticSizeSegment = int(reflect.TypeOf(Segment{}).Size())
+	reflectStaticSizeSegmentField = int(reflect.TypeOf(segmentField{}).Size())
 	var md metaData
 	reflectStaticSizeMetaData = int(reflect.TypeOf(md).Size())
 	var dvi docValueReader
@@ -42,6 +43,8 @@ func init() {
 	reflectStaticSizePosting = int(reflect.TypeOf(p).Size())
 	var l Location
 	reflectStaticSizeLocation = int(reflect.TypeOf(l).Size())
+	var de DictEntry
+	reflectStaticSizeDictEntry = int(reflect.TypeOf(de).Size())
 }
 
 var sizeOfPtr int
@@ -50,9 +53,11 @@ var sizeOfUint16 int
 var sizeOfUint32 int
 var sizeOfUint64 int
 var reflectStaticSizeSegment int
+var reflectStaticSizeSegmentField int
 var reflectStaticSizeMetaData int
 var reflectStaticSizedocValueReader int
 var reflectStaticSizePostingsList int
 var reflectStaticSizePostingsIterator int
 var reflectStaticSizePosting int
 var reflectStaticSizeLocation int
+var reflectStaticSizeDictEntry int
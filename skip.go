@@ -0,0 +1,146 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Since version 3, each chunk of the freq/norm section of a postings list
+// starts with its skip points, as a uvarint number of skip points followed
+// by the uvarint doc num, offset in the freq/norm chunk and offset in the
+// location chunk of each of them, as the difference from the previous one.
+// A skip point is recorded every skipInterval postings of the chunk, so
+// advancing within a chunk decodes fewer than skipInterval postings before
+// the target instead of every posting of the chunk.
+
+// skipInterval is the number of postings of a chunk between skip points
+const skipInterval = 128
+
+// chunkSkip is where the posting of a doc num starts in the chunk of
+// freq/norms, after the skip points, and in the chunk of locations
+type chunkSkip struct {
+	docNum    uint64
+	offset    uint64
+	locOffset uint64
+}
+
+// appendChunkSkips appends the encoded skip points to dst
+func appendChunkSkips(dst []byte, skips []chunkSkip) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(skips)))
+	dst = append(dst, buf[:n]...)
+	var prev chunkSkip
+	for _, skip := range skips {
+		n = binary.PutUvarint(buf[:], skip.docNum-prev.docNum)
+		dst = append(dst, buf[:n]...)
+		n = binary.PutUvarint(buf[:], skip.offset-prev.offset)
+		dst = append(dst, buf[:n]...)
+		n = binary.PutUvarint(buf[:], skip.locOffset-prev.locOffset)
+		dst = append(dst, buf[:n]...)
+		prev = skip
+	}
+	return dst
+}
+
+// readChunkSkips decodes the skip points at the start of the chunk data
+// into skips, returning them and the data of the chunk after them
+func readChunkSkips(data []byte, skips []chunkSkip) ([]chunkSkip, []byte, error) {
+	skips = skips[:0]
+	numSkips, read := binary.Uvarint(data)
+	if read <= 0 || numSkips > uint64(len(data)) {
+		return nil, nil, fmt.Errorf("invalid number of skip points")
+	}
+	data = data[read:]
+	var skip chunkSkip
+	for i := uint64(0); i < numSkips; i++ {
+		var vals [3]uint64
+		for j := range vals {
+			vals[j], read = binary.Uvarint(data)
+			if read <= 0 {
+				return nil, nil, fmt.Errorf("invalid skip point %d", i)
+			}
+			data = data[read:]
+		}
+		if i > 0 && vals[0] == 0 {
+			return nil, nil, fmt.Errorf("skip point %d repeats doc num %d", i, skip.docNum)
+		}
+		skip.docNum += vals[0]
+		skip.offset += vals[1]
+		skip.locOffset += vals[2]
+		skips = append(skips, skip)
+	}
+	return skips, data, nil
+}
+
+// skipFor returns the last skip point of the loaded chunk after the doc num
+// from and at or before docNum, and whether there is one
+func (d *chunkedIntDecoder) skipFor(from, docNum uint64) (chunkSkip, bool) {
+	i := sort.Search(len(d.skips), func(i int) bool {
+		return d.skips[i].docNum > docNum
+	}) - 1
+	if i < 0 || d.skips[i].docNum <= from {
+		return chunkSkip{}, false
+	}
+	return d.skips[i], true
+}
+
+// skipPostings moves the freq/norm and location readers from the posting
+// of the doc num from, the next one they would read, to the posting of the
+// doc num n, both on the postings list.  The postings in between are read
+// off one at a time from the last skip point at or before n.
+func (i *PostingsIterator) skipPostings(from, n uint32) error {
+	chunkSize := uint32(i.postings.chunkSize)
+	nChunk := n / chunkSize
+	if i.currChunk != nChunk || i.freqNormReader.isNil() {
+		err := i.loadChunk(int(nChunk))
+		if err != nil {
+			return fmt.Errorf("error loading chunk: %v", err)
+		}
+		from = nChunk * chunkSize
+	}
+	if from >= n {
+		return nil
+	}
+
+	if skip, ok := i.freqNormReader.skipFor(uint64(from), uint64(n)); ok {
+		err := i.freqNormReader.seek(skip.offset)
+		if err != nil {
+			return err
+		}
+		if i.includeLocs {
+			err = i.locReader.seek(skip.locOffset)
+			if err != nil {
+				return err
+			}
+		}
+		from = uint32(skip.docNum)
+	}
+
+	// the postings on the postings list in [from, n)
+	count := i.postings.postings.Rank(n - 1)
+	if from > 0 {
+		count -= i.postings.postings.Rank(from - 1)
+	}
+	for j := uint64(0); j < count; j++ {
+		err := i.currChunkNext(nChunk)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
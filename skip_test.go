@@ -0,0 +1,165 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+// buildTestAnalysisResultsSkips builds documents where the term x occurs
+// in most of them, at varying positions, and y in every 7th one
+func buildTestAnalysisResultsSkips(numDocs int) []segment.Document {
+	var results []segment.Document
+	for i := 0; i < numDocs; i++ {
+		body := strings.Repeat("z ", i%5) + strings.Repeat("x ", i%3+1) + "z"
+		if i%11 == 0 {
+			body = "z"
+		}
+		if i%7 == 0 {
+			body += " y"
+		}
+		results = append(results, &FakeDocument{
+			NewFakeField("_id", fmt.Sprintf("%04d", i), true, false, false),
+			NewFakeField("body", body, true, true, false),
+		})
+	}
+	return results
+}
+
+type skipTestPosting struct {
+	docNum uint64
+	freq   int
+	norm   float64
+	pos    []int
+}
+
+// skipTestPostings collects the postings of the term returned by next
+func skipTestPostings(t *testing.T, itr *PostingsIterator,
+	next func(itr *PostingsIterator) (segment.Posting, error)) []skipTestPosting {
+	var rv []skipTestPosting
+	posting, err := next(itr)
+	for err == nil && posting != nil {
+		p := skipTestPosting{docNum: posting.Number(), freq: posting.Frequency(), norm: posting.Norm()}
+		for _, loc := range posting.Locations() {
+			p.pos = append(p.pos, loc.Pos())
+		}
+		rv = append(rv, p)
+		posting, err = next(itr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rv
+}
+
+func TestPostingsIteratorSkips(t *testing.T) {
+	segInt, _, err := New(buildTestAnalysisResultsSkips(3000), encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := segInt.(*Segment)
+	err = seg.Verify(context.Background())
+	if err != nil {
+		t.Fatalf("expected segment to verify, got: %v", err)
+	}
+	dict, err := seg.dictionary("body")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, term := range []string{"x", "y"} {
+		for _, except := range []*roaring.Bitmap{nil, roaring.BitmapOf(1, 2, 130, 131, 500, 1999, 2001)} {
+			for _, includeLocs := range []bool{false, true} {
+				pl, err := dict.postingsList([]byte(term), except, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				itr, err := pl.iterator(true, true, includeLocs, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				all := skipTestPostings(t, itr, func(itr *PostingsIterator) (segment.Posting, error) {
+					return itr.Next()
+				})
+				if term == "x" && (itr.freqNormReader.Len() != 0 || len(itr.freqNormReader.skips) == 0) {
+					t.Errorf("expected the last chunk of x read to its end with skip points, got %d bytes left, %d skips",
+						itr.freqNormReader.Len(), len(itr.freqNormReader.skips))
+				}
+
+				rnd := rand.New(rand.NewSource(int64(len(all))))
+				for _, maxStep := range []int{1, 10, 200, 1500} {
+					var expected []skipTestPosting
+					var targets []uint64
+					var target uint64
+					for _, p := range all {
+						if p.docNum >= target {
+							expected = append(expected, p)
+							targets = append(targets, target)
+							target = p.docNum + 1 + uint64(rnd.Intn(maxStep))
+						}
+					}
+					itr, err = pl.iterator(true, true, includeLocs, nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+					var i int
+					actual := skipTestPostings(t, itr, func(itr *PostingsIterator) (segment.Posting, error) {
+						if i == len(targets) {
+							return itr.Advance(target)
+						}
+						i++
+						return itr.Advance(targets[i-1])
+					})
+					if !reflect.DeepEqual(actual, expected) {
+						t.Errorf("term %s except %v locs %t max step %d: expected %d postings advancing, got %d",
+							term, except, includeLocs, maxStep, len(expected), len(actual))
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestChunkSkips(t *testing.T) {
+	skips := []chunkSkip{{128, 256, 0}, {300, 512, 1024}, {301, 520, 1030}}
+	data := appendChunkSkips(nil, skips)
+	data = append(data, make([]byte, 1100)...)
+	actual, rest, err := readChunkSkips(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, skips) || len(rest) != 1100 {
+		t.Errorf("expected %v and 1100 bytes, got %v and %d", skips, actual, len(rest))
+	}
+
+	for _, data := range [][]byte{
+		nil,
+		{2, 1, 1, 1},
+		{2, 1, 1, 1, 0, 1, 1, 0, 0},
+	} {
+		_, _, err = readChunkSkips(data, nil)
+		if err == nil {
+			t.Errorf("expected error reading skip points %v", data)
+		}
+	}
+}
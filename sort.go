@@ -0,0 +1,630 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/RoaringBitmap/roaring"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+// SortField is one of the keys the documents of a segment are sorted on
+type SortField struct {
+	// Field is the name of a field indexed with doc values.  Documents are
+	// sorted on its numeric value when the field has numeric doc values,
+	// see NumericField, otherwise on its terms.  Merging segments where
+	// only some have the numeric doc values of the field, the documents of
+	// the others are sorted on their terms prefix coded as numbers at full
+	// precision, as numeric fields index them.
+	Field string
+
+	// Descending sorts documents from the largest value of the field
+	// down, using the largest value of each document, instead of from
+	// the smallest value up, using the smallest value of each document
+	Descending bool
+
+	// MissingFirst puts documents without a value for the field before
+	// those with one, instead of after
+	MissingFirst bool
+}
+
+const (
+	sortFlagDescending = 1 << iota
+	sortFlagMissingFirst
+)
+
+// docSorter sorts documents on their sort keys, keys holds the key of
+// each document for each sort field, nil if the document has no value,
+// documents with the same keys keep their original order
+type docSorter struct {
+	fields  []SortField
+	numeric []bool     // sort field -> keyed on numbers, see setNumericFields
+	keys    [][][]byte // sort field -> doc -> key
+	order   []int
+}
+
+func newDocSorter(fields []SortField, numDocs int) *docSorter {
+	rv := &docSorter{
+		fields:  fields,
+		numeric: make([]bool, len(fields)),
+		keys:    make([][][]byte, len(fields)),
+		order:   make([]int, numDocs),
+	}
+	for i := range rv.keys {
+		rv.keys[i] = make([][]byte, numDocs)
+	}
+	for i := range rv.order {
+		rv.order[i] = i
+	}
+	return rv
+}
+
+// less returns true if document a sorts before document b
+func (d *docSorter) less(a, b int) bool {
+	for i, field := range d.fields {
+		ka, kb := d.keys[i][a], d.keys[i][b]
+		if ka == nil || kb == nil {
+			if (ka == nil) != (kb == nil) {
+				return (ka == nil) == field.MissingFirst
+			}
+			continue
+		}
+		c := bytes.Compare(ka, kb)
+		if c != 0 {
+			return (c < 0) != field.Descending
+		}
+	}
+	return false
+}
+
+func (d *docSorter) Len() int           { return len(d.order) }
+func (d *docSorter) Less(i, j int) bool { return d.less(d.order[i], d.order[j]) }
+func (d *docSorter) Swap(i, j int)      { d.order[i], d.order[j] = d.order[j], d.order[i] }
+
+// sort returns the documents in sorted order
+func (d *docSorter) sort() []int {
+	sort.Stable(d)
+	return d.order
+}
+
+// setKey sets the key of the document for the sort field from its terms,
+// which are in ascending order, each followed by the termSeparator
+func (d *docSorter) setKey(field, doc int, terms []byte) {
+	if len(terms) == 0 {
+		return
+	}
+	d.keys[field][doc] = termsSortKey(splitTerms(terms), d.fields[field].Descending)
+}
+
+// setNumericTermsKey sets the key of the document for the numeric sort
+// field from its terms, like setKey, when the document has no numeric doc
+// values for the field
+func (d *docSorter) setNumericTermsKey(field, doc int, terms []byte) error {
+	if len(terms) == 0 {
+		return nil
+	}
+	key, ok := numericTermsSortKey(splitTerms(terms), d.fields[field].Descending)
+	if !ok {
+		return fmt.Errorf("sort field %s has numeric doc values, but doc %d has terms which are not prefix coded numbers",
+			d.fields[field].Field, doc)
+	}
+	d.keys[field][doc] = key
+	return nil
+}
+
+// splitTerms splits the terms of a document, each followed by the
+// termSeparator
+func splitTerms(terms []byte) [][]byte {
+	// trim the final separator
+	return bytes.Split(terms[:len(terms)-1], termSeparatorSplitSlice)
+}
+
+// termsSortKey returns the key of a document from its terms of a sort
+// field, its smallest term, or its largest when descending, nil if it has
+// none
+func termsSortKey(terms [][]byte, descending bool) []byte {
+	var rv []byte
+	for _, term := range terms {
+		c := bytes.Compare(term, rv)
+		if rv == nil || descending && c > 0 || !descending && c < 0 {
+			rv = term
+		}
+	}
+	if rv == nil {
+		return nil
+	}
+	return append([]byte{}, rv...)
+}
+
+// prefixCodedShiftStart is the first byte of a number prefix coded at
+// shift 0, as numeric fields index their terms for range queries
+const prefixCodedShiftStart = 0x20
+
+// prefixCodedNumber returns the number of the term prefix coded at shift
+// 0: the shift start, followed by the 64 bits of the number, with the sign
+// bit flipped, 7 per byte
+func prefixCodedNumber(term []byte) (int64, bool) {
+	if len(term) != 63/7+2 || term[0] != prefixCodedShiftStart {
+		return 0, false
+	}
+	var bits uint64
+	for _, b := range term[1:] {
+		if b > 0x7f {
+			return 0, false
+		}
+		bits = bits<<7 | uint64(b)
+	}
+	return int64(bits ^ 1<<63), true
+}
+
+// numericTermsSortKey returns the key of a document from its terms of a
+// numeric sort field, the numericSortKey of its smallest number prefix
+// coded at full precision, or its largest when descending, reporting
+// whether it has one
+func numericTermsSortKey(terms [][]byte, descending bool) ([]byte, bool) {
+	var rv int64
+	var ok bool
+	for _, term := range terms {
+		val, isNumber := prefixCodedNumber(term)
+		if !isNumber {
+			continue
+		}
+		if !ok || descending && val > rv || !descending && val < rv {
+			rv = val
+		}
+		ok = true
+	}
+	if !ok {
+		return nil, false
+	}
+	return numericSortKey(rv), true
+}
+
+// numericSortKey returns the key of a document from its numeric doc value,
+// the bytes of which are ordered as the values
+func numericSortKey(val int64) []byte {
+	rv := make([]byte, 8)
+	binary.BigEndian.PutUint64(rv, uint64(val)^1<<63)
+	return rv
+}
+
+// sortDocuments returns the documents ordered on the sort fields, the
+// key of a document being its numeric doc value or its terms of the
+// field, when the field is indexed with doc values in any of the
+// documents, like the doc values which New will record for it
+func sortDocuments(results []segment.Document, fields []SortField) []segment.Document {
+	docValueFields := map[string]bool{}
+	numericFields := map[string]bool{}
+	for _, result := range results {
+		result.EachField(func(field segment.Field) {
+			if field.IndexDocValues() {
+				docValueFields[field.Name()] = true
+				if _, ok := field.(NumericField); ok {
+					numericFields[field.Name()] = true
+				}
+			}
+		})
+	}
+
+	sorter := newDocSorter(fields, len(results))
+	var terms [][]byte
+	for i, sortField := range fields {
+		if !docValueFields[sortField.Field] {
+			continue
+		}
+		for doc, result := range results {
+			terms = terms[:0]
+			result.EachField(func(field segment.Field) {
+				if field.Name() != sortField.Field {
+					return
+				}
+				if numericFields[sortField.Field] {
+					// like the numeric doc values, the first value
+					numericField, ok := field.(NumericField)
+					if ok && field.IndexDocValues() && sorter.keys[i][doc] == nil {
+						sorter.keys[i][doc] = numericSortKey(numericField.NumericValue())
+					}
+					return
+				}
+				field.EachTerm(func(term segment.FieldTerm) {
+					terms = append(terms, term.Term())
+				})
+			})
+			if !numericFields[sortField.Field] {
+				sorter.keys[i][doc] = termsSortKey(terms, sortField.Descending)
+			}
+		}
+	}
+
+	rv := make([]segment.Document, len(results))
+	for i, doc := range sorter.sort() {
+		rv[i] = results[doc]
+	}
+	return rv
+}
+
+// setNumericFields records which sort fields are keyed on numbers, those
+// with numeric doc values in any of the segments, so that the documents of
+// the segments without them are keyed on the numbers of their terms
+func (d *docSorter) setNumericFields(segments []*Segment) error {
+	for i, field := range d.fields {
+		d.numeric[i] = false
+		for _, s := range segments {
+			numerics, err := s.NumericDocValues(field.Field)
+			if err != nil {
+				return err
+			}
+			if numerics != nil {
+				d.numeric[i] = true
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// setSegmentKeys sets the keys of the documents of a segment from the doc
+// values of each sort field, the documents of the segment starting at base,
+// where for a numeric field those without numeric doc values, as merged
+// from segments older than them, are keyed on the numbers of their terms
+func (d *docSorter) setSegmentKeys(s *Segment, base int) error {
+	var dvIterClone *docValueReader
+	for i, field := range d.fields {
+		fieldIDPlus1 := s.fieldsMap[field.Field]
+		if fieldIDPlus1 == 0 {
+			continue
+		}
+		numerics, err := s.NumericDocValues(field.Field)
+		if err != nil {
+			return err
+		}
+		if numerics != nil {
+			for docNum := uint64(0); docNum < s.footer.numDocs; docNum++ {
+				var val int64
+				var ok bool
+				val, ok, err = numerics.Get(docNum)
+				if err != nil {
+					return err
+				}
+				if ok {
+					d.keys[i][base+int(docNum)] = numericSortKey(val)
+				}
+			}
+		}
+		dvIter, err := s.fieldDocValueReader(fieldIDPlus1 - 1)
+		if err != nil {
+			return err
+		}
+		if dvIter == nil {
+			continue
+		}
+		dvIterClone = dvIter.cloneInto(dvIterClone)
+		err = dvIterClone.iterateAllDocValues(s, func(docNum uint64, terms []byte) error {
+			if !d.numeric[i] {
+				d.setKey(i, base+int(docNum), terms)
+				return nil
+			}
+			if d.keys[i][base+int(docNum)] != nil {
+				return nil
+			}
+			return d.setNumericTermsKey(i, base+int(docNum), terms)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sort returns the fields the documents of the segment are sorted on, or
+// nil if the documents are in the order they were added
+func (s *Segment) Sort() []SortField {
+	return s.sort
+}
+
+// SortOffset returns the location of the sort in the segment, 0 if the
+// segment is not sorted
+func (s *Segment) SortOffset() uint64 {
+	return s.footer.sortOffset
+}
+
+// persistSort writes out the sort fields as a uvarint count followed by the
+// uvarint name length, name and uvarint flags of each, returning where they
+// start, or 0 if there are none
+func persistSort(fields []SortField, w *countHashWriter) (uint64, error) {
+	if len(fields) == 0 {
+		return 0, nil
+	}
+	rv := uint64(w.Count())
+	err := writeUvarints(w, uint64(len(fields)))
+	if err != nil {
+		return 0, err
+	}
+	for _, field := range fields {
+		err = writeUvarints(w, uint64(len(field.Field)))
+		if err != nil {
+			return 0, err
+		}
+		_, err = w.Write([]byte(field.Field))
+		if err != nil {
+			return 0, err
+		}
+		var flags uint64
+		if field.Descending {
+			flags |= sortFlagDescending
+		}
+		if field.MissingFirst {
+			flags |= sortFlagMissingFirst
+		}
+		err = writeUvarints(w, flags)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return rv, nil
+}
+
+func (s *Segment) loadSort() error {
+	if s.footer.sortOffset == 0 {
+		return nil
+	}
+	if s.footer.sortOffset >= s.footer.fieldsIndexOffset {
+		return fmt.Errorf("sort offset %d past fields index", s.footer.sortOffset)
+	}
+	data, err := s.data.Read(int(s.footer.sortOffset), int(s.footer.fieldsIndexOffset))
+	if err != nil {
+		return err
+	}
+	r := newMemUvarintReader(data)
+	numFields, err := r.ReadUvarint()
+	if err != nil {
+		return fmt.Errorf("error reading sort: %v", err)
+	}
+	for i := uint64(0); i < numFields; i++ {
+		nameLen, err := r.ReadUvarint()
+		if err != nil {
+			return fmt.Errorf("error reading sort field: %v", err)
+		}
+		if nameLen > uint64(r.Len()) {
+			return fmt.Errorf("sort field name length %d past end of sort", nameLen)
+		}
+		start := len(data) - r.Len()
+		name := string(data[start : start+int(nameLen)])
+		r.SkipBytes(int(nameLen))
+		flags, err := r.ReadUvarint()
+		if err != nil {
+			return fmt.Errorf("error reading sort field flags: %v", err)
+		}
+		s.sort = append(s.sort, SortField{
+			Field:        name,
+			Descending:   flags&sortFlagDescending != 0,
+			MissingFirst: flags&sortFlagMissingFirst != 0,
+		})
+	}
+	return nil
+}
+
+// sortedDocNums computes the new doc numbers of the documents remaining in
+// the segments once sorted, the first segments' documents coming first when
+// their keys are the same
+func sortedDocNums(segments []*Segment, drops []*roaring.Bitmap, fields []SortField) (
+	newDocNums [][]uint64, err error) {
+	var numDocs int
+	for _, seg := range segments {
+		numDocs += int(seg.footer.numDocs)
+	}
+
+	sorter := newDocSorter(fields, numDocs)
+	err = sorter.setNumericFields(segments)
+	if err != nil {
+		return nil, err
+	}
+	bases := make([]int, len(segments))
+	var base int
+	for segI, seg := range segments {
+		bases[segI] = base
+		err = sorter.setSegmentKeys(seg, base)
+		if err != nil {
+			return nil, err
+		}
+		base += int(seg.footer.numDocs)
+	}
+
+	// leave out the dropped documents
+	order := sorter.order[:0]
+	newDocNums = make([][]uint64, len(segments))
+	for segI, seg := range segments {
+		newDocNums[segI] = make([]uint64, seg.footer.numDocs)
+		for docNum := range newDocNums[segI] {
+			if drops[segI] != nil && drops[segI].Contains(uint32(docNum)) {
+				newDocNums[segI][docNum] = docDropped
+				continue
+			}
+			order = append(order, bases[segI]+docNum)
+		}
+	}
+	sorter.order = order
+
+	for newDocNum, doc := range sorter.sort() {
+		segI := sort.SearchInts(bases, doc+1) - 1
+		newDocNums[segI][doc-bases[segI]] = uint64(newDocNum)
+	}
+	return newDocNums, nil
+}
+
+// sortedHit is a hit of a term buffered by sortedHits, its locations being
+// locs[locStart:locEnd] of the sortedHits
+type sortedHit struct {
+	docNum, freq, norm uint64
+	locStart, locEnd   int
+}
+
+// sortedHits buffers the hits of a term while merging into a sorted
+// segment, where the hits of each segment are no longer in the order of
+// their new doc numbers, so they can be encoded in that order, or with a
+// chunkModeBytes chunk mode, which sizes the chunks from the hits
+type sortedHits struct {
+	hits     []sortedHit
+	locs     []uint64 // field id, pos, start, end of each location
+	payloads [][]byte // the payload of each location, copied
+
+	chunkMode uint32
+	numDocs   uint64 // of the new segment
+}
+
+// add buffers the hits of the postings iterator with their new doc numbers
+func (h *sortedHits) add(fieldsMap map[string]uint16, postItr *PostingsIterator,
+	newDocNums []uint64, newRoaring, docTracking *roaring.Bitmap) error {
+	next, err := postItr.Next()
+	for next != nil && err == nil {
+		hitNewDocNum := newDocNums[next.Number()]
+		if hitNewDocNum == docDropped {
+			return fmt.Errorf("see hit with dropped docNum")
+		}
+
+		newRoaring.Add(uint32(hitNewDocNum))
+		docTracking.Add(uint32(hitNewDocNum))
+
+		hit := sortedHit{
+			docNum:   hitNewDocNum,
+			freq:     uint64(next.Frequency()),
+			norm:     uint64(math.Float32bits(float32(next.Norm()))),
+			locStart: len(h.locs),
+		}
+		for _, loc := range next.Locations() {
+			h.locs = append(h.locs, uint64(fieldsMap[loc.Field()]-1),
+				uint64(loc.Pos()), uint64(loc.Start()), uint64(loc.End()))
+			var payload []byte
+			if p := locationPayload(loc); len(p) > 0 {
+				payload = append(payload, p...)
+			}
+			h.payloads = append(h.payloads, payload)
+		}
+		hit.locEnd = len(h.locs)
+		h.hits = append(h.hits, hit)
+
+		next, err = postItr.Next()
+	}
+	return err
+}
+
+// encode adds the buffered hits to the encoders in doc number order,
+// returning the last one, and empties the buffer
+func (h *sortedHits) encode(tfEncoder, locEncoder *chunkedIntCoder) (
+	lastDocNum, lastFreq, lastNorm uint64, err error) {
+	sort.Slice(h.hits, func(i, j int) bool {
+		return h.hits[i].docNum < h.hits[j].docNum
+	})
+	if chunkTargetBytes(h.chunkMode) > 0 {
+		var chunkSize uint64
+		chunkSize, err = chunkSizeFor(h.chunkMode, uint64(len(h.hits)), h.bytes(), h.numDocs)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		tfEncoder.SetChunkSize(chunkSize, h.numDocs-1)
+		locEncoder.SetChunkSize(chunkSize, h.numDocs-1)
+	}
+	for _, hit := range h.hits {
+		locs := h.locs[hit.locStart:hit.locEnd]
+		payloads := h.payloads[hit.locStart/numUintsLocation : hit.locEnd/numUintsLocation]
+
+		err = tfEncoder.Add(hit.docNum, encodeFreqHasLocs(hit.freq, len(locs) > 0), hit.norm)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+		if len(locs) > 0 {
+			numBytesLocs := 0
+			for i := 0; i < len(locs); i += numUintsLocation {
+				numBytesLocs += locEncoder.locationLen(locs[i], locs[i+1], locs[i+2], locs[i+3], payloads[i/numUintsLocation])
+			}
+
+			err = locEncoder.Add(hit.docNum, uint64(numBytesLocs))
+			if err != nil {
+				return 0, 0, 0, err
+			}
+
+			for i := 0; i < len(locs); i += numUintsLocation {
+				err = addLocation(locEncoder, hit.docNum, locs[i], locs[i+1], locs[i+2], locs[i+3],
+					payloads[i/numUintsLocation])
+				if err != nil {
+					return 0, 0, 0, err
+				}
+			}
+		}
+
+		lastDocNum, lastFreq, lastNorm = hit.docNum, hit.freq, hit.norm
+	}
+	h.hits = h.hits[:0]
+	h.locs = h.locs[:0]
+	h.payloads = h.payloads[:0]
+	return lastDocNum, lastFreq, lastNorm, nil
+}
+
+// bytes returns the postingBytes of the buffered hits
+func (h *sortedHits) bytes() uint64 {
+	var rv uint64
+	for _, hit := range h.hits {
+		locBytes := 0
+		for i := hit.locStart; i < hit.locEnd; i += numUintsLocation {
+			locBytes += locationBytes(h.locs[i], h.locs[i+1], h.locs[i+2], h.locs[i+3],
+				h.payloads[i/numUintsLocation])
+		}
+		rv += postingBytes(hit.freq, hit.norm, locBytes)
+	}
+	return rv
+}
+
+// sortedDocValues buffers the doc values of a field while merging into a
+// sorted segment, so they can be encoded in new doc number order, or with a
+// chunk mode sizing the chunks from the doc values
+type sortedDocValues struct {
+	docNums []uint64
+	starts  []int
+	terms   []byte
+}
+
+func (s *sortedDocValues) add(docNum uint64, terms []byte) {
+	s.docNums = append(s.docNums, docNum)
+	s.starts = append(s.starts, len(s.terms))
+	s.terms = append(s.terms, terms...)
+}
+
+// encode adds the buffered doc values to the encoder in doc number order
+func (s *sortedDocValues) encode(fdvEncoder *chunkedContentCoder) error {
+	order := make([]int, len(s.docNums))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return s.docNums[order[i]] < s.docNums[order[j]]
+	})
+	for _, i := range order {
+		end := len(s.terms)
+		if i+1 < len(s.starts) {
+			end = s.starts[i+1]
+		}
+		err := fdvEncoder.Add(s.docNums[i], s.terms[s.starts[i]:end])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,529 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+// buildTestAnalysisResultsSort builds documents with the specified ids
+// from a, with a price and color, either of which may be missing, and f
+// having two prices
+func buildTestAnalysisResultsSort(ids ...string) []segment.Document {
+	prices := map[string]string{"a": "30", "b": "10", "d": "20", "e": "10", "f": "40 05"}
+	colors := map[string]string{"a": "red", "b": "blue", "c": "red", "e": "green", "f": "blue"}
+	var results []segment.Document
+	for _, id := range ids {
+		doc := &FakeDocument{
+			NewFakeField("_id", id, true, false, false),
+			NewFakeField("body", "the "+id, true, true, false),
+		}
+		if price, ok := prices[id]; ok {
+			*doc = append(*doc, NewFakeField("price", price, true, false, true))
+		}
+		if color, ok := colors[id]; ok {
+			*doc = append(*doc, NewFakeField("color", color, true, false, true))
+		}
+		results = append(results, doc)
+	}
+	return results
+}
+
+func storedIDs(t *testing.T, seg *Segment) []string {
+	var rv []string
+	for docNum := uint64(0); docNum < seg.footer.numDocs; docNum++ {
+		err := seg.VisitStoredFields(docNum, func(field string, value []byte) bool {
+			if field == _idFieldName {
+				rv = append(rv, string(value))
+			}
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rv
+}
+
+var testSorts = []struct {
+	name     string
+	sort     []SortField
+	expected []string
+}{
+	{
+		name:     "ascending",
+		sort:     []SortField{{Field: "price"}},
+		expected: []string{"f", "b", "e", "d", "a", "c"},
+	},
+	{
+		name:     "ascending missing first",
+		sort:     []SortField{{Field: "price", MissingFirst: true}},
+		expected: []string{"c", "f", "b", "e", "d", "a"},
+	},
+	{
+		name:     "descending",
+		sort:     []SortField{{Field: "price", Descending: true}},
+		expected: []string{"f", "a", "d", "b", "e", "c"},
+	},
+	{
+		name:     "descending missing first",
+		sort:     []SortField{{Field: "price", Descending: true, MissingFirst: true}},
+		expected: []string{"c", "f", "a", "d", "b", "e"},
+	},
+	{
+		name:     "multiple fields",
+		sort:     []SortField{{Field: "color"}, {Field: "price", Descending: true}},
+		expected: []string{"f", "b", "e", "a", "c", "d"},
+	},
+	{
+		name:     "unknown field",
+		sort:     []SortField{{Field: "unknown"}},
+		expected: []string{"a", "b", "c", "d", "e", "f"},
+	},
+}
+
+func TestSortNew(t *testing.T) {
+	for _, test := range testSorts {
+		t.Run(test.name, func(t *testing.T) {
+			seg, _, err := NewWithOptions(buildTestAnalysisResultsSort("a", "b", "c", "d", "e", "f"),
+				encodeNorm, WithSort(test.sort...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := storedIDs(t, seg.(*Segment)); !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+
+			var buf bytes.Buffer
+			_, err = seg.WriteTo(&buf, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := load(segment.NewDataBytes(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(loaded.Sort(), test.sort) {
+				t.Errorf("expected sort %v, got %v", test.sort, loaded.Sort())
+			}
+			if loaded.SortOffset() == 0 {
+				t.Errorf("expected sort offset")
+			}
+			if actual := storedIDs(t, loaded); !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("expected loaded %v, got %v", test.expected, actual)
+			}
+			err = loaded.Verify(context.Background())
+			if err != nil {
+				t.Errorf("expected sorted segment to verify, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestSortMerge(t *testing.T) {
+	segABC, _, err := New(buildTestAnalysisResultsSort("a", "b", "c"), encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segDEF, _, err := New(buildTestAnalysisResultsSort("d", "e", "f"), encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := []segment.Segment{segABC, segDEF}
+	drops := []*roaring.Bitmap{roaring.BitmapOf(1), nil}
+
+	sortFields := []SortField{{Field: "price"}}
+	merger := MergeWithOptions(segments, drops, 1024, WithSort(sortFields...))
+	var merged bytes.Buffer
+	_, err = merger.WriteTo(&merged, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seg, err := load(segment.NewDataBytes(merged.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"f", "e", "d", "a", "c"}
+	if actual := storedIDs(t, seg); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+	if !reflect.DeepEqual(seg.Sort(), sortFields) {
+		t.Errorf("expected sort %v, got %v", sortFields, seg.Sort())
+	}
+	expectedDocNums := [][]uint64{{3, docDropped, 4}, {2, 1, 0}}
+	if !reflect.DeepEqual(merger.DocumentNumbers(), expectedDocNums) {
+		t.Errorf("expected doc numbers %v, got %v", expectedDocNums, merger.DocumentNumbers())
+	}
+	err = seg.Verify(context.Background())
+	if err != nil {
+		t.Errorf("expected merged segment to verify, got: %v", err)
+	}
+
+	// up to the field stats, which depend on how the documents were split
+	// across the segments, the merged segment is the same as merging the
+	// remaining documents already sorted, where none of them move
+	sorted, _, err := NewWithOptions(buildTestAnalysisResultsSort("a", "c", "d", "e", "f"), encodeNorm,
+		WithSort(sortFields...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var built bytes.Buffer
+	_, err = MergeWithOptions([]segment.Segment{sorted}, []*roaring.Bitmap{nil}, 1024, WithSort(sortFields...)).
+		WriteTo(&built, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(built.Bytes()[:seg.SortOffset()], merged.Bytes()[:seg.SortOffset()]) {
+		t.Errorf("expected sorted merge to match merge of sorted documents")
+	}
+
+	var parallel bytes.Buffer
+	_, err = MergeWithOptions(segments, drops, 1024, WithSort(sortFields...), WithMergeWorkers(4)).
+		WriteTo(&parallel, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(merged.Bytes(), parallel.Bytes()) {
+		t.Errorf("expected parallel sorted merge to match serial merge")
+	}
+}
+
+func TestSortMergeMany(t *testing.T) {
+	segMany, _, err := New(buildTestAnalysisResultsMany(2000), encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := []segment.Segment{segMany, segMany}
+	drops := []*roaring.Bitmap{roaring.BitmapOf(1, 7, 500), nil}
+	opts := []Option{WithSort(SortField{Field: "rare", MissingFirst: true}, SortField{Field: "tag", Descending: true})}
+
+	var merged bytes.Buffer
+	_, err = MergeWithOptions(segments, drops, 1024, opts...).WriteTo(&merged, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg, err := load(segment.NewDataBytes(merged.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seg.footer.numDocs != 3997 {
+		t.Errorf("expected 3997 docs, got %d", seg.footer.numDocs)
+	}
+	err = seg.Verify(context.Background())
+	if err != nil {
+		t.Errorf("expected merged segment to verify, got: %v", err)
+	}
+
+	var parallel bytes.Buffer
+	_, err = MergeWithOptions(segments, drops, 1024, append(opts, WithMergeWorkers(3))...).WriteTo(&parallel, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(merged.Bytes(), parallel.Bytes()) {
+		t.Errorf("expected parallel sorted merge to match serial merge")
+	}
+}
+
+func TestSortBuilder(t *testing.T) {
+	sortFields := []SortField{{Field: "color"}, {Field: "price", Descending: true}}
+	seg, _, err := NewWithOptions(buildTestAnalysisResultsSort("a", "b", "c", "d", "e", "f"), encodeNorm,
+		WithSort(sortFields...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected bytes.Buffer
+	_, err = seg.WriteTo(&expected, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewBuilder(encodeNorm, WithSort(sortFields...), WithTempDir(t.TempDir()))
+	for _, doc := range buildTestAnalysisResultsSort("a", "b", "c", "d", "e", "f") {
+		err = b.Add(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var actual bytes.Buffer
+	n, err := b.WriteTo(&actual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(actual.Len()) {
+		t.Errorf("expected %d bytes written, got %d", actual.Len(), n)
+	}
+	if !bytes.Equal(expected.Bytes(), actual.Bytes()) {
+		t.Errorf("expected sorted Builder segment to match New")
+	}
+}
+
+// prefixCodedTerms returns the terms of the number prefix coded at every
+// 4th shift, as indexed for numeric range queries
+func prefixCodedTerms(val int64) []*FakeTerm {
+	var rv []*FakeTerm
+	for shift := uint(0); shift < 64; shift += 4 {
+		numChars := (63-shift)/7 + 1
+		term := make([]byte, numChars+1)
+		term[0] = prefixCodedShiftStart + byte(shift)
+		bits := (uint64(val) ^ 1<<63) >> shift
+		for i := numChars; i > 0; i-- {
+			term[i] = byte(bits & 0x7f)
+			bits >>= 7
+		}
+		rv = append(rv, &FakeTerm{T: string(term), F: 1})
+	}
+	return rv
+}
+
+// buildTestAnalysisResultsSortNumeric builds documents with the specified
+// ids from a, with a date indexed as prefix coded terms, with numeric doc
+// values when numericDates, as segments older than them have it, and a
+// count with numeric doc values, either of which may be missing
+func buildTestAnalysisResultsSortNumeric(numericDates bool, ids ...string) []segment.Document {
+	dates := map[string]int64{"a": 1000, "b": 1002, "d": 1001, "e": 5000}
+	counts := map[string]int64{"a": 9, "b": 100, "c": 10, "e": 9}
+	var results []segment.Document
+	for _, id := range ids {
+		doc := &FakeTypedDocument{
+			FakeDocument: FakeDocument{NewFakeField("_id", id, true, false, false)},
+		}
+		if date, ok := dates[id]; ok {
+			field := &FakeField{N: "date", T: prefixCodedTerms(date), DV: true}
+			if numericDates {
+				doc.Typed = append(doc.Typed, &FakeNumericField{FakeField: field, NT: NumericInt64, NV: date})
+			} else {
+				doc.FakeDocument = append(doc.FakeDocument, field)
+			}
+		}
+		if count, ok := counts[id]; ok {
+			doc.Typed = append(doc.Typed, NewFakeNumericField("count", NumericInt64, count, false, true))
+		}
+		results = append(results, doc)
+	}
+	return results
+}
+
+func TestSortNumeric(t *testing.T) {
+	tests := []struct {
+		sort     SortField
+		expected []string
+	}{
+		{
+			sort:     SortField{Field: "date"},
+			expected: []string{"a", "d", "b", "e", "c"},
+		},
+		{
+			sort:     SortField{Field: "date", Descending: true},
+			expected: []string{"e", "b", "d", "a", "c"},
+		},
+		{
+			// on the values, not on their decimal terms
+			sort:     SortField{Field: "count"},
+			expected: []string{"a", "e", "c", "b", "d"},
+		},
+		{
+			sort:     SortField{Field: "count", Descending: true},
+			expected: []string{"b", "c", "a", "e", "d"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%+v", test.sort), func(t *testing.T) {
+			results := buildTestAnalysisResultsSortNumeric(true, "a", "b", "c", "d", "e")
+			built, _, err := NewWithOptions(results, encodeNorm, WithSort(test.sort))
+			if err != nil {
+				t.Fatal(err)
+			}
+			segs := []*Segment{built.(*Segment)}
+
+			segABC, _, err := New(results[:3], encodeNorm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			segDE, _, err := New(results[3:], encodeNorm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var merged bytes.Buffer
+			_, err = MergeWithOptions([]segment.Segment{segABC, segDE}, []*roaring.Bitmap{nil, nil}, 1024,
+				WithSort(test.sort)).WriteTo(&merged, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seg, err := load(segment.NewDataBytes(merged.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			segs = append(segs, seg)
+
+			// merging segments with and without numeric doc values for the
+			// date, either way round, keys all of them on the numbers
+			older := buildTestAnalysisResultsSortNumeric(false, "a", "b", "c", "d", "e")
+			segOlderABC, _, err := New(older[:3], encodeNorm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			segOlderDE, _, err := New(older[3:], encodeNorm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, pair := range [][]segment.Segment{{segOlderABC, segDE}, {segABC, segOlderDE}} {
+				var mergedPair bytes.Buffer
+				_, err = MergeWithOptions(pair, []*roaring.Bitmap{nil, nil}, 1024, WithSort(test.sort)).WriteTo(&mergedPair, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				seg, err = load(segment.NewDataBytes(mergedPair.Bytes()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				segs = append(segs, seg)
+			}
+
+			b := NewBuilder(encodeNorm, WithSort(test.sort), WithTempDir(t.TempDir()))
+			for _, doc := range results {
+				err = b.Add(doc)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			var buf bytes.Buffer
+			_, err = b.WriteTo(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seg, err = load(segment.NewDataBytes(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			segs = append(segs, seg)
+
+			for _, seg := range segs {
+				if actual := storedIDs(t, seg); !reflect.DeepEqual(actual, test.expected) {
+					t.Errorf("expected %v, got %v", test.expected, actual)
+				}
+				err = seg.Verify(context.Background())
+				if err != nil {
+					t.Errorf("expected sorted segment to verify, got: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestSortMergeNumericAndTextTerms(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/v2.ice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := load(segment.NewDataBytes(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg, _, err := New([]segment.Document{&FakeTypedDocument{
+		FakeDocument: FakeDocument{NewFakeField("_id", "g", true, false, false)},
+		Typed:        []segment.Field{NewFakeNumericField("price", NumericInt64, 20, false, true)},
+	}}, encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the prices of the older segment are text, which cannot be sorted with
+	// the numeric prices
+	var merged bytes.Buffer
+	_, err = MergeWithOptions([]segment.Segment{old, seg}, []*roaring.Bitmap{nil, nil}, 1024,
+		WithSort(SortField{Field: "price"})).WriteTo(&merged, nil)
+	if err == nil {
+		t.Errorf("expected error merging text and numeric prices sorted on the price")
+	}
+
+	// without sorting on it they merge
+	merged.Reset()
+	_, err = MergeWithOptions([]segment.Segment{old, seg}, []*roaring.Bitmap{nil, nil}, 1024,
+		WithSort(SortField{Field: "_id"})).WriteTo(&merged, nil)
+	if err != nil {
+		t.Fatalf("expected merge sorted on the id, got: %v", err)
+	}
+}
+
+func TestSortLoadOlderVersions(t *testing.T) {
+	tests := []struct {
+		path string
+		sort []SortField
+		ids  []string
+	}{
+		{
+			path: "testdata/v2.ice",
+			ids:  []string{"a", "b", "c", "d", "e", "f"},
+		},
+		{
+			path: "testdata/v3.ice",
+			sort: []SortField{{Field: "price"}},
+			ids:  []string{"f", "b", "e", "d", "a", "c"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			data, err := ioutil.ReadFile(test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			old, err := load(segment.NewDataBytes(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(old.Sort(), test.sort) {
+				t.Errorf("expected sort %v, got %v", test.sort, old.Sort())
+			}
+			if actual := storedIDs(t, old); !reflect.DeepEqual(actual, test.ids) {
+				t.Errorf("expected %v, got %v", test.ids, actual)
+			}
+			err = old.Verify(context.Background())
+			if err != nil {
+				t.Errorf("expected segment to verify, got: %v", err)
+			}
+
+			// merging it writes the current version, the same as merging
+			// the segment New builds for the same documents
+			seg, _, err := NewWithOptions(buildTestAnalysisResultsSort("a", "b", "c", "d", "e", "f"), encodeNorm,
+				WithSort(test.sort...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var expected, merged bytes.Buffer
+			_, err = MergeWithOptions([]segment.Segment{seg}, []*roaring.Bitmap{nil}, 1024, WithSort(test.sort...)).
+				WriteTo(&expected, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = MergeWithOptions([]segment.Segment{old}, []*roaring.Bitmap{nil}, 1024, WithSort(test.sort...)).
+				WriteTo(&merged, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(expected.Bytes(), merged.Bytes()) {
+				t.Errorf("expected merged segment to match merged New segment")
+			}
+		})
+	}
+}
@@ -0,0 +1,554 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+// SortedSetField is implemented by fields whose doc values may also be
+// stored as sorted-set doc values: the sorted terms of the field, and the
+// ordinals of the terms of each document, see Segment.SortedSetDocValues
+type SortedSetField interface {
+	segment.Field
+
+	// SortedSetDocValues reports whether the terms of the field are stored
+	// as sorted-set doc values, when it indexes doc values
+	SortedSetDocValues() bool
+}
+
+const (
+	// sortedSetChunkSize is the number of documents in each chunk of
+	// sorted-set ordinals
+	sortedSetChunkSize = 1024
+	// sortedSetTermsBlockSize is the number of terms between the recorded
+	// term offsets, so looking up a term reads at most this many terms
+	sortedSetTermsBlockSize = 32
+)
+
+// sortedSetColumn holds the sorted-set doc values of a field while a
+// segment is being built or merged
+type sortedSetColumn struct {
+	termIDs  map[string]uint64 // term -> id, in the order they were added
+	terms    []string          // id -> term
+	docTerms [][]uint64        // docNum -> term ids
+}
+
+func newSortedSetColumn() *sortedSetColumn {
+	return &sortedSetColumn{
+		termIDs: map[string]uint64{},
+	}
+}
+
+// termID returns the id of the term, adding it if needed
+func (c *sortedSetColumn) termID(term string) uint64 {
+	id, ok := c.termIDs[term]
+	if !ok {
+		id = uint64(len(c.terms))
+		c.termIDs[term] = id
+		c.terms = append(c.terms, term)
+	}
+	return id
+}
+
+// add adds the term id to the terms of docNum
+func (c *sortedSetColumn) add(docNum, id uint64) {
+	if uint64(len(c.docTerms)) <= docNum {
+		c.docTerms = append(c.docTerms, make([][]uint64, docNum+1-uint64(len(c.docTerms)))...)
+	}
+	c.docTerms[docNum] = append(c.docTerms[docNum], id)
+}
+
+// addSortedSetField adds the terms of the field to the sorted-set doc
+// values of the field id, if it has them
+func addSortedSetField(columns map[uint16]*sortedSetColumn, fieldID uint16, field segment.Field,
+	docNum uint64) {
+	sortedSetField, ok := field.(SortedSetField)
+	if !ok || !field.IndexDocValues() || !sortedSetField.SortedSetDocValues() {
+		return
+	}
+	column := columns[fieldID]
+	if column == nil {
+		column = newSortedSetColumn()
+		columns[fieldID] = column
+	}
+	field.EachTerm(func(term segment.FieldTerm) {
+		column.add(docNum, column.termID(string(term.Term())))
+	})
+}
+
+// persistSortedSetDocValues writes out the sorted-set doc values of each
+// field, then an index of them, returning where the index starts, or 0 if
+// there are none.  The index is a uvarint count, then the uvarint field id
+// and uvarint column header offset of each field.
+func persistSortedSetDocValues(columns map[uint16]*sortedSetColumn, numDocs uint64,
+	w *countHashWriter) (uint64, error) {
+	fieldIDs := make([]uint16, 0, len(columns))
+	for fieldID := range columns {
+		fieldIDs = append(fieldIDs, fieldID)
+	}
+	sort.Slice(fieldIDs, func(i, j int) bool {
+		return fieldIDs[i] < fieldIDs[j]
+	})
+	return persistSortedSetColumns(fieldIDs, numDocs, w, func(fieldID uint16) (*sortedSetColumn, error) {
+		return columns[fieldID], nil
+	})
+}
+
+// persistSortedSetColumns is persistSortedSetDocValues for the ascending
+// field ids, getting the column of each field only once the previous one
+// is written
+func persistSortedSetColumns(fieldIDs []uint16, numDocs uint64, w *countHashWriter,
+	column func(fieldID uint16) (*sortedSetColumn, error)) (uint64, error) {
+	if len(fieldIDs) == 0 || numDocs == 0 {
+		return 0, nil
+	}
+
+	headerOffsets := make([]uint64, len(fieldIDs))
+	for i, fieldID := range fieldIDs {
+		c, err := column(fieldID)
+		if err != nil {
+			return 0, err
+		}
+		headerOffsets[i], err = persistSortedSetColumn(c, numDocs, w)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	rv := uint64(w.Count())
+	err := writeUvarints(w, uint64(len(fieldIDs)))
+	if err != nil {
+		return 0, err
+	}
+	for i, fieldID := range fieldIDs {
+		err = writeUvarints(w, uint64(fieldID), headerOffsets[i])
+		if err != nil {
+			return 0, err
+		}
+	}
+	return rv, nil
+}
+
+// persistSortedSetColumn writes out the sorted terms of the column, each
+// a uvarint length and the term, then the chunks of ordinals, each holding
+// for every document the uvarint number of ordinals, then the first
+// ordinal and the difference from the previous of each other, as uvarints.
+// Finally the column header is written: uvarint number of terms, uvarint
+// start of the terms, the uvarint offset from the start of the terms of
+// every sortedSetTermsBlockSize'th term, uvarint chunk size, uvarint start
+// of the chunks, uvarint number of chunks and the uvarint length of each.
+// It returns where the header starts.
+func persistSortedSetColumn(column *sortedSetColumn, numDocs uint64, w *countHashWriter) (uint64, error) {
+	// the ordinal of a term is its position once sorted
+	byTerm := make([]uint64, len(column.terms))
+	for id := range byTerm {
+		byTerm[id] = uint64(id)
+	}
+	sort.Slice(byTerm, func(i, j int) bool {
+		return column.terms[byTerm[i]] < column.terms[byTerm[j]]
+	})
+	ords := make([]uint64, len(column.terms))
+	for ord, id := range byTerm {
+		ords[id] = uint64(ord)
+	}
+
+	termsStart := uint64(w.Count())
+	var blockOffsets []uint64
+	for ord, id := range byTerm {
+		if ord%sortedSetTermsBlockSize == 0 {
+			blockOffsets = append(blockOffsets, uint64(w.Count())-termsStart)
+		}
+		err := writeUvarints(w, uint64(len(column.terms[id])))
+		if err != nil {
+			return 0, err
+		}
+		_, err = w.Write([]byte(column.terms[id]))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	chunksStart := uint64(w.Count())
+	var chunkLens []uint64
+	var docOrds []uint64
+	for start := uint64(0); start < numDocs; start += sortedSetChunkSize {
+		end := start + sortedSetChunkSize
+		if end > numDocs {
+			end = numDocs
+		}
+		chunkStart := uint64(w.Count())
+		for docNum := start; docNum < end; docNum++ {
+			docOrds = docOrds[:0]
+			if docNum < uint64(len(column.docTerms)) {
+				for _, id := range column.docTerms[docNum] {
+					docOrds = append(docOrds, ords[id])
+				}
+			}
+			err := writeSortedSetDoc(w, docOrds)
+			if err != nil {
+				return 0, err
+			}
+		}
+		chunkLens = append(chunkLens, uint64(w.Count())-chunkStart)
+	}
+
+	rv := uint64(w.Count())
+	err := writeUvarints(w, uint64(len(column.terms)), termsStart)
+	if err != nil {
+		return 0, err
+	}
+	err = writeUvarints(w, blockOffsets...)
+	if err != nil {
+		return 0, err
+	}
+	err = writeUvarints(w, sortedSetChunkSize, chunksStart, uint64(len(chunkLens)))
+	if err != nil {
+		return 0, err
+	}
+	err = writeUvarints(w, chunkLens...)
+	if err != nil {
+		return 0, err
+	}
+	return rv, nil
+}
+
+// writeSortedSetDoc writes out the distinct ordinals of a document, in order
+func writeSortedSetDoc(w *countHashWriter, ords []uint64) error {
+	sort.Slice(ords, func(i, j int) bool {
+		return ords[i] < ords[j]
+	})
+	var n int
+	for i, ord := range ords {
+		if i == 0 || ord != ords[n-1] {
+			ords[n] = ord
+			n++
+		}
+	}
+	ords = ords[:n]
+	err := writeUvarints(w, uint64(len(ords)))
+	if err != nil {
+		return err
+	}
+	for i := len(ords) - 1; i > 0; i-- {
+		ords[i] -= ords[i-1]
+	}
+	return writeUvarints(w, ords...)
+}
+
+// sortedSetColumnMeta holds the column header of a field's sorted-set doc
+// values
+type sortedSetColumnMeta struct {
+	numTerms     uint64
+	termsStart   uint64
+	blockOffsets []uint64
+	chunkSize    uint64
+	chunkStarts  []uint64 // chunk i spans chunkStarts[i] to chunkStarts[i+1]
+}
+
+// loadSortedSetIndex reads where the sorted-set doc values of each field
+// are
+func (s *Segment) loadSortedSetIndex() error {
+	if s.footer.sortedSetOffset == 0 {
+		return nil
+	}
+	numFields, n, err := readUvarintAt(s.data, s.footer.sortedSetOffset)
+	if err != nil {
+		return fmt.Errorf("error reading sorted-set doc values: %v", err)
+	}
+	offset := s.footer.sortedSetOffset + n
+	for i := uint64(0); i < numFields; i++ {
+		var fieldID, headerOffset uint64
+		fieldID, n, err = readUvarintAt(s.data, offset)
+		if err != nil {
+			return fmt.Errorf("error reading sorted-set doc values field: %v", err)
+		}
+		offset += n
+		headerOffset, n, err = readUvarintAt(s.data, offset)
+		if err != nil {
+			return fmt.Errorf("error reading sorted-set doc values field: %v", err)
+		}
+		offset += n
+		if fieldID >= uint64(len(s.fieldsInv)) {
+			return fmt.Errorf("sorted-set doc values field id %d out of range", fieldID)
+		}
+		s.fields[fieldID].sortedSetHeader = headerOffset
+		s.fields[fieldID].hasSortedSet = true
+	}
+	return nil
+}
+
+// fieldSortedSetMeta returns the column header of the sorted-set doc values
+// of the field, nil if it has none, reading it on first use
+func (s *Segment) fieldSortedSetMeta(fieldID uint16) (*sortedSetColumnMeta, error) {
+	err := s.loadDocValueIndexOnce()
+	if err != nil {
+		return nil, err
+	}
+	f := &s.fields[fieldID]
+	f.sortedSetOnce.Do(func() {
+		if !f.hasSortedSet {
+			return
+		}
+		f.sortedSet, f.sortedSetErr = s.loadSortedSetColumnMeta(f.sortedSetHeader)
+		if f.sortedSetErr != nil {
+			f.sortedSetErr = fmt.Errorf("error reading sorted-set doc values of field %s: %v", s.fieldsInv[fieldID],
+				f.sortedSetErr)
+			return
+		}
+		s.addSize(sizeOfPtr + (len(f.sortedSet.blockOffsets)+len(f.sortedSet.chunkStarts))*sizeOfUint64)
+	})
+	return f.sortedSet, f.sortedSetErr
+}
+
+func (s *Segment) loadSortedSetColumnMeta(offset uint64) (*sortedSetColumnMeta, error) {
+	r := &uvarintAtReader{data: s.data, offset: offset}
+	rv := &sortedSetColumnMeta{
+		numTerms:   r.next(),
+		termsStart: r.next(),
+	}
+	numBlocks := (rv.numTerms + sortedSetTermsBlockSize - 1) / sortedSetTermsBlockSize
+	for i := uint64(0); i < numBlocks && r.err == nil; i++ {
+		rv.blockOffsets = append(rv.blockOffsets, r.next())
+	}
+	rv.chunkSize = r.next()
+	chunkStart := r.next()
+	numChunks := r.next()
+	rv.chunkStarts = append(rv.chunkStarts, chunkStart)
+	for i := uint64(0); i < numChunks && r.err == nil; i++ {
+		chunkStart += r.next()
+		rv.chunkStarts = append(rv.chunkStarts, chunkStart)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if rv.chunkSize == 0 {
+		return nil, fmt.Errorf("chunk size 0")
+	}
+	return rv, nil
+}
+
+// SortedSetDocValues reads the sorted-set doc values of a field, whose
+// terms are numbered by ordinals in the order of the terms.  It caches the
+// current chunk of ordinals, so is not safe for concurrent use.
+type SortedSetDocValues struct {
+	sb   *Segment
+	meta *sortedSetColumnMeta
+
+	curChunk   int
+	docOffsets []int // doc in chunk -> start of its ordinals in ords
+	ords       []uint64
+}
+
+// SortedSetDocValues returns a reader of the sorted-set doc values of the
+// field, or nil if the field has none, see SortedSetField
+func (s *Segment) SortedSetDocValues(field string) (*SortedSetDocValues, error) {
+	fieldIDPlus1 := s.fieldsMap[field]
+	if fieldIDPlus1 == 0 {
+		return nil, nil
+	}
+	meta, err := s.fieldSortedSetMeta(fieldIDPlus1 - 1)
+	if meta == nil || err != nil {
+		return nil, err
+	}
+	return &SortedSetDocValues{
+		sb:       s,
+		meta:     meta,
+		curChunk: -1,
+	}, nil
+}
+
+// NumTerms returns the number of distinct terms, the ordinals are from 0
+// to NumTerms-1
+func (d *SortedSetDocValues) NumTerms() uint64 {
+	return d.meta.numTerms
+}
+
+// Ordinals appends the ordinals of the terms of the document to ords, in
+// ascending order, and returns the result
+func (d *SortedSetDocValues) Ordinals(docNum uint64, ords []uint64) ([]uint64, error) {
+	if docNum >= d.sb.footer.numDocs {
+		return ords, nil
+	}
+	chunk := int(docNum / d.meta.chunkSize)
+	if chunk != d.curChunk {
+		err := d.loadChunk(chunk)
+		if err != nil {
+			return ords, err
+		}
+	}
+	doc := int(docNum % d.meta.chunkSize)
+	return append(ords, d.ords[d.docOffsets[doc]:d.docOffsets[doc+1]]...), nil
+}
+
+func (d *SortedSetDocValues) loadChunk(chunk int) error {
+	if chunk+1 >= len(d.meta.chunkStarts) {
+		return fmt.Errorf("sorted-set doc values chunk %d out of range", chunk)
+	}
+	start, end := d.meta.chunkStarts[chunk], d.meta.chunkStarts[chunk+1]
+	data, err := d.sb.data.Read(int(start), int(end))
+	if err != nil {
+		return err
+	}
+	chunkDocs := d.sb.footer.numDocs - uint64(chunk)*d.meta.chunkSize
+	if chunkDocs > d.meta.chunkSize {
+		chunkDocs = d.meta.chunkSize
+	}
+	d.curChunk = -1
+	d.docOffsets = append(d.docOffsets[:0], 0)
+	d.ords = d.ords[:0]
+	r := newMemUvarintReader(data)
+	for i := uint64(0); i < chunkDocs; i++ {
+		var n uint64
+		n, err = r.ReadUvarint()
+		if err != nil {
+			return fmt.Errorf("error reading sorted-set doc values chunk %d: %v", chunk, err)
+		}
+		var ord uint64
+		for j := uint64(0); j < n; j++ {
+			var delta uint64
+			delta, err = r.ReadUvarint()
+			if err != nil {
+				return fmt.Errorf("error reading sorted-set doc values chunk %d: %v", chunk, err)
+			}
+			ord += delta
+			d.ords = append(d.ords, ord)
+		}
+		d.docOffsets = append(d.docOffsets, len(d.ords))
+	}
+	if r.Len() > 0 {
+		return fmt.Errorf("sorted-set doc values chunk %d has %d trailing bytes", chunk, r.Len())
+	}
+	d.curChunk = chunk
+	return nil
+}
+
+// Term returns the term of the ordinal
+func (d *SortedSetDocValues) Term(ord uint64) ([]byte, error) {
+	if ord >= d.meta.numTerms {
+		return nil, fmt.Errorf("ordinal %d out of range, %d terms", ord, d.meta.numTerms)
+	}
+	block := ord / sortedSetTermsBlockSize
+	offset := d.meta.termsStart + d.meta.blockOffsets[block]
+	for i := block * sortedSetTermsBlockSize; ; i++ {
+		term, next, err := d.readTerm(offset)
+		if err != nil || i == ord {
+			return term, err
+		}
+		offset = next
+	}
+}
+
+// Ordinal returns the ordinal of the term, and whether the field has it
+func (d *SortedSetDocValues) Ordinal(term []byte) (uint64, bool, error) {
+	// find the last block starting with a term no greater than the term
+	var err error
+	block := sort.Search(len(d.meta.blockOffsets), func(i int) bool {
+		var firstTerm []byte
+		if err == nil {
+			firstTerm, _, err = d.readTerm(d.meta.termsStart + d.meta.blockOffsets[i])
+		}
+		return bytes.Compare(firstTerm, term) > 0
+	}) - 1
+	if err != nil || block < 0 {
+		return 0, false, err
+	}
+	offset := d.meta.termsStart + d.meta.blockOffsets[block]
+	for ord := uint64(block) * sortedSetTermsBlockSize; ord < d.meta.numTerms &&
+		ord < uint64(block+1)*sortedSetTermsBlockSize; ord++ {
+		var blockTerm []byte
+		blockTerm, offset, err = d.readTerm(offset)
+		if err != nil {
+			return 0, false, err
+		}
+		switch bytes.Compare(blockTerm, term) {
+		case 0:
+			return ord, true, nil
+		case 1:
+			return 0, false, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// readTerm reads the term at offset, returning it and the offset of the
+// next term
+func (d *SortedSetDocValues) readTerm(offset uint64) ([]byte, uint64, error) {
+	termLen, n, err := readUvarintAt(d.sb.data, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += n
+	term, err := d.sb.data.Read(int(offset), int(offset+termLen))
+	if err != nil {
+		return nil, 0, err
+	}
+	return term, offset + termLen, nil
+}
+
+// mergeSortedSetDocValues collects the sorted-set doc values of the
+// segments' remaining documents, at their new doc numbers
+func mergeSortedSetDocValues(segments []*Segment, newDocNums [][]uint64,
+	fieldsMap map[string]uint16) (map[uint16]*sortedSetColumn, error) {
+	columns := map[uint16]*sortedSetColumn{}
+	var ords []uint64
+	for segI, seg := range segments {
+		for fieldID, name := range seg.fieldsInv {
+			meta, err := seg.fieldSortedSetMeta(uint16(fieldID))
+			if err != nil {
+				return nil, err
+			}
+			if meta == nil {
+				continue
+			}
+			newFieldID := fieldsMap[name] - 1
+			column := columns[newFieldID]
+			if column == nil {
+				column = newSortedSetColumn()
+				columns[newFieldID] = column
+			}
+
+			// map the ordinals of the segment to the ids of the terms as
+			// they are used, leaving out the terms of dropped documents
+			reader := &SortedSetDocValues{sb: seg, meta: meta, curChunk: -1}
+			termIDPlus1s := make([]uint64, meta.numTerms)
+			for docNum, newDocNum := range newDocNums[segI] {
+				if newDocNum == docDropped {
+					continue
+				}
+				ords, err = reader.Ordinals(uint64(docNum), ords[:0])
+				if err != nil {
+					return nil, err
+				}
+				for _, ord := range ords {
+					if termIDPlus1s[ord] == 0 {
+						var term []byte
+						term, err = reader.Term(ord)
+						if err != nil {
+							return nil, err
+						}
+						termIDPlus1s[ord] = column.termID(string(term)) + 1
+					}
+					column.add(newDocNum, termIDPlus1s[ord]-1)
+				}
+			}
+		}
+	}
+	return columns, nil
+}
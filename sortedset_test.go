@@ -0,0 +1,235 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+var testSortedSetFields = []struct {
+	name  string
+	terms func(i int) []string
+}{
+	{
+		name: "tags",
+		terms: func(i int) []string {
+			if i%5 == 0 {
+				return nil
+			}
+			return []string{fmt.Sprintf("t%d", i%7), fmt.Sprintf("t%d", i%11)}
+		},
+	},
+	{
+		name: "code",
+		terms: func(i int) []string {
+			return []string{fmt.Sprintf("c%05d", i)}
+		},
+	},
+}
+
+// buildTestAnalysisResultsSortedSet builds documents with the sorted-set
+// fields of testSortedSetFields, and the id i as a 5 digit number
+func buildTestAnalysisResultsSortedSet(numDocs int) []segment.Document {
+	var results []segment.Document
+	for i := 0; i < numDocs; i++ {
+		doc := &FakeTypedDocument{
+			FakeDocument: FakeDocument{
+				NewFakeField("_id", fmt.Sprintf("%05d", i), true, false, false),
+				NewFakeField("body", "the "+strconv.Itoa(i%3), true, true, false),
+			},
+		}
+		for _, field := range testSortedSetFields {
+			for _, term := range field.terms(i) {
+				doc.Typed = append(doc.Typed, NewFakeSortedSetField(field.name, term))
+			}
+		}
+		results = append(results, doc)
+	}
+	return results
+}
+
+// checkSortedSets checks the sorted-set doc values of each document of the
+// segment are those of the document with its id, and that the ordinals
+// number exactly the terms of the documents in sorted order
+func checkSortedSets(t *testing.T, seg *Segment) {
+	ids := storedIDs(t, seg)
+	for _, field := range testSortedSetFields {
+		dvs, err := seg.SortedSetDocValues(field.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dvs == nil {
+			t.Fatalf("expected sorted-set doc values for %s", field.name)
+		}
+
+		allTerms := map[string]struct{}{}
+		var ords []uint64
+		for docNum, id := range ids {
+			i, err := strconv.Atoi(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := map[string]struct{}{}
+			for _, term := range field.terms(i) {
+				expected[term] = struct{}{}
+				allTerms[term] = struct{}{}
+			}
+
+			ords, err = dvs.Ordinals(uint64(docNum), ords[:0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ords) != len(expected) {
+				t.Errorf("%s doc %d (%s): expected %d ordinals, got %v", field.name, docNum, id, len(expected), ords)
+			}
+			for j, ord := range ords {
+				if j > 0 && ord <= ords[j-1] {
+					t.Errorf("%s doc %d (%s): expected ascending ordinals, got %v", field.name, docNum, id, ords)
+				}
+				term, err := dvs.Term(ord)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, ok := expected[string(term)]; !ok {
+					t.Errorf("%s doc %d (%s): unexpected term %s", field.name, docNum, id, term)
+				}
+				actual, ok, err := dvs.Ordinal(term)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ok || actual != ord {
+					t.Errorf("%s: expected ordinal %d for %s, got %d %t", field.name, ord, term, actual, ok)
+				}
+			}
+		}
+
+		var expectedTerms []string
+		for term := range allTerms {
+			expectedTerms = append(expectedTerms, term)
+		}
+		sort.Strings(expectedTerms)
+		var actualTerms []string
+		for ord := uint64(0); ord < dvs.NumTerms(); ord++ {
+			term, err := dvs.Term(ord)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actualTerms = append(actualTerms, string(term))
+		}
+		if !reflect.DeepEqual(actualTerms, expectedTerms) {
+			t.Errorf("%s: expected terms %v, got %v", field.name, expectedTerms, actualTerms)
+		}
+		if _, err := dvs.Term(dvs.NumTerms()); err == nil {
+			t.Errorf("%s: expected error for ordinal out of range", field.name)
+		}
+
+		// terms before the first, between each pair and after the last
+		for _, term := range []string{"", "a", "c00000a", "t0a", "zzz"} {
+			_, ok, err := dvs.Ordinal([]byte(term))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok {
+				t.Errorf("%s: expected no ordinal for %q", field.name, term)
+			}
+		}
+	}
+}
+
+func TestSortedSetDocValues(t *testing.T) {
+	segInt, _, err := New(buildTestAnalysisResultsSortedSet(2500), encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := segInt.(*Segment)
+	checkSortedSets(t, seg)
+
+	for _, field := range []string{"body", "missing"} {
+		dvs, err := seg.SortedSetDocValues(field)
+		if dvs != nil || err != nil {
+			t.Errorf("expected no sorted-set doc values for %s, got %v, %v", field, dvs, err)
+		}
+	}
+	err = seg.Verify(context.Background())
+	if err != nil {
+		t.Errorf("expected segment to verify, got: %v", err)
+	}
+}
+
+func TestSortedSetDocValuesMerge(t *testing.T) {
+	results := buildTestAnalysisResultsSortedSet(1500)
+	segA, _, err := New(results[:1000], encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segB, _, err := New(results[1000:], encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segC, _, err := New(buildTestAnalysisResultsSort("a", "b"), encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{
+			name: "serial",
+		},
+		{
+			name: "parallel",
+			opts: []Option{WithMergeWorkers(4)},
+		},
+		{
+			name: "sorted",
+			opts: []Option{WithSort(SortField{Field: "body", Descending: true})},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var merged bytes.Buffer
+			_, err = MergeWithOptions([]segment.Segment{segA, segC, segB},
+				[]*roaring.Bitmap{roaring.BitmapOf(0, 5, 999), roaring.BitmapOf(0, 1), nil}, 1024, test.opts...).
+				WriteTo(&merged, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seg, err := load(segment.NewDataBytes(merged.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seg.Count() != 1497 {
+				t.Errorf("expected 1497 docs, got %d", seg.Count())
+			}
+			// the terms of the dropped documents are not kept
+			checkSortedSets(t, seg)
+			err = seg.Verify(context.Background())
+			if err != nil {
+				t.Errorf("expected merged segment to verify, got: %v", err)
+			}
+		})
+	}
+}
@@ -15,6 +15,10 @@
 package ice
 
 import (
+	"fmt"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/blevesearch/vellum"
 	segment "github.com/blugelabs/bluge_segment_api"
 )
 
@@ -46,9 +50,264 @@ func (s *Segment) CollectionStats(field string) (segment.CollectionStats, error)
 	var rv = &CollectionStats{}
 	fieldIDPlus1 := s.fieldsMap[field]
 	if fieldIDPlus1 > 0 {
+		var err error
 		rv.totalDocCount = s.footer.numDocs
-		rv.docCount = s.fieldDocs[fieldIDPlus1-1]
-		rv.sumTotalTermFreq = s.fieldFreqs[fieldIDPlus1-1]
+		rv.docCount, rv.sumTotalTermFreq, err = s.fieldStats(fieldIDPlus1 - 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rv, nil
+}
+
+// fieldStats returns the number of docs with a value in the field, and the
+// total number of its tokens, reading them on first use
+func (s *Segment) fieldStats(fieldID uint16) (docs, freqs uint64, err error) {
+	if err = s.checkOpen(); err != nil {
+		return 0, 0, err
+	}
+	f := &s.fields[fieldID]
+	f.statsOnce.Do(func() {
+		r := &uvarintAtReader{data: s.data, offset: f.statsAddr}
+		f.docs, f.freqs = r.next(), r.next()
+		f.statsErr = r.err
+	})
+	return f.docs, f.freqs, f.statsErr
+}
+
+// SegmentStats reports the bytes taken by the sections of a segment, see
+// Stats
+type SegmentStats struct {
+	NumDocs uint64 `json:"num_docs"`
+	Bytes   uint64 `json:"bytes"` // the whole segment, footer included
+	// StoredBytes is the bytes of the stored fields, their chunks, large
+	// values, chunk index and stored index
+	StoredBytes uint64        `json:"stored_bytes"`
+	Fields      []*FieldStats `json:"fields"`
+}
+
+// FieldStats reports the bytes taken by a field in each section of a
+// segment, and what its terms and doc values hold
+type FieldStats struct {
+	Name string `json:"name"`
+
+	// DictionaryBytes is the bytes of the dictionary, its top terms and its
+	// reversed terms
+	DictionaryBytes uint64 `json:"dictionary_bytes"`
+	// PostingsBytes is the bytes of the postings lists, their headers and
+	// impacts
+	PostingsBytes          uint64 `json:"postings_bytes"`
+	FreqNormBytes          uint64 `json:"freq_norm_bytes"`
+	LocationBytes          uint64 `json:"location_bytes"`
+	DocValueBytes          uint64 `json:"doc_value_bytes"`
+	NumericDocValueBytes   uint64 `json:"numeric_doc_value_bytes"`
+	SortedSetDocValueBytes uint64 `json:"sorted_set_doc_value_bytes"`
+
+	Terms uint64 `json:"terms"`
+	// OneHitTerms is the number of terms whose only posting is encoded in
+	// the dictionary, without a postings list
+	OneHitTerms        uint64  `json:"one_hit_terms"`
+	Docs               uint64  `json:"docs"` // docs with a value in the field
+	TotalTermFrequency uint64  `json:"total_term_frequency"`
+	AvgPostingsLen     float64 `json:"avg_postings_len"` // docs per term
+	DocValueChunks     int     `json:"doc_value_chunks"`
+}
+
+// Stats walks the dictionary of each field, returning the bytes taken by
+// each section of the segment, per field, to find which fields take the
+// most space
+func (s *Segment) Stats() (*SegmentStats, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	rv := &SegmentStats{
+		NumDocs:     s.footer.numDocs,
+		Bytes:       uint64(s.data.Len() + s.footer.length()),
+		StoredBytes: s.footer.storedIndexOffset + s.footer.numDocs*fileAddrWidth,
+	}
+	w := &fieldStatsWalker{s: s, postings: roaring.New()}
+	for fieldID := range s.fieldsInv {
+		fieldStats, err := w.fieldStats(uint16(fieldID))
+		if err != nil {
+			return nil, fmt.Errorf("error reading stats of field %s: %w", s.fieldsInv[fieldID], err)
+		}
+		rv.Fields = append(rv.Fields, fieldStats)
+	}
+	return rv, nil
+}
+
+// fieldStatsWalker holds what is reused walking the postings of fields
+type fieldStatsWalker struct {
+	s        *Segment
+	postings *roaring.Bitmap
+	decoder  *chunkedIntDecoder
+}
+
+func (w *fieldStatsWalker) fieldStats(fieldID uint16) (*FieldStats, error) {
+	s := w.s
+	rv := &FieldStats{Name: s.fieldsInv[fieldID]}
+	var err error
+	rv.Docs, rv.TotalTermFrequency, err = s.fieldStats(fieldID)
+	if err != nil {
+		return nil, err
+	}
+
+	fst, err := s.fieldFST(fieldID)
+	if err != nil {
+		return nil, err
+	}
+	if fst != nil {
+		err = w.dictionaryStats(rv, fieldID, fst)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = w.docValueStats(rv, fieldID)
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// dictionaryStats adds the bytes of the dictionary of the field, and of the
+// postings of each of its terms, to its stats
+func (w *fieldStatsWalker) dictionaryStats(rv *FieldStats, fieldID uint16, fst *vellum.FST) error {
+	s := w.s
+	dictLoc := s.fields[fieldID].dictLoc
+	vellumLen, n, err := readUvarintAt(s.data, dictLoc)
+	if err != nil {
+		return err
+	}
+	rv.DictionaryBytes = n + vellumLen
+	if s.footer.format().hasTopTerms() {
+		var end uint64
+		_, end, err = s.readTopTerms(dictLoc)
+		if err != nil {
+			return err
+		}
+		rv.DictionaryBytes = end - dictLoc
+	}
+	if s.footer.format().hasReverseTerms() {
+		var end uint64
+		_, end, err = s.readReverseDictLoc(dictLoc)
+		if err != nil {
+			return err
+		}
+		rv.DictionaryBytes = end - dictLoc
+	}
+
+	var numPostings uint64
+	itr, err := fst.Iterator(nil, nil)
+	for err == nil {
+		_, postingsOffset := itr.Current()
+		var card uint64
+		card, err = w.postingsStats(rv, postingsOffset)
+		if err != nil {
+			return err
+		}
+		numPostings += card
+		err = itr.Next()
+	}
+	if err != vellum.ErrIteratorDone {
+		return err
+	}
+	if rv.Terms > 0 {
+		rv.AvgPostingsLen = float64(numPostings) / float64(rv.Terms)
+	}
+	return nil
+}
+
+// postingsStats adds the bytes of the postings of a term to the stats of
+// its field, returning their number
+func (w *fieldStatsWalker) postingsStats(rv *FieldStats, postingsOffset uint64) (uint64, error) {
+	s := w.s
+	rv.Terms++
+	if postingsOffset&fSTValEncodingMask == fSTValEncoding1Hit {
+		rv.OneHitTerms++
+		return 1, nil
+	}
+
+	header, err := s.footer.format().readPostingsHeader(s.data, postingsOffset)
+	if err != nil {
+		return 0, err
+	}
+	postingsLen, read, err := readUvarintAt(s.data, postingsOffset+header.n)
+	if err != nil {
+		return 0, err
+	}
+	start := postingsOffset + header.n + read
+	roaringData, err := s.data.Read(int(start), int(start+postingsLen))
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.postings.FromBuffer(roaringData)
+	if err != nil {
+		return 0, fmt.Errorf("error loading roaring bitmap: %v", err)
+	}
+	if header.impactsOffset != termNotEncoded && header.impactsOffset < postingsOffset {
+		// the impacts precede the postings list
+		rv.PostingsBytes += postingsOffset - header.impactsOffset
+	}
+	rv.PostingsBytes += start + postingsLen - postingsOffset
+
+	freqNormBytes, err := w.chunkedIntBytes(header.freqOffset)
+	if err != nil {
+		return 0, err
+	}
+	rv.FreqNormBytes += freqNormBytes
+	locationBytes, err := w.chunkedIntBytes(header.locOffset)
+	if err != nil {
+		return 0, err
+	}
+	rv.LocationBytes += locationBytes
+	return w.postings.GetCardinality(), nil
+}
+
+// chunkedIntBytes returns the bytes of the chunked ints section at offset
+func (w *fieldStatsWalker) chunkedIntBytes(offset uint64) (uint64, error) {
+	if offset == termNotEncoded {
+		return 0, nil
+	}
+	var err error
+	w.decoder, err = newChunkedIntDecoder(w.s.data, offset, w.decoder)
+	if err != nil {
+		return 0, err
+	}
+	rv := w.decoder.dataStartOffset - offset
+	if len(w.decoder.chunkOffsets) > 0 {
+		rv += w.decoder.chunkOffsets[len(w.decoder.chunkOffsets)-1]
 	}
 	return rv, nil
 }
+
+// docValueStats adds the bytes of the doc values of the field to its stats
+func (w *fieldStatsWalker) docValueStats(rv *FieldStats, fieldID uint16) error {
+	s := w.s
+	dvr, err := s.fieldDocValueReader(fieldID)
+	if err != nil {
+		return err
+	}
+	f := &s.fields[fieldID]
+	if dvr != nil {
+		rv.DocValueBytes = f.dvEnd - f.dvStart
+		rv.DocValueChunks = len(dvr.chunkOffsets)
+	}
+	numeric, err := s.fieldNumericMeta(fieldID)
+	if err != nil {
+		return err
+	}
+	if numeric != nil {
+		// the chunks of values precede the column header
+		rv.NumericDocValueBytes = f.numericHeader - numeric.chunkStarts[0]
+	}
+	sortedSet, err := s.fieldSortedSetMeta(fieldID)
+	if err != nil {
+		return err
+	}
+	if sortedSet != nil {
+		// the terms and the chunks of ordinals precede the column header
+		rv.SortedSetDocValueBytes = f.sortedSetHeader - sortedSet.termsStart
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+// checkStatsBytes checks the sections of the fields sum to at most the
+// bytes of the segment
+func checkStatsBytes(t *testing.T, stats *SegmentStats) {
+	sum := stats.StoredBytes
+	for _, f := range stats.Fields {
+		sum += f.DictionaryBytes + f.PostingsBytes + f.FreqNormBytes + f.LocationBytes +
+			f.DocValueBytes + f.NumericDocValueBytes + f.SortedSetDocValueBytes
+	}
+	if sum == 0 || sum > stats.Bytes {
+		t.Errorf("expected sections to take at most the %d bytes of the segment, got %d", stats.Bytes, sum)
+	}
+}
+
+func TestStats(t *testing.T) {
+	const numDocs = 500
+	results := buildTestAnalysisResultsNumeric(numDocs)
+	for i, result := range buildTestAnalysisResultsSortedSet(numDocs) {
+		results[i].(*FakeTypedDocument).Typed = append(results[i].(*FakeTypedDocument).Typed,
+			result.(*FakeTypedDocument).Typed...)
+	}
+	segInt, _, err := New(results, encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// terms are only 1-hit encoded by merges
+	var buf bytes.Buffer
+	_, err = Merge([]segment.Segment{segInt}, []*roaring.Bitmap{nil}, 1024).WriteTo(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg, err := load(segment.NewDataBytes(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := seg.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumDocs != numDocs || stats.StoredBytes == 0 {
+		t.Errorf("expected %d docs with stored fields, got %+v", numDocs, stats)
+	}
+	checkStatsBytes(t, stats)
+
+	fields := map[string]*FieldStats{}
+	for _, f := range stats.Fields {
+		fields[f.Name] = f
+	}
+	id := fields["_id"]
+	if id == nil || id.Terms != numDocs || id.OneHitTerms != numDocs || id.AvgPostingsLen != 1 ||
+		id.Docs != numDocs || id.PostingsBytes != 0 || id.DictionaryBytes == 0 {
+		t.Errorf("expected a 1-hit encoded term for each doc in _id, got %+v", id)
+	}
+	body := fields["body"]
+	if body == nil || body.Terms != 4 || body.OneHitTerms != 0 || body.TotalTermFrequency != 2*numDocs ||
+		body.PostingsBytes == 0 || body.FreqNormBytes == 0 || body.LocationBytes == 0 {
+		t.Errorf("expected postings with locations for body, got %+v", body)
+	}
+	// "the" in every doc, and each of "0", "1" and "2" in a third of them
+	if body != nil && body.AvgPostingsLen != 2*numDocs/4.0 {
+		t.Errorf("expected body terms in %f docs on average, got %f", 2*numDocs/4.0, body.AvgPostingsLen)
+	}
+	for _, field := range testNumericFields {
+		if f := fields[field.name]; f == nil || f.NumericDocValueBytes == 0 {
+			t.Errorf("expected numeric doc values for %s, got %+v", field.name, f)
+		}
+	}
+	for _, field := range testSortedSetFields {
+		if f := fields[field.name]; f == nil || f.SortedSetDocValueBytes == 0 {
+			t.Errorf("expected sorted-set doc values for %s, got %+v", field.name, f)
+		}
+	}
+
+	docValues, _, err := New(buildTestAnalysisResultsCached(0, 1000), encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err = docValues.(*Segment).Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range stats.Fields {
+		if (f.Name != "_id") != (f.DocValueBytes > 0 && f.DocValueChunks > 0) {
+			t.Errorf("expected doc values only for title and body, got %+v", f)
+		}
+	}
+
+	err = seg.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = seg.Stats()
+	if !errors.Is(err, ErrSegmentClosed) {
+		t.Errorf("expected stats of closed segment to fail, got: %v", err)
+	}
+}
+
+func TestStatsVersions(t *testing.T) {
+	for version := uint32(2); version < Version; version++ {
+		t.Run(fmt.Sprintf("version %d", version), func(t *testing.T) {
+			seg := loadTestFile(t, fmt.Sprintf("testdata/v%d.ice", version))
+			stats, err := seg.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkStatsBytes(t, stats)
+			for _, f := range stats.Fields {
+				if f.Docs > 0 && (f.Terms == 0 || f.DictionaryBytes == 0) {
+					t.Errorf("expected terms in field %+v", f)
+				}
+			}
+		})
+	}
+}
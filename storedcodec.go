@@ -0,0 +1,259 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// StoredCodecID identifies the codec compressing the chunks of stored
+// fields, it is recorded in the segment since version 3
+type StoredCodecID uint32
+
+const (
+	// StoredCodecNone leaves the chunks uncompressed
+	StoredCodecNone StoredCodecID = iota + 1
+	// StoredCodecSnappy compresses the chunks with snappy
+	StoredCodecSnappy
+	// StoredCodecZSTD compresses the chunks with zstd
+	StoredCodecZSTD
+	// StoredCodecZSTDDict compresses the chunks with zstd and a
+	// dictionary, which is recorded in the segment
+	StoredCodecZSTDDict
+)
+
+func (id StoredCodecID) String() string {
+	switch id {
+	case StoredCodecNone:
+		return "none"
+	case StoredCodecSnappy:
+		return "snappy"
+	case StoredCodecZSTD:
+		return "zstd"
+	case StoredCodecZSTDDict:
+		return "zstd-dict"
+	}
+	return fmt.Sprintf("unknown(%d)", uint32(id))
+}
+
+// StoredCodec compresses the chunks of stored fields of a segment.  Only
+// the id and dictionary of the codec are recorded in the segment, so a
+// segment is read with the codec of that id, whatever the settings it was
+// written with.
+type StoredCodec interface {
+	// ID identifies the codec in the segment
+	ID() StoredCodecID
+
+	// Dict returns the dictionary recorded in the segment, if any
+	Dict() []byte
+
+	// Compress compresses src, reusing the capacity of dst
+	Compress(dst, src []byte) ([]byte, error)
+
+	// Decompress decompresses src, reusing the capacity of dst
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+var errStoredCodecClosed = fmt.Errorf("stored codec closed")
+
+// defaultStoredCodec is the codec of segments written before the codec
+// was recorded, and of segments written without WithStoredCodec
+var defaultStoredCodec StoredCodec = zstdStoredCodec{level: ZSTDCompressionLevel}
+
+// NewNoneStoredCodec returns a codec storing the chunks uncompressed,
+// trading space for cheaper reads of stored fields
+func NewNoneStoredCodec() StoredCodec {
+	return noneStoredCodec{}
+}
+
+// NewSnappyStoredCodec returns a codec compressing the chunks with snappy
+func NewSnappyStoredCodec() StoredCodec {
+	return snappyStoredCodec{}
+}
+
+// NewZSTDStoredCodec returns a codec compressing the chunks with zstd at
+// the level, see ZSTDCompressionLevel
+func NewZSTDStoredCodec(level int) StoredCodec {
+	return zstdStoredCodec{level: level}
+}
+
+// NewZSTDDictStoredCodec returns a codec compressing the chunks with zstd
+// at the level, with the dictionary.  The dictionary must be in the zstd
+// dictionary format, as trained by "zstd --train" on samples of the stored
+// fields, it is recorded in each segment written with the codec.  The codec
+// holds zstd coders for the dictionary, it implements io.Closer to release
+// them once no segment is being built or merged with it.
+func NewZSTDDictStoredCodec(level int, dict []byte) (StoredCodec, error) {
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dict))
+	if err != nil {
+		return nil, fmt.Errorf("error loading zstd dictionary: %w", err)
+	}
+	return &zstdDictStoredCodec{
+		dict:    append([]byte(nil), dict...),
+		level:   level,
+		decoder: decoder,
+	}, nil
+}
+
+// loadStoredCodec returns the codec to read the chunks of a segment with
+func loadStoredCodec(id StoredCodecID, dict []byte) (StoredCodec, error) {
+	switch id {
+	case StoredCodecNone:
+		return noneStoredCodec{}, nil
+	case StoredCodecSnappy:
+		return snappyStoredCodec{}, nil
+	case StoredCodecZSTD:
+		return defaultStoredCodec, nil
+	case StoredCodecZSTDDict:
+		return NewZSTDDictStoredCodec(ZSTDCompressionLevel, dict)
+	}
+	return nil, fmt.Errorf("unknown stored codec %d", id)
+}
+
+type noneStoredCodec struct{}
+
+func (noneStoredCodec) ID() StoredCodecID {
+	return StoredCodecNone
+}
+
+func (noneStoredCodec) Dict() []byte {
+	return nil
+}
+
+func (noneStoredCodec) Compress(dst, src []byte) ([]byte, error) {
+	return append(dst[:0], src...), nil
+}
+
+func (noneStoredCodec) Decompress(dst, src []byte) ([]byte, error) {
+	return append(dst[:0], src...), nil
+}
+
+type snappyStoredCodec struct{}
+
+func (snappyStoredCodec) ID() StoredCodecID {
+	return StoredCodecSnappy
+}
+
+func (snappyStoredCodec) Dict() []byte {
+	return nil
+}
+
+func (snappyStoredCodec) Compress(dst, src []byte) ([]byte, error) {
+	return snappy.Encode(dst[:cap(dst)], src), nil
+}
+
+func (snappyStoredCodec) Decompress(dst, src []byte) ([]byte, error) {
+	return snappy.Decode(dst[:cap(dst)], src)
+}
+
+type zstdStoredCodec struct {
+	level int
+}
+
+func (zstdStoredCodec) ID() StoredCodecID {
+	return StoredCodecZSTD
+}
+
+func (zstdStoredCodec) Dict() []byte {
+	return nil
+}
+
+func (c zstdStoredCodec) Compress(dst, src []byte) ([]byte, error) {
+	return ZSTDCompress(dst, src, c.level)
+}
+
+func (zstdStoredCodec) Decompress(dst, src []byte) ([]byte, error) {
+	return ZSTDDecompress(dst, src)
+}
+
+// zstdDictStoredCodec holds the decoder of its dictionary, and the
+// encoder once it compresses.  Closing the coders waits for the calls
+// using them, the calls after fail.
+type zstdDictStoredCodec struct {
+	dict    []byte
+	level   int
+	decoder *zstd.Decoder
+
+	m      sync.RWMutex // held for reading while the coders are used
+	closed bool
+
+	encoderM sync.Mutex
+	encoder  *zstd.Encoder
+}
+
+func (*zstdDictStoredCodec) ID() StoredCodecID {
+	return StoredCodecZSTDDict
+}
+
+func (c *zstdDictStoredCodec) Dict() []byte {
+	return c.dict
+}
+
+func (c *zstdDictStoredCodec) Compress(dst, src []byte) ([]byte, error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if c.closed {
+		return nil, errStoredCodecClosed
+	}
+	encoder, err := c.loadEncoder()
+	if err != nil {
+		return nil, err
+	}
+	return encoder.EncodeAll(src, dst[:0]), nil
+}
+
+func (c *zstdDictStoredCodec) Decompress(dst, src []byte) ([]byte, error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if c.closed {
+		return nil, errStoredCodecClosed
+	}
+	return c.decoder.DecodeAll(src, dst[:0])
+}
+
+// loadEncoder returns the encoder, creating it on first use, as segments
+// which are only read never need it
+func (c *zstdDictStoredCodec) loadEncoder() (*zstd.Encoder, error) {
+	c.encoderM.Lock()
+	defer c.encoderM.Unlock()
+	if c.encoder == nil {
+		var err error
+		c.encoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.level)),
+			zstd.WithEncoderDict(c.dict))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.encoder, nil
+}
+
+// Close releases the coders, the codec can no longer be used
+func (c *zstdDictStoredCodec) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.decoder.Close()
+	if c.encoder != nil {
+		return c.encoder.Close()
+	}
+	return nil
+}
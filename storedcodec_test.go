@@ -0,0 +1,415 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+var testStoredWords = strings.Fields("the quick brown fox jumps over lazy dog search index segment stored field " +
+	"value document term posting")
+
+// testStoredValues returns the stored field values of the document with
+// the id i, the dictionary in testdata/stored.dict is trained on the like
+func testStoredValues(i int) map[string]string {
+	var body []string
+	for j := 1; j < 12; j++ {
+		body = append(body, testStoredWords[(i*j)%len(testStoredWords)])
+	}
+	return map[string]string{
+		"_id":   fmt.Sprintf("%05d", i),
+		"title": fmt.Sprintf("document %d about %s", i, testStoredWords[i%len(testStoredWords)]),
+		"body":  strings.Join(body, " "),
+	}
+}
+
+func buildTestAnalysisResultsStored(start, end int) []segment.Document {
+	var results []segment.Document
+	for i := start; i < end; i++ {
+		vals := testStoredValues(i)
+		results = append(results, &FakeDocument{
+			NewFakeField("_id", vals["_id"], true, false, false),
+			NewFakeField("title", vals["title"], true, false, false),
+			NewFakeField("body", vals["body"], true, false, false),
+		})
+	}
+	return results
+}
+
+// checkStoredValues checks the stored fields of each document of the
+// segment are those of the document with its id
+func checkStoredValues(t *testing.T, seg *Segment, numDocs int) {
+	if int(seg.Count()) != numDocs {
+		t.Fatalf("expected %d docs, got %d", numDocs, seg.Count())
+	}
+	for docNum := uint64(0); docNum < seg.Count(); docNum++ {
+		actual := map[string]string{}
+		err := seg.VisitStoredFields(docNum, func(field string, value []byte) bool {
+			actual[field] = string(value)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var i int
+		_, err = fmt.Sscanf(actual["_id"], "%d", &i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for field, expected := range testStoredValues(i) {
+			if actual[field] != expected {
+				t.Errorf("doc %d: expected %s %q, got %q", docNum, field, expected, actual[field])
+			}
+		}
+	}
+}
+
+func testStoredCodecs(t *testing.T) []StoredCodec {
+	dict, err := ioutil.ReadFile("testdata/stored.dict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dictCodec, err := NewZSTDDictStoredCodec(19, dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []StoredCodec{
+		NewNoneStoredCodec(),
+		NewSnappyStoredCodec(),
+		NewZSTDStoredCodec(1),
+		NewZSTDStoredCodec(19),
+		dictCodec,
+	}
+}
+
+func TestStoredCodecs(t *testing.T) {
+	results := buildTestAnalysisResultsStored(0, 1000)
+	sizes := map[StoredCodecID]int{}
+	for _, codec := range testStoredCodecs(t) {
+		t.Run(codec.ID().String(), func(t *testing.T) {
+			segInt, _, err := NewWithOptions(results, encodeNorm, WithStoredCodec(codec))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			_, err = segInt.(*Segment).WriteTo(&buf, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes[codec.ID()] = buf.Len()
+
+			b := NewBuilder(encodeNorm, WithStoredCodec(codec))
+			defer func() { _ = b.Close() }()
+			for _, result := range results {
+				err = b.Add(result)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			var built bytes.Buffer
+			_, err = b.WriteTo(&built)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, data := range [][]byte{buf.Bytes(), built.Bytes()} {
+				seg, err := load(segment.NewDataBytes(data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if seg.StoredCodec() != codec.ID() {
+					t.Errorf("expected stored codec %v, got %v", codec.ID(), seg.StoredCodec())
+				}
+				checkStoredValues(t, seg, len(results))
+				err = seg.Verify(context.Background())
+				if err != nil {
+					t.Errorf("expected segment to verify, got: %v", err)
+				}
+			}
+		})
+	}
+	if sizes[StoredCodecNone] <= sizes[StoredCodecZSTD] {
+		t.Errorf("expected uncompressed segment of %d bytes to be larger than zstd's %d",
+			sizes[StoredCodecNone], sizes[StoredCodecZSTD])
+	}
+}
+
+func TestStoredCodecsMerge(t *testing.T) {
+	codecs := testStoredCodecs(t)
+	var segments []segment.Segment
+	var drops []*roaring.Bitmap
+	for i, codec := range codecs {
+		seg, _, err := NewWithOptions(buildTestAnalysisResultsStored(i*200, (i+1)*200), encodeNorm,
+			WithStoredCodec(codec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments = append(segments, seg)
+		drops = append(drops, nil)
+	}
+	drops[1] = roaring.BitmapOf(7)
+
+	for _, codec := range codecs {
+		for _, sorted := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%v sorted %t", codec.ID(), sorted), func(t *testing.T) {
+				opts := []Option{WithStoredCodec(codec)}
+				if sorted {
+					opts = append(opts, WithSort(SortField{Field: "_id", Descending: true}))
+				}
+				var merged bytes.Buffer
+				_, err := MergeWithOptions(segments, drops, 1024, opts...).WriteTo(&merged, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				seg, err := load(segment.NewDataBytes(merged.Bytes()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if seg.StoredCodec() != codec.ID() {
+					t.Errorf("expected stored codec %v, got %v", codec.ID(), seg.StoredCodec())
+				}
+				checkStoredValues(t, seg, len(codecs)*200-1)
+				err = seg.Verify(context.Background())
+				if err != nil {
+					t.Errorf("expected merged segment to verify, got: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestStoredCodecInvalidDict(t *testing.T) {
+	_, err := NewZSTDDictStoredCodec(ZSTDCompressionLevel, []byte("not a dictionary"))
+	if err == nil {
+		t.Errorf("expected error creating codec with an invalid dictionary")
+	}
+}
+
+func TestStoredCodecNil(t *testing.T) {
+	results := buildTestAnalysisResultsStored(0, 10)
+	seg, _, err := New(results, encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = NewWithOptions(results, encodeNorm, WithStoredCodec(nil))
+	if err == nil {
+		t.Errorf("expected error building with a nil codec")
+	}
+	_, err = MergeWithOptions([]segment.Segment{seg}, []*roaring.Bitmap{nil}, 1024, WithStoredCodec(nil)).
+		WriteTo(ioutil.Discard, nil)
+	if err == nil {
+		t.Errorf("expected error merging with a nil codec")
+	}
+	b := NewBuilder(encodeNorm, WithStoredCodec(nil))
+	for _, result := range results {
+		err = b.Add(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = b.WriteTo(ioutil.Discard)
+	if err == nil {
+		t.Errorf("expected error writing a builder with a nil codec")
+	}
+}
+
+func TestStoredCodecDictClose(t *testing.T) {
+	dict, err := ioutil.ReadFile("testdata/stored.dict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec, err := NewZSTDDictStoredCodec(ZSTDCompressionLevel, dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segInt, _, err := NewWithOptions(buildTestAnalysisResultsStored(0, 10), encodeNorm, WithStoredCodec(codec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := codec.Compress(nil, []byte("stored value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = codec.(io.Closer).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = codec.Compress(nil, []byte("stored value"))
+	if err == nil {
+		t.Errorf("expected error compressing with a closed codec")
+	}
+
+	// the segment has coders of its own, released once it is closed
+	seg := segInt.(*Segment)
+	err = seg.VisitStoredFields(0, func(string, []byte) bool {
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	segCodec := seg.storedCodec
+	if segCodec == codec {
+		t.Fatalf("expected the segment to load a codec of its own")
+	}
+	uncompressed, err := segCodec.Decompress(nil, compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(uncompressed) != "stored value" {
+		t.Errorf("expected the stored value, got %q", uncompressed)
+	}
+	err = seg.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = segCodec.Decompress(nil, compressed)
+	if err == nil {
+		t.Errorf("expected error decompressing with the codec of a closed segment")
+	}
+}
+
+func TestStoredChunking(t *testing.T) {
+	results := buildTestAnalysisResultsStored(0, 1000)
+	tests := []struct {
+		name      string
+		docs      int
+		bytes     int
+		maxDocs   uint64 // most docs in a chunk
+		minChunks int
+	}{
+		{
+			name:      "default",
+			docs:      int(defaultDocumentChunkSize),
+			maxDocs:   uint64(defaultDocumentChunkSize),
+			minChunks: 8,
+		},
+		{
+			name:      "one doc",
+			docs:      1,
+			maxDocs:   1,
+			minChunks: 1000,
+		},
+		{
+			name:      "docs",
+			docs:      7,
+			maxDocs:   7,
+			minChunks: 143,
+		},
+		{
+			name:      "one byte",
+			bytes:     1,
+			maxDocs:   1,
+			minChunks: 1000,
+		},
+		{
+			name:      "bytes",
+			bytes:     4096,
+			maxDocs:   100,
+			minChunks: 10,
+		},
+		{
+			name:      "docs and bytes",
+			docs:      20,
+			bytes:     4096,
+			maxDocs:   20,
+			minChunks: 50,
+		},
+		{
+			name:      "unlimited",
+			maxDocs:   1300,
+			minChunks: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opt := WithStoredChunking(test.docs, test.bytes)
+			segInt, _, err := NewWithOptions(results, encodeNorm, opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := NewBuilder(encodeNorm, opt)
+			defer func() { _ = b.Close() }()
+			for _, result := range results {
+				err = b.Add(result)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			var built bytes.Buffer
+			_, err = b.WriteTo(&built)
+			if err != nil {
+				t.Fatal(err)
+			}
+			builtSeg, err := load(segment.NewDataBytes(built.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// merge the default chunks of another segment with the policy
+			other, _, err := New(buildTestAnalysisResultsStored(1000, 1300), encodeNorm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var merged bytes.Buffer
+			_, err = MergeWithOptions([]segment.Segment{segInt, other}, []*roaring.Bitmap{nil, nil}, 1024, opt).
+				WriteTo(&merged, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mergedSeg, err := load(segment.NewDataBytes(merged.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, seg := range []*Segment{segInt.(*Segment), builtSeg, mergedSeg} {
+				docs, bytes := seg.StoredChunking()
+				if docs != uint64(test.docs) || bytes != uint64(test.bytes) {
+					t.Errorf("expected chunking %d docs %d bytes, got %d docs %d bytes", test.docs, test.bytes, docs, bytes)
+				}
+				numChunks := 0
+				docStarts := seg.storedFieldChunkDocStarts
+				for chunk := 0; chunk+1 < len(docStarts); chunk++ {
+					chunkDocs := docStarts[chunk+1] - docStarts[chunk]
+					if chunkDocs > test.maxDocs {
+						t.Errorf("chunk %d has %d docs, expected at most %d", chunk, chunkDocs, test.maxDocs)
+					}
+					if chunkDocs > 0 {
+						numChunks++
+					}
+				}
+				if numChunks < test.minChunks {
+					t.Errorf("expected at least %d chunks, got %d", test.minChunks, numChunks)
+				}
+				numDocs := len(results)
+				if i == 2 {
+					numDocs += 300
+				}
+				checkStoredValues(t, seg, numDocs)
+				err = seg.Verify(context.Background())
+				if err != nil {
+					t.Errorf("expected segment to verify, got: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,352 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+const testLargeThreshold = 1024
+
+// testLargeValues returns the stored field values of the document with the
+// id i, every third having a body larger than testLargeThreshold, and
+// every fifth a second large value in the attachment field
+func testLargeValues(i int) map[string][]string {
+	vals := testStoredValues(i)
+	rv := map[string][]string{
+		"_id":   {vals["_id"]},
+		"title": {vals["title"]},
+		"body":  {vals["body"]},
+	}
+	if i%3 == 0 {
+		rv["body"] = []string{strings.Repeat(vals["body"]+" ", 100)}
+	}
+	if i%5 == 0 {
+		rv["attachment"] = []string{strings.Repeat(vals["_id"], 500), "small"}
+	}
+	return rv
+}
+
+func buildTestAnalysisResultsLarge(start, end int) []segment.Document {
+	var results []segment.Document
+	for i := start; i < end; i++ {
+		var doc FakeDocument
+		vals := testLargeValues(i)
+		for _, field := range []string{"_id", "title", "body", "attachment"} {
+			for _, val := range vals[field] {
+				doc = append(doc, NewFakeField(field, val, true, false, false))
+			}
+		}
+		results = append(results, &doc)
+	}
+	return results
+}
+
+// visitStoredSubset returns the values of the fields of the document
+func visitStoredSubset(t *testing.T, seg *Segment, docNum uint64, fields []string) map[string][]string {
+	rv := map[string][]string{}
+	err := seg.VisitStoredFieldsSubset(docNum, fields, func(field string, value []byte) bool {
+		rv[field] = append(rv[field], string(value))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rv
+}
+
+// checkLargeValues checks every stored field, and each subset of them, of
+// each document of the segment are those of the document with its id
+func checkLargeValues(t *testing.T, seg *Segment, numDocs int) {
+	if int(seg.Count()) != numDocs {
+		t.Fatalf("expected %d docs, got %d", numDocs, seg.Count())
+	}
+	subsets := [][]string{
+		{"_id", "title", "body", "attachment"},
+		{"title", "_id"},
+		{"body"},
+		{"attachment", "missing"},
+		{"missing"},
+		nil,
+	}
+	for docNum := uint64(0); docNum < seg.Count(); docNum++ {
+		var i int
+		_, err := fmt.Sscanf(visitStoredSubset(t, seg, docNum, []string{"_id"})["_id"][0], "%d", &i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vals := testLargeValues(i)
+
+		all := map[string][]string{}
+		err = seg.VisitStoredFields(docNum, func(field string, value []byte) bool {
+			all[field] = append(all[field], string(value))
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(all, vals) {
+			t.Errorf("doc %d: expected all fields %v, got %v", docNum, vals, all)
+		}
+
+		for _, fields := range subsets {
+			expected := map[string][]string{}
+			for _, field := range fields {
+				if val, ok := vals[field]; ok {
+					expected[field] = val
+				}
+			}
+			if actual := visitStoredSubset(t, seg, docNum, fields); !reflect.DeepEqual(actual, expected) {
+				t.Errorf("doc %d: expected fields %v to be %v, got %v", docNum, fields, expected, actual)
+			}
+		}
+	}
+}
+
+func TestStoredLargeValues(t *testing.T) {
+	results := buildTestAnalysisResultsLarge(0, 300)
+	for _, codec := range []StoredCodec{NewNoneStoredCodec(), defaultStoredCodec} {
+		t.Run(codec.ID().String(), func(t *testing.T) {
+			opts := []Option{WithStoredLargeValues(testLargeThreshold), WithStoredCodec(codec)}
+			segInt, _, err := NewWithOptions(results, encodeNorm, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := NewBuilder(encodeNorm, opts...)
+			defer func() { _ = b.Close() }()
+			for _, result := range results {
+				err = b.Add(result)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			var built bytes.Buffer
+			_, err = b.WriteTo(&built)
+			if err != nil {
+				t.Fatal(err)
+			}
+			builtSeg, err := load(segment.NewDataBytes(built.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, seg := range []*Segment{segInt.(*Segment), builtSeg} {
+				threshold, largeBytes := seg.StoredLargeValues()
+				if threshold != testLargeThreshold || largeBytes == 0 {
+					t.Errorf("expected large values of at least %d bytes, got %d taking %d bytes",
+						testLargeThreshold, threshold, largeBytes)
+				}
+				checkLargeValues(t, seg, len(results))
+				err = seg.Verify(context.Background())
+				if err != nil {
+					t.Errorf("expected segment to verify, got: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestStoredLargeValuesSkipped(t *testing.T) {
+	segInt, _, err := NewWithOptions(buildTestAnalysisResultsLarge(0, 30), encodeNorm,
+		WithStoredLargeValues(testLargeThreshold))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = segInt.(*Segment).WriteTo(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// corrupt the large value region, which only visiting the large fields
+	// reads
+	data := buf.Bytes()
+	seg := segInt.(*Segment)
+	err = seg.loadStoredIndexOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := seg.storedLargeStart; i < seg.storedLargeStart+seg.storedLargeLen; i++ {
+		data[i] = 0xff
+	}
+	corrupt, err := load(segment.NewDataBytes(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for docNum := uint64(0); docNum < corrupt.Count(); docNum++ {
+		actual := visitStoredSubset(t, corrupt, docNum, []string{"_id", "title"})
+		if len(actual["_id"]) != 1 || len(actual["title"]) != 1 {
+			t.Errorf("doc %d: expected _id and title, got %v", docNum, actual)
+		}
+	}
+	err = corrupt.VisitStoredFields(0, func(field string, value []byte) bool {
+		return true
+	})
+	if err == nil {
+		t.Errorf("expected error decompressing a corrupt large value")
+	}
+	if corrupt.Verify(context.Background()) == nil {
+		t.Errorf("expected corrupt large values to fail verification")
+	}
+}
+
+func TestStoredLargeValuesMerge(t *testing.T) {
+	segLarge, _, err := NewWithOptions(buildTestAnalysisResultsLarge(0, 300), encodeNorm,
+		WithStoredLargeValues(testLargeThreshold))
+	if err != nil {
+		t.Fatal(err)
+	}
+	segSmall, _, err := New(buildTestAnalysisResultsLarge(300, 500), encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segLower, _, err := NewWithOptions(buildTestAnalysisResultsLarge(500, 600), encodeNorm,
+		WithStoredLargeValues(testLargeThreshold/2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := []segment.Segment{segLarge, segSmall, segLower}
+
+	tests := []struct {
+		name      string
+		threshold int
+		drops     []*roaring.Bitmap
+		opts      []Option
+	}{
+		{
+			name:      "large",
+			threshold: testLargeThreshold,
+			drops:     []*roaring.Bitmap{nil, nil, nil},
+		},
+		{
+			name:      "large with drops",
+			threshold: testLargeThreshold,
+			drops:     []*roaring.Bitmap{roaring.BitmapOf(3), nil, roaring.BitmapOf(0, 1)},
+		},
+		{
+			name:  "none",
+			drops: []*roaring.Bitmap{nil, nil, nil},
+		},
+		{
+			name:      "sorted",
+			threshold: testLargeThreshold,
+			drops:     []*roaring.Bitmap{nil, roaring.BitmapOf(7), nil},
+			opts:      []Option{WithSort(SortField{Field: "_id", Descending: true})},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := append([]Option{WithStoredLargeValues(test.threshold)}, test.opts...)
+			var merged bytes.Buffer
+			_, err := MergeWithOptions(segments, test.drops, 1024, opts...).WriteTo(&merged, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seg, err := load(segment.NewDataBytes(merged.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			numDocs := 600
+			for _, drops := range test.drops {
+				if drops != nil {
+					numDocs -= int(drops.GetCardinality())
+				}
+			}
+			threshold, largeBytes := seg.StoredLargeValues()
+			if threshold != uint64(test.threshold) || (test.threshold > 0) != (largeBytes > 0) {
+				t.Errorf("expected large values of at least %d bytes, got %d taking %d bytes",
+					test.threshold, threshold, largeBytes)
+			}
+			checkLargeValues(t, seg, numDocs)
+			err = seg.Verify(context.Background())
+			if err != nil {
+				t.Errorf("expected merged segment to verify, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestVisitStoredFieldsBatch(t *testing.T) {
+	segLarge, _, err := NewWithOptions(buildTestAnalysisResultsLarge(0, 1000), encodeNorm,
+		WithStoredLargeValues(testLargeThreshold))
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := []*Segment{segLarge.(*Segment), loadTestFile(t, "testdata/v2.ice")}
+
+	type visit struct {
+		docNum uint64
+		field  string
+		value  string
+	}
+	for _, seg := range segments {
+		t.Run(fmt.Sprintf("version %d", seg.Version()), func(t *testing.T) {
+			// out of order, across chunks, repeated and out of range
+			var docNums []uint64
+			for i := uint64(0); i < seg.Count()*2; i++ {
+				docNums = append(docNums, (i*7919)%(seg.Count()+3))
+			}
+			docNums = append(docNums, docNums[1], docNums[1])
+
+			var expected, expectedFirst []visit
+			for _, docNum := range docNums {
+				first := true
+				err := seg.VisitStoredFields(docNum, func(field string, value []byte) bool {
+					expected = append(expected, visit{docNum, field, string(value)})
+					if first {
+						expectedFirst = append(expectedFirst, visit{docNum, field, string(value)})
+						first = false
+					}
+					return true
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var actual []visit
+			err := seg.VisitStoredFieldsBatch(docNums, func(docNum uint64, field string, value []byte) bool {
+				actual = append(actual, visit{docNum, field, string(value)})
+				return true
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("expected batch to visit the stored fields of each doc in order")
+			}
+
+			// stopping skips the rest of the document
+			actual = actual[:0]
+			err = seg.VisitStoredFieldsBatch(docNums, func(docNum uint64, field string, value []byte) bool {
+				actual = append(actual, visit{docNum, field, string(value)})
+				return false
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(actual, expectedFirst) {
+				t.Errorf("expected batch to visit the first stored field of each doc in order")
+			}
+		})
+	}
+}
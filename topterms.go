@@ -0,0 +1,305 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/blevesearch/vellum"
+)
+
+// defaultTopTerms is the number of terms of each field with the highest
+// doc frequency recorded after its dictionary
+const defaultTopTerms = 32
+
+// topTerm is a term and its doc frequency
+type topTerm struct {
+	term  []byte
+	count uint64
+}
+
+// before reports whether a ranks before b, by highest doc frequency, then
+// by term
+func (a *topTerm) before(b *topTerm) bool {
+	if a.count != b.count {
+		return a.count > b.count
+	}
+	return bytes.Compare(a.term, b.term) < 0
+}
+
+// topTermsHeap holds the top terms with the one ranking last first
+type topTermsHeap []*topTerm
+
+func (h topTermsHeap) Len() int            { return len(h) }
+func (h topTermsHeap) Less(i, j int) bool  { return h[j].before(h[i]) }
+func (h topTermsHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *topTermsHeap) Push(x interface{}) { *h = append(*h, x.(*topTerm)) }
+func (h *topTermsHeap) Pop() interface{} {
+	old := *h
+	rv := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return rv
+}
+
+// topTermsCollector keeps the n terms with the highest doc frequency of
+// the terms added, it copies the terms, so callers may reuse them
+type topTermsCollector struct {
+	n     int
+	terms topTermsHeap
+	spare []*topTerm
+}
+
+func newTopTermsCollector(n int) *topTermsCollector {
+	return &topTermsCollector{n: n}
+}
+
+func (c *topTermsCollector) add(term []byte, count uint64) {
+	if c.n <= 0 || count == 0 {
+		return
+	}
+	candidate := topTerm{term: term, count: count}
+	if len(c.terms) < c.n {
+		t := c.next()
+		t.term = append(t.term[:0], term...)
+		t.count = count
+		heap.Push(&c.terms, t)
+		return
+	}
+	if !candidate.before(c.terms[0]) {
+		return
+	}
+	// replace the term ranking last
+	c.terms[0].term = append(c.terms[0].term[:0], term...)
+	c.terms[0].count = count
+	heap.Fix(&c.terms, 0)
+}
+
+func (c *topTermsCollector) next() *topTerm {
+	if len(c.spare) > 0 {
+		rv := c.spare[len(c.spare)-1]
+		c.spare = c.spare[:len(c.spare)-1]
+		return rv
+	}
+	return &topTerm{}
+}
+
+// sorted returns the terms collected, by highest doc frequency then by
+// term, and resets the collector for the next field
+func (c *topTermsCollector) sorted() []*topTerm {
+	rv := make([]*topTerm, len(c.terms))
+	copy(rv, c.terms)
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].before(rv[j])
+	})
+	c.spare = append(c.spare, c.terms...)
+	c.terms = c.terms[:0]
+	return rv
+}
+
+// write writes out the number of terms collected, and each term's doc
+// frequency, length and bytes, and resets the collector for the next field
+func (c *topTermsCollector) write(w io.Writer, buf []byte) error {
+	terms := c.sorted()
+	n := binary.PutUvarint(buf, uint64(len(terms)))
+	_, err := w.Write(buf[:n])
+	if err != nil {
+		return err
+	}
+	for _, t := range terms {
+		n = binary.PutUvarint(buf, t.count)
+		_, err = w.Write(buf[:n])
+		if err != nil {
+			return err
+		}
+		n = binary.PutUvarint(buf, uint64(len(t.term)))
+		_, err = w.Write(buf[:n])
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(t.term)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fieldTopTerms returns the top terms recorded after the field's
+// dictionary, nil if none are, reading them on first use
+func (s *Segment) fieldTopTerms(fieldID uint16) ([]DictEntry, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	f := &s.fields[fieldID]
+	f.topTermsOnce.Do(func() {
+		if f.dictLoc == 0 || !s.footer.format().hasTopTerms() {
+			return
+		}
+		f.topTerms, _, f.topTermsErr = s.readTopTerms(f.dictLoc)
+		if f.topTermsErr == nil {
+			for _, entry := range f.topTerms {
+				s.addSize(reflectStaticSizeDictEntry + len(entry.term))
+			}
+		}
+	})
+	return f.topTerms, f.topTermsErr
+}
+
+// readTopTerms reads the top terms following the dictionary at dictLoc,
+// returning them and where they end
+func (s *Segment) readTopTerms(dictLoc uint64) (rv []DictEntry, end uint64, err error) {
+	vellumLen, n, err := readUvarintAt(s.data, dictLoc)
+	if err != nil {
+		return nil, 0, err
+	}
+	r := &uvarintAtReader{data: s.data, offset: dictLoc + n + vellumLen}
+	numTerms := r.next()
+	if r.err != nil {
+		return nil, 0, r.err
+	}
+	if numTerms > uint64(s.data.Len()) {
+		return nil, 0, fmt.Errorf("invalid number of top terms %d", numTerms)
+	}
+	for i := uint64(0); i < numTerms; i++ {
+		count, termLen := r.next(), r.next()
+		if r.err != nil {
+			return nil, 0, r.err
+		}
+		var term []byte
+		term, err = s.data.Read(int(r.offset), int(r.offset+termLen))
+		if err != nil {
+			return nil, 0, err
+		}
+		r.offset += termLen
+		rv = append(rv, DictEntry{term: string(term), count: count})
+	}
+	return rv, r.offset, nil
+}
+
+// TopTerms returns the n terms of the dictionary with the highest doc
+// frequency, by highest doc frequency then by term, not counting the docs
+// in except.  The terms recorded when the segment was written answer it
+// when they hold the n first, otherwise every postings list of the
+// dictionary is read.
+func (d *Dictionary) TopTerms(n int, except *roaring.Bitmap) ([]DictEntry, error) {
+	if d.fst == nil || n <= 0 {
+		return nil, nil
+	}
+	recorded, err := d.sb.fieldTopTerms(d.fieldID)
+	if err != nil {
+		return nil, err
+	}
+	rv, ok, err := d.topTermsRecorded(recorded, n, except)
+	if err != nil || ok {
+		return rv, err
+	}
+	return d.topTermsScan(n, except)
+}
+
+// topTermsRecorded answers TopTerms from the terms recorded, if they hold
+// the n first.  Any term not recorded has at most the doc frequency of the
+// last one recorded, so the recorded terms hold the n first when the nth
+// still has more docs than it once the docs in except are removed.
+func (d *Dictionary) topTermsRecorded(recorded []DictEntry, n int, except *roaring.Bitmap) (
+	[]DictEntry, bool, error) {
+	if len(recorded) == 0 {
+		return nil, false, nil
+	}
+	complete := len(recorded) == d.fst.Len()
+	if except == nil || except.IsEmpty() {
+		if n <= len(recorded) || complete {
+			return append([]DictEntry(nil), recorded[:minInt(n, len(recorded))]...), true, nil
+		}
+		return nil, false, nil
+	}
+
+	rv := make([]DictEntry, 0, len(recorded))
+	var pl PostingsList
+	for _, entry := range recorded {
+		postingsOffset, exists, err := d.fstReader.Get([]byte(entry.term))
+		if err != nil {
+			return nil, false, fmt.Errorf("vellum err: %v", err)
+		}
+		if !exists {
+			return nil, false, fmt.Errorf("top term %q not in the dictionary", entry.term)
+		}
+		count, err := d.termCount(&pl, postingsOffset, except)
+		if err != nil {
+			return nil, false, err
+		}
+		if count > 0 {
+			rv = append(rv, DictEntry{term: entry.term, count: count})
+		}
+	}
+	sort.SliceStable(rv, func(i, j int) bool {
+		return rv[i].count > rv[j].count || (rv[i].count == rv[j].count && rv[i].term < rv[j].term)
+	})
+	if complete {
+		return rv[:minInt(n, len(rv))], true, nil
+	}
+	if len(rv) < n || rv[n-1].count <= recorded[len(recorded)-1].count {
+		return nil, false, nil
+	}
+	return rv[:n], true, nil
+}
+
+// topTermsScan answers TopTerms reading the postings list of every term
+func (d *Dictionary) topTermsScan(n int, except *roaring.Bitmap) ([]DictEntry, error) {
+	c := newTopTermsCollector(n)
+	var pl PostingsList
+	itr, err := d.fst.Iterator(nil, nil)
+	for err == nil {
+		term, postingsOffset := itr.Current()
+		var count uint64
+		count, err = d.termCount(&pl, postingsOffset, except)
+		if err != nil {
+			return nil, err
+		}
+		c.add(term, count)
+		err = itr.Next()
+	}
+	if err != vellum.ErrIteratorDone {
+		return nil, err
+	}
+	terms := c.sorted()
+	rv := make([]DictEntry, len(terms))
+	for i, t := range terms {
+		rv[i] = DictEntry{term: string(t.term), count: t.count}
+	}
+	return rv, nil
+}
+
+// termCount returns the number of docs of the postings, not in except
+func (d *Dictionary) termCount(pl *PostingsList, postingsOffset uint64, except *roaring.Bitmap) (uint64, error) {
+	pl = d.postingsListInit(pl, except)
+	err := pl.read(postingsOffset, d)
+	if err != nil {
+		return 0, err
+	}
+	return pl.Count(), nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
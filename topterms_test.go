@@ -0,0 +1,204 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+// buildTestAnalysisResultsTopTerms builds documents whose tag is t0 in
+// every doc, t1 in every other, t2 in every third and so on, giving tags
+// fewer docs the higher their number, with ties between the rarest
+func buildTestAnalysisResultsTopTerms(start, end int) []segment.Document {
+	var results []segment.Document
+	for i := start; i < end; i++ {
+		doc := FakeDocument{NewFakeField("_id", fmt.Sprintf("%05d", i), true, false, false)}
+		for tag := 0; tag < 100; tag++ {
+			if i%(tag+1) == 0 {
+				doc = append(doc, NewFakeField("tag", fmt.Sprintf("t%d", tag), false, false, false))
+			}
+		}
+		results = append(results, &doc)
+	}
+	return results
+}
+
+// scanTopTerms returns the n terms of the field with the most docs not in
+// except, counting the docs of every term
+func scanTopTerms(t *testing.T, seg *Segment, field string, n int, except *roaring.Bitmap) []DictEntry {
+	dict, err := seg.Dictionary(field)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rv []DictEntry
+	itr := dict.Iterator(nil, nil, nil)
+	for entry, err := itr.Next(); entry != nil || err != nil; entry, err = itr.Next() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		pl, err := dict.PostingsList([]byte(entry.Term()), except, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pl.Count() > 0 {
+			rv = append(rv, DictEntry{term: entry.Term(), count: pl.Count()})
+		}
+	}
+	sort.SliceStable(rv, func(i, j int) bool {
+		return rv[i].count > rv[j].count
+	})
+	if len(rv) > n {
+		rv = rv[:n]
+	}
+	return rv
+}
+
+func checkTopTerms(t *testing.T, seg *Segment) {
+	dict, err := seg.Dictionary("tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	excepts := []*roaring.Bitmap{nil, roaring.New(), roaring.BitmapOf(0, 1, 2, 3), roaring.New()}
+	excepts[3].AddRange(0, seg.Count()/2)
+	for _, except := range excepts {
+		for _, n := range []int{1, 5, 31, 32, 33, 200} {
+			actual, err := dict.(*Dictionary).TopTerms(n, except)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := scanTopTerms(t, seg, "tag", n, except)
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("except %v: expected top %d terms %v, got %v", except, n, expected, actual)
+			}
+		}
+	}
+	err = seg.Verify(context.Background())
+	if err != nil {
+		t.Errorf("expected segment to verify, got: %v", err)
+	}
+}
+
+func TestTopTerms(t *testing.T) {
+	results := buildTestAnalysisResultsTopTerms(0, 1000)
+	segInt, _, err := New(results, encodeNorm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := segInt.(*Segment)
+	checkTopTerms(t, seg)
+	if recorded := seg.fields[seg.fieldsMap["tag"]-1].topTerms; len(recorded) != defaultTopTerms ||
+		recorded[0].term != "t0" || recorded[0].count != 1000 {
+		t.Errorf("expected %d top terms recorded, from t0 in every doc, got %v", defaultTopTerms, recorded)
+	}
+
+	b := NewBuilder(encodeNorm, WithMemoryBudget(1<<10))
+	defer func() { _ = b.Close() }()
+	for _, result := range results {
+		err = b.Add(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var built bytes.Buffer
+	_, err = b.WriteTo(&built)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected bytes.Buffer
+	_, err = seg.WriteTo(&expected, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(built.Bytes(), expected.Bytes()) {
+		t.Errorf("expected Builder segment to match New segment")
+	}
+
+	// none recorded, so every TopTerms reads the postings
+	none, _, err := NewWithOptions(results, encodeNorm, WithTopTerms(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTopTerms(t, none.(*Segment))
+	if recorded := none.(*Segment).fields[seg.fieldsMap["tag"]-1].topTerms; recorded != nil {
+		t.Errorf("expected no top terms recorded, got %v", recorded)
+	}
+
+	// the dictionary of a missing field is empty
+	dict, err := seg.Dictionary("missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual, err := dict.(*Dictionary).TopTerms(5, nil); err != nil || len(actual) != 0 {
+		t.Errorf("expected no top terms of a missing field, got %v, err: %v", actual, err)
+	}
+}
+
+func TestTopTermsMerge(t *testing.T) {
+	var segments []segment.Segment
+	for i := 0; i < 3; i++ {
+		segInt, _, err := New(buildTestAnalysisResultsTopTerms(i*400, (i+1)*400), encodeNorm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments = append(segments, segInt)
+	}
+	segments = append(segments, loadTestFile(t, "testdata/v2.ice"))
+	drops := []*roaring.Bitmap{roaring.BitmapOf(0, 2, 4, 6), nil, roaring.BitmapOf(399), nil}
+
+	var expected []byte
+	for _, workers := range []int{1, 2} {
+		t.Run(fmt.Sprintf("workers %d", workers), func(t *testing.T) {
+			var merged bytes.Buffer
+			_, err := MergeWithOptions(segments, drops, 1024, WithMergeWorkers(workers)).WriteTo(&merged, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected == nil {
+				expected = merged.Bytes()
+			} else if !bytes.Equal(merged.Bytes(), expected) {
+				t.Errorf("expected parallel merge to match serial merge")
+			}
+			seg, err := load(segment.NewDataBytes(merged.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTopTerms(t, seg)
+		})
+	}
+}
+
+func TestTopTermsOlderVersion(t *testing.T) {
+	seg := loadTestFile(t, "testdata/v2.ice")
+	dict, err := seg.Dictionary("color")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := dict.(*Dictionary).TopTerms(2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []DictEntry{{term: "blue", count: 2}, {term: "red", count: 2}}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected top terms %v, got %v", expected, actual)
+	}
+}
@@ -0,0 +1,1202 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/blevesearch/vellum"
+)
+
+// sections reported by Verify
+const (
+	SectionFooter      = "footer"
+	SectionFields      = "fields"
+	SectionDictionary  = "dictionary"
+	SectionPostings    = "postings"
+	SectionFreqNorm    = "freqnorm"
+	SectionLocations   = "locations"
+	SectionImpacts     = "impacts"
+	SectionStored      = "stored"
+	SectionStoredIndex = "stored index"
+	SectionDocValues   = "docvalues"
+	SectionSort        = "sort"
+	SectionNumeric     = "numeric"
+	SectionSortedSet   = "sortedset"
+)
+
+// verifyCRCReadSize is the number of bytes read at a time while
+// recomputing the CRC of the segment data
+const verifyCRCReadSize = 1 << 20
+
+// VerifyProblem describes a single inconsistency found by Verify
+type VerifyProblem struct {
+	Section string
+	Field   string
+	Term    string
+	Offset  uint64
+	Err     error
+}
+
+func (p *VerifyProblem) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s", p.Section)
+	if p.Field != "" {
+		fmt.Fprintf(&sb, " field '%s'", p.Field)
+	}
+	if p.Term != "" {
+		fmt.Fprintf(&sb, " term '%s'", p.Term)
+	}
+	fmt.Fprintf(&sb, " offset %d: %v", p.Offset, p.Err)
+	return sb.String()
+}
+
+func (p *VerifyProblem) Unwrap() error {
+	return p.Err
+}
+
+// VerifyError is returned by Verify when one or more problems were
+// found in the segment
+type VerifyError struct {
+	Problems []*VerifyProblem
+}
+
+func (e *VerifyError) Error() string {
+	if len(e.Problems) == 1 {
+		return fmt.Sprintf("segment verification failed: %v", e.Problems[0])
+	}
+	return fmt.Sprintf("segment verification failed with %d problems, first: %v",
+		len(e.Problems), e.Problems[0])
+}
+
+// Verify recomputes the CRC of the segment and compares it with the one
+// recorded in the footer, then walks every section of the segment
+// checking that it can be decoded.  All the problems found are returned
+// in a *VerifyError, verification stops early only if the context is
+// done, in which case the context error is returned.
+func (s *Segment) Verify(ctx context.Context) error {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	v := &verifier{ctx: ctx, s: s}
+
+	steps := []func() error{
+		v.verifyCRC,
+		v.verifyFooter,
+		v.verifyFields,
+		v.verifyStored,
+		v.verifyDictionaries,
+		v.verifyDocValues,
+		v.verifyNumericDocValues,
+		v.verifySortedSetDocValues,
+		v.verifySort,
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+
+	if len(v.problems) > 0 {
+		return &VerifyError{Problems: v.problems}
+	}
+	return nil
+}
+
+type verifier struct {
+	ctx      context.Context
+	s        *Segment
+	problems []*VerifyProblem
+
+	buf []byte
+}
+
+func (v *verifier) report(section, field, term string, offset uint64, err error) {
+	v.problems = append(v.problems, &VerifyProblem{
+		Section: section,
+		Field:   field,
+		Term:    term,
+		Offset:  offset,
+		Err:     err,
+	})
+}
+
+// guard runs f, recording the error it returns, or the panic it raises
+// while decoding corrupt data, as a problem at the specified location.
+// It returns true if f completed without error.
+func (v *verifier) guard(section, field, term string, offset uint64, f func() error) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			v.report(section, field, term, offset, fmt.Errorf("panic: %v", r))
+			ok = false
+		}
+	}()
+	if err := f(); err != nil {
+		v.report(section, field, term, offset, err)
+		return false
+	}
+	return true
+}
+
+// read returns the data in [start, end) after checking it is in bounds
+func (v *verifier) read(start, end uint64) ([]byte, error) {
+	if start > end || end > uint64(v.s.data.Len()) {
+		return nil, fmt.Errorf("range %d-%d out of bounds, data len %d",
+			start, end, v.s.data.Len())
+	}
+	return v.s.data.Read(int(start), int(end))
+}
+
+// readUvarint decodes the uvarint at offset, returning it along with
+// the number of bytes read
+func (v *verifier) readUvarint(offset uint64) (val, n uint64, err error) {
+	end := offset + binary.MaxVarintLen64
+	if end > uint64(v.s.data.Len()) {
+		end = uint64(v.s.data.Len())
+	}
+	data, err := v.read(offset, end)
+	if err != nil {
+		return 0, 0, err
+	}
+	val, read := binary.Uvarint(data)
+	if read <= 0 {
+		return 0, 0, fmt.Errorf("invalid uvarint at %d", offset)
+	}
+	return val, uint64(read), nil
+}
+
+func (v *verifier) verifyCRC() error {
+	crc := uint32(0)
+	dataLen := uint64(v.s.data.Len())
+	for start := uint64(0); start < dataLen; start += verifyCRCReadSize {
+		if err := v.ctx.Err(); err != nil {
+			return err
+		}
+		end := start + verifyCRCReadSize
+		if end > dataLen {
+			end = dataLen
+		}
+		data, err := v.s.data.Read(int(start), int(end))
+		if err != nil {
+			v.report(SectionFooter, "", "", start, fmt.Errorf("error reading data: %w", err))
+			return nil
+		}
+		crc = crc32.Update(crc, crc32.IEEETable, data)
+	}
+
+	expected, err := v.s.footer.fileCRC(crc)
+	if err != nil {
+		return err
+	}
+	if expected != v.s.footer.crc {
+		v.report(SectionFooter, "", "", dataLen+uint64(v.s.footer.length())-crcWidth,
+			fmt.Errorf("crc mismatch, computed %#x, footer has %#x", expected, v.s.footer.crc))
+	}
+	return nil
+}
+
+func (v *verifier) verifyFooter() error {
+	f := v.s.footer
+	dataLen := uint64(v.s.data.Len())
+	if f.numDocs > 0 && f.storedIndexOffset+f.numDocs*fileAddrWidth > f.fieldsIndexOffset {
+		v.report(SectionFooter, "", "", f.storedIndexOffset,
+			fmt.Errorf("stored index for %d docs overlaps fields index at %d", f.numDocs, f.fieldsIndexOffset))
+	}
+	if f.fieldsIndexOffset > dataLen || (dataLen-f.fieldsIndexOffset)%fileAddrWidth != 0 {
+		v.report(SectionFooter, "", "", f.fieldsIndexOffset,
+			fmt.Errorf("fields index offset does not line up with end of data %d", dataLen))
+	}
+	if f.docValueOffset != fieldNotUninverted && f.docValueOffset > f.fieldsIndexOffset {
+		v.report(SectionFooter, "", "", f.docValueOffset,
+			fmt.Errorf("doc value offset past fields index at %d", f.fieldsIndexOffset))
+	}
+	if f.sortOffset != 0 && f.sortOffset >= f.fieldsIndexOffset {
+		v.report(SectionFooter, "", "", f.sortOffset,
+			fmt.Errorf("sort offset past fields index at %d", f.fieldsIndexOffset))
+	}
+	if f.numericOffset != 0 && f.numericOffset >= f.fieldsIndexOffset {
+		v.report(SectionFooter, "", "", f.numericOffset,
+			fmt.Errorf("numeric doc values offset past fields index at %d", f.fieldsIndexOffset))
+	}
+	if f.sortedSetOffset != 0 && f.sortedSetOffset >= f.fieldsIndexOffset {
+		v.report(SectionFooter, "", "", f.sortedSetOffset,
+			fmt.Errorf("sorted-set doc values offset past fields index at %d", f.fieldsIndexOffset))
+	}
+	err := validChunkMode(f.chunkMode, true)
+	if err == nil && !f.format().hasChunkSizes() {
+		_, err = getChunkSize(f.chunkMode, 0, f.numDocs)
+	}
+	if err != nil {
+		v.report(SectionFooter, "", "", dataLen+uint64(f.length())-crcWidth-verWidth-chunkWidth, err)
+	}
+	return nil
+}
+
+func (v *verifier) verifyFields() error {
+	fieldsIndexOffset := v.s.footer.fieldsIndexOffset
+	for fieldID, field := range v.s.fieldsInv {
+		indexOffset := fieldsIndexOffset + uint64(fieldID)*fileAddrWidth
+		v.guard(SectionFields, field, "", indexOffset, func() error {
+			addrData, err := v.read(indexOffset, indexOffset+fileAddrWidth)
+			if err != nil {
+				return err
+			}
+			addr := binary.BigEndian.Uint64(addrData)
+			if addr >= fieldsIndexOffset {
+				return fmt.Errorf("field entry at %d past fields index", addr)
+			}
+			dictLoc, n, err := v.readUvarint(addr)
+			if err != nil {
+				return err
+			}
+			if dictLoc >= addr {
+				return fmt.Errorf("dictionary at %d past field entry", dictLoc)
+			}
+			nameLen, read, err := v.readUvarint(addr + n)
+			if err != nil {
+				return err
+			}
+			n += read
+			name, err := v.read(addr+n, addr+n+nameLen)
+			if err != nil {
+				return err
+			}
+			if string(name) != field {
+				return fmt.Errorf("field name '%s' does not match loaded name", name)
+			}
+			_, _, err = v.s.fieldStats(uint16(fieldID))
+			return err
+		})
+	}
+	if v.s.fieldsMap[_idFieldName] != 1 {
+		v.report(SectionFields, _idFieldName, "", fieldsIndexOffset, fmt.Errorf("_id is not the first field"))
+	}
+	return nil
+}
+
+func (v *verifier) verifyStored() error {
+	if !v.guard(SectionStored, "", "", v.s.footer.storedIndexOffset, v.s.loadStoredIndexOnce) {
+		return nil
+	}
+	offsets := v.s.storedFieldChunkOffsets
+	docStarts := v.s.storedFieldChunkDocStarts
+	numDocs := v.s.footer.numDocs
+	if len(offsets) < 2 || len(docStarts) != len(offsets) {
+		v.report(SectionStored, "", "", 0,
+			fmt.Errorf("found %d chunk offsets and %d chunk doc starts", len(offsets), len(docStarts)))
+		return nil
+	}
+	for i, docStart := range docStarts {
+		if (i == 0 && docStart != 0) || (i > 0 && docStart < docStarts[i-1]) ||
+			(i == len(docStarts)-1 && docStart != numDocs) {
+			v.report(SectionStored, "", "", 0,
+				fmt.Errorf("chunk %d starts at doc %d out of order of %d docs", i, docStart, numDocs))
+			return nil
+		}
+	}
+
+	if v.s.storedLargeStart+v.s.storedLargeLen > v.s.footer.storedIndexOffset {
+		v.report(SectionStored, "", "", v.s.storedLargeStart,
+			fmt.Errorf("large value region of %d bytes past stored index", v.s.storedLargeLen))
+		return nil
+	}
+
+	var uncompressed []byte
+	for chunk := 0; chunk+1 < len(offsets); chunk++ {
+		firstDoc, lastDoc := docStarts[chunk], docStarts[chunk+1]
+		if firstDoc == lastDoc {
+			if offsets[chunk] != offsets[chunk+1] {
+				v.report(SectionStored, "", "", offsets[chunk], fmt.Errorf("chunk %d has no docs", chunk))
+			}
+			continue
+		}
+		if err := v.ctx.Err(); err != nil {
+			return err
+		}
+		start, end := offsets[chunk], offsets[chunk+1]
+		ok := v.guard(SectionStored, "", "", start, func() error {
+			if end < start {
+				return fmt.Errorf("chunk %d ends at %d before its start", chunk, end)
+			}
+			compressed, err := v.read(start, end)
+			if err != nil {
+				return err
+			}
+			uncompressed, err = v.s.decompressStored(uncompressed[:cap(uncompressed)], compressed)
+			if err != nil {
+				return fmt.Errorf("error decompressing chunk %d: %w", chunk, err)
+			}
+			return nil
+		})
+		if !ok {
+			continue
+		}
+
+		for docNum := firstDoc; docNum < lastDoc; docNum++ {
+			indexOffset := v.s.footer.storedIndexOffset + docNum*fileAddrWidth
+			v.guard(SectionStoredIndex, "", "", indexOffset, func() error {
+				storedOffsetData, err := v.read(indexOffset, indexOffset+fileAddrWidth)
+				if err != nil {
+					return err
+				}
+				storedOffset := binary.BigEndian.Uint64(storedOffsetData)
+				return v.verifyStoredDoc(docNum, uncompressed, storedOffset)
+			})
+		}
+	}
+	return nil
+}
+
+func (v *verifier) verifyStoredDoc(docNum uint64, uncompressed []byte, storedOffset uint64) error {
+	if storedOffset >= uint64(len(uncompressed)) {
+		return fmt.Errorf("doc %d stored at %d past end of chunk %d", docNum, storedOffset, len(uncompressed))
+	}
+	metaLen, read := binary.Uvarint(uncompressed[storedOffset:])
+	if read <= 0 {
+		return fmt.Errorf("doc %d invalid meta length", docNum)
+	}
+	n := storedOffset + uint64(read)
+	dataLen, read := binary.Uvarint(uncompressed[n:])
+	if read <= 0 {
+		return fmt.Errorf("doc %d invalid data length", docNum)
+	}
+	n += uint64(read)
+	if n+metaLen+dataLen > uint64(len(uncompressed)) {
+		return fmt.Errorf("doc %d meta and data past end of chunk", docNum)
+	}
+	meta := uncompressed[n : n+metaLen]
+	largeFlags := v.s.footer.format().storedLayout() >= storedLayoutV3
+	var prevField uint64
+	for len(meta) > 0 {
+		var vals [3]uint64
+		for i := range vals {
+			val, read := binary.Uvarint(meta)
+			if read <= 0 {
+				return fmt.Errorf("doc %d invalid field meta", docNum)
+			}
+			vals[i] = val
+			meta = meta[read:]
+		}
+		var large bool
+		if largeFlags {
+			large = vals[0]&storedLargeValueFlag != 0
+			vals[0] >>= 1
+		}
+		if vals[0] >= uint64(len(v.s.fieldsInv)) {
+			return fmt.Errorf("doc %d unknown field id %d", docNum, vals[0])
+		}
+		// reading a subset of the fields relies on the field id order
+		if vals[0] < prevField {
+			return fmt.Errorf("doc %d field id %d after %d", docNum, vals[0], prevField)
+		}
+		prevField = vals[0]
+		if large {
+			if err := v.verifyStoredLargeValue(vals[1], vals[2]); err != nil {
+				return fmt.Errorf("doc %d field '%s' %w", docNum, v.s.fieldsInv[vals[0]], err)
+			}
+		} else if vals[1]+vals[2] > dataLen {
+			return fmt.Errorf("doc %d field '%s' value past end of data", docNum, v.s.fieldsInv[vals[0]])
+		}
+	}
+	return nil
+}
+
+func (v *verifier) verifyStoredLargeValue(offset, l uint64) error {
+	if offset+l > v.s.storedLargeLen {
+		return fmt.Errorf("large value at %d of %d bytes past end of region of %d bytes", offset, l, v.s.storedLargeLen)
+	}
+	compressed, err := v.read(v.s.storedLargeStart+offset, v.s.storedLargeStart+offset+l)
+	if err != nil {
+		return err
+	}
+	v.buf, err = v.s.decompressStored(v.buf[:cap(v.buf)], compressed)
+	if err != nil {
+		return fmt.Errorf("error decompressing large value: %w", err)
+	}
+	return nil
+}
+
+func (v *verifier) verifyDictionaries() error {
+	for fieldID, field := range v.s.fieldsInv {
+		if err := v.ctx.Err(); err != nil {
+			return err
+		}
+		dictStart := v.s.fields[fieldID].dictLoc
+		if dictStart == 0 {
+			continue
+		}
+		var fst *vellum.FST
+		v.guard(SectionDictionary, field, "", dictStart, func() error {
+			vellumLen, n, err := v.readUvarint(dictStart)
+			if err != nil {
+				return err
+			}
+			fstBytes, err := v.read(dictStart+n, dictStart+n+vellumLen)
+			if err != nil {
+				return err
+			}
+			fst, err = vellum.Load(fstBytes)
+			return err
+		})
+		if fst == nil {
+			continue
+		}
+		err := v.verifyDictionary(field, dictStart, fst)
+		if err != nil {
+			return err
+		}
+		if v.s.footer.format().hasTopTerms() {
+			v.guard(SectionDictionary, field, "", dictStart, func() error {
+				return v.verifyTopTerms(dictStart, fst)
+			})
+		}
+		if v.s.footer.format().hasReverseTerms() {
+			v.guard(SectionDictionary, field, "", dictStart, func() error {
+				return v.verifyReverseTerms(dictStart, fst)
+			})
+		}
+	}
+	return nil
+}
+
+// verifyTopTerms checks the top terms following the dictionary are terms
+// of the dictionary with their doc frequency, in order
+func (v *verifier) verifyTopTerms(dictStart uint64, fst *vellum.FST) error {
+	topTerms, _, err := v.s.readTopTerms(dictStart)
+	if err != nil {
+		return err
+	}
+	if len(topTerms) > fst.Len() {
+		return fmt.Errorf("%d top terms for %d terms", len(topTerms), fst.Len())
+	}
+	d := &Dictionary{sb: v.s}
+	var pl PostingsList
+	for i, entry := range topTerms {
+		var postingsOffset, count uint64
+		var exists bool
+		postingsOffset, exists, err = fst.Get([]byte(entry.term))
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("top term %q not in the dictionary", entry.term)
+		}
+		count, err = d.termCount(&pl, postingsOffset, nil)
+		if err != nil {
+			return err
+		}
+		if count != entry.count {
+			return fmt.Errorf("top term %q has %d docs, recorded %d", entry.term, count, entry.count)
+		}
+		if i > 0 && (topTerms[i-1].count < entry.count ||
+			(topTerms[i-1].count == entry.count && topTerms[i-1].term >= entry.term)) {
+			return fmt.Errorf("top term %q out of order", entry.term)
+		}
+	}
+	return nil
+}
+
+// verifyReverseTerms checks the reversed terms following the top terms, if
+// any, are the terms of the dictionary, each with the postings of the term
+func (v *verifier) verifyReverseTerms(dictStart uint64, fst *vellum.FST) error {
+	start, end, err := v.s.readReverseDictLoc(dictStart)
+	if err != nil || start == end {
+		return err
+	}
+	reverseData, err := v.read(start, end)
+	if err != nil {
+		return err
+	}
+	reverse, err := vellum.Load(reverseData)
+	if err != nil {
+		return err
+	}
+	if reverse.Len() != fst.Len() {
+		return fmt.Errorf("%d reversed terms for %d terms", reverse.Len(), fst.Len())
+	}
+	var term []byte
+	itr, err := reverse.Iterator(nil, nil)
+	for err == nil {
+		reversed, postingsOffset := itr.Current()
+		term = reverseBytes(term[:0], reversed)
+		var expected uint64
+		var exists bool
+		expected, exists, err = fst.Get(term)
+		if err != nil {
+			return err
+		}
+		if !exists || expected != postingsOffset {
+			return fmt.Errorf("reversed term %q not in the dictionary with postings %d", term, postingsOffset)
+		}
+		err = itr.Next()
+	}
+	if err != vellum.ErrIteratorDone {
+		return err
+	}
+	return nil
+}
+
+func (v *verifier) verifyDictionary(field string, dictStart uint64, fst *vellum.FST) error {
+	var itr *vellum.FSTIterator
+	var itrErr error
+	ok := v.guard(SectionDictionary, field, "", dictStart, func() error {
+		itr, itrErr = fst.Iterator(nil, nil)
+		if itrErr == vellum.ErrIteratorDone {
+			return nil
+		}
+		return itrErr
+	})
+	for ok && itrErr == nil {
+		if err := v.ctx.Err(); err != nil {
+			return err
+		}
+		term, postingsOffset := itr.Current()
+		v.guard(SectionPostings, field, string(term), postingsOffset, func() error {
+			return v.verifyPostings(field, string(term), postingsOffset)
+		})
+		ok = v.guard(SectionDictionary, field, string(term), dictStart, func() error {
+			itrErr = itr.Next()
+			if itrErr == vellum.ErrIteratorDone {
+				return nil
+			}
+			return itrErr
+		})
+	}
+	return nil
+}
+
+func (v *verifier) verifyPostings(field, term string, postingsOffset uint64) error {
+	if postingsOffset&fSTValEncodingMask == fSTValEncoding1Hit {
+		docNum, _ := fSTValDecode1Hit(postingsOffset)
+		if docNum >= v.s.footer.numDocs {
+			return fmt.Errorf("1-hit docNum %d out of range", docNum)
+		}
+		return nil
+	}
+	if postingsOffset&fSTValEncodingMask != 0 {
+		return fmt.Errorf("reserved postings encoding %#x", postingsOffset)
+	}
+
+	header, err := v.s.footer.format().readPostingsHeader(v.s.data, postingsOffset)
+	if err != nil {
+		return err
+	}
+	freqOffset, locOffset, impactsOffset, n := header.freqOffset, header.locOffset, header.impactsOffset, header.n
+	postingsLen, read, err := v.readUvarint(postingsOffset + n)
+	if err != nil {
+		return err
+	}
+	n += read
+	roaringBytes, err := v.read(postingsOffset+n, postingsOffset+n+postingsLen)
+	if err != nil {
+		return err
+	}
+	postings := roaring.NewBitmap()
+	_, err = postings.FromBuffer(roaringBytes)
+	if err != nil {
+		return fmt.Errorf("error loading roaring bitmap: %w", err)
+	}
+	if postings.IsEmpty() {
+		return fmt.Errorf("empty postings list")
+	}
+	if uint64(postings.Maximum()) >= v.s.footer.numDocs {
+		return fmt.Errorf("docNum %d out of range", postings.Maximum())
+	}
+	if freqOffset >= postingsOffset || locOffset >= postingsOffset || impactsOffset >= postingsOffset {
+		return fmt.Errorf("freq/norm offset %d, location offset %d or impacts offset %d past postings",
+			freqOffset, locOffset, impactsOffset)
+	}
+
+	chunkSize, err := v.s.postingsChunkSize(header, postings.GetCardinality())
+	if err != nil {
+		return err
+	}
+	if chunkSize == 0 {
+		return fmt.Errorf("chunk size 0")
+	}
+
+	var hasLocs []bool
+	var impacts chunkImpacts
+	var skips []chunkSkip
+	ok := v.guard(SectionFreqNorm, field, term, freqOffset, func() error {
+		hasLocs, impacts, skips, err = v.verifyFreqNorms(postings, freqOffset, chunkSize)
+		return err
+	})
+	if !ok {
+		return nil
+	}
+	if v.s.footer.format().hasImpacts() {
+		v.guard(SectionImpacts, field, term, impactsOffset, func() error {
+			return v.verifyImpacts(impactsOffset, postingsOffset, impacts)
+		})
+	}
+	if locOffset != termNotEncoded {
+		v.guard(SectionLocations, field, term, locOffset, func() error {
+			return v.verifyLocations(postings, locOffset, chunkSize, hasLocs, skips)
+		})
+		return nil
+	}
+	for _, docHasLocs := range hasLocs {
+		if docHasLocs {
+			return fmt.Errorf("postings have locations but no location section")
+		}
+	}
+	return nil
+}
+
+// chunkDecoder decodes the chunked ints section at offset, checking the
+// number of chunks matches the chunk size, and returns a func to load
+// the contents of each chunk
+func (v *verifier) chunkDecoder(offset, chunkSize uint64) (func(chunk int) ([]byte, uint64, error), error) {
+	d, err := newChunkedIntDecoder(v.s.data, offset, nil)
+	if err != nil {
+		return nil, err
+	}
+	expectedChunks := (v.s.footer.numDocs-1)/chunkSize + 1
+	if uint64(len(d.chunkOffsets)) != expectedChunks {
+		return nil, fmt.Errorf("found %d chunks, expected %d", len(d.chunkOffsets), expectedChunks)
+	}
+	var prev uint64
+	for i, chunkOffset := range d.chunkOffsets {
+		if chunkOffset < prev {
+			return nil, fmt.Errorf("chunk %d offset %d before previous chunk %d", i, chunkOffset, prev)
+		}
+		prev = chunkOffset
+	}
+	return func(chunk int) ([]byte, uint64, error) {
+		s, e := readChunkBoundary(chunk, d.chunkOffsets)
+		compressed, err := v.read(d.dataStartOffset+s, d.dataStartOffset+e)
+		if err != nil {
+			return nil, d.dataStartOffset + s, err
+		}
+		v.buf, err = ZSTDDecompress(v.buf[:cap(v.buf)], compressed)
+		if err != nil {
+			return nil, d.dataStartOffset + s, fmt.Errorf("error decompressing chunk %d: %w", chunk, err)
+		}
+		return v.buf, d.dataStartOffset + s, nil
+	}, nil
+}
+
+// verifyFreqNorms decodes the freq/norm entries for every hit in postings
+// and returns whether each of them has locations, along with the impacts
+// of the chunks and the skip points of the chunks, checked to point at the
+// freq/norms of every skipInterval'th hit of their chunk
+func (v *verifier) verifyFreqNorms(postings *roaring.Bitmap, freqOffset, chunkSize uint64) (
+	[]bool, chunkImpacts, []chunkSkip, error) {
+	if freqOffset == termNotEncoded {
+		return nil, nil, nil, fmt.Errorf("missing freq/norm section")
+	}
+	loadChunk, err := v.chunkDecoder(freqOffset, chunkSize)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var impacts chunkImpacts
+	impacts.reset(int((v.s.footer.numDocs-1)/chunkSize + 1))
+
+	hasLocs := make([]bool, 0, postings.GetCardinality())
+	var skips, chunkSkips []chunkSkip
+	var vals chunkValues
+	var chunkStart uint64
+	var chunkHits int
+	currChunk := -1
+	itr := postings.Iterator()
+	for itr.HasNext() {
+		docNum := uint64(itr.Next())
+		chunk := int(docNum / chunkSize)
+		if chunk != currChunk {
+			if currChunk >= 0 && vals.len() > 0 {
+				return nil, nil, nil, fmt.Errorf("chunk %d at %d has %d trailing bytes", currChunk, chunkStart, vals.len())
+			}
+			if len(chunkSkips) > 0 {
+				return nil, nil, nil, fmt.Errorf("chunk %d at %d has skip point past its hits", currChunk, chunkStart)
+			}
+			var chunkData []byte
+			chunkData, chunkStart, err = loadChunk(chunk)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if v.s.footer.format().hasChunkSkips() && len(chunkData) > 0 {
+				chunkSkips, chunkData, err = readChunkSkips(chunkData, chunkSkips)
+				if err != nil {
+					return nil, nil, nil, fmt.Errorf("chunk %d at %d: %w", chunk, chunkStart, err)
+				}
+				skips = append(skips, chunkSkips...)
+			}
+			err = v.chunkValues(chunkData, &vals)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("chunk %d at %d: %w", chunk, chunkStart, err)
+			}
+			currChunk = chunk
+			chunkHits = 0
+		}
+		if chunkHits > 0 && chunkHits%skipInterval == 0 {
+			offset := uint64(vals.off)
+			if len(chunkSkips) == 0 || chunkSkips[0].docNum != docNum || chunkSkips[0].offset != offset {
+				return nil, nil, nil, fmt.Errorf("missing skip point for doc %d at %d in chunk at %d",
+					docNum, offset, chunkStart)
+			}
+			chunkSkips = chunkSkips[1:]
+		}
+		chunkHits++
+		freqHasLocs, ok := vals.next()
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("invalid freq for doc %d in chunk at %d", docNum, chunkStart)
+		}
+		normBits, ok := vals.next()
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("invalid norm for doc %d in chunk at %d", docNum, chunkStart)
+		}
+		freq, docHasLocs := decodeFreqHasLocs(freqHasLocs)
+		hasLocs = append(hasLocs, docHasLocs)
+		impacts.add(uint64(chunk), uint64(freq), normBits)
+	}
+	if vals.len() > 0 {
+		return nil, nil, nil, fmt.Errorf("chunk %d at %d has %d trailing bytes", currChunk, chunkStart, vals.len())
+	}
+	if len(chunkSkips) > 0 {
+		return nil, nil, nil, fmt.Errorf("chunk %d at %d has skip point past its hits", currChunk, chunkStart)
+	}
+	return hasLocs, impacts, skips, nil
+}
+
+// verifyImpacts checks the impacts of the chunks recorded before the
+// postings at postingsOffset are those of the freq/norms
+func (v *verifier) verifyImpacts(impactsOffset, postingsOffset uint64, expected chunkImpacts) error {
+	if impactsOffset == termNotEncoded {
+		return fmt.Errorf("missing impacts section")
+	}
+	data, err := v.read(impactsOffset, postingsOffset)
+	if err != nil {
+		return err
+	}
+	var impacts chunkImpacts
+	err = impacts.read(data)
+	if err != nil {
+		return err
+	}
+	if len(impacts) != len(expected) {
+		return fmt.Errorf("found %d impacts, expected %d", len(impacts), len(expected))
+	}
+	for chunk, impact := range impacts {
+		if impact.maxFreq != expected[chunk].maxFreq || impact.minNorm != expected[chunk].minNorm {
+			return fmt.Errorf("chunk %d impact max freq %d min norm %#x, expected %d %#x", chunk,
+				impact.maxFreq, impact.minNorm, expected[chunk].maxFreq, expected[chunk].minNorm)
+		}
+	}
+	return nil
+}
+
+// verifyLocations decodes the locations of the hits in postings which have
+// some, checking the skip points of the freq/norms point at the locations
+// of their hits
+func (v *verifier) verifyLocations(postings *roaring.Bitmap, locOffset, chunkSize uint64, hasLocs []bool,
+	skips []chunkSkip) error {
+	loadChunk, err := v.chunkDecoder(locOffset, chunkSize)
+	if err != nil {
+		return err
+	}
+
+	var vals chunkValues
+	var chunkStart uint64
+	currChunk := -1
+	itr := postings.Iterator()
+	for i := 0; itr.HasNext(); i++ {
+		docNum := uint64(itr.Next())
+		chunk := int(docNum / chunkSize)
+		if chunk != currChunk {
+			if currChunk >= 0 && vals.len() > 0 {
+				return fmt.Errorf("chunk %d at %d has %d trailing bytes", currChunk, chunkStart, vals.len())
+			}
+			var chunkData []byte
+			chunkData, chunkStart, err = loadChunk(chunk)
+			if err != nil {
+				return err
+			}
+			err = v.chunkValues(chunkData, &vals)
+			if err != nil {
+				return fmt.Errorf("chunk %d at %d: %w", chunk, chunkStart, err)
+			}
+			currChunk = chunk
+		}
+		if len(skips) > 0 && skips[0].docNum == docNum {
+			offset := uint64(vals.off)
+			if skips[0].locOffset != offset {
+				return fmt.Errorf("skip point for doc %d at location offset %d, expected %d in chunk at %d",
+					docNum, skips[0].locOffset, offset, chunkStart)
+			}
+			skips = skips[1:]
+		}
+		if !hasLocs[i] {
+			continue
+		}
+		numLocsBytes, ok := vals.next()
+		if !ok || uint64(vals.len()) < numLocsBytes {
+			return fmt.Errorf("invalid locations length for doc %d in chunk at %d", docNum, chunkStart)
+		}
+		end := vals.off + int(numLocsBytes)
+		for vals.off < end {
+			err = v.verifyLocation(&vals, docNum, chunkStart)
+			if err != nil {
+				return err
+			}
+		}
+		if vals.off != end {
+			return fmt.Errorf("locations of doc %d past their length in chunk at %d", docNum, chunkStart)
+		}
+	}
+	if vals.len() > 0 {
+		return fmt.Errorf("chunk %d at %d has %d trailing bytes", currChunk, chunkStart, vals.len())
+	}
+	return nil
+}
+
+// verifyLocation checks the location at the start of the values left
+func (v *verifier) verifyLocation(vals *chunkValues, docNum, chunkStart uint64) error {
+	var hasPayload bool
+	for j := 0; j < numUintsLocation; j++ {
+		val, ok := vals.next()
+		if !ok {
+			return fmt.Errorf("invalid location for doc %d in chunk at %d", docNum, chunkStart)
+		}
+		if j == 0 && v.s.footer.format().hasPayloads() {
+			val, hasPayload = decodeLocationField(val)
+		}
+		if j == 0 && val >= uint64(len(v.s.fieldsInv)) {
+			return fmt.Errorf("unknown location field id %d for doc %d", val, docNum)
+		}
+	}
+	if hasPayload {
+		payloadLen, ok := vals.next()
+		if !ok || payloadLen == 0 || !vals.skipBytes(payloadLen) {
+			return fmt.Errorf("invalid location payload for doc %d in chunk at %d", docNum, chunkStart)
+		}
+	}
+	return nil
+}
+
+// chunkValues reads the values of a chunk of freq/norms or locations, the
+// uvarints of the chunk, or its values decoded when they are packed, off
+// counting the bytes, or values when packed, read
+type chunkValues struct {
+	data   []byte
+	vals   []uint64
+	packed bool
+	off    int
+}
+
+// chunkValues starts reading the values of the chunk data into rv
+func (v *verifier) chunkValues(data []byte, rv *chunkValues) error {
+	rv.data, rv.vals, rv.off = data, rv.vals[:0], 0
+	rv.packed = packedChunks(v.s.footer.chunkMode)
+	if !rv.packed {
+		return nil
+	}
+	var r packedReader
+	err := r.Reset(data)
+	if err != nil {
+		return err
+	}
+	for r.Len() > 0 {
+		val, err := r.ReadUvarint()
+		if err != nil {
+			return err
+		}
+		rv.vals = append(rv.vals, val)
+	}
+	if r.next != len(r.data) {
+		return fmt.Errorf("%d trailing bytes after packed values", len(r.data)-r.next)
+	}
+	return nil
+}
+
+// len returns the number of bytes, or values when packed, left
+func (c *chunkValues) len() int {
+	if c.packed {
+		return len(c.vals) - c.off
+	}
+	return len(c.data) - c.off
+}
+
+// next returns the next value, and whether there is a valid one
+func (c *chunkValues) next() (uint64, bool) {
+	if c.packed {
+		if c.off >= len(c.vals) {
+			return 0, false
+		}
+		c.off++
+		return c.vals[c.off-1], true
+	}
+	val, read := binary.Uvarint(c.data[c.off:])
+	if read <= 0 {
+		return 0, false
+	}
+	c.off += read
+	return val, true
+}
+
+// skipBytes skips n bytes, or n values when packed, each a byte, and
+// reports whether there were
+func (c *chunkValues) skipBytes(n uint64) bool {
+	if n > uint64(c.len()) {
+		return false
+	}
+	if c.packed {
+		for _, val := range c.vals[c.off : c.off+int(n)] {
+			if val > 0xff {
+				return false
+			}
+		}
+	}
+	c.off += int(n)
+	return true
+}
+
+func (v *verifier) verifyDocValues() error {
+	for fieldID, field := range v.s.fieldsInv {
+		if err := v.ctx.Err(); err != nil {
+			return err
+		}
+		var dvr *docValueReader
+		v.guard(SectionDocValues, field, "", v.s.footer.docValueOffset, func() (err error) {
+			dvr, err = v.s.fieldDocValueReader(uint16(fieldID))
+			return err
+		})
+		if dvr == nil {
+			continue
+		}
+		expectedChunks := (v.s.footer.numDocs-1)/dvr.chunkSize + 1
+		if uint64(len(dvr.chunkOffsets)) != expectedChunks {
+			v.report(SectionDocValues, field, "", dvr.dvDataLoc,
+				fmt.Errorf("found %d chunks, expected %d", len(dvr.chunkOffsets), expectedChunks))
+			continue
+		}
+		for chunk := range dvr.chunkOffsets {
+			start, end := readChunkBoundary(chunk, dvr.chunkOffsets)
+			v.guard(SectionDocValues, field, "", dvr.dvDataLoc+start, func() error {
+				if start > end {
+					return fmt.Errorf("chunk %d ends at %d before its start", chunk, end)
+				}
+				if start == end {
+					return nil
+				}
+				return v.verifyDocValuesChunk(uint64(chunk), dvr.chunkSize, dvr.dvDataLoc+start, dvr.dvDataLoc+end)
+			})
+		}
+	}
+	return nil
+}
+
+func (v *verifier) verifyDocValuesChunk(chunk, chunkSize, start, end uint64) error {
+	numDocs, n, err := v.readUvarint(start)
+	if err != nil {
+		return err
+	}
+	var docNum, dvOffset uint64
+	for i := uint64(0); i < numDocs; i++ {
+		docNumDelta, read, err := v.readUvarint(start + n)
+		if err != nil {
+			return err
+		}
+		n += read
+		dvOffsetDelta, read, err := v.readUvarint(start + n)
+		if err != nil {
+			return err
+		}
+		n += read
+		if i > 0 && docNumDelta == 0 {
+			return fmt.Errorf("docNum %d repeated in chunk %d", docNum, chunk)
+		}
+		docNum += docNumDelta
+		dvOffset += dvOffsetDelta
+		if docNum >= v.s.footer.numDocs || docNum/chunkSize != chunk {
+			return fmt.Errorf("docNum %d does not belong in chunk %d", docNum, chunk)
+		}
+	}
+	if start+n > end {
+		return fmt.Errorf("chunk %d header past end of chunk", chunk)
+	}
+	compressed, err := v.read(start+n, end)
+	if err != nil {
+		return err
+	}
+	v.buf, err = ZSTDDecompress(v.buf[:cap(v.buf)], compressed)
+	if err != nil {
+		return fmt.Errorf("error decompressing chunk %d: %w", chunk, err)
+	}
+	if dvOffset != uint64(len(v.buf)) {
+		return fmt.Errorf("chunk %d has %d bytes of values, header expects %d", chunk, len(v.buf), dvOffset)
+	}
+	return nil
+}
+
+// verifyNumericDocValues checks that each chunk of the numeric doc values
+// of each field can be decoded, and covers the documents it should
+func (v *verifier) verifyNumericDocValues() error {
+	for fieldID, field := range v.s.fieldsInv {
+		var meta *numericColumnMeta
+		v.guard(SectionNumeric, field, "", v.s.footer.numericOffset, func() (err error) {
+			meta, err = v.s.fieldNumericMeta(uint16(fieldID))
+			return err
+		})
+		if meta == nil {
+			continue
+		}
+		if err := v.ctx.Err(); err != nil {
+			return err
+		}
+		v.guard(SectionNumeric, field, "", meta.chunkStarts[0], func() error {
+			return v.verifyNumericColumn(meta)
+		})
+	}
+	return nil
+}
+
+func (v *verifier) verifyNumericColumn(meta *numericColumnMeta) error {
+	if meta.typ < NumericInt64 || meta.typ > NumericDate {
+		return fmt.Errorf("unknown numeric type %d", meta.typ)
+	}
+	numChunks := (v.s.footer.numDocs + meta.chunkSize - 1) / meta.chunkSize
+	if uint64(len(meta.chunkStarts)-1) != numChunks {
+		return fmt.Errorf("%d chunks for %d docs in chunks of %d", len(meta.chunkStarts)-1,
+			v.s.footer.numDocs, meta.chunkSize)
+	}
+	if !meta.docs.IsEmpty() && uint64(meta.docs.Maximum()) >= v.s.footer.numDocs {
+		return fmt.Errorf("docNum %d out of range", meta.docs.Maximum())
+	}
+	if meta.chunkStarts[numChunks] > v.s.footer.numericOffset {
+		return fmt.Errorf("chunks end at %d past numeric doc values index", meta.chunkStarts[numChunks])
+	}
+	reader := &NumericDocValues{sb: v.s, meta: meta, curChunk: -1}
+	for chunk := 0; chunk < int(numChunks); chunk++ {
+		err := reader.loadChunk(chunk)
+		if err != nil {
+			return err
+		}
+		chunkDocs := v.s.footer.numDocs - uint64(chunk)*meta.chunkSize
+		if chunkDocs > meta.chunkSize {
+			chunkDocs = meta.chunkSize
+		}
+		if len(reader.packed) != packedLen(int(chunkDocs), reader.numBits) {
+			return fmt.Errorf("chunk %d has %d bytes of values for %d docs of %d bits",
+				chunk, len(reader.packed), chunkDocs, reader.numBits)
+		}
+	}
+	return nil
+}
+
+// verifySortedSetDocValues checks that the terms of the sorted-set doc
+// values of each field are in order, and that the ordinals of each
+// document are in order and in range
+func (v *verifier) verifySortedSetDocValues() error {
+	for fieldID, field := range v.s.fieldsInv {
+		var meta *sortedSetColumnMeta
+		v.guard(SectionSortedSet, field, "", v.s.footer.sortedSetOffset, func() (err error) {
+			meta, err = v.s.fieldSortedSetMeta(uint16(fieldID))
+			return err
+		})
+		if meta == nil {
+			continue
+		}
+		if err := v.ctx.Err(); err != nil {
+			return err
+		}
+		v.guard(SectionSortedSet, field, "", meta.termsStart, func() error {
+			return v.verifySortedSetColumn(meta)
+		})
+	}
+	return nil
+}
+
+func (v *verifier) verifySortedSetColumn(meta *sortedSetColumnMeta) error {
+	reader := &SortedSetDocValues{sb: v.s, meta: meta, curChunk: -1}
+	offset := meta.termsStart
+	var prev []byte
+	for ord := uint64(0); ord < meta.numTerms; ord++ {
+		if ord%sortedSetTermsBlockSize == 0 &&
+			meta.blockOffsets[ord/sortedSetTermsBlockSize] != offset-meta.termsStart {
+			return fmt.Errorf("term block %d at %d, expected %d", ord/sortedSetTermsBlockSize,
+				meta.blockOffsets[ord/sortedSetTermsBlockSize], offset-meta.termsStart)
+		}
+		term, next, err := reader.readTerm(offset)
+		if err != nil {
+			return err
+		}
+		if ord > 0 && bytes.Compare(prev, term) >= 0 {
+			return fmt.Errorf("term %d '%s' not after '%s'", ord, term, prev)
+		}
+		prev, offset = term, next
+	}
+	if offset > meta.chunkStarts[0] {
+		return fmt.Errorf("terms end at %d past start of chunks at %d", offset, meta.chunkStarts[0])
+	}
+
+	numChunks := (v.s.footer.numDocs + meta.chunkSize - 1) / meta.chunkSize
+	if uint64(len(meta.chunkStarts)-1) != numChunks {
+		return fmt.Errorf("%d chunks for %d docs in chunks of %d", len(meta.chunkStarts)-1,
+			v.s.footer.numDocs, meta.chunkSize)
+	}
+	if meta.chunkStarts[numChunks] > v.s.footer.sortedSetOffset {
+		return fmt.Errorf("chunks end at %d past sorted-set doc values index", meta.chunkStarts[numChunks])
+	}
+	var ords []uint64
+	for docNum := uint64(0); docNum < v.s.footer.numDocs; docNum++ {
+		var err error
+		ords, err = reader.Ordinals(docNum, ords[:0])
+		if err != nil {
+			return err
+		}
+		for i, ord := range ords {
+			if ord >= meta.numTerms || i > 0 && ord <= ords[i-1] {
+				return fmt.Errorf("doc %d has ordinals %v out of order or range, %d terms", docNum, ords, meta.numTerms)
+			}
+		}
+	}
+	return nil
+}
+
+// verifySort checks that each document sorts no earlier than the one
+// before it, if the segment is sorted
+func (v *verifier) verifySort() error {
+	if len(v.s.sort) == 0 || v.s.footer.numDocs == 0 {
+		return nil
+	}
+	if err := v.ctx.Err(); err != nil {
+		return err
+	}
+	sorter := newDocSorter(v.s.sort, int(v.s.footer.numDocs))
+	ok := v.guard(SectionSort, "", "", v.s.footer.sortOffset, func() error {
+		err := sorter.setNumericFields([]*Segment{v.s})
+		if err != nil {
+			return err
+		}
+		return sorter.setSegmentKeys(v.s, 0)
+	})
+	if !ok {
+		return nil
+	}
+	for docNum := 1; docNum < int(v.s.footer.numDocs); docNum++ {
+		if sorter.less(docNum, docNum-1) {
+			v.report(SectionSort, "", "", v.s.footer.sortOffset,
+				fmt.Errorf("doc %d sorts before doc %d", docNum, docNum-1))
+		}
+	}
+	return nil
+}
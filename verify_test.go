@@ -0,0 +1,156 @@
+//  Copyright (c) 2020 The Bluge Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ice
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	segment "github.com/blugelabs/bluge_segment_api"
+)
+
+func TestVerify(t *testing.T) {
+	path, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	memSeg, err := buildTestSegmentMulti()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = memSeg.Verify(context.Background())
+	if err != nil {
+		t.Fatalf("expected in-memory segment to verify, got: %v", err)
+	}
+
+	segPath := filepath.Join(path, "segment.ice")
+	seg, closeF, err := createDiskSegment(buildTestSegmentMulti, segPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cerr := closeF()
+		if cerr != nil {
+			t.Fatalf("error closing segment: %v", cerr)
+		}
+	}()
+	err = seg.Verify(context.Background())
+	if err != nil {
+		t.Fatalf("expected segment to verify, got: %v", err)
+	}
+	if seg.CRC() != memSeg.CRC() {
+		t.Errorf("expected loaded crc %#x to match in-memory crc %#x", seg.CRC(), memSeg.CRC())
+	}
+
+	mergedPath := filepath.Join(path, "merged.ice")
+	_, err = mergeSegments([]segment.Segment{seg, seg}, []*roaring.Bitmap{nil, roaring.BitmapOf(1)}, mergedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, closeMerged, err := openFromFile(mergedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cerr := closeMerged()
+		if cerr != nil {
+			t.Fatalf("error closing segment: %v", cerr)
+		}
+	}()
+	err = merged.Verify(context.Background())
+	if err != nil {
+		t.Fatalf("expected merged segment to verify, got: %v", err)
+	}
+}
+
+func TestVerifyCorrupt(t *testing.T) {
+	memSeg, err := buildTestSegmentMulti()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = memSeg.WriteTo(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := buf.Bytes()
+	err = memSeg.loadStoredIndexOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		offset  uint64
+		section string
+	}{
+		{
+			name:    "stored chunk",
+			offset:  memSeg.storedFieldChunkOffsets[0] + 2,
+			section: SectionStored,
+		},
+		{
+			name:    "dictionary",
+			offset:  memSeg.fields[memSeg.fieldsMap["desc"]-1].dictLoc + 4,
+			section: SectionDictionary,
+		},
+	}
+
+	for _, test := range tests {
+		corrupt := append([]byte(nil), good...)
+		corrupt[test.offset] ^= 0xff
+
+		seg, err := load(segment.NewDataBytes(corrupt))
+		if err != nil {
+			t.Fatalf("%s: error loading corrupt segment: %v", test.name, err)
+		}
+		err = seg.Verify(context.Background())
+		var verifyErr *VerifyError
+		if !errors.As(err, &verifyErr) {
+			t.Fatalf("%s: expected verify error, got: %v", test.name, err)
+		}
+		var sawCRC, sawSection bool
+		for _, problem := range verifyErr.Problems {
+			switch problem.Section {
+			case SectionFooter:
+				sawCRC = true
+			case test.section:
+				sawSection = true
+			}
+		}
+		if !sawCRC {
+			t.Errorf("%s: expected crc problem, got: %v", test.name, verifyErr.Problems)
+		}
+		if !sawSection {
+			t.Errorf("%s: expected %s problem, got: %v", test.name, test.section, verifyErr.Problems)
+		}
+	}
+}
+
+func TestVerifyCanceled(t *testing.T) {
+	seg, err := buildTestSegmentMulti()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = seg.Verify(ctx)
+	if err != context.Canceled {
+		t.Fatalf("expected context canceled, got: %v", err)
+	}
+}
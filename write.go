@@ -26,13 +26,30 @@ const fieldNotUninverted = math.MaxUint64
 
 type varintEncoder func(uint64) (int, error)
 
+// encodeStoredFieldValues encodes the meta of each value, and appends it
+// to data, unless docChunkCoder moves it to the large value region, then
+// the meta flags it as large, and holds its offset in the region instead
 func encodeStoredFieldValues(fieldID int,
 	storedFieldValues [][]byte,
-	curr int, metaEncode varintEncoder, data []byte) (
+	curr int, metaEncode varintEncoder, data []byte, docChunkCoder *chunkedDocumentCoder) (
 	newCurr int, newData []byte, err error) {
 	for i := 0; i < len(storedFieldValues); i++ {
+		offset, length, large, err := docChunkCoder.addLargeValue(storedFieldValues[i])
+		if err != nil {
+			return 0, nil, err
+		}
+		if large {
+			for _, val := range []uint64{uint64(fieldID)<<1 | storedLargeValueFlag, offset, length} {
+				_, err = metaEncode(val)
+				if err != nil {
+					return 0, nil, err
+				}
+			}
+			continue
+		}
+
 		// encode field
-		_, err := metaEncode(uint64(fieldID))
+		_, err = metaEncode(uint64(fieldID) << 1)
 		if err != nil {
 			return 0, nil, err
 		}
@@ -82,14 +99,38 @@ func writePostings(postings *roaring.Bitmap, tfEncoder, locEncoder *chunkedIntCo
 		return 0, err
 	}
 
+	var impactsOffset uint64
+	impactsOffset, err = tfEncoder.writeImpactsAt(w)
+	if err != nil {
+		return 0, err
+	}
+
 	postingsOffset := uint64(w.Count())
 
-	n := binary.PutUvarint(bufMaxVarintLen64, tfOffset)
-	_, err = w.Write(bufMaxVarintLen64[:n])
+	err = writePostingsOffsets(tfOffset, locOffset, impactsOffset, tfEncoder.chunkSize, w, bufMaxVarintLen64)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = writeRoaringWithLen(postings, w, bufMaxVarintLen64)
 	if err != nil {
 		return 0, err
 	}
 
+	return postingsOffset, nil
+}
+
+// writePostingsOffsets writes the start of a postings list, the offsets of
+// its freq/norm, location and impacts sections and its chunk size, which is
+// followed by its bitmap
+func writePostingsOffsets(tfOffset, locOffset, impactsOffset, chunkSize uint64, w io.Writer,
+	bufMaxVarintLen64 []byte) error {
+	n := binary.PutUvarint(bufMaxVarintLen64, tfOffset)
+	_, err := w.Write(bufMaxVarintLen64[:n])
+	if err != nil {
+		return err
+	}
+
 	if locOffset > 0 && tfOffset > 0 {
 		n = binary.PutUvarint(bufMaxVarintLen64, locOffset-tfOffset)
 	} else {
@@ -97,15 +138,22 @@ func writePostings(postings *roaring.Bitmap, tfEncoder, locEncoder *chunkedIntCo
 	}
 	_, err = w.Write(bufMaxVarintLen64[:n])
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	_, err = writeRoaringWithLen(postings, w, bufMaxVarintLen64)
+	if impactsOffset > 0 && tfOffset > 0 {
+		n = binary.PutUvarint(bufMaxVarintLen64, impactsOffset-tfOffset)
+	} else {
+		n = binary.PutUvarint(bufMaxVarintLen64, impactsOffset)
+	}
+	_, err = w.Write(bufMaxVarintLen64[:n])
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return postingsOffset, nil
+	n = binary.PutUvarint(bufMaxVarintLen64, chunkSize)
+	_, err = w.Write(bufMaxVarintLen64[:n])
+	return err
 }
 
 // returns the total # of bytes needed to encode the given uint64's
@@ -202,6 +250,20 @@ func persistFooter(footer *footer, writerIn io.Writer) error {
 	w := newCountHashWriter(writerIn)
 	w.crc = footer.crc
 
+	err := persistFooterFields(footer, w)
+	if err != nil {
+		return err
+	}
+	// write out CRC-32 of everything upto but not including this CRC
+	err = binary.Write(w, binary.BigEndian, w.crc)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// persistFooterFields writes out everything in the footer except the CRC
+func persistFooterFields(footer *footer, w io.Writer) error {
 	// write out the number of docs
 	err := binary.Write(w, binary.BigEndian, footer.numDocs)
 	if err != nil {
@@ -222,18 +284,34 @@ func persistFooter(footer *footer, writerIn io.Writer) error {
 	if err != nil {
 		return err
 	}
+	if footer.format().hasSortOffset() {
+		// write out the sort location
+		err = binary.Write(w, binary.BigEndian, footer.sortOffset)
+		if err != nil {
+			return err
+		}
+	}
+	if footer.format().hasNumericOffset() {
+		// write out the numeric doc values location
+		err = binary.Write(w, binary.BigEndian, footer.numericOffset)
+		if err != nil {
+			return err
+		}
+	}
+	if footer.format().hasSortedSetOffset() {
+		// write out the sorted-set doc values location
+		err = binary.Write(w, binary.BigEndian, footer.sortedSetOffset)
+		if err != nil {
+			return err
+		}
+	}
 	// write out 32-bit chunk factor
 	err = binary.Write(w, binary.BigEndian, footer.chunkMode)
 	if err != nil {
 		return err
 	}
 	// write out 32-bit version
-	err = binary.Write(w, binary.BigEndian, Version)
-	if err != nil {
-		return err
-	}
-	// write out CRC-32 of everything upto but not including this CRC
-	err = binary.Write(w, binary.BigEndian, w.crc)
+	err = binary.Write(w, binary.BigEndian, footer.version)
 	if err != nil {
 		return err
 	}
@@ -27,9 +27,11 @@ const ZSTDCompressionLevel = 3 // 1, 3, 9
 
 var (
 	decoder *zstd.Decoder
-	encoder *zstd.Encoder
+	decOnce sync.Once
 
-	encOnce, decOnce sync.Once
+	// encoders holds an encoder for each level, created as needed
+	encoders     = map[zstd.EncoderLevel]*zstd.Encoder{}
+	encodersLock sync.Mutex
 )
 
 // ZSTDDecompress decompresses a block using ZSTD algorithm.
@@ -46,14 +48,18 @@ func ZSTDDecompress(dst, src []byte) ([]byte, error) {
 
 // ZSTDCompress compresses a block using ZSTD algorithm.
 func ZSTDCompress(dst, src []byte, compressionLevel int) ([]byte, error) {
-	encOnce.Do(func() {
+	level := zstd.EncoderLevelFromZstd(compressionLevel)
+	encodersLock.Lock()
+	encoder, ok := encoders[level]
+	if !ok {
 		var err error
-		level := zstd.EncoderLevelFromZstd(compressionLevel)
 		encoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
 		if err != nil {
 			log.Panicf("ZSTDCompress: %+v", err)
 		}
-	})
+		encoders[level] = encoder
+	}
+	encodersLock.Unlock()
 	return encoder.EncodeAll(src, dst[:0]), nil
 }
 